@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"slices"
 	"strings"
+	"time"
 
 	flag "github.com/spf13/pflag"
 
@@ -13,7 +17,13 @@ import (
 
 	"github.com/vince-riv/argo-diff/internal/argocd"
 	"github.com/vince-riv/argo-diff/internal/github"
+	"github.com/vince-riv/argo-diff/internal/gitlab"
+	"github.com/vince-riv/argo-diff/internal/process_event"
+	"github.com/vince-riv/argo-diff/internal/render"
+	"github.com/vince-riv/argo-diff/internal/repoconfig"
+	"github.com/vince-riv/argo-diff/internal/results"
 	"github.com/vince-riv/argo-diff/internal/server"
+	"github.com/vince-riv/argo-diff/internal/webhook"
 )
 
 // Version is set via -ldflags at build time
@@ -64,19 +74,185 @@ func init() {
 	flag.StringVarP(&eventFile, "event-file", "f", "", "Run once and read event data from file")
 }
 
-func startServer(listenHost string, listenPort int, githubWebhookSecret string, devMode bool) {
+const diffUsage = `Usage: argo-diff diff --repo owner/name --revision <sha> [flags]
+
+Diffs the ArgoCD applications a pull request from revision into base would match, and prints the
+results instead of commenting. Only ArgoCD credentials are needed.
+
+Flags:
+`
+
+// runDiff is the `diff` subcommand: a local preview of what the bot would comment on a pull request
+func runDiff(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, diffUsage)
+		fs.PrintDefaults()
+	}
+	repo := fs.String("repo", "", "Repository as owner/name (required)")
+	revision := fs.String("revision", "", "Commit sha (or branch) to diff (required)")
+	base := fs.String("base", "main", "Branch the change would merge into")
+	defaultRef := fs.String("default-ref", "", "Default branch of the repository (defaults to --base)")
+	mergeBase := fs.String("merge-base", "", "Commit to render the desired state at, for a desired-state diff, eg: $(git merge-base main HEAD) (without it, the diff is against the live state)")
+	files := fs.StringSlice("files", nil, "Changed files, for the manifest-generate-paths filter (default: no filtering)")
+	format := fs.StringP("output", "o", render.FormatText, "Output format: "+strings.Join(render.Formats, ", "))
+	color := fs.String("color", "auto", "Color text output: auto, always or never")
+	repoConfigFile := fs.String("repo-config", "", "A local "+repoconfig.Path+" to apply")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	owner, name, ok := strings.Cut(*repo, "/")
+	if !ok || owner == "" || name == "" {
+		return fmt.Errorf("--repo must be owner/name, not '%s'", *repo)
+	}
+	if *revision == "" {
+		return fmt.Errorf("--revision is required")
+	}
+	if !slices.Contains(render.Formats, *format) {
+		return fmt.Errorf("--output must be one of %s, not '%s'", strings.Join(render.Formats, ", "), *format)
+	}
+	opts := process_event.LocalDiffOptions{Format: *format}
+	var err error
+	if opts.Color, err = useColor(*color); err != nil {
+		return err
+	}
+	if *repoConfigFile != "" {
+		data, err := os.ReadFile(*repoConfigFile)
+		if err != nil {
+			return err
+		}
+		if opts.RepoConfig, err = repoconfig.Parse(data); err != nil {
+			return err
+		}
+	}
+	if *defaultRef == "" {
+		*defaultRef = *base
+	}
+
+	if os.Getenv("ARGOCD_AUTH_TOKEN") == "" {
+		return fmt.Errorf("ARGOCD_AUTH_TOKEN environment variable not set")
+	}
+	if os.Getenv("ARGOCD_SERVER_ADDR") == "" {
+		return fmt.Errorf("ARGOCD_SERVER_ADDR environment variable not set")
+	}
+	if err := argocd.ConnectivityCheck(); err != nil {
+		return fmt.Errorf("connectivity check to ArgoCD failed: %w", err)
+	}
+	sweepPreviewApps()
+
+	eventInfo := webhook.EventInfo{
+		RepoOwner:      owner,
+		RepoName:       name,
+		RepoDefaultRef: *defaultRef,
+		Sha:            *revision,
+		ChangeRef:      *revision,
+		BaseRef:        *base,
+		MergeBase:      *mergeBase,
+		ChangedFiles:   *files,
+		Provider:       webhook.ProviderGithub,
+	}
+	log.Info().Msgf("Diffing %s/%s@%s against %s", owner, name, *revision, *base)
+	return process_event.ProcessLocalDiff(eventInfo, opts, os.Stdout)
+}
+
+// sweepPreviewApps deletes temporary preview Applications that earlier runs left behind
+func sweepPreviewApps() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	process_event.SweepPreviewApps(ctx)
+}
+
+// useColor decides whether text output is colored from the --color flag
+func useColor(color string) (bool, error) {
+	switch color {
+	case "always":
+		return true, nil
+	case "never":
+		return false, nil
+	case "auto":
+		return os.Getenv("NO_COLOR") == "" && isTerminal(os.Stdout), nil
+	}
+	return false, fmt.Errorf("--color must be auto, always or never, not '%s'", color)
+}
+
+const renderUsage = `Usage: argo-diff render [flags] <results.json>
+
+Renders a results document (written via ARGO_DIFF_RESULTS_FILE, served by /results or printed by
+'argo-diff diff -o json') without contacting ArgoCD or GitHub.
+
+Flags:
+`
+
+// runRender is the `render` subcommand: re-renders a saved results document
+func runRender(args []string) error {
+	fs := flag.NewFlagSet("render", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, renderUsage)
+		fs.PrintDefaults()
+	}
+	format := fs.StringP("output", "o", render.FormatMarkdown, "Output format: "+strings.Join(render.Formats, ", "))
+	color := fs.String("color", "auto", "Color text output: auto, always or never")
+	collapse := fs.Bool("collapse-diffs", false, "Collapse the resource diffs in markdown output")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected one results document, got %d arguments", fs.NArg())
+	}
+	opts := render.Options{CollapseDiffs: *collapse}
+	var err error
+	if opts.Color, err = useColor(*color); err != nil {
+		return err
+	}
+	doc, err := results.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	out, err := render.Render(*doc, *format, opts)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprint(os.Stdout, out)
+	return err
+}
+
+// isTerminal returns true when f is a terminal rather than a file or pipe
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func startServer(listenHost string, listenPort int, githubWebhookSecret string, gitlabWebhookSecret string, devMode bool) {
 	addr := fmt.Sprintf("%s:%d", listenHost, listenPort)
 	if addr == ":0" {
 		addr = ":8080"
 	}
-	server.StartWebhookProcessor(addr, githubWebhookSecret, devMode)
+	server.StartWebhookProcessor(addr, githubWebhookSecret, gitlabWebhookSecret, devMode)
 }
 
 func main() {
 	var err error
+	// subcommands have flags of their own: diff previews a change locally and needs no GitHub
+	// credentials; render re-renders saved results and needs no credentials at all
+	subcommands := map[string]func([]string) error{"diff": runDiff, "render": runRender}
+	if len(os.Args) > 1 && subcommands[os.Args[1]] != nil {
+		if err = subcommands[os.Args[1]](os.Args[2:]); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return
+			}
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 	flag.Parse()
 
 	githubWebhookSecret := os.Getenv("GITHUB_WEBHOOK_SECRET")
+	gitlabWebhookSecret := os.Getenv("GITLAB_WEBHOOK_SECRET")
+	// a GitLab-only deployment doesn't need any GitHub credentials
+	gitlabOnly := gitlab.Configured() && os.Getenv("GITHUB_PERSONAL_ACCESS_TOKEN") == "" && os.Getenv("GITHUB_TOKEN") == "" && os.Getenv("GITHUB_APP_ID") == ""
 
 	// make sure critical secrets are set in the environment
 	if os.Getenv("ARGOCD_AUTH_TOKEN") == "" {
@@ -85,7 +261,9 @@ func main() {
 	if os.Getenv("ARGOCD_SERVER_ADDR") == "" {
 		log.Fatal().Msg("ARGOCD_SERVER_ADDR environment variable not set")
 	}
-	if os.Getenv("GITHUB_PERSONAL_ACCESS_TOKEN") == "" && os.Getenv("GITHUB_TOKEN") == "" {
+	if gitlabOnly {
+		log.Info().Msg("GITLAB_TOKEN set and no GitHub credentials found - running for GitLab only")
+	} else if os.Getenv("GITHUB_PERSONAL_ACCESS_TOKEN") == "" && os.Getenv("GITHUB_TOKEN") == "" {
 		log.Info().Msg("GITHUB_PERSONAL_ACCESS_TOKEN or GITHUB_TOKEN environment variable not set - assuming Github App installation")
 		for _, e := range []string{"GITHUB_APP_ID", "GITHUB_APP_INSTALLATION_ID", "GITHUB_APP_PRIVATE_KEY"} {
 			if os.Getenv(e) == "" {
@@ -101,6 +279,7 @@ func main() {
 	if err = argocd.ConnectivityCheck(); err != nil {
 		log.Fatal().Err(err).Msg("Connectivity check to ArgoCD failed")
 	}
+	sweepPreviewApps()
 
 	// if running under Github Actions, skip github connectivity check
 	if os.Getenv("GITHUB_ACTIONS") == "true" {
@@ -114,8 +293,15 @@ func main() {
 	}
 
 	// check github connectivity for run-once and server modes
-	if err = github.ConnectivityCheck(); err != nil {
-		log.Fatal().Err(err).Msg("Connectivity check to Github API failed")
+	if !gitlabOnly {
+		if err = github.ConnectivityCheck(); err != nil {
+			log.Fatal().Err(err).Msg("Connectivity check to Github API failed")
+		}
+	}
+	if gitlab.Configured() {
+		if err = gitlab.ConnectivityCheck(); err != nil {
+			log.Fatal().Err(err).Msg("Connectivity check to GitLab API failed")
+		}
 	}
 
 	// if event file is defined, process it and exit
@@ -129,8 +315,11 @@ func main() {
 	}
 
 	// other assume we're running as a web server
-	if githubWebhookSecret == "" {
+	if githubWebhookSecret == "" && !gitlabOnly {
 		log.Fatal().Msg("GITHUB_WEBHOOK_SECRET environment variable not set")
 	}
-	startServer(serverListenHost, serverListenPort, githubWebhookSecret, serverDevMode)
+	if gitlab.Configured() && gitlabWebhookSecret == "" {
+		log.Fatal().Msg("GITLAB_WEBHOOK_SECRET environment variable not set")
+	}
+	startServer(serverListenHost, serverListenPort, githubWebhookSecret, gitlabWebhookSecret, serverDevMode)
 }
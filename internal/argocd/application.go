@@ -10,20 +10,43 @@ type Application struct {
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 	Spec              ApplicationSpec   `json:"spec"`
 	Status            ApplicationStatus `json:"status,omitempty"`
+	// manifest is the whole Application, for one read from an application's rendered manifests
+	// rather than from ArgoCD; the fields above are only the ones used here
+	manifest map[string]any
 }
 
 type ApplicationSpec struct {
-	Source     *ApplicationSource  `json:"source,omitempty"`
-	Sources    []ApplicationSource `json:"sources,omitempty"`
-	SyncPolicy *SyncPolicy         `json:"syncPolicy,omitempty"`
+	Project     string                 `json:"project,omitempty"`
+	Destination ApplicationDestination `json:"destination,omitempty"`
+	Source      *ApplicationSource     `json:"source,omitempty"`
+	Sources     []ApplicationSource    `json:"sources,omitempty"`
+	SyncPolicy  *SyncPolicy            `json:"syncPolicy,omitempty"`
+}
+
+type ApplicationDestination struct {
+	Server    string `json:"server,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name,omitempty"`
 }
 
 type ApplicationSource struct {
-	RepoURL        string `json:"repoURL"`
-	TargetRevision string `json:"targetRevision"`
-	Path           string `json:"path,omitempty"`
-	Chart          string `json:"chart,omitempty"`
-	Ref            string `json:"ref,omitempty"`
+	RepoURL        string                 `json:"repoURL"`
+	TargetRevision string                 `json:"targetRevision"`
+	Path           string                 `json:"path,omitempty"`
+	Chart          string                 `json:"chart,omitempty"`
+	Ref            string                 `json:"ref,omitempty"`
+	Helm           *ApplicationSourceHelm `json:"helm,omitempty"`
+}
+
+type ApplicationSourceHelm struct {
+	// ValueFiles may read from another of a multi-source application's sources, as $<ref>/<path>
+	ValueFiles []string `json:"valueFiles,omitempty"`
+}
+
+// refOnly returns true for a source that's only there for other sources to read files from, as
+// $<ref>/<path>: it has a ref, and no manifests of its own
+func (src ApplicationSource) refOnly() bool {
+	return src.Ref != "" && src.Path == "" && src.Chart == ""
 }
 
 type SyncPolicy struct {
@@ -36,8 +59,29 @@ type SyncPolicyAutomated struct {
 }
 
 type ApplicationStatus struct {
-	Sync   SyncStatus   `json:"sync,omitempty"`
-	Health HealthStatus `json:"health,omitempty"`
+	Sync      SyncStatus       `json:"sync,omitempty"`
+	Health    HealthStatus     `json:"health,omitempty"`
+	Resources []ResourceStatus `json:"resources,omitempty"`
+}
+
+// ResourceStatus is one of the live resources an application manages
+type ResourceStatus struct {
+	Group     string `json:"group,omitempty"`
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+}
+
+// String names the resource like the header of its diff, eg: apps/Deployment default/guestbook
+func (r ResourceStatus) String() string {
+	kind := r.Kind
+	if r.Group != "" {
+		kind = r.Group + "/" + r.Kind
+	}
+	if r.Namespace == "" {
+		return kind + " " + r.Name
+	}
+	return kind + " " + r.Namespace + "/" + r.Name
 }
 
 type SyncStatus struct {
@@ -55,6 +99,31 @@ type ApplicationList struct {
 	Items           []Application `json:"items"`
 }
 
+// Custom ApplicationSet struct with only the fields we need; its generators are read from the whole
+// manifest, since they nest (matrix and merge generators) and have to be sent back to ArgoCD intact
+type ApplicationSet struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              ApplicationSetSpec `json:"spec"`
+	manifest          map[string]any
+}
+
+type ApplicationSetSpec struct {
+	SyncPolicy *ApplicationSetSyncPolicy `json:"syncPolicy,omitempty"`
+}
+
+type ApplicationSetSyncPolicy struct {
+	PreserveResourcesOnDeletion bool `json:"preserveResourcesOnDeletion,omitempty"`
+	// ApplicationsSync is create-only, create-update, create-delete or sync (the default)
+	ApplicationsSync string `json:"applicationsSync,omitempty"`
+}
+
+// AutoSync returns true when ArgoCD syncs the application automatically, so a change merged into
+// the branch it tracks is deployed without anyone clicking sync
+func (spec *ApplicationSpec) AutoSync() bool {
+	return spec.SyncPolicy != nil && spec.SyncPolicy.Automated != nil
+}
+
 // GetSource returns the application's single source or the first source if multiple sources are defined
 func (spec *ApplicationSpec) GetSource() ApplicationSource {
 	if spec.Source != nil {
@@ -0,0 +1,312 @@
+package argocd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+
+	"github.com/vince-riv/argo-diff/internal/webhook"
+)
+
+const argoApplicationSetApiKind = "ApplicationSet"
+
+// ApplicationSet applicationsSync policies under which the ApplicationSet controller never deletes
+// the Applications it stops generating
+const appSetSyncCreateOnly = "create-only"
+const appSetSyncCreateUpdate = "create-update"
+
+// parseApplicationSets decodes ApplicationSets, keeping each one's whole manifest so it can be sent
+// back to ArgoCD to generate
+func parseApplicationSets(items []json.RawMessage) ([]ApplicationSet, error) {
+	var appSets []ApplicationSet
+	for _, item := range items {
+		var appSet ApplicationSet
+		if err := json.Unmarshal(item, &appSet); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(item, &appSet.manifest); err != nil {
+			return nil, err
+		}
+		appSets = append(appSets, appSet)
+	}
+	return appSets, nil
+}
+
+// jsonManifests turns JSON objects (eg: the Applications an ApplicationSet generates) into
+// K8sManifests, as if they had been rendered as YAML
+func jsonManifests(items []json.RawMessage) ([]K8sManifest, error) {
+	var manifests []K8sManifest
+	for _, item := range items {
+		var m K8sManifest
+		if err := json.Unmarshal(item, &m.Unstruct.Object); err != nil {
+			return nil, err
+		}
+		yamlSrc, err := yaml.JSONToYAML(item)
+		if err != nil {
+			return nil, err
+		}
+		m.YamlSrc = yamlSrc
+		manifests = append(manifests, m)
+	}
+	return manifests, nil
+}
+
+// deletesApplications returns true when the ApplicationSet controller deletes the Applications an
+// ApplicationSet no longer generates
+func (s *ApplicationSet) deletesApplications() bool {
+	if s.Spec.SyncPolicy == nil {
+		return true
+	}
+	policy := s.Spec.SyncPolicy.ApplicationsSync
+	return policy != appSetSyncCreateOnly && policy != appSetSyncCreateUpdate
+}
+
+// preservesResources returns true when deleting an ApplicationSet's Applications never deletes
+// their resources, whatever their finalizers
+func (s *ApplicationSet) preservesResources() bool {
+	return s.Spec.SyncPolicy != nil && s.Spec.SyncPolicy.PreserveResourcesOnDeletion
+}
+
+// appSetGitGenerators returns the git generators in an ApplicationSet's manifest, including those
+// nested in matrix and merge generators. They're the manifest's own maps, so changing one changes
+// the manifest.
+func appSetGitGenerators(manifest map[string]any) []map[string]any {
+	generators, _, _ := unstructured.NestedFieldNoCopy(manifest, "spec", "generators")
+	return gitGeneratorsIn(generators)
+}
+
+func gitGeneratorsIn(generators any) []map[string]any {
+	list, _ := generators.([]any)
+	var gits []map[string]any
+	for _, g := range list {
+		gen, ok := g.(map[string]any)
+		if !ok {
+			continue
+		}
+		if git, ok := gen["git"].(map[string]any); ok {
+			gits = append(gits, git)
+		}
+		for _, combining := range []string{"matrix", "merge"} {
+			if c, ok := gen[combining].(map[string]any); ok {
+				gits = append(gits, gitGeneratorsIn(c["generators"])...)
+			}
+		}
+	}
+	return gits
+}
+
+// gitGeneratorSource is a git generator's repository and revision, as an application source, so
+// it's matched to a change the same way
+func gitGeneratorSource(git map[string]any) ApplicationSource {
+	repoURL, _ := git["repoURL"].(string)
+	revision, _ := git["revision"].(string)
+	if revision == "" {
+		revision = "HEAD"
+	}
+	return ApplicationSource{RepoURL: repoURL, TargetRevision: revision}
+}
+
+// gitGeneratorPaths returns a git generator's files or directories path patterns, split into those
+// it includes and (for directories) those it excludes
+func gitGeneratorPaths(git map[string]any, field string) (include []string, exclude []string) {
+	list, _ := git[field].([]any)
+	for _, p := range list {
+		entry, ok := p.(map[string]any)
+		if !ok {
+			continue
+		}
+		pattern, _ := entry["path"].(string)
+		if pattern == "" {
+			continue
+		}
+		if excluded, _ := entry["exclude"].(bool); excluded {
+			exclude = append(exclude, pattern)
+		} else {
+			include = append(include, pattern)
+		}
+	}
+	return include, exclude
+}
+
+// matchPath matches a git generator path pattern as ArgoCD does, where ** matches any number of
+// directories (see globMatch), with a bad pattern matching nothing
+func matchPath(pattern, name string) bool {
+	ok, err := globMatch(pattern, name)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Invalid git generator path %s", pattern)
+	}
+	return ok
+}
+
+// gitGeneratorFile returns the first of changedFiles that a git generator reads: one of its files,
+// or a file in (or under) one of its directories, which may add or remove that directory. It
+// returns "" when the generator doesn't read any of them.
+func gitGeneratorFile(git map[string]any, changedFiles []string) string {
+	files, _ := gitGeneratorPaths(git, "files")
+	dirs, excludedDirs := gitGeneratorPaths(git, "directories")
+	for _, f := range changedFiles {
+		f = strings.TrimPrefix(f, "/")
+		for _, pattern := range files {
+			if matchPath(pattern, f) {
+				return f
+			}
+		}
+		for dir := path.Dir(f); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			matched, excluded := false, false
+			for _, pattern := range dirs {
+				matched = matched || matchPath(pattern, dir)
+			}
+			for _, pattern := range excludedDirs {
+				excluded = excluded || matchPath(pattern, dir)
+			}
+			if matched && !excluded {
+				return f
+			}
+		}
+	}
+	return ""
+}
+
+// appSetMatch returns which of an ApplicationSet's git generators read the repository at the
+// change's base, and why the ApplicationSet matched; it matches when any of them also reads a
+// changed file (or the changed files aren't known).
+func appSetMatch(appSet ApplicationSet, eventInfo webhook.EventInfo) ([]map[string]any, string) {
+	var matching []map[string]any
+	var reason string
+	for _, git := range appSetGitGenerators(appSet.manifest) {
+		src := gitGeneratorSource(git)
+		if !checkSource(src, appSet.ObjectMeta.Name, eventInfo, true) {
+			continue
+		}
+		matching = append(matching, git)
+		if reason != "" {
+			continue
+		}
+		if len(eventInfo.ChangedFiles) == 0 {
+			reason = fmt.Sprintf("git generator %s (revision %s)", src.RepoURL, src.TargetRevision)
+		} else if f := gitGeneratorFile(git, eventInfo.ChangedFiles); f != "" {
+			reason = fmt.Sprintf("git generator %s (revision %s) reads %s", src.RepoURL, src.TargetRevision, f)
+		}
+	}
+	return matching, reason
+}
+
+// matchingAppSets returns the ApplicationSets with a git generator that reads the change, with why
+// each matched
+func matchingAppSets(appSets []ApplicationSet, eventInfo webhook.EventInfo) ([]ApplicationSet, []string) {
+	var matched []ApplicationSet
+	var reasons []string
+	for _, appSet := range appSets {
+		if _, reason := appSetMatch(appSet, eventInfo); reason != "" {
+			matched = append(matched, appSet)
+			reasons = append(reasons, reason)
+		} else {
+			log.Debug().Msgf("Filtering ApplicationSet %s: no git generator reads the change", appSet.ObjectMeta.Name)
+		}
+	}
+	return matched, reasons
+}
+
+// appSetManifestAt is an ApplicationSet's manifest with its matching git generators reading
+// revision, fit to send to ArgoCD to generate: without status or server-set metadata
+func appSetManifestAt(appSet ApplicationSet, eventInfo webhook.EventInfo, revision string) map[string]any {
+	manifest := map[string]any{}
+	if appSet.manifest != nil {
+		manifest = runtime.DeepCopyJSON(appSet.manifest)
+	}
+	manifest["apiVersion"] = argoApplicationApiGroup + "/v1alpha1"
+	manifest["kind"] = argoApplicationSetApiKind
+	metadata := map[string]any{"name": appSet.ObjectMeta.Name}
+	if appSet.ObjectMeta.Namespace != "" {
+		metadata["namespace"] = appSet.ObjectMeta.Namespace
+	}
+	manifest["metadata"] = metadata
+	delete(manifest, "status")
+	if revision != "" {
+		gits, _ := appSetMatch(ApplicationSet{ObjectMeta: appSet.ObjectMeta, manifest: manifest}, eventInfo)
+		for _, git := range gits {
+			git["revision"] = revision
+		}
+	}
+	return manifest
+}
+
+// processAppSet generates the Applications an ApplicationSet produces today and at the change's
+// head, and diffs the two. The result lists the Applications the change adds, removes or
+// re-templates; those it removes are added to its children straight away (see removedApps), and
+// those it adds or changes are queued as nestedJobs, to be diffed (or previewed) in wave 2 like an
+// app-of-apps' nested Applications.
+func processAppSet(ctx context.Context, appSet ApplicationSet, appLookup map[string]Application, eventInfo webhook.EventInfo) appTreeResult {
+	var res appTreeResult
+	appSetName := appSet.ObjectMeta.Name
+	if ctx.Err() != nil {
+		res.notDiffed = append(res.notDiffed, appSetName)
+		return res
+	}
+	appSetRes := ApplicationResourcesWithChanges{
+		ArgoApp:        &Application{TypeMeta: appSet.TypeMeta, ObjectMeta: appSet.ObjectMeta},
+		ApplicationSet: &appSet,
+	}
+	log.Info().Msgf("Generating the Applications of ArgoCD ApplicationSet '%s' w/ revision %s", appSetName, eventInfo.Sha)
+	changes, err := appSetDiff(ctx, appSet, eventInfo)
+	if err != nil {
+		if ctx.Err() != nil {
+			res.notDiffed = append(res.notDiffed, appSetName)
+			return res
+		}
+		appSetRes.WarnStr = fmt.Sprintf("Failed to generate ApplicationSet %s: %s", appSetName, err.Error())
+		res.diffResult = &appSetRes
+		return res
+	}
+	if len(changes) == 0 {
+		return res
+	}
+	appSetRes.ChangedResources = changes
+	res.diffResult = &appSetRes
+	addRemovals(ctx, &res, removedApps(appSetName, changes, appLookup, appSetRes.PruneOutcome, appSet.preservesResources()))
+	var appsWithChanges []Application
+	for _, r := range changes {
+		if r.Action() == ActionDeleted {
+			continue
+		}
+		yamlSrc, err := yaml.Marshal(r.Target)
+		var app Application
+		if err == nil {
+			app, err = genericManifestToArgoApplication(K8sManifest{Unstruct: unstructured.Unstructured{Object: r.Target}, YamlSrc: yamlSrc})
+		}
+		if err != nil {
+			log.Warn().Err(err).Msgf("Unable to decode Application %s generated by ApplicationSet %s", r.Name, appSetName)
+			continue
+		}
+		appsWithChanges = append(appsWithChanges, app)
+	}
+	log.Info().Msgf("ApplicationSet '%s' adds or changes %d Application(s)", appSetName, len(appsWithChanges))
+	queueNestedJobs(ctx, &res, appsWithChanges, appLookup, []string{appSetName})
+	return res
+}
+
+// appSetDiff diffs the Applications an ApplicationSet generates today with those it generates with
+// its matching git generators reading the change's head
+func appSetDiff(ctx context.Context, appSet ApplicationSet, eventInfo webhook.EventInfo) ([]AppResource, error) {
+	base, err := generateApplicationSet(ctx, appSetManifestAt(appSet, eventInfo, ""))
+	if err != nil {
+		return nil, fmt.Errorf("at its current revision: %w", err)
+	}
+	head, err := generateApplicationSet(ctx, appSetManifestAt(appSet, eventInfo, eventInfo.Sha))
+	if err != nil {
+		return nil, fmt.Errorf("at %s: %w", eventInfo.Sha, err)
+	}
+	appResList, err := manifestsDiff(base, head)
+	if err != nil {
+		return nil, err
+	}
+	log.Debug().Msgf("ApplicationSet %s generates %d Application(s) at %s, %d today; %d differ", appSet.ObjectMeta.Name, len(head), eventInfo.Sha, len(base), len(appResList))
+	return redactResources(appResList), nil
+}
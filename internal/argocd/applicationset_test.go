@@ -0,0 +1,231 @@
+package argocd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	wh "github.com/vince-riv/argo-diff/internal/webhook"
+)
+
+const appSetJSON = `{
+  "metadata": {"name": "guestbook", "namespace": "argocd", "resourceVersion": "123"},
+  "spec": {
+    "generators": [{"matrix": {"generators": [
+      {"clusters": {}},
+      {"git": {"repoURL": "https://github.com/acme/widgets.git", "revision": "HEAD", "files": [{"path": "clusters/*/config.json"}]}}
+    ]}}],
+    "template": {"metadata": {"name": "guestbook-{{.cluster}}"}}
+  },
+  "status": {"conditions": []}
+}`
+
+// setupAppSet mocks the cli for the guestbook ApplicationSet, whose git generator reads the pull
+// request's repository: at the pull request's sha it re-templates guestbook-dev, stops generating
+// guestbook-old and generates guestbook-new. It returns the args of each diff call.
+func setupAppSet(t *testing.T) *[][]string {
+	old := Application{ObjectMeta: metav1.ObjectMeta{Name: "guestbook-old", Finalizers: []string{resourcesFinalizer}}, Spec: ApplicationSpec{Source: &ApplicationSource{RepoURL: "https://github.com/acme/guestbook.git", TargetRevision: "v1", Path: "deploy"}}}
+	old.Status.Resources = []ResourceStatus{{Group: "apps", Kind: "Deployment", Namespace: "old", Name: "guestbook"}}
+	apps := []Application{
+		{ObjectMeta: metav1.ObjectMeta{Name: "guestbook-dev"}, Spec: ApplicationSpec{Source: &ApplicationSource{RepoURL: "https://github.com/acme/guestbook.git", TargetRevision: "v1", Path: "deploy"}}},
+		old,
+	}
+	appListJSON, err := json.Marshal(apps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	generated := func(name, revision string) string {
+		return fmt.Sprintf(`{"apiVersion": "argoproj.io/v1alpha1", "kind": "Application", "metadata": {"name": %q, "namespace": "argocd"}, "spec": {"source": {"repoURL": "https://github.com/acme/guestbook.git", "path": "deploy", "targetRevision": %q}}}`, name, revision)
+	}
+	var calls [][]string
+	originalExecArgoCdCli := execArgoCdCli
+	t.Cleanup(func() { execArgoCdCli = originalExecArgoCdCli })
+	execArgoCdCli = func(ctx context.Context, args []string) ([]byte, error) {
+		switch args[0] + " " + args[1] {
+		case "app list":
+			return appListJSON, nil
+		case "appset list":
+			return []byte("[" + appSetJSON + "]"), nil
+		case "appset generate":
+			manifest, err := os.ReadFile(args[2])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(string(manifest), "status") || strings.Contains(string(manifest), "resourceVersion") {
+				t.Errorf("Expected the ApplicationSet's status and server-set metadata to be dropped:\n%s", manifest)
+			}
+			if strings.Contains(string(manifest), "revision: abcdef") {
+				return []byte("[" + generated("guestbook-dev", "v2") + "," + generated("guestbook-new", "v2") + "]"), nil
+			}
+			return []byte("[" + generated("guestbook-dev", "v1") + "," + generated("guestbook-old", "v1") + "]"), nil
+		case "app diff":
+			calls = append(calls, args[1:])
+			return []byte("===== apps/Deployment dev/guestbook ======\n--- a\n+++ b\n@@ -1 +1 @@\n-old\n+new\n"), makeExitError(t, nil)
+		}
+		return nil, fmt.Errorf("unexpected argocd args: %v", args)
+	}
+	return &calls
+}
+
+func TestGetApplicationChangesAppSet(t *testing.T) {
+	calls := setupAppSet(t)
+	evtInfo := wh.EventInfo{RepoOwner: "acme", RepoName: "widgets", RepoDefaultRef: "main", ChangeRef: "add-cluster", BaseRef: "main", Sha: "abcdef", ChangedFiles: []string{"clusters/new/config.json"}}
+	var matchLog MatchLog
+	appResList, notDiffed, err := GetApplicationChanges(NewMatchContext(context.Background(), &matchLog), evtInfo)
+	if err != nil || len(notDiffed) != 0 {
+		t.Fatalf("GetApplicationChanges() = %v, %v", notDiffed, err)
+	}
+	var got []string
+	for _, r := range appResList {
+		got = append(got, r.ArgoApp.Name+"<"+r.Parent)
+	}
+	if want := []string{"guestbook<", "guestbook-old<guestbook", "guestbook-dev<guestbook"}; !slices.Equal(got, want) {
+		t.Fatalf("apps = %v, want %v", got, want)
+	}
+	appSet := appResList[0]
+	if appSet.ApplicationSet == nil || len(appSet.ChangedResources) != 3 {
+		t.Fatalf("Expected the ApplicationSet to add, alter and remove an Application each, got %+v", appSet)
+	}
+	if notes := appSet.Notes; len(notes) != 1 || !strings.Contains(notes[0], "guestbook-new") {
+		t.Errorf("Expected a note that guestbook-new wasn't previewed, got %v", notes)
+	}
+	if removal := appResList[1].Removal; removal == nil || removal.Prune != PruneAutomatic || !removal.Cascade || len(removal.Resources) != 1 {
+		t.Errorf("Unexpected removal of guestbook-old: %+v", removal)
+	}
+	// guestbook-dev is diffed at the revision the ApplicationSet now templates it with
+	if len(*calls) != 1 || !strings.HasPrefix(strings.Join((*calls)[0], " "), "diff guestbook-dev --revision v2") {
+		t.Errorf("Expected guestbook-dev to be diffed at v2, got %v", *calls)
+	}
+	if reason := matchLog.Reason("guestbook"); !strings.Contains(reason, "reads clusters/new/config.json") {
+		t.Errorf("Unexpected match reason for the ApplicationSet: %q", reason)
+	}
+}
+
+func TestAppSetPolicy(t *testing.T) {
+	appSet := ApplicationSet{Spec: ApplicationSetSpec{SyncPolicy: &ApplicationSetSyncPolicy{ApplicationsSync: appSetSyncCreateUpdate, PreserveResourcesOnDeletion: true}}}
+	res := ApplicationResourcesWithChanges{ApplicationSet: &appSet}
+	deleted := AppResource{Live: map[string]any{"kind": "Application"}}
+	if prune := res.PruneOutcome(deleted); prune != PruneRetained {
+		t.Errorf("Expected create-update to retain Applications, got %s", prune)
+	}
+	if !appSet.preservesResources() {
+		t.Errorf("Expected preserveResourcesOnDeletion to preserve resources")
+	}
+	appSet.Spec.SyncPolicy = nil
+	if prune := res.PruneOutcome(deleted); prune != PruneAutomatic || appSet.preservesResources() {
+		t.Errorf("Expected the default policy to delete Applications and their resources, got %s", prune)
+	}
+}
+
+func TestAppSetMatch(t *testing.T) {
+	appSets, err := parseApplicationSets([]json.RawMessage{json.RawMessage(appSetJSON)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appSet := appSets[0]
+	evtInfo := wh.EventInfo{RepoOwner: "acme", RepoName: "widgets", RepoDefaultRef: "main", BaseRef: "main", Sha: "abcdef"}
+	tests := []struct {
+		changedFiles []string
+		want         bool
+	}{
+		{nil, true},
+		{[]string{"clusters/prod/config.json"}, true},
+		{[]string{"clusters/prod/values.yaml"}, false},
+		{[]string{"README.md"}, false},
+	}
+	for _, tt := range tests {
+		evtInfo.ChangedFiles = tt.changedFiles
+		gits, reason := appSetMatch(appSet, evtInfo)
+		if (reason != "") != tt.want || len(gits) != 1 {
+			t.Errorf("appSetMatch() with %v = %d generator(s), %q; want match %t", tt.changedFiles, len(gits), reason, tt.want)
+		}
+	}
+
+	// a pull request against another branch doesn't change what the generator reads
+	evtInfo.BaseRef = "release"
+	if gits, reason := appSetMatch(appSet, evtInfo); len(gits) != 0 || reason != "" {
+		t.Errorf("Expected no match for a pull request against another branch, got %d, %q", len(gits), reason)
+	}
+
+	manifest := appSetManifestAt(appSet, wh.EventInfo{RepoOwner: "acme", RepoName: "widgets", RepoDefaultRef: "main", BaseRef: "main"}, "abcdef")
+	if git := appSetGitGenerators(manifest)[0]; git["revision"] != "abcdef" {
+		t.Errorf("Expected the git generator to read abcdef, got %v", git["revision"])
+	}
+	if git := appSetGitGenerators(appSet.manifest)[0]; git["revision"] != "HEAD" {
+		t.Errorf("Expected the ApplicationSet's own manifest to be left alone, got %v", git["revision"])
+	}
+}
+
+func TestGitGeneratorFile(t *testing.T) {
+	git := map[string]any{"directories": []any{
+		map[string]any{"path": "apps/*"},
+		map[string]any{"path": "apps/skip", "exclude": true},
+	}}
+	tests := map[string]string{
+		"apps/guestbook/deploy.yaml":    "apps/guestbook/deploy.yaml",
+		"apps/guestbook/base/kust.yaml": "apps/guestbook/base/kust.yaml",
+		"apps/skip/deploy.yaml":         "",
+		"apps/README.md":                "",
+		"other/guestbook/deploy.yaml":   "",
+	}
+	for file, want := range tests {
+		if got := gitGeneratorFile(git, []string{file}); got != want {
+			t.Errorf("gitGeneratorFile(%s) = %q, want %q", file, got, want)
+		}
+	}
+
+	// ** matches any number of directories, as in ArgoCD's own git files generator examples
+	git = map[string]any{"files": []any{map[string]any{"path": "clusters/**/config.json"}}}
+	tests = map[string]string{
+		"clusters/prod-eu/config.json":       "clusters/prod-eu/config.json",
+		"clusters/eu/prod/config.json":       "clusters/eu/prod/config.json",
+		"clusters/config.json":               "clusters/config.json",
+		"clusters/prod-eu/values.yaml":       "",
+		"other/clusters/prod-eu/config.json": "",
+	}
+	for file, want := range tests {
+		if got := gitGeneratorFile(git, []string{file}); got != want {
+			t.Errorf("gitGeneratorFile(%s) with ** = %q, want %q", file, got, want)
+		}
+	}
+}
+
+func TestApiApplicationSets(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.RequestURI())
+		if r.Method == http.MethodGet {
+			w.Write([]byte(`{"items": [` + appSetJSON + `]}`))
+			return
+		}
+		var req struct {
+			ApplicationSet map[string]any `json:"applicationSet"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ApplicationSet["kind"] != "ApplicationSet" {
+			t.Errorf("Unexpected request body (%v): %v", err, req)
+		}
+		w.Write([]byte(`{"applications": [{"apiVersion": "argoproj.io/v1alpha1", "kind": "Application", "metadata": {"name": "guestbook-dev"}}]}`))
+	}))
+	defer server.Close()
+	b := newApiBackend(server.URL, "test1234", server.Client())
+	appSets, err := b.listApplicationSets(context.Background())
+	if err != nil || len(appSets) != 1 || appSets[0].ObjectMeta.Name != "guestbook" {
+		t.Fatalf("listApplicationSets() = %+v, %v", appSets, err)
+	}
+	manifests, err := b.generateApplicationSet(context.Background(), appSetManifestAt(appSets[0], wh.EventInfo{}, ""))
+	if err != nil || len(manifests) != 1 || manifests[0].Unstruct.GetName() != "guestbook-dev" || !manifestIsArgoApplication(manifests[0]) {
+		t.Fatalf("generateApplicationSet() = %+v, %v", manifests, err)
+	}
+	want := []string{"GET /api/v1/applicationsets", "POST /api/v1/applicationsets/generate"}
+	if !slices.Equal(requests, want) {
+		t.Errorf("requests = %v, want %v", requests, want)
+	}
+}
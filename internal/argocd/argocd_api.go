@@ -0,0 +1,545 @@
+package argocd
+
+/*
+ * Client for the ArgoCD server's REST API (the grpc-gateway in front of its gRPC services)
+ */
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+
+	"github.com/vince-riv/argo-diff/internal/gendiff"
+)
+
+const lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+const trackingLabel = "argocd.argoproj.io/instance"
+const trackingAnnotation = "argocd.argoproj.io/tracking-id"
+
+type apiBackend struct {
+	baseUrl    string // eg: https://argocd.example.com/api
+	token      string
+	httpClient *http.Client
+}
+
+// newApiBackendFromEnv builds an apiBackend from the same environment variables that configure
+// the argocd cli, so switching backends doesn't require any other configuration changes
+func newApiBackendFromEnv() *apiBackend {
+	scheme := "https"
+	if strings.ToLower(os.Getenv("ARGOCD_SERVER_PLAINTEXT")) == "true" {
+		scheme = "http"
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	if strings.ToLower(os.Getenv("ARGOCD_SERVER_INSECURE")) == "true" {
+		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true} //nolint:gosec // mirrors argocd --insecure
+	}
+	baseUrl := fmt.Sprintf("%s://%s", scheme, os.Getenv("ARGOCD_SERVER_ADDR"))
+	if rootPath := strings.Trim(os.Getenv("ARGOCD_GRPC_WEB_ROOT_PATH"), "/"); rootPath != "" {
+		baseUrl += "/" + rootPath
+	}
+	return newApiBackend(baseUrl, os.Getenv("ARGOCD_AUTH_TOKEN"), &http.Client{Transport: tr, Timeout: 5 * time.Minute})
+}
+
+func newApiBackend(serverUrl, token string, httpClient *http.Client) *apiBackend {
+	return &apiBackend{
+		baseUrl:    strings.TrimRight(serverUrl, "/") + "/api",
+		token:      token,
+		httpClient: httpClient,
+	}
+}
+
+// apiError is the error body returned by the grpc-gateway
+type apiError struct {
+	Error   string `json:"error"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// get calls the ArgoCD API and decodes the JSON response into out
+func (b *apiBackend) get(ctx context.Context, path string, query url.Values, out any) error {
+	return b.call(ctx, http.MethodGet, path, query, nil, out)
+}
+
+// call sends a request to the ArgoCD API, with in (when not nil) as its JSON body, and decodes the
+// JSON response into out (when not nil)
+func (b *apiBackend) call(ctx context.Context, method string, path string, query url.Values, in any, out any) error {
+	reqUrl := b.baseUrl + path
+	if len(query) > 0 {
+		reqUrl += "?" + query.Encode()
+	}
+	log.Info().Msgf("Calling ArgoCD API: %s %s", method, reqUrl)
+	var reqBody io.Reader
+	if in != nil {
+		buf, err := json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("encoding request of %s %s: %w", method, path, err)
+		}
+		reqBody = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, reqUrl, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+b.token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := b.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", method, path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiErr apiError
+		if json.Unmarshal(body, &apiErr) == nil && apiErr.Message != "" {
+			return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, apiErr.Message)
+		}
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("decoding response of %s %s: %w", method, path, err)
+	}
+	return nil
+}
+
+func (b *apiBackend) listApplications(ctx context.Context) (*ApplicationList, error) {
+	log.Trace().Msg("apiBackend.listApplications() called")
+	var apps ApplicationList
+	if err := b.get(ctx, "/v1/applications", nil, &apps); err != nil {
+		log.Error().Err(err).Msg("Application List failed")
+		return nil, err
+	}
+	return &apps, nil
+}
+
+func (b *apiBackend) version(ctx context.Context) (string, string, error) {
+	var v struct {
+		Version string `json:"Version"`
+	}
+	if err := b.get(ctx, "/version", nil, &v); err != nil {
+		log.Error().Err(err).Msg("ArgoCD version failed")
+		return "", "", err
+	}
+	if v.Version == "" {
+		return "", "", fmt.Errorf("empty server version")
+	}
+	return "", strings.Split(v.Version, "+")[0], nil
+}
+
+// manifestsQuery builds the query for the manifests endpoint; multi-source applications pass
+// parallel revisions/sourcePositions lists instead of a single revision
+func manifestsQuery(revision string, revisions []string, srcPos []int) url.Values {
+	query := url.Values{}
+	if len(revisions) == 0 {
+		query.Set("revision", revision)
+		return query
+	}
+	for i, rev := range revisions {
+		query.Add("revisions", rev)
+		query.Add("sourcePositions", strconv.Itoa(srcPos[i]))
+	}
+	return query
+}
+
+func (b *apiBackend) manifests(ctx context.Context, appName string, query url.Values) ([]K8sManifest, error) {
+	var res struct {
+		Manifests []string `json:"manifests"`
+	}
+	if err := b.get(ctx, "/v1/applications/"+url.PathEscape(appName)+"/manifests", query, &res); err != nil {
+		return nil, err
+	}
+	var manifests []K8sManifest
+	for _, m := range res.Manifests {
+		var manifest K8sManifest
+		if err := json.Unmarshal([]byte(m), &manifest.Unstruct.Object); err != nil {
+			return manifests, err
+		}
+		yamlSrc, err := yaml.JSONToYAML([]byte(m))
+		if err != nil {
+			return manifests, err
+		}
+		manifest.YamlSrc = yamlSrc
+		manifests = append(manifests, manifest)
+	}
+	return manifests, nil
+}
+
+func (b *apiBackend) getApplicationManifests(ctx context.Context, appName string, revision string, revisions []string, srcPos []int) ([]K8sManifest, error) {
+	manifests, err := b.manifests(ctx, appName, manifestsQuery(revision, revisions, srcPos))
+	if err != nil {
+		log.Error().Err(err).Msgf("Get Argo application manifests for %s failed", appName)
+		return nil, err
+	}
+	return manifests, nil
+}
+
+// liveManifests returns the normalized live state of each of the application's resources (hooks
+// and resources that don't exist aren't included)
+func (b *apiBackend) liveManifests(ctx context.Context, appName string) ([]K8sManifest, error) {
+	var managed struct {
+		Items []managedResource `json:"items"`
+	}
+	if err := b.get(ctx, "/v1/applications/"+url.PathEscape(appName)+"/managed-resources", nil, &managed); err != nil {
+		log.Error().Err(err).Msgf("Fetching managed resources for %s failed", appName)
+		return nil, err
+	}
+	var manifests []K8sManifest
+	for _, mr := range managed.Items {
+		if mr.Hook {
+			continue
+		}
+		obj, err := decodeState(mr.NormalizedLiveState)
+		if err != nil {
+			return nil, fmt.Errorf("decoding live state of %s/%s %s/%s: %w", mr.Group, mr.Kind, mr.Namespace, mr.Name, err)
+		}
+		if obj == nil {
+			continue
+		}
+		var manifest K8sManifest
+		manifest.Unstruct.Object = obj
+		if manifest.YamlSrc, err = yaml.Marshal(obj); err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, manifest)
+	}
+	return manifests, nil
+}
+
+func (b *apiBackend) createApplication(ctx context.Context, manifest map[string]any) error {
+	return b.call(ctx, http.MethodPost, "/v1/applications", nil, manifest, nil)
+}
+
+func (b *apiBackend) deleteApplication(ctx context.Context, appName string) error {
+	return b.call(ctx, http.MethodDelete, "/v1/applications/"+url.PathEscape(appName), url.Values{"cascade": {"false"}}, nil, nil)
+}
+
+func (b *apiBackend) listApplicationSets(ctx context.Context) ([]ApplicationSet, error) {
+	var res struct {
+		Items []json.RawMessage `json:"items"`
+	}
+	if err := b.get(ctx, "/v1/applicationsets", nil, &res); err != nil {
+		return nil, err
+	}
+	return parseApplicationSets(res.Items)
+}
+
+func (b *apiBackend) generateApplicationSet(ctx context.Context, manifest map[string]any) ([]K8sManifest, error) {
+	var res struct {
+		Applications []json.RawMessage `json:"applications"`
+	}
+	req := map[string]any{"applicationSet": manifest}
+	if err := b.call(ctx, http.MethodPost, "/v1/applicationsets/generate", nil, req, &res); err != nil {
+		return nil, err
+	}
+	return jsonManifests(res.Applications)
+}
+
+// managedResource is one entry of the managed-resources endpoint. The states are JSON documents
+// encoded as strings ("null" when absent).
+type managedResource struct {
+	Group               string `json:"group"`
+	Kind                string `json:"kind"`
+	Namespace           string `json:"namespace"`
+	Name                string `json:"name"`
+	TargetState         string `json:"targetState"`
+	LiveState           string `json:"liveState"`
+	NormalizedLiveState string `json:"normalizedLiveState"`
+	PredictedLiveState  string `json:"predictedLiveState"`
+	Hook                bool   `json:"hook"`
+	Modified            bool   `json:"modified"`
+}
+
+func resourceKey(group, kind, namespace, name string) string {
+	return strings.Join([]string{group, kind, namespace, name}, "/")
+}
+
+// decodeState decodes a managed resource state, returning nil for absent ("null" or empty) ones
+func decodeState(state string) (map[string]any, error) {
+	if state == "" || state == "null" {
+		return nil, nil
+	}
+	var obj map[string]any
+	if err := json.Unmarshal([]byte(state), &obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (b *apiBackend) diffApplication(ctx context.Context, appName string, revision string, revisions []string, srcPos []int) ([]AppResource, error) {
+	var appResList []AppResource
+	log.Trace().Msg("apiBackend.diffApplication() called")
+	target, err := b.manifests(ctx, appName, manifestsQuery(revision, revisions, srcPos))
+	if err != nil {
+		log.Error().Err(err).Msgf("Application diff for %s, revision %s, failed", appName, revision)
+		return nil, err
+	}
+	var managed struct {
+		Items []managedResource `json:"items"`
+	}
+	if err := b.get(ctx, "/v1/applications/"+url.PathEscape(appName)+"/managed-resources", nil, &managed); err != nil {
+		log.Error().Err(err).Msgf("Fetching managed resources for %s failed", appName)
+		return nil, err
+	}
+	live := make(map[string]map[string]any)
+	liveRes := make(map[string]managedResource)
+	var liveOrder []managedResource
+	for _, mr := range managed.Items {
+		if mr.Hook {
+			continue
+		}
+		obj, err := decodeState(mr.NormalizedLiveState)
+		if err != nil {
+			return nil, fmt.Errorf("decoding live state of %s/%s %s/%s: %w", mr.Group, mr.Kind, mr.Namespace, mr.Name, err)
+		}
+		key := resourceKey(mr.Group, mr.Kind, mr.Namespace, mr.Name)
+		live[key] = obj
+		liveRes[key] = mr
+		liveOrder = append(liveOrder, mr)
+	}
+	serverSide := appDiffServerSideDiff == "true"
+	var pending []serverSideDiffResource
+	var order []string
+	changes := make(map[string]AppResource)
+	seen := make(map[string]bool)
+	for _, m := range target {
+		u := m.Unstruct
+		gvk := u.GroupVersionKind()
+		ns := u.GetNamespace()
+		key := resourceKey(gvk.Group, gvk.Kind, ns, u.GetName())
+		liveObj, ok := live[key]
+		if !ok && ns == "" {
+			// rendered manifests usually leave the namespace to the application's destination
+			key, ok = findByName(liveOrder, gvk.Group, gvk.Kind, u.GetName())
+			if ok {
+				liveObj = live[key]
+				ns = strings.Split(key, "/")[2]
+			}
+		}
+		seen[key] = true
+		order = append(order, key)
+		if serverSide && liveObj != nil && !isSecret(gvk.Group, gvk.Kind) {
+			// diffed in one batch below; resources that don't exist yet have nothing to dry-run
+			// apply onto, and Secrets stay out of ArgoCD's request logs
+			pending = append(pending, serverSideDiffResource{group: gvk.Group, kind: gvk.Kind, namespace: ns, name: u.GetName(), apiVersion: u.GetAPIVersion(), live: liveRes[key], target: u.Object})
+			continue
+		}
+		appRes, changed, err := resourceDiff(gvk.Group, gvk.Kind, ns, u.GetName(), liveObj, u.Object)
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			appRes.ApiVersion = u.GetAPIVersion()
+			changes[key] = appRes
+		}
+	}
+	if len(pending) > 0 {
+		ssdList, err := b.serverSideDiff(ctx, appName, pending)
+		if err != nil {
+			log.Error().Err(err).Msgf("Server-side diff of %s failed", appName)
+			return nil, err
+		}
+		for _, appRes := range ssdList {
+			changes[resourceKey(appRes.Group, appRes.Kind, appRes.Namespace, appRes.Name)] = appRes
+		}
+	}
+	for _, key := range order {
+		if appRes, ok := changes[key]; ok {
+			appResList = append(appResList, appRes)
+			delete(changes, key)
+		}
+	}
+	// anything live that's no longer rendered will be pruned (or left orphaned)
+	for _, mr := range liveOrder {
+		key := resourceKey(mr.Group, mr.Kind, mr.Namespace, mr.Name)
+		if seen[key] || live[key] == nil {
+			continue
+		}
+		appRes, changed, err := resourceDiff(mr.Group, mr.Kind, mr.Namespace, mr.Name, live[key], nil)
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			appResList = append(appResList, appRes)
+		}
+	}
+	if len(appResList) == 0 {
+		log.Trace().Msgf("Application %s revision %s has no changes", appName, revision)
+	}
+	return appResList, nil
+}
+
+// findByName finds the live resource with the given group/kind/name when exactly one namespace
+// has it
+func findByName(items []managedResource, group, kind, name string) (string, bool) {
+	found := ""
+	for _, mr := range items {
+		if mr.Group == group && mr.Kind == kind && mr.Name == name {
+			if found != "" {
+				return "", false
+			}
+			found = resourceKey(mr.Group, mr.Kind, mr.Namespace, mr.Name)
+		}
+	}
+	return found, found != ""
+}
+
+// resourceDiff renders a unified diff of one resource's live and target states (either may be
+// nil). It returns false when there's no difference.
+func resourceDiff(group, kind, namespace, name string, liveObj, targetObj map[string]any) (AppResource, bool, error) {
+	appRes := AppResource{Group: group, Kind: kind, Namespace: namespace, Name: name, Live: resourceObject(liveObj), Target: resourceObject(targetObj)}
+	var liveYaml, targetYaml []byte
+	var err error
+	if targetObj != nil {
+		targetObj = compact(stripTracking(targetObj)).(map[string]any)
+		if targetYaml, err = yaml.Marshal(targetObj); err != nil {
+			return appRes, false, err
+		}
+	}
+	if liveObj != nil {
+		var lastApplied map[string]any
+		if la, ok, _ := unstructured.NestedString(liveObj, "metadata", "annotations", lastAppliedAnnotation); ok {
+			_ = json.Unmarshal([]byte(la), &lastApplied)
+		}
+		liveObj = stripTracking(liveObj)
+		if targetObj != nil {
+			liveObj = pruneToConfig(liveObj, targetObj, lastApplied).(map[string]any)
+		} else {
+			liveObj = stripServerFields(liveObj)
+		}
+		liveObj, _ = compact(liveObj).(map[string]any)
+		if liveYaml, err = yaml.Marshal(liveObj); err != nil {
+			return appRes, false, err
+		}
+	}
+	if string(liveYaml) == string(targetYaml) {
+		return appRes, false, nil
+	}
+	appRes.DiffStr = gendiff.UnifiedDiff(name+"-live.yaml", name, string(liveYaml), string(targetYaml))
+	appRes.Changes = gendiff.StructuredDiff(liveObj, targetObj)
+	return appRes, true, nil
+}
+
+// stripTracking returns a copy of obj without the label and annotation ArgoCD uses to track the
+// resources it manages; like ArgoCD's own diff, they're left out of the comparison
+func stripTracking(obj map[string]any) map[string]any {
+	u := unstructured.Unstructured{Object: obj}
+	u = *u.DeepCopy()
+	unstructured.RemoveNestedField(u.Object, "metadata", "labels", trackingLabel)
+	unstructured.RemoveNestedField(u.Object, "metadata", "annotations", trackingAnnotation)
+	return u.Object
+}
+
+// pruneToConfig drops the fields of a live object that neither the target manifest nor the
+// last-applied configuration mention - server-populated fields like status, uid and defaulted
+// values - so the diff shows what a sync would change rather than everything the API server
+// added. It's an approximation of ArgoCD's own three-way diff. Lists are compared by position, so
+// a list the API server reorders or extends (eg: defaulted container ports) can show changes the
+// cli wouldn't; ARGOCD_APP_DIFF_SERVER_SIDE_DIFF=true has ArgoCD compute the diff instead (see
+// serverSideDiff).
+func pruneToConfig(live, target, lastApplied any) any {
+	switch l := live.(type) {
+	case map[string]any:
+		t, _ := target.(map[string]any)
+		la, _ := lastApplied.(map[string]any)
+		res := make(map[string]any)
+		for k, v := range l {
+			tv, inTarget := t[k]
+			lav, inLastApplied := la[k]
+			if !inTarget && !inLastApplied {
+				continue
+			}
+			if k == lastAppliedAnnotation {
+				continue
+			}
+			res[k] = pruneToConfig(v, pick(inTarget, tv, lav), pick(inLastApplied, lav, tv))
+		}
+		return res
+	case []any:
+		t, _ := target.([]any)
+		la, _ := lastApplied.([]any)
+		res := make([]any, len(l))
+		for i, v := range l {
+			var tv, lav any
+			if i < len(t) {
+				tv = t[i]
+			}
+			if i < len(la) {
+				lav = la[i]
+			}
+			if tv == nil && lav == nil {
+				res[i] = v
+				continue
+			}
+			res[i] = pruneToConfig(v, pick(tv != nil, tv, lav), pick(lav != nil, lav, tv))
+		}
+		return res
+	}
+	return live
+}
+
+func pick(ok bool, a, b any) any {
+	if ok {
+		return a
+	}
+	return b
+}
+
+// stripServerFields removes the fields the API server manages from a live object that has no
+// target to prune it against (ie: it's about to be deleted)
+func stripServerFields(obj map[string]any) map[string]any {
+	u := unstructured.Unstructured{Object: obj}
+	u = *u.DeepCopy()
+	unstructured.RemoveNestedField(u.Object, "status")
+	for _, f := range []string{"managedFields", "resourceVersion", "uid", "generation", "creationTimestamp", "selfLink"} {
+		unstructured.RemoveNestedField(u.Object, "metadata", f)
+	}
+	unstructured.RemoveNestedField(u.Object, "metadata", "annotations", lastAppliedAnnotation)
+	return u.Object
+}
+
+// compact removes null values (eg: "creationTimestamp: null" in rendered manifests) and the
+// empty maps left behind once their contents are pruned or removed
+func compact(v any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		res := make(map[string]any)
+		for k, val := range t {
+			if val == nil {
+				continue
+			}
+			val = compact(val)
+			if m, ok := val.(map[string]any); ok && len(m) == 0 {
+				continue
+			}
+			res[k] = val
+		}
+		return res
+	case []any:
+		res := make([]any, len(t))
+		for i, val := range t {
+			res[i] = compact(val)
+		}
+		return res
+	}
+	return v
+}
@@ -0,0 +1,349 @@
+package argocd
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/vince-riv/argo-diff/internal/gendiff"
+)
+
+const payloadApplications = "payload-GET-applications-brief.json"
+const payloadManagedResources = "payload-GET-managed-resources.json"
+const payloadManifestCurrent = "payload-GET-manifest-current.json"
+const payloadManifestChange = "payload-GET-manifest-change-1.json"
+const payloadManifestBadKustomize = "payload-GET-manifest-bad-kustomize.json"
+
+// newArgoApiTestServer stands in for the ArgoCD API; the manifests returned depend on the
+// revision requested
+func newArgoApiTestServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test1234" {
+			t.Errorf("Missing Authorization header on %s", r.URL)
+		}
+		statusCode := http.StatusOK
+		var fileName string
+		switch path := r.URL.Path; {
+		case path == "/api/version":
+			w.WriteHeader(statusCode)
+			w.Write([]byte(`{"Version":"v2.13.2+dc43124"}`))
+			return
+		case path == "/api/v1/applications":
+			fileName = payloadApplications
+		case path == "/api/v1/applications/argo-diff/managed-resources":
+			fileName = payloadManagedResources
+		case path == serverSideDiffMethod:
+			if r.Method != http.MethodPost || r.URL.RawQuery != "" || r.Header.Get("Content-Type") != "application/grpc-web+proto" {
+				t.Errorf("Unexpected server-side diff request: %s %s (%s)", r.Method, r.URL, r.Header.Get("Content-Type"))
+			}
+			serverSideDiffCalls++
+			body, _ := io.ReadAll(r.Body)
+			w.Header().Set("Content-Type", "application/grpc-web+proto")
+			w.WriteHeader(statusCode)
+			w.Write(grpcWebFrame(0, serverSideDiffResponse(t, body[5:])))
+			w.Write(grpcWebFrame(0x80, []byte("grpc-status:0\r\ngrpc-message:\r\n")))
+			return
+		case path == "/api/v1/applications/argo-diff/manifests":
+			switch r.URL.Query().Get("revision") {
+			case "current":
+				fileName = payloadManifestCurrent
+			case "change-1":
+				fileName = payloadManifestChange
+			default:
+				statusCode = http.StatusInternalServerError
+				fileName = payloadManifestBadKustomize
+			}
+		default:
+			t.Errorf("Mock server not configured to serve path %s", path)
+			statusCode = http.StatusNotFound
+		}
+		var payload []byte
+		if fileName != "" {
+			var err error
+			payload, _, err = readFileToByteArray(fileName)
+			if err != nil {
+				t.Errorf("readFileToByteArray() failed: %s", err)
+			}
+		}
+		w.WriteHeader(statusCode)
+		w.Write(payload)
+	}))
+}
+
+// serverSideDiffCalls counts the gRPC-web calls the mock server has answered
+var serverSideDiffCalls int
+
+func grpcWebFrame(flag byte, msg []byte) []byte {
+	frame := []byte{flag, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+// serverSideDiffResponse stands in for ArgoCD's dry-run apply, reduced to the one field the tests
+// change: each target's spec.replicas is applied onto the live object paired with it
+func serverSideDiffResponse(t *testing.T, query []byte) []byte {
+	var lives, targets []map[string]any
+	err := consumeFields(query, func(num protowire.Number, v []byte) error {
+		var state []byte
+		switch num {
+		case ssdQueryLiveResources:
+			if err := consumeFields(v, func(num protowire.Number, v []byte) error {
+				if num == resourceDiffLiveState {
+					state = v
+				}
+				return nil
+			}, nil); err != nil {
+				return err
+			}
+		case ssdQueryTargetManifests:
+			state = v
+		default:
+			return nil
+		}
+		var obj map[string]any
+		if err := json.Unmarshal(state, &obj); err != nil {
+			return err
+		}
+		if num == ssdQueryLiveResources {
+			lives = append(lives, obj)
+		} else {
+			targets = append(targets, obj)
+		}
+		return nil
+	}, nil)
+	if err != nil || len(lives) != len(targets) {
+		t.Errorf("Bad server-side diff query: %d live, %d target, %v", len(lives), len(targets), err)
+	}
+	var res []byte
+	for i, live := range lives {
+		if live["kind"] == "Secret" {
+			t.Errorf("Secret %v sent for a server-side diff", live["metadata"])
+		}
+		predicted := (&unstructured.Unstructured{Object: live}).DeepCopy().Object
+		modified := false
+		if replicas, ok, _ := unstructured.NestedFieldNoCopy(targets[i], "spec", "replicas"); ok {
+			current, _, _ := unstructured.NestedFieldNoCopy(live, "spec", "replicas")
+			modified = current != replicas
+			_ = unstructured.SetNestedField(predicted, replicas, "spec", "replicas")
+		}
+		liveState, _ := json.Marshal(live)
+		predictedState, _ := json.Marshal(predicted)
+		item := protowire.AppendTag(nil, resourceDiffLiveState, protowire.BytesType)
+		item = protowire.AppendBytes(item, liveState)
+		item = protowire.AppendTag(item, resourceDiffPredictedLiveState, protowire.BytesType)
+		item = protowire.AppendBytes(item, predictedState)
+		item = protowire.AppendTag(item, resourceDiffModified, protowire.VarintType)
+		item = protowire.AppendVarint(item, protowire.EncodeBool(modified))
+		res = protowire.AppendTag(res, ssdResponseItems, protowire.BytesType)
+		res = protowire.AppendBytes(res, item)
+	}
+	return res
+}
+
+func setupApiBackend(t *testing.T) {
+	server := newArgoApiTestServer(t)
+	originalBackend := argoBackend
+	argoBackend = newApiBackend(server.URL, "test1234", server.Client())
+	t.Cleanup(func() {
+		argoBackend = originalBackend
+		server.Close()
+	})
+}
+
+func TestApiListApplications(t *testing.T) {
+	setupApiBackend(t)
+	apps, err := listApplications(context.Background())
+	if err != nil {
+		t.Fatalf("listApplications() failed: %v", err)
+	}
+	if len(apps.Items) == 0 || apps.Items[0].ObjectMeta.Name != "argo-apps" {
+		t.Errorf("listApplications() returned unexpected items: %+v", apps.Items)
+	}
+}
+
+func TestApiVersion(t *testing.T) {
+	setupApiBackend(t)
+	clientV, serverV, err := argocdVersion(context.Background())
+	if err != nil {
+		t.Fatalf("argocdVersion() failed: %v", err)
+	}
+	if clientV != "" || serverV != "v2.13.2" {
+		t.Errorf("argocdVersion() returned %q, %q; expected \"\", \"v2.13.2\"", clientV, serverV)
+	}
+	if err := ConnectivityCheck(); err != nil {
+		t.Errorf("ConnectivityCheck() failed: %v", err)
+	}
+}
+
+func TestApiGetApplicationManifests(t *testing.T) {
+	setupApiBackend(t)
+	manifests, err := getApplicationManifests(context.Background(), "argo-diff", "current", nil, nil)
+	if err != nil {
+		t.Fatalf("getApplicationManifests() failed: %v", err)
+	}
+	if len(manifests) != 4 {
+		t.Fatalf("getApplicationManifests() returned %d manifests, 4 expected", len(manifests))
+	}
+	if manifests[1].Unstruct.GetKind() != "Deployment" || !strings.Contains(string(manifests[1].YamlSrc), "replicas: 1") {
+		t.Errorf("Unexpected 2nd manifest: %s", manifests[1].YamlSrc)
+	}
+	if _, err := getApplicationManifests(context.Background(), "argo-diff", "bad", nil, nil); err == nil || !strings.Contains(err.Error(), "kustomize build") {
+		t.Errorf("Expected the kustomize error from the server, got %v", err)
+	}
+}
+
+func TestApiLiveManifests(t *testing.T) {
+	setupApiBackend(t)
+	manifests, err := liveManifests(context.Background(), "argo-diff")
+	if err != nil {
+		t.Fatalf("liveManifests() failed: %v", err)
+	}
+	if len(manifests) != 4 || manifests[1].Unstruct.GetKind() != "Deployment" || manifests[1].Unstruct.GetNamespace() != "argocd" {
+		t.Fatalf("Unexpected live manifests: %+v", manifests)
+	}
+	if !strings.Contains(string(manifests[1].YamlSrc), "kind: Deployment") {
+		t.Errorf("Expected YamlSrc to hold the live object, got %s", manifests[1].YamlSrc)
+	}
+}
+
+func TestApiDiffApplication(t *testing.T) {
+	setupApiBackend(t)
+	ctx := context.Background()
+	// the live Deployment runs a PR image, so there's drift even at the current revision; once
+	// server-populated fields are pruned, it's the only difference
+	res, err := diffApplication(ctx, "argo-diff", "current", nil, nil)
+	if err != nil {
+		t.Fatalf("diffApplication() failed: %v", err)
+	}
+	if len(res) != 1 || res[0].Kind != "Deployment" || strings.Contains(res[0].DiffStr, "replicas") {
+		t.Errorf("Expected only the Deployment image drift at the current revision, got %+v", res)
+	}
+
+	res, err = diffApplication(ctx, "argo-diff", "change-1", nil, nil)
+	if err != nil {
+		t.Fatalf("diffApplication() failed: %v", err)
+	}
+	if len(res) != 1 {
+		t.Fatalf("Expected 1 changed resource, got %+v", res)
+	}
+	ar := res[0]
+	if ar.ApiVersion != "apps/v1" || ar.Group != "apps" || ar.Kind != "Deployment" || ar.Namespace != "argocd" || ar.Name != "argo-diff" {
+		t.Errorf("Unexpected changed resource: %+v", ar)
+	}
+	if !strings.Contains(ar.DiffStr, "-  replicas: 1") || !strings.Contains(ar.DiffStr, "+  replicas: 2") {
+		t.Errorf("Unexpected diff: %s", ar.DiffStr)
+	}
+	if !slices.ContainsFunc(ar.Changes, func(c gendiff.Change) bool { return c.Path == "spec.replicas" && c.Op == gendiff.ChangeModified }) {
+		t.Errorf("Expected a structured change to spec.replicas, got %+v", ar.Changes)
+	}
+
+	if _, err := diffApplication(ctx, "argo-diff", "bad", nil, nil); err == nil {
+		t.Error("Expected an error diffing a revision that fails to render")
+	}
+}
+
+func TestApiDiffApplicationServerSide(t *testing.T) {
+	setupApiBackend(t)
+	original := appDiffServerSideDiff
+	appDiffServerSideDiff = "true"
+	t.Cleanup(func() { appDiffServerSideDiff = original })
+	ctx := context.Background()
+
+	serverSideDiffCalls = 0
+	res, err := diffApplication(ctx, "argo-diff", "change-1", nil, nil)
+	if err != nil {
+		t.Fatalf("diffApplication() failed: %v", err)
+	}
+	if serverSideDiffCalls != 1 {
+		t.Errorf("Expected one server-side diff call for the application, got %d", serverSideDiffCalls)
+	}
+	var deploy *AppResource
+	for i := range res {
+		if res[i].Kind == "Deployment" {
+			deploy = &res[i]
+		}
+	}
+	if deploy == nil || deploy.Namespace != "argocd" || deploy.Target == nil {
+		t.Fatalf("Expected a changed Deployment, got %+v", res)
+	}
+	if !strings.Contains(deploy.DiffStr, "-  replicas: 1") || !strings.Contains(deploy.DiffStr, "+  replicas: 2") {
+		t.Errorf("Unexpected diff: %s", deploy.DiffStr)
+	}
+	if !slices.ContainsFunc(deploy.Changes, func(c gendiff.Change) bool { return c.Path == "spec.replicas" && c.Op == gendiff.ChangeModified }) {
+		t.Errorf("Expected a structured change to spec.replicas, got %+v", deploy.Changes)
+	}
+	if len(res) != 1 || strings.Contains(deploy.DiffStr, "image:") {
+		t.Errorf("Expected only what ArgoCD predicts a sync would change, got %+v", res)
+	}
+
+	// unlike the client-side comparison, drift a sync wouldn't touch isn't reported
+	if res, err := diffApplication(ctx, "argo-diff", "current", nil, nil); err != nil || len(res) != 0 {
+		t.Errorf("Expected no changes at the current revision, got %+v, %v", res, err)
+	}
+}
+
+func TestPruneToConfig(t *testing.T) {
+	live := map[string]any{
+		"metadata": map[string]any{"name": "a", "uid": "123"},
+		"spec": map[string]any{
+			"replicas": 1.0,
+			"ports":    []any{map[string]any{"port": 80.0, "protocol": "TCP"}},
+		},
+		"status": map[string]any{"ready": true},
+	}
+	target := map[string]any{
+		"metadata": map[string]any{"name": "a"},
+		"spec":     map[string]any{"ports": []any{map[string]any{"port": 81.0}}},
+	}
+	lastApplied := map[string]any{"spec": map[string]any{"replicas": 1.0}}
+	got := pruneToConfig(live, target, lastApplied).(map[string]any)
+	if _, ok := got["status"]; ok {
+		t.Error("status should have been pruned")
+	}
+	if _, ok := got["metadata"].(map[string]any)["uid"]; ok {
+		t.Error("metadata.uid should have been pruned")
+	}
+	spec := got["spec"].(map[string]any)
+	if spec["replicas"] != 1.0 {
+		t.Error("spec.replicas is in the last-applied configuration and should be kept")
+	}
+	port := spec["ports"].([]any)[0].(map[string]any)
+	if _, ok := port["protocol"]; ok || port["port"] != 80.0 {
+		t.Errorf("Unexpected port after pruning: %+v", port)
+	}
+}
+
+func TestApiCreateDeleteApplication(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.RequestURI())
+		if r.Method == http.MethodPost {
+			var app map[string]any
+			if err := json.NewDecoder(r.Body).Decode(&app); err != nil || app["kind"] != "Application" {
+				t.Errorf("Unexpected request body (%v): %v", err, app)
+			}
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	b := newApiBackend(server.URL, "test1234", server.Client())
+	if err := b.createApplication(context.Background(), map[string]any{"kind": "Application"}); err != nil {
+		t.Fatalf("createApplication() failed: %v", err)
+	}
+	if err := b.deleteApplication(context.Background(), "argo-diff-preview-0a1b2c3d"); err != nil {
+		t.Fatalf("deleteApplication() failed: %v", err)
+	}
+	want := []string{"POST /api/v1/applications", "DELETE /api/v1/applications/argo-diff-preview-0a1b2c3d?cascade=false"}
+	if !slices.Equal(requests, want) {
+		t.Errorf("requests = %v, want %v", requests, want)
+	}
+}
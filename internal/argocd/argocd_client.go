@@ -17,6 +17,9 @@ import (
 
 	"github.com/rs/zerolog/log"
 	"sigs.k8s.io/yaml"
+
+	"github.com/vince-riv/argo-diff/internal/gendiff"
+	"github.com/vince-riv/argo-diff/internal/metrics"
 )
 
 var (
@@ -24,8 +27,18 @@ var (
 	commonCliArgv         []string
 	envArgoCdOpts         string
 	appDiffServerSideDiff string
+	// resourceObjects has the cli backend fill in each changed resource's Live and Target objects
+	// (see FetchResourceObjects)
+	resourceObjects bool
 )
 
+// FetchResourceObjects has the cli backend fill in the Live and Target objects of the resources
+// an application diff changes, as the api backend always does. The cli only gives them up through
+// two more calls per application with changes, so it's for callers that need them: policy rules.
+func FetchResourceObjects() {
+	resourceObjects = true
+}
+
 func init() {
 	serverAddr := os.Getenv("ARGOCD_SERVER_ADDR")
 	httpBearerToken = os.Getenv("ARGOCD_AUTH_TOKEN")
@@ -79,6 +92,17 @@ func logTraceCommandEnv(cmd *exec.Cmd) {
 	}
 }
 
+// cliSubcommand names the argocd subcommand being run, eg: "app diff" or "version"
+func cliSubcommand(args []string) string {
+	if len(args) > 1 && args[0] == "app" {
+		return "app " + args[1]
+	}
+	if len(args) > 0 {
+		return args[0]
+	}
+	return ""
+}
+
 // Wrapper around argocd cli; returns raw output in []bytes
 // Set as variable so it can be mocked in tests
 var execArgoCdCli = func(ctx context.Context, args []string) ([]byte, error) {
@@ -88,12 +112,13 @@ var execArgoCdCli = func(ctx context.Context, args []string) ([]byte, error) {
 	// can write into commonCliArgv's spare capacity and corrupt other concurrent callers' argv.
 	argv := slices.Concat(commonCliArgv, args)
 	cmd := exec.CommandContext(ctx, argocdCmdName, argv...)
-	cmd.Env = append(cmd.Environ(), "KUBECTL_EXTERNAL_DIFF=diff -u")
+	cmd.Env = append(cmd.Environ(), "KUBECTL_EXTERNAL_DIFF="+externalDiffCmd(ctx))
 	if envArgoCdOpts != "" {
 		cmd.Env = append(cmd.Env, fmt.Sprintf("ARGOCD_OPTS=%s", envArgoCdOpts))
 	}
 	logTraceCommandEnv(cmd)
 	out, err := cmd.Output()
+	metrics.ArgocdCliCall(cliSubcommand(args), cmd.ProcessState.ExitCode())
 	if err != nil {
 		// log.Error().Err(err).Msgf("Failed to execute: %s ... %s", argocdCmdName, strings.Join(argv, " "))
 		return out, err
@@ -101,7 +126,10 @@ var execArgoCdCli = func(ctx context.Context, args []string) ([]byte, error) {
 	return out, nil
 }
 
-func listApplications(ctx context.Context) (*ApplicationList, error) {
+// cliBackend is the default backend: it shells out to the argocd cli via execArgoCdCli
+type cliBackend struct{}
+
+func (cliBackend) listApplications(ctx context.Context) (*ApplicationList, error) {
 	var appList []Application
 	var apps ApplicationList
 	log.Trace().Msg("listApplications() called")
@@ -148,7 +176,7 @@ func parseArgoCDVersion(output []byte) (clientVersion, serverVersion string, err
 	return clientVersion, serverVersion, nil
 }
 
-func argocdVersion(ctx context.Context) (string, string, error) {
+func (cliBackend) version(ctx context.Context) (string, string, error) {
 	// argocd version
 	output, err := execArgoCdCli(ctx, []string{"version"})
 	if err != nil {
@@ -194,9 +222,28 @@ func appManifestHelper(input []byte) ([]K8sManifest, error) {
 	return manifests, nil
 }
 
-func getApplicationManifests(ctx context.Context, appName, revision string) ([]K8sManifest, error) {
+// revisionArgs are the flags selecting what an app manifests or app diff call renders: --revision,
+// or for multi-source applications, parallel --revisions and --source-positions
+func revisionArgs(revision string, revisions []string, srcPos []int) []string {
+	if len(revisions) == 0 {
+		return []string{"--revision", revision}
+	}
+	var args []string
+	for _, rev := range revisions {
+		args = append(args, "--revisions")
+		args = append(args, rev)
+	}
+	for _, pos := range srcPos {
+		args = append(args, "--source-positions")
+		args = append(args, strconv.Itoa(pos))
+	}
+	return args
+}
+
+func (cliBackend) getApplicationManifests(ctx context.Context, appName string, revision string, revisions []string, srcPos []int) ([]K8sManifest, error) {
 	// argocd app manifests argo-diff --revision HEAD
-	output, err := execArgoCdCli(ctx, []string{"app", "manifests", appName, "--revision", revision})
+	// argocd app manifests argo-diff --revisions XXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXX --source-positions 1
+	output, err := execArgoCdCli(ctx, append([]string{"app", "manifests", appName}, revisionArgs(revision, revisions, srcPos)...))
 	if err != nil {
 		log.Error().Err(err).Msgf("Get Argo application manifests for %s failed", appName)
 		return nil, err
@@ -209,23 +256,101 @@ func getApplicationManifests(ctx context.Context, appName, revision string) ([]K
 	return manifests, nil
 }
 
-func diffApplication(ctx context.Context, appName string, revision string, revisions []string, srcPos []int) ([]AppResource, error) {
+func (cliBackend) liveManifests(ctx context.Context, appName string) ([]K8sManifest, error) {
+	// argocd app manifests argo-diff --source live
+	output, err := execArgoCdCli(ctx, []string{"app", "manifests", appName, "--source", "live"})
+	if err != nil {
+		log.Error().Err(err).Msgf("Get live manifests of Argo application %s failed", appName)
+		return nil, err
+	}
+	return appManifestHelper(output)
+}
+
+// withManifestFile writes manifest to a temporary YAML file for a cli command that reads one, calls
+// fn with its path, and removes it again
+func withManifestFile(manifest map[string]any, fn func(path string) error) error {
+	f, err := os.CreateTemp("", "argo-diff-*.yaml")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	buf, err := yaml.Marshal(manifest)
+	if err == nil {
+		_, err = f.Write(buf)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return fn(f.Name())
+}
+
+func (cliBackend) createApplication(ctx context.Context, manifest map[string]any) error {
+	// argocd app create -f app.yaml
+	return withManifestFile(manifest, func(path string) error {
+		if _, err := execArgoCdCli(ctx, []string{"app", "create", "-f", path}); err != nil {
+			log.Error().Err(err).Msg("Create Argo application failed")
+			return err
+		}
+		return nil
+	})
+}
+
+func (cliBackend) deleteApplication(ctx context.Context, appName string) error {
+	// argocd app delete argo-diff-preview-0a1b2c3d --cascade=false --yes
+	if _, err := execArgoCdCli(ctx, []string{"app", "delete", appName, "--cascade=false", "--yes"}); err != nil {
+		log.Error().Err(err).Msgf("Delete Argo application %s failed", appName)
+		return err
+	}
+	return nil
+}
+
+func (cliBackend) listApplicationSets(ctx context.Context) ([]ApplicationSet, error) {
+	// argocd appset list -o json
+	output, err := execArgoCdCli(ctx, []string{"appset", "list", "-o", "json"})
+	if err != nil {
+		log.Error().Err(err).Msg("ApplicationSet List failed")
+		return nil, err
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal(output, &items); err != nil {
+		log.Error().Err(err).Msg("Decoding ApplicationSet List failed")
+		return nil, err
+	}
+	return parseApplicationSets(items)
+}
+
+func (cliBackend) generateApplicationSet(ctx context.Context, manifest map[string]any) ([]K8sManifest, error) {
+	// argocd appset generate appset.yaml -o json
+	var output []byte
+	err := withManifestFile(manifest, func(path string) error {
+		var err error
+		output, err = execArgoCdCli(ctx, []string{"appset", "generate", path, "-o", "json"})
+		return err
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Generate ApplicationSet failed")
+		return nil, err
+	}
+	// a list of Applications, or just the one when only one is generated
+	var items []json.RawMessage
+	if trimmed := bytes.TrimSpace(output); len(trimmed) > 0 && trimmed[0] == '{' {
+		items = []json.RawMessage{trimmed}
+	} else if err := json.Unmarshal(output, &items); err != nil {
+		log.Error().Err(err).Msg("Decoding generated Applications failed")
+		return nil, err
+	}
+	return jsonManifests(items)
+}
+
+func (cliBackend) diffApplication(ctx context.Context, appName string, revision string, revisions []string, srcPos []int) ([]AppResource, error) {
 	var appResList []AppResource
 	log.Trace().Msg("diffApplication() called")
 	// argocd app diff argo-diff --revision XXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXX [--refresh]
 	// argocd app diff argo-diff --revisions XXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXX --source-positions 1 --revisions a.b.c --source-positions 2
-	args := []string{"app", "diff", appName, "--revision", revision}
-	if len(revisions) > 0 {
-		args = []string{"app", "diff", appName}
-		for _, rev := range revisions {
-			args = append(args, "--revisions")
-			args = append(args, rev)
-		}
-		for _, pos := range srcPos {
-			args = append(args, "--source-positions")
-			args = append(args, strconv.Itoa(pos))
-		}
-	}
+	args := append([]string{"app", "diff", appName}, revisionArgs(revision, revisions, srcPos)...)
 	if appDiffServerSideDiff != "" {
 		args = append(args, fmt.Sprintf("--server-side-diff=%s", appDiffServerSideDiff))
 	}
@@ -239,8 +364,14 @@ func diffApplication(ctx context.Context, appName string, revision string, revis
 					hdrStr, diffStr := extractFirstLine(diffStr)
 					appRes.DiffStr = diffStr
 					appRes.Group, appRes.Kind, appRes.Namespace, appRes.Name = extractKubernetesFields(hdrStr)
+					if DiffFormatFor(ctx) == DiffFormatStructured {
+						structuredFromFullDiff(&appRes)
+					}
 					appResList = append(appResList, appRes)
 				}
+				if resourceObjects {
+					fillResourceObjects(ctx, appName, revision, revisions, srcPos, appResList)
+				}
 				return appResList, nil
 			} else {
 				execError := fmt.Errorf("%s: %s: %s", strings.Join(args, " "), err.Error(), exitErr.Stderr)
@@ -257,6 +388,122 @@ func diffApplication(ctx context.Context, appName string, revision string, revis
 	return appResList, nil
 }
 
+// fillResourceObjects sets the Live and Target objects of an application's changed resources from
+// its live manifests and its manifests at the diffed revision(s), normalized like the api
+// backend's (see resourceObject). A resource keeps neither when an object its diff says exists
+// can't be found, so it's still classified by its diff; a failed call leaves them all unset.
+func fillResourceObjects(ctx context.Context, appName string, revision string, revisions []string, srcPos []int, appResList []AppResource) {
+	target, err := cliBackend{}.getApplicationManifests(ctx, appName, revision, revisions, srcPos)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Unable to fetch the target objects of %s for policy rules", appName)
+		return
+	}
+	output, err := execArgoCdCli(ctx, []string{"app", "manifests", appName, "--source", "live"})
+	var live []K8sManifest
+	if err == nil {
+		live, err = appManifestHelper(output)
+	}
+	if err != nil {
+		log.Warn().Err(err).Msgf("Unable to fetch the live objects of %s for policy rules", appName)
+		return
+	}
+	targetObjs, liveObjs := manifestObjects(target), manifestObjects(live)
+	lookup := func(objs map[string]map[string]any, r AppResource) map[string]any {
+		if obj, ok := objs[resourceKey(r.Group, r.Kind, r.Namespace, r.Name)]; ok {
+			return obj
+		}
+		if obj, ok := objs[resourceKey(r.Group, r.Kind, "", r.Name)]; ok {
+			return obj
+		}
+		// the diff names the namespace a resource lands in, which a rendered manifest that leaves
+		// it to the destination doesn't; fall back to the only object with that group/kind/name
+		var found map[string]any
+		for key, obj := range objs {
+			if k := strings.Split(key, "/"); k[0] == r.Group && k[1] == r.Kind && k[3] == r.Name {
+				if found != nil {
+					return nil
+				}
+				found = obj
+			}
+		}
+		return found
+	}
+	for i := range appResList {
+		r := &appResList[i]
+		liveObj, targetObj := lookup(liveObjs, *r), lookup(targetObjs, *r)
+		switch r.Action() {
+		case ActionAdded:
+			liveObj = nil
+		case ActionDeleted:
+			targetObj = nil
+		}
+		if (r.Action() != ActionAdded && liveObj == nil) || (r.Action() != ActionDeleted && targetObj == nil) {
+			log.Debug().Msgf("No live or target object for %s/%s %s/%s of %s", r.Group, r.Kind, r.Namespace, r.Name, appName)
+			continue
+		}
+		r.Live, r.Target = resourceObject(liveObj), resourceObject(targetObj)
+	}
+}
+
+// manifestObjects indexes manifests' objects by resourceKey
+func manifestObjects(manifests []K8sManifest) map[string]map[string]any {
+	objs := make(map[string]map[string]any)
+	for _, m := range manifests {
+		gvk := m.Unstruct.GroupVersionKind()
+		objs[resourceKey(gvk.Group, gvk.Kind, m.Unstruct.GetNamespace(), m.Unstruct.GetName())] = m.Unstruct.Object
+	}
+	return objs
+}
+
+// externalDiffCmd is the diff command `argocd app diff` runs. Structured diffs need whole objects,
+// which the cli only gives us as the full context of a diff.
+func externalDiffCmd(ctx context.Context) string {
+	if DiffFormatFor(ctx) == DiffFormatStructured {
+		return "diff -U1000000"
+	}
+	return "diff -u"
+}
+
+// structuredFromFullDiff rebuilds a resource's live and target YAML from a full-context diff,
+// fills in its structured changes, and swaps the diff for one with the usual 3 lines of context.
+// If either side doesn't parse, the diff is left as it is and there are no structured changes.
+func structuredFromFullDiff(appRes *AppResource) {
+	var from, to strings.Builder
+	inHunk := false
+	for _, line := range strings.SplitAfter(appRes.DiffStr, "\n") {
+		if strings.HasPrefix(line, "@@") {
+			inHunk = true
+			continue
+		}
+		if !inHunk || line == "" {
+			continue
+		}
+		switch line[0] {
+		case ' ':
+			from.WriteString(line[1:])
+			to.WriteString(line[1:])
+		case '-':
+			from.WriteString(line[1:])
+		case '+':
+			to.WriteString(line[1:])
+		}
+	}
+	if !inHunk {
+		return
+	}
+	var fromObj, toObj map[string]any
+	if err := yaml.Unmarshal([]byte(from.String()), &fromObj); err != nil {
+		log.Warn().Err(err).Msgf("Can't parse the live state of %s/%s %s/%s for a structured diff", appRes.Group, appRes.Kind, appRes.Namespace, appRes.Name)
+		return
+	}
+	if err := yaml.Unmarshal([]byte(to.String()), &toObj); err != nil {
+		log.Warn().Err(err).Msgf("Can't parse the target state of %s/%s %s/%s for a structured diff", appRes.Group, appRes.Kind, appRes.Namespace, appRes.Name)
+		return
+	}
+	appRes.Changes = gendiff.StructuredDiff(fromObj, toObj)
+	appRes.DiffStr = gendiff.UnifiedDiff(appRes.Name+"-live.yaml", appRes.Name, from.String(), to.String())
+}
+
 func diffBytesToStr(input []byte) []string {
 	// each resource diff has a header that looks like this:
 	// ===== rbac.authorization.k8s.io/ClusterRoleBinding /loki-clusterrolebinding ======
@@ -10,6 +10,8 @@ import (
 	"strings"
 	"sync"
 	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 )
 
 // makeExitError runs a trivial failing command to obtain a real *exec.ExitError
@@ -80,6 +82,20 @@ func TestParseArgoCDVersion(t *testing.T) {
 	}
 }
 
+func TestCliSubcommand(t *testing.T) {
+	cases := map[string][]string{
+		"app diff": {"app", "diff", "my-app", "--revision", "abc"},
+		"app list": {"app", "list", "-o", "json"},
+		"version":  {"version"},
+		"":         {},
+	}
+	for want, args := range cases {
+		if got := cliSubcommand(args); got != want {
+			t.Errorf("cliSubcommand(%v) = %q, want %q", args, got, want)
+		}
+	}
+}
+
 func TestExtractFirstLin(t *testing.T) {
 	firstLine, remaining := extractFirstLine(lokiClusterRoleDiff)
 	expectedFirstLine := "===== rbac.authorization.k8s.io/ClusterRoleBinding /loki-clusterrolebinding ======"
@@ -214,6 +230,115 @@ func TestDiffApplicationExitCodeHandling(t *testing.T) {
 	})
 }
 
+// what `argocd app diff` prints with KUBECTL_EXTERNAL_DIFF="diff -U1000000": each resource in full
+const fullContextDiff = `
+===== /Secret default/db-creds ======
+--- /tmp/argocd-diff1/db-creds-live.yaml	2026-03-02 14:01:12
++++ /tmp/argocd-diff1/db-creds	2026-03-02 14:01:12
+@@ -1,7 +1,7 @@
+ apiVersion: v1
+ data:
+-  password: c3VwZXJzZWNyZXQ=
++  password: bmV3c2VjcmV0
+ kind: Secret
+ metadata:
+   name: db-creds
+   namespace: default
+
+===== apps/Deployment default/api ======
+--- /tmp/argocd-diff1/api-live.yaml	2026-03-02 14:01:12
++++ /tmp/argocd-diff1/api	2026-03-02 14:01:12
+@@ -1,12 +1,12 @@
+ apiVersion: apps/v1
+ kind: Deployment
+ metadata:
+   name: api
+   namespace: default
+ spec:
+   template:
+     spec:
+       containers:
+-      - image: api:v1
++      - image: api:v2
+         name: api
+ status: {}
+`
+
+// With FetchResourceObjects, the cli backend fills in Live and Target from the live manifests and
+// the manifests at the diffed revision, normalized as the api backend does
+func TestDiffApplicationResourceObjects(t *testing.T) {
+	originalExecArgoCdCli := execArgoCdCli
+	t.Cleanup(func() { execArgoCdCli = originalExecArgoCdCli; resourceObjects = false })
+	FetchResourceObjects()
+	deployment := func(replicas int) string {
+		return fmt.Sprintf("apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: web\n  namespace: default\nspec:\n  replicas: %d\n", replicas)
+	}
+	execArgoCdCli = func(ctx context.Context, args []string) ([]byte, error) {
+		switch strings.Join(args[:2], " ") {
+		case "app diff":
+			return []byte("===== apps/Deployment default/web ======\n--- a\n+++ b\n@@ -7 +7 @@\n-  replicas: 3\n+  replicas: 1\n\n===== /ConfigMap default/settings ======\n--- a\n+++ b\n@@ -0,0 +1,3 @@\n+apiVersion: v1\n+kind: ConfigMap\n+metadata: {name: settings}\n"), makeExitError(t, nil)
+		case "app manifests":
+			if slices.Contains(args, "live") {
+				return []byte(deployment(3) + "status:\n  readyReplicas: 3\n"), nil
+			}
+			if !slices.Contains(args, "abcdef") {
+				t.Errorf("Expected the target manifests at the diffed revision, got %v", args)
+			}
+			// both leave their namespace to the destination's
+			return []byte(strings.Replace(deployment(1), "  namespace: default\n", "", 1) + "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: settings\n"), nil
+		}
+		return nil, fmt.Errorf("unexpected argocd args: %v", args)
+	}
+	appResList, err := diffApplication(context.Background(), "web", "abcdef", nil, nil)
+	if err != nil || len(appResList) != 2 {
+		t.Fatalf("diffApplication() = %+v, %v", appResList, err)
+	}
+	web, settings := appResList[0], appResList[1]
+	if replicas, _, _ := unstructured.NestedFieldNoCopy(web.Live, "spec", "replicas"); fmt.Sprint(replicas) != "3" || web.Live["status"] != nil {
+		t.Errorf("Unexpected live object %v", web.Live)
+	}
+	if replicas, _, _ := unstructured.NestedFieldNoCopy(web.Target, "spec", "replicas"); fmt.Sprint(replicas) != "1" {
+		t.Errorf("Unexpected target object %v", web.Target)
+	}
+	if settings.Live != nil || settings.Target == nil || settings.Action() != ActionAdded {
+		t.Errorf("Expected the ConfigMap to be added, with only a target object: %+v", settings)
+	}
+}
+
+func TestDiffApplicationStructured(t *testing.T) {
+	originalExecArgoCdCli := execArgoCdCli
+	defer func() { execArgoCdCli = originalExecArgoCdCli }()
+	defer func() { diffFormat = DiffFormatUnified }()
+	diffFormat = DiffFormatStructured
+	if cmd := externalDiffCmd(context.Background()); cmd != "diff -U1000000" {
+		t.Errorf("Expected a full-context diff command, got %s", cmd)
+	}
+	execArgoCdCli = func(ctx context.Context, args []string) ([]byte, error) {
+		return []byte(fullContextDiff), makeExitError(t, nil)
+	}
+	appResList, err := diffApplication(context.Background(), "argo-diff", "HEAD", nil, nil)
+	if err != nil {
+		t.Fatalf("diffApplication() failed: %v", err)
+	}
+	if len(appResList) != 2 {
+		t.Fatalf("Expected 2 changed resources, got %+v", appResList)
+	}
+	secret, deploy := appResList[0], appResList[1]
+	if got := deploy.DisplayDiff(DiffFormatStructured); got != "! spec.template.spec.containers[name=api].image: api:v1 -> api:v2\n" {
+		t.Errorf("Unexpected structured diff: %s", got)
+	}
+	// the unified diff is re-rendered with the usual context
+	if strings.Contains(deploy.DiffStr, "apiVersion") || !strings.Contains(deploy.DiffStr, "+      - image: api:v2") {
+		t.Errorf("Unexpected unified diff: %s", deploy.DiffStr)
+	}
+	if got := secret.DisplayDiff(DiffFormatStructured); got != "! data.password: <redacted> -> <redacted>\n" {
+		t.Errorf("Expected the Secret's structured diff to be redacted, got: %s", got)
+	}
+	if strings.Contains(secret.DiffStr, "c3VwZXJzZWNyZXQ=") {
+		t.Errorf("Expected the Secret's unified diff to be redacted, got: %s", secret.DiffStr)
+	}
+}
+
 // TestExecArgoCdCliConcurrentArgvIsolation exercises the real argv construction in
 // execArgoCdCli (unlike every other test in this package, which replaces execArgoCdCli
 // wholesale and so can never see this bug). It reproduces commonCliArgv with spare
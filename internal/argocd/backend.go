@@ -0,0 +1,158 @@
+package argocd
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/vince-riv/argo-diff/internal/redact"
+	"github.com/vince-riv/argo-diff/internal/repoconfig"
+)
+
+// backend is how this package talks to ArgoCD. cliBackend (the default) runs the argocd cli;
+// apiBackend calls the ArgoCD server's REST API directly, so no cli binary is needed.
+type backend interface {
+	// listApplications returns every Application the token can see
+	listApplications(ctx context.Context) (*ApplicationList, error)
+	// version returns the client and server versions; the client version is empty when there's
+	// no client to speak of (apiBackend)
+	version(ctx context.Context) (string, string, error)
+	// getApplicationManifests renders an application's manifests at revision (or, for multi-source
+	// applications, at revisions for the 1-based source positions srcPos)
+	getApplicationManifests(ctx context.Context, appName string, revision string, revisions []string, srcPos []int) ([]K8sManifest, error)
+	// liveManifests returns the live objects of an application's resources
+	liveManifests(ctx context.Context, appName string) ([]K8sManifest, error)
+	// diffApplication diffs an application at revision (or, for multi-source applications, at
+	// revisions for the 1-based source positions srcPos) against its live state
+	diffApplication(ctx context.Context, appName string, revision string, revisions []string, srcPos []int) ([]AppResource, error)
+	// createApplication creates an Application from its manifest (see previewNewApplication)
+	createApplication(ctx context.Context, manifest map[string]any) error
+	// deleteApplication deletes an Application without deleting its resources
+	deleteApplication(ctx context.Context, appName string) error
+	// listApplicationSets returns every ApplicationSet the token can see
+	listApplicationSets(ctx context.Context) ([]ApplicationSet, error)
+	// generateApplicationSet returns the Applications an ApplicationSet manifest generates
+	generateApplicationSet(ctx context.Context, manifest map[string]any) ([]K8sManifest, error)
+}
+
+const backendCli = "cli"
+const backendApi = "api"
+
+// How resource diffs are rendered: a unified diff of the YAML, or a list of field-level changes
+const DiffFormatUnified = "unified"
+const DiffFormatStructured = "structured"
+
+var diffFormat = DiffFormatUnified
+
+// What the manifests at a pull request's head are compared to: the live state (what argocd app
+// diff shows), the manifests rendered at the merge-base (a desired-state diff, which leaves out
+// drift and changes on the base branch that haven't been synced), or both
+const DiffModeLive = "live"
+const DiffModeDesired = "desired"
+const DiffModeBoth = "both"
+
+var diffMode = DiffModeLive
+
+// Set as variable so tests can swap in an httptest-backed apiBackend
+var argoBackend backend = cliBackend{}
+
+func init() {
+	switch name := strings.ToLower(strings.TrimSpace(os.Getenv("ARGO_DIFF_ARGOCD_BACKEND"))); name {
+	case "", backendCli:
+		log.Debug().Msg("Using the argocd cli to talk to ArgoCD")
+	case backendApi:
+		log.Info().Msg("ARGO_DIFF_ARGOCD_BACKEND is 'api' - calling the ArgoCD API directly instead of the argocd cli")
+		argoBackend = newApiBackendFromEnv()
+	default:
+		log.Warn().Msgf("Invalid value for ARGO_DIFF_ARGOCD_BACKEND: %s; must be '%s' or '%s'; using %s", name, backendCli, backendApi, backendCli)
+	}
+	switch format := strings.ToLower(strings.TrimSpace(os.Getenv("ARGO_DIFF_DIFF_FORMAT"))); format {
+	case "", DiffFormatUnified:
+	case DiffFormatStructured:
+		log.Info().Msg("ARGO_DIFF_DIFF_FORMAT is 'structured' - rendering field-level changes instead of unified diffs")
+		diffFormat = DiffFormatStructured
+	default:
+		log.Warn().Msgf("Invalid value for ARGO_DIFF_DIFF_FORMAT: %s; must be '%s' or '%s'; using %s", format, DiffFormatUnified, DiffFormatStructured, DiffFormatUnified)
+	}
+	switch mode := strings.ToLower(strings.TrimSpace(os.Getenv("ARGO_DIFF_DIFF_MODE"))); mode {
+	case "", DiffModeLive:
+	case DiffModeDesired, DiffModeBoth:
+		log.Info().Msgf("ARGO_DIFF_DIFF_MODE is '%s' - diffing against the manifests rendered at the merge-base", mode)
+		diffMode = mode
+	default:
+		log.Warn().Msgf("Invalid value for ARGO_DIFF_DIFF_MODE: %s; must be '%s', '%s' or '%s'; using %s", mode, DiffModeLive, DiffModeDesired, DiffModeBoth, DiffModeLive)
+	}
+}
+
+// DiffFormat returns the configured diff format (DiffFormatUnified or DiffFormatStructured)
+func DiffFormat() string {
+	return diffFormat
+}
+
+// DiffFormatFor returns the diff format for a run: the repository config's (see
+// internal/repoconfig), else the configured one
+func DiffFormatFor(ctx context.Context) string {
+	return repoconfig.FromContext(ctx).DiffFormatOr(diffFormat)
+}
+
+// DiffMode returns the configured diff mode (DiffModeLive, DiffModeDesired or DiffModeBoth)
+func DiffMode() string {
+	return diffMode
+}
+
+// DiffModeFor returns the diff mode for a run: the repository config's (see internal/repoconfig),
+// else the configured one
+func DiffModeFor(ctx context.Context) string {
+	return repoconfig.FromContext(ctx).DiffModeOr(diffMode)
+}
+
+func listApplications(ctx context.Context) (*ApplicationList, error) {
+	return argoBackend.listApplications(ctx)
+}
+
+func argocdVersion(ctx context.Context) (string, string, error) {
+	return argoBackend.version(ctx)
+}
+
+func getApplicationManifests(ctx context.Context, appName string, revision string, revisions []string, srcPos []int) ([]K8sManifest, error) {
+	return argoBackend.getApplicationManifests(ctx, appName, revision, revisions, srcPos)
+}
+
+func createApplication(ctx context.Context, manifest map[string]any) error {
+	return argoBackend.createApplication(ctx, manifest)
+}
+
+func deleteApplication(ctx context.Context, appName string) error {
+	return argoBackend.deleteApplication(ctx, appName)
+}
+
+func listApplicationSets(ctx context.Context) ([]ApplicationSet, error) {
+	return argoBackend.listApplicationSets(ctx)
+}
+
+func generateApplicationSet(ctx context.Context, manifest map[string]any) ([]K8sManifest, error) {
+	return argoBackend.generateApplicationSet(ctx, manifest)
+}
+
+func liveManifests(ctx context.Context, appName string) ([]K8sManifest, error) {
+	return argoBackend.liveManifests(ctx, appName)
+}
+
+// diffApplication diffs via the configured backend, then masks sensitive values (see
+// internal/redact) so that nothing downstream ever holds them in a diff
+func diffApplication(ctx context.Context, appName string, revision string, revisions []string, srcPos []int) ([]AppResource, error) {
+	appResList, err := argoBackend.diffApplication(ctx, appName, revision, revisions, srcPos)
+	return redactResources(appResList), err
+}
+
+// redactResources masks the sensitive values in each resource's diff and changes
+func redactResources(appResList []AppResource) []AppResource {
+	for i := range appResList {
+		ar := &appResList[i]
+		ar.DiffStr = redact.Diff(ar.Group, ar.Kind, ar.DiffStr)
+		ar.Changes = redact.Changes(ar.Group, ar.Kind, ar.Changes)
+	}
+	return appResList
+}
@@ -7,6 +7,8 @@ import (
 	"sync"
 
 	"github.com/rs/zerolog/log"
+
+	"github.com/vince-riv/argo-diff/internal/metrics"
 )
 
 // How many `argocd app diff`/`app manifests` calls GetApplicationChanges() is
@@ -48,6 +50,7 @@ func runWithLimit(n, limit int, work func(i int)) {
 	if limit < 1 {
 		limit = 1
 	}
+	metrics.WorkerPoolStarted(limit)
 	sem := make(chan struct{}, limit)
 	var wg sync.WaitGroup
 	for i := 0; i < n; i++ {
@@ -56,6 +59,7 @@ func runWithLimit(n, limit int, work func(i int)) {
 		go func(i int) {
 			defer wg.Done()
 			defer func() { <-sem }()
+			defer metrics.WorkerBusy()()
 			work(i)
 		}(i)
 	}
@@ -0,0 +1,122 @@
+package argocd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	"sigs.k8s.io/yaml"
+
+	"github.com/vince-riv/argo-diff/internal/gendiff"
+)
+
+// appRevisions is what an application is rendered at: revision, or for a multi-source application,
+// revisions for the 1-based source positions srcPos
+type appRevisions struct {
+	revision  string
+	revisions []string
+	srcPos    []int
+}
+
+func (r appRevisions) isZero() bool {
+	return r.revision == "" && len(r.revisions) == 0
+}
+
+func (r appRevisions) String() string {
+	if len(r.revisions) == 0 {
+		return r.revision
+	}
+	return fmt.Sprintf("%v (sources %v)", r.revisions, r.srcPos)
+}
+
+// desiredStateDiff renders an application's manifests at base and head and diffs them, so the
+// result is what the change itself does to the application's desired state, with none of the drift
+// or unsynced changes a diff against the live state picks up
+func desiredStateDiff(ctx context.Context, appName string, base, head appRevisions) ([]AppResource, error) {
+	baseManifests, err := getApplicationManifests(ctx, appName, base.revision, base.revisions, base.srcPos)
+	if err != nil {
+		return nil, fmt.Errorf("rendering manifests at the merge-base %s: %w", base, err)
+	}
+	headManifests, err := getApplicationManifests(ctx, appName, head.revision, head.revisions, head.srcPos)
+	if err != nil {
+		return nil, fmt.Errorf("rendering manifests at %s: %w", head, err)
+	}
+	appResList, err := manifestsDiff(baseManifests, headManifests)
+	if err != nil {
+		return nil, err
+	}
+	log.Debug().Msgf("Desired-state diff of %s from %s to %s: %d resource(s) changed", appName, base, head, len(appResList))
+	return redactResources(appResList), nil
+}
+
+// manifestsDiff diffs two renderings of an application's manifests, matching resources on
+// group/kind/namespace/name: resources only in head are added, and those only in base deleted.
+// Like the live diff, ArgoCD's tracking label and annotation are left out. Live and Target hold
+// the base and head objects.
+func manifestsDiff(base, head []K8sManifest) ([]AppResource, error) {
+	var appResList []AppResource
+	baseObjs := make(map[string]map[string]any)
+	for _, m := range base {
+		gvk := m.Unstruct.GroupVersionKind()
+		baseObjs[resourceKey(gvk.Group, gvk.Kind, m.Unstruct.GetNamespace(), m.Unstruct.GetName())] = m.Unstruct.Object
+	}
+	seen := make(map[string]bool)
+	for _, m := range head {
+		u := m.Unstruct
+		gvk := u.GroupVersionKind()
+		key := resourceKey(gvk.Group, gvk.Kind, u.GetNamespace(), u.GetName())
+		seen[key] = true
+		appRes, changed, err := manifestDiff(gvk.Group, gvk.Kind, u.GetNamespace(), u.GetName(), baseObjs[key], u.Object)
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			appRes.ApiVersion = u.GetAPIVersion()
+			appResList = append(appResList, appRes)
+		}
+	}
+	for _, m := range base {
+		u := m.Unstruct
+		gvk := u.GroupVersionKind()
+		key := resourceKey(gvk.Group, gvk.Kind, u.GetNamespace(), u.GetName())
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		appRes, changed, err := manifestDiff(gvk.Group, gvk.Kind, u.GetNamespace(), u.GetName(), u.Object, nil)
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			appRes.ApiVersion = u.GetAPIVersion()
+			appResList = append(appResList, appRes)
+		}
+	}
+	return appResList, nil
+}
+
+// manifestDiff renders a unified diff of one resource's base and head manifests (either may be
+// nil). It returns false when there's no difference.
+func manifestDiff(group, kind, namespace, name string, baseObj, headObj map[string]any) (AppResource, bool, error) {
+	appRes := AppResource{Group: group, Kind: kind, Namespace: namespace, Name: name}
+	var baseYaml, headYaml []byte
+	var err error
+	if baseObj != nil {
+		appRes.Live = compact(stripTracking(baseObj)).(map[string]any)
+		if baseYaml, err = yaml.Marshal(appRes.Live); err != nil {
+			return appRes, false, err
+		}
+	}
+	if headObj != nil {
+		appRes.Target = compact(stripTracking(headObj)).(map[string]any)
+		if headYaml, err = yaml.Marshal(appRes.Target); err != nil {
+			return appRes, false, err
+		}
+	}
+	if string(baseYaml) == string(headYaml) {
+		return appRes, false, nil
+	}
+	appRes.DiffStr = gendiff.UnifiedDiff(name+"-base.yaml", name, string(baseYaml), string(headYaml))
+	appRes.Changes = gendiff.StructuredDiff(appRes.Live, appRes.Target)
+	return appRes, true, nil
+}
@@ -0,0 +1,92 @@
+package argocd
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/vince-riv/argo-diff/internal/repoconfig"
+)
+
+func TestDesiredStateDiff(t *testing.T) {
+	setupApiBackend(t)
+	app := &Application{}
+	app.ObjectMeta.Name = "argo-diff"
+	head, base := appRevisions{revision: "change-1"}, appRevisions{revision: "current"}
+
+	// the live Deployment's image drift isn't the change's doing, so only the replicas bump shows
+	ctx := repoconfig.NewContext(context.Background(), &repoconfig.Config{DiffMode: DiffModeDesired})
+	res, err := getApplicationChanges(ctx, app, head, base)
+	if err != nil {
+		t.Fatalf("getApplicationChanges() failed: %v", err)
+	}
+	if len(res.ChangedResources) != 1 || res.LiveResources != nil {
+		t.Fatalf("Expected only the desired-state diff of the Deployment, got %+v", res)
+	}
+	ar := res.ChangedResources[0]
+	if ar.Kind != "Deployment" || ar.Action() != ActionModified || !strings.Contains(ar.DiffStr, "+  replicas: 2") || strings.Contains(ar.DiffStr, "image:") {
+		t.Errorf("Unexpected desired-state diff %+v", ar)
+	}
+
+	ctx = repoconfig.NewContext(context.Background(), &repoconfig.Config{DiffMode: DiffModeBoth})
+	if res, err = getApplicationChanges(ctx, app, head, base); err != nil {
+		t.Fatalf("getApplicationChanges() failed: %v", err)
+	}
+	if len(res.ChangedResources) != 1 || len(res.LiveResources) != 1 || !strings.Contains(res.LiveResources[0].DiffStr, "image:") {
+		t.Errorf("Expected the live diff alongside the desired-state diff, got %+v", res)
+	}
+
+	// without a merge-base, there's only the live diff
+	if res, err = getApplicationChanges(ctx, app, head, appRevisions{}); err != nil || len(res.ChangedResources) != 1 || res.LiveResources != nil {
+		t.Errorf("Expected a live diff without a base, got %+v, %v", res, err)
+	}
+
+	if _, err = getApplicationChanges(ctx, app, head, appRevisions{revision: "bad"}); err == nil || !strings.Contains(err.Error(), "merge-base") {
+		t.Errorf("Expected an error rendering the merge-base, got %v", err)
+	}
+}
+
+func TestManifestsDiff(t *testing.T) {
+	manifest := func(kind, name string, data map[string]any) K8sManifest {
+		obj := map[string]any{
+			"apiVersion": "v1",
+			"kind":       kind,
+			"metadata": map[string]any{
+				"name":   name,
+				"labels": map[string]any{trackingLabel: "app"},
+			},
+		}
+		if data != nil {
+			obj["data"] = data
+		}
+		return K8sManifest{Unstruct: unstructured.Unstructured{Object: obj}}
+	}
+	base := []K8sManifest{
+		manifest("ConfigMap", "same", map[string]any{"a": "1"}),
+		manifest("ConfigMap", "changed", map[string]any{"a": "1"}),
+		manifest("ConfigMap", "removed", map[string]any{"a": "1"}),
+	}
+	head := []K8sManifest{
+		manifest("ConfigMap", "same", map[string]any{"a": "1"}),
+		manifest("ConfigMap", "changed", map[string]any{"a": "2"}),
+		manifest("Service", "added", nil),
+	}
+	res, err := manifestsDiff(base, head)
+	if err != nil {
+		t.Fatalf("manifestsDiff() failed: %v", err)
+	}
+	want := map[string]string{"changed": ActionModified, "added": ActionAdded, "removed": ActionDeleted}
+	if len(res) != len(want) {
+		t.Fatalf("Expected %d changed resources, got %+v", len(want), res)
+	}
+	for _, ar := range res {
+		if ar.Action() != want[ar.Name] {
+			t.Errorf("%s: Action() = %s, want %s", ar.Name, ar.Action(), want[ar.Name])
+		}
+		if strings.Contains(ar.DiffStr, trackingLabel) {
+			t.Errorf("%s: the tracking label should be left out of the diff:\n%s", ar.Name, ar.DiffStr)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package argocd
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Where a resource's live diff comes from, when its application was already OutOfSync
+const OriginChange = "change" // the change alters the resource; it had no drift
+const OriginDrift = "drift"   // the resource had already drifted, and the change doesn't alter it
+const OriginBoth = "both"     // the resource had already drifted, and the change alters it too
+
+const syncOutOfSync = "OutOfSync"
+
+// currentRevisions is what the change is measured against: the merge-base for the sources it
+// touches (when base has one; see appRevisions), otherwise what ArgoCD renders the application at
+// today, its sources' target revisions. Commits that landed on the base branch after the change
+// branched off are then not counted as drift.
+func currentRevisions(app *Application, base appRevisions) appRevisions {
+	if len(app.Spec.Sources) == 0 {
+		revision := app.Spec.GetSource().TargetRevision
+		if base.revision != "" {
+			revision = base.revision
+		} else if revision == "" {
+			revision = "HEAD"
+		}
+		return appRevisions{revision: revision}
+	}
+	var r appRevisions
+	for i, src := range app.Spec.Sources {
+		revision := src.TargetRevision
+		if j := slices.Index(base.srcPos, i+1); j >= 0 && j < len(base.revisions) {
+			revision = base.revisions[j]
+		} else if revision == "" {
+			revision = "HEAD"
+		}
+		r.revisions = append(r.revisions, revision)
+		r.srcPos = append(r.srcPos, i+1)
+	}
+	return r
+}
+
+// diffWithDrift diffs app at head against its live state and labels each resource's Origin (see
+// labelDrift). Drift is found by comparing the diffs before sensitive values are masked (see
+// internal/redact): masked, a Secret that had drifted and that the change alters too would look
+// like drift alone, and slip past the policy rules that judge the change.
+func diffWithDrift(ctx context.Context, app *Application, head, base appRevisions) ([]AppResource, error) {
+	resources, err := argoBackend.diffApplication(ctx, app.ObjectMeta.Name, head.revision, head.revisions, head.srcPos)
+	if err == nil {
+		err = labelDrift(ctx, app, resources, base)
+	}
+	return redactResources(resources), err
+}
+
+// labelDrift sets the Origin of each resource in an OutOfSync application's live diff: the
+// application is diffed at its current revisions (see currentRevisions) too, and whatever differs
+// there already is drift. The resources' diffs must not be redacted yet.
+// A Synced application has no drift, so its resources are left unlabelled. It returns an error only
+// when ctx ran out (the application then counts as not diffed); otherwise a failed drift diff
+// leaves the resources unlabelled.
+func labelDrift(ctx context.Context, app *Application, resources []AppResource, base appRevisions) error {
+	if len(resources) == 0 || app.Status.Sync.Status != syncOutOfSync {
+		return nil
+	}
+	cur := currentRevisions(app, base)
+	drifted, err := argoBackend.diffApplication(ctx, app.ObjectMeta.Name, cur.revision, cur.revisions, cur.srcPos)
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		log.Warn().Err(err).Msgf("Unable to diff %s at %s to find its existing drift", app.ObjectMeta.Name, cur)
+		return nil
+	}
+	driftDiffs := make(map[string]string)
+	for _, r := range drifted {
+		driftDiffs[resourceKey(r.Group, r.Kind, r.Namespace, r.Name)] = diffBody(r.DiffStr)
+	}
+	for i := range resources {
+		r := &resources[i]
+		driftDiff, ok := driftDiffs[resourceKey(r.Group, r.Kind, r.Namespace, r.Name)]
+		switch {
+		case !ok:
+			r.Origin = OriginChange
+		case driftDiff == diffBody(r.DiffStr):
+			r.Origin = OriginDrift
+		default:
+			r.Origin = OriginBoth
+		}
+	}
+	log.Debug().Msgf("%s is OutOfSync; %d resource(s) had drifted at %s", app.ObjectMeta.Name, len(drifted), cur)
+	return nil
+}
+
+// diffBody is a unified diff without its ---/+++ file header, which the cli fills with temporary
+// paths and timestamps
+func diffBody(diffStr string) string {
+	if i := strings.Index(diffStr, "\n@@"); i >= 0 {
+		return diffStr[i+1:]
+	}
+	return diffStr
+}
@@ -0,0 +1,104 @@
+package argocd
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLabelDrift(t *testing.T) {
+	setupApiBackend(t)
+	ctx := context.Background()
+	app := &Application{Spec: ApplicationSpec{Source: &ApplicationSource{TargetRevision: "current"}}}
+	app.ObjectMeta.Name = "argo-diff"
+	app.Status.Sync.Status = syncOutOfSync
+
+	// the live Deployment already runs a PR image; change-1 scales it as well
+	res, err := getApplicationChanges(ctx, app, appRevisions{revision: "change-1"}, appRevisions{})
+	if err != nil {
+		t.Fatalf("getApplicationChanges() failed: %v", err)
+	}
+	if len(res.ChangedResources) != 1 || res.ChangedResources[0].Origin != OriginBoth {
+		t.Errorf("Expected the Deployment to be both drifted and changed, got %+v", res.ChangedResources)
+	}
+
+	// at the current revision, the image is all there is, and it's drift
+	if res, err = getApplicationChanges(ctx, app, appRevisions{revision: "current"}, appRevisions{}); err != nil {
+		t.Fatalf("getApplicationChanges() failed: %v", err)
+	}
+	if len(res.ChangedResources) != 1 || res.ChangedResources[0].Origin != OriginDrift {
+		t.Errorf("Expected the Deployment to be drift only, got %+v", res.ChangedResources)
+	}
+
+	// a Synced application isn't diffed twice, or labelled
+	app.Status.Sync.Status = "Synced"
+	if res, err = getApplicationChanges(ctx, app, appRevisions{revision: "change-1"}, appRevisions{}); err != nil {
+		t.Fatalf("getApplicationChanges() failed: %v", err)
+	}
+	if len(res.ChangedResources) != 1 || res.ChangedResources[0].Origin != "" {
+		t.Errorf("Expected no label on a Synced application, got %+v", res.ChangedResources)
+	}
+
+	// a drift diff that fails leaves the resources unlabelled rather than failing the application
+	app.Status.Sync.Status = syncOutOfSync
+	app.Spec.Source.TargetRevision = "bad"
+	if res, err = getApplicationChanges(ctx, app, appRevisions{revision: "change-1"}, appRevisions{}); err != nil {
+		t.Fatalf("getApplicationChanges() failed: %v", err)
+	}
+	if len(res.ChangedResources) != 1 || res.ChangedResources[0].Origin != "" {
+		t.Errorf("Expected no label when the drift diff fails, got %+v", res.ChangedResources)
+	}
+}
+
+func TestCurrentRevisions(t *testing.T) {
+	app := &Application{Spec: ApplicationSpec{Source: &ApplicationSource{}}}
+	if r := currentRevisions(app, appRevisions{}); r.revision != "HEAD" || r.revisions != nil {
+		t.Errorf("Expected HEAD for a source without a targetRevision, got %+v", r)
+	}
+	if r := currentRevisions(app, appRevisions{revision: "012345"}); r.revision != "012345" {
+		t.Errorf("Expected the merge-base, got %+v", r)
+	}
+	app.Spec = ApplicationSpec{Sources: []ApplicationSource{{TargetRevision: "main"}, {TargetRevision: "v1.2.3"}}}
+	if r := currentRevisions(app, appRevisions{}); len(r.revisions) != 2 || r.revisions[1] != "v1.2.3" || r.srcPos[1] != 2 {
+		t.Errorf("Unexpected revisions for a multi-source application: %+v", r)
+	}
+	// the merge-base replaces only the revisions of the sources the change touches
+	if r := currentRevisions(app, appRevisions{revisions: []string{"012345"}, srcPos: []int{1}}); len(r.revisions) != 2 || r.revisions[0] != "012345" || r.revisions[1] != "v1.2.3" {
+		t.Errorf("Unexpected revisions with a merge-base: %+v", r)
+	}
+}
+
+// A Secret that had drifted and that the change alters too has the same diff as its drift once
+// its values are masked; it must still be labelled as changed.
+func TestLabelDriftRedacted(t *testing.T) {
+	secretDiff := func(value string) []byte {
+		return []byte("===== /Secret default/creds ======\n--- a\n+++ b\n@@ -1,3 +1,3 @@\n apiVersion: v1\n data:\n-  password: c2VjcmV0\n+  password: " + value + "\n")
+	}
+	var revisions []string
+	originalExecArgoCdCli := execArgoCdCli
+	t.Cleanup(func() { execArgoCdCli = originalExecArgoCdCli })
+	execArgoCdCli = func(ctx context.Context, args []string) ([]byte, error) {
+		revisions = append(revisions, args[4])
+		if args[4] == "abcdef" {
+			return secretDiff("Y2hhbmdlZA=="), makeExitError(t, nil)
+		}
+		return secretDiff("ZHJpZnRlZA=="), makeExitError(t, nil)
+	}
+	app := &Application{Spec: ApplicationSpec{Source: &ApplicationSource{TargetRevision: "main"}}}
+	app.ObjectMeta.Name = "creds"
+	app.Status.Sync.Status = syncOutOfSync
+	res, err := getApplicationChanges(context.Background(), app, appRevisions{revision: "abcdef"}, appRevisions{revision: "012345"})
+	if err != nil {
+		t.Fatalf("getApplicationChanges() failed: %v", err)
+	}
+	if len(res.ChangedResources) != 1 || res.ChangedResources[0].Origin != OriginBoth {
+		t.Fatalf("Expected the Secret to be both drifted and changed, got %+v", res.ChangedResources)
+	}
+	if strings.Contains(res.ChangedResources[0].DiffStr, "Y2hhbmdlZA==") {
+		t.Errorf("Expected the Secret's diff to be redacted: %s", res.ChangedResources[0].DiffStr)
+	}
+	if want := []string{"abcdef", "012345"}; !slices.Equal(revisions, want) {
+		t.Errorf("Expected diffs at the head and the merge-base, got %v", revisions)
+	}
+}
@@ -1,50 +1,173 @@
 package argocd
 
 import (
+	"path"
 	"path/filepath"
 	"strings"
 
 	"github.com/rs/zerolog/log"
 )
 
+const manifestGeneratePathsAnnotation = "argocd.argoproj.io/manifest-generate-paths"
+
+// PathMatch is one changed file that satisfied an application's manifest-generate-paths: the
+// pattern it matched, as resolved against the source at position Source (1-based)
+type PathMatch struct {
+	Source  int    `json:"source"`
+	Pattern string `json:"pattern"`
+	File    string `json:"file"`
+}
+
 // containsGlob returns true if the pattern contains glob meta characters.
 func containsGlob(pattern string) bool {
 	return strings.ContainsAny(pattern, "*?[")
 }
 
-// matchChangedFiles checks if any of the changed files match one of the given patterns.
-func matchChangedFiles(changedFiles []string, patterns []string) bool {
+// matchPattern reports whether a changed file (relative to the repository root) satisfies a
+// manifest-generate-paths pattern, as ArgoCD does: the file itself, a file under the directory,
+// or a glob matching the whole file path, where a ** segment matches any number of directories.
+// The pattern "" is the repository root.
+func matchPattern(pattern, file string) bool {
+	if pattern == "" {
+		return true
+	}
+	if file == pattern || strings.HasPrefix(file, strings.TrimSuffix(pattern, "/")+"/") {
+		return true
+	}
+	if !containsGlob(pattern) {
+		return false
+	}
+	ok, err := globMatch(pattern, file)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Invalid manifest-generate-paths pattern %s", pattern)
+	}
+	return ok
+}
+
+// globMatch reports whether a slash-separated path matches a glob as a whole: segment by segment
+// with path.Match, except that a ** segment matches zero or more of them
+func globMatch(pattern, name string) (bool, error) {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) (bool, error) {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if ok, err := matchSegments(pattern[1:], name[i:]); ok || err != nil {
+					return ok, err
+				}
+			}
+			return false, nil
+		}
+		if len(name) == 0 {
+			return false, nil
+		}
+		if ok, err := path.Match(pattern[0], name[0]); !ok || err != nil {
+			return false, err
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0, nil
+}
+
+// cleanChangedFile turns a changed file into a path relative to the repository root; changed
+// files shouldn't have absolute paths, but we'll trim / to be safe
+func cleanChangedFile(file string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(file)), "/")
+}
+
+// firstMatchingFile returns the first of the changed files that matches one of the given patterns,
+// or "" if none do.
+func firstMatchingFile(changedFiles []string, patterns []string) string {
 	for _, file := range changedFiles {
-		// changed files shouldn't have absolute paths, but we'll trim / to be safe
-		if filepath.IsAbs(file) {
-			file = strings.TrimPrefix(file, "/")
+		for _, pattern := range patterns {
+			log.Trace().Msgf("firstMatchingFile(): matching file %s to pattern %s", file, pattern)
+			if matchPattern(pattern, cleanChangedFile(file)) {
+				return file
+			}
+		}
+	}
+	return ""
+}
+
+// refValueFiles returns the paths, relative to its repository's root, of the Helm value files an
+// application's sources read through the source with ref: from their `$<ref>/<path>` valueFiles
+func refValueFiles(app Application, ref string) []string {
+	var paths []string
+	prefix := "$" + ref + "/"
+	for _, src := range app.Spec.GetSources() {
+		if src.Helm == nil {
+			continue
+		}
+		for _, f := range src.Helm.ValueFiles {
+			if p, ok := strings.CutPrefix(f, prefix); ok {
+				paths = append(paths, strings.TrimPrefix(p, "/"))
+			}
+		}
+	}
+	return paths
+}
+
+// refSourceFile returns the first of the changed files that a ref-only source supplies to the
+// application's other sources, or "" if none. ok is false when nothing reads from the source
+// through a valueFiles reference argo-diff knows, so what it supplies is unknown.
+func refSourceFile(app Application, src ApplicationSource, changedFiles []string) (file string, ok bool) {
+	paths := refValueFiles(app, src.Ref)
+	if len(paths) == 0 {
+		return "", false
+	}
+	return firstMatchingFile(changedFiles, paths), true
+}
+
+// manifestPathPatterns turns a manifest-generate-paths annotation into patterns relative to the
+// repository root, resolving relative entries against the source's path. Like ArgoCD, it cleans
+// them: .. climbs out of the source's path, but never above the repository root.
+func manifestPathPatterns(manifestPaths string, source ApplicationSource) []string {
+	var patterns []string
+	// Split the annotation on semicolons and build full patterns.
+	parts := strings.Split(manifestPaths, ";")
+	for _, p := range parts {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		var fullPattern string
+		if strings.HasPrefix(p, "/") {
+			fullPattern = path.Clean(p)
+		} else {
+			// If p is not an absolute path, join it with the source's path.
+			fullPattern = path.Join("/", source.Path, p)
+		}
+		patterns = append(patterns, strings.TrimPrefix(fullPattern, "/"))
+	}
+	return patterns
+}
+
+// manifestPathMatches explains how app fares against its manifest-generate-paths annotation: every
+// pattern, resolved against each of its sources, that one of the changed files matched. filtered is
+// false when the annotation doesn't filter at all (it's absent, empty, or "/").
+func manifestPathMatches(app Application, changedFiles []string) (matches []PathMatch, filtered bool) {
+	manifestPaths, ok := app.GetAnnotations()[manifestGeneratePathsAnnotation]
+	if !ok || strings.TrimSpace(manifestPaths) == "" || strings.TrimSpace(manifestPaths) == "/" {
+		return nil, false
+	}
+	for i, source := range app.Spec.GetSources() {
+		patterns := manifestPathPatterns(manifestPaths, source)
+		if source.refOnly() {
+			// it has no path for relative entries to resolve against, but what it supplies is
+			// known: the value files other sources read through it
+			patterns = append(patterns, refValueFiles(app, source.Ref)...)
 		}
 		for _, pattern := range patterns {
-			log.Trace().Msgf("matchChangedFiles(): matching files %s to pattern %s", file, pattern)
-			if containsGlob(pattern) {
-				// filepath.Match expects the pattern to match the entire name.
-				if ok, err := filepath.Match(pattern, file); err == nil && ok {
-					return true
-				} else if err != nil {
-					log.Warn().Err(err).Msgf("failed to call filepath.Match(%s, %s)", pattern, file)
-				}
-			} else {
-				// For a non-glob pattern, treat it as a directory prefix.
-				dirPrefix := pattern
-				if !strings.HasSuffix(dirPrefix, string(filepath.Separator)) {
-					dirPrefix += string(filepath.Separator)
-				}
-				// Clean paths to avoid mismatches.
-				cleanFile := filepath.Clean(file)
-				cleanPrefix := filepath.Clean(dirPrefix)
-				// Check if the changed file is under the directory.
-				if strings.HasPrefix(cleanFile, cleanPrefix) {
-					return true
+			for _, file := range changedFiles {
+				if matchPattern(pattern, cleanChangedFile(file)) {
+					matches = append(matches, PathMatch{Source: i + 1, Pattern: pattern, File: file})
 				}
 			}
 		}
 	}
-	return false
+	return matches, true
 }
 
 // FilterApplications returns a list of Application objects whose annotation-based manifest-generate-paths
@@ -54,64 +177,20 @@ func FilterApplicationsByPath(apps []Application, changedFiles []string) []Appli
 	var matchedApps []Application
 
 	for _, app := range apps {
-		annotations := app.GetAnnotations()
-		var manifestPaths string
-		var ok bool
-		if manifestPaths, ok = annotations["argocd.argoproj.io/manifest-generate-paths"]; !ok {
-			// if the app does not have this annotation, include it in the results
+		matches, filtered := manifestPathMatches(app, changedFiles)
+		if !filtered {
+			// if the app does not filter by path, include it in the results
 			matchedApps = append(matchedApps, app)
 			continue
 		}
-		// Treat "/" as "no annotation" - include the app without path filtering
-		if strings.TrimSpace(manifestPaths) == "/" {
-			matchedApps = append(matchedApps, app)
+		if len(matches) == 0 {
+			log.Debug().Msgf("Filtering app %s: no changed file matches manifest-generate-paths %q", app.ObjectMeta.Name, app.GetAnnotations()[manifestGeneratePathsAnnotation])
 			continue
 		}
-
-		// Get all sources from the Application.
-		sources := app.Spec.GetSources()
-		matched := false
-
-		for _, source := range sources {
-			var patterns []string
-
-			if manifestPaths != "" {
-				// Split the annotation on semicolons and build full patterns.
-				parts := strings.Split(manifestPaths, ";")
-				for _, p := range parts {
-					p = strings.TrimSpace(p)
-					if p == "" {
-						continue
-					}
-					var fullPattern string
-					if !filepath.IsAbs(p) {
-						// If p is not an absolute path, join it with the source's path.
-						if p == "." {
-							fullPattern = source.Path
-						} else if strings.HasPrefix(p, "./") {
-							fullPattern = filepath.Join(source.Path, strings.TrimPrefix(p, "./"))
-						} else {
-							fullPattern = filepath.Join(source.Path, p)
-						}
-					} else {
-						fullPattern = strings.TrimPrefix(p, "/")
-					}
-					patterns = append(patterns, fullPattern)
-				}
-			} else {
-				// Empty annotation, include it in the results
-				matched = true
-			}
-
-			if matchChangedFiles(changedFiles, patterns) {
-				matched = true
-				break // No need to check further sources for this Application.
-			}
-		}
-
-		if matched {
-			matchedApps = append(matchedApps, app)
+		for _, m := range matches {
+			log.Debug().Msgf("App %s: manifest-generate-paths pattern %s (source %d) matched %s", app.ObjectMeta.Name, m.Pattern, m.Source, m.File)
 		}
+		matchedApps = append(matchedApps, app)
 	}
 
 	return matchedApps
@@ -2,6 +2,7 @@ package argocd
 
 import (
 	"encoding/json"
+	"slices"
 	"testing"
 )
 
@@ -108,4 +109,69 @@ func TestFilterApplicationsByPath(t *testing.T) {
 	if len(rootMatchEmpty) != 1 {
 		t.Error("rootMatchEmpty failed - '/' annotation should include app even with no changed files")
 	}
+
+	// a ref-only source matches the value files other sources read through it
+	refApp := Application{Spec: ApplicationSpec{Sources: []ApplicationSource{
+		{RepoURL: "https://charts.example.com", TargetRevision: "1.0.0", Chart: "widgets", Helm: &ApplicationSourceHelm{ValueFiles: []string{"$values/envs/prod/widgets.yaml"}}},
+		{RepoURL: "https://github.com/acme/widgets.git", TargetRevision: "main", Ref: "values"},
+	}}}
+	refApp.SetAnnotations(map[string]string{annotationStr: "/charts"})
+	if refMatch := FilterApplicationsByPath([]Application{refApp}, []string{"envs/prod/widgets.yaml"}); len(refMatch) != 1 {
+		t.Error("refMatch failed")
+	}
+	if refNoMatch := FilterApplicationsByPath([]Application{refApp}, []string{"envs/dev/widgets.yaml"}); len(refNoMatch) != 0 {
+		t.Error("refNoMatch failed")
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern, file string
+		want          bool
+	}{
+		{"charts/**/values-prod.yaml", "charts/web/values-prod.yaml", true},
+		{"charts/**/values-prod.yaml", "charts/values-prod.yaml", true},
+		{"charts/**/values-prod.yaml", "charts/web/env/values-prod.yaml", true},
+		{"charts/**/values-prod.yaml", "charts/web/values-dev.yaml", false},
+		{"charts/**", "charts/web/Chart.yaml", true},
+		{"**/*.yaml", "apps/web/deploy.yaml", true},
+		{"apps/*/deploy.yaml", "apps/web/v2/deploy.yaml", false},
+		{"apps/web/deploy.yaml", "apps/web/deploy.yaml", true},
+		{"apps/web/deploy.yaml", "apps/web/deploy.yaml.bak", false},
+		{"apps/web", "apps/web/deploy.yaml", true},
+		{"apps/web", "apps/webapp/deploy.yaml", false},
+		{"", "anything/at/all.yaml", true},
+	}
+	for _, tt := range tests {
+		if got := matchPattern(tt.pattern, tt.file); got != tt.want {
+			t.Errorf("matchPattern(%q, %q) = %t, want %t", tt.pattern, tt.file, got, tt.want)
+		}
+	}
+}
+
+func TestManifestPathMatches(t *testing.T) {
+	app := Application{Spec: ApplicationSpec{Sources: []ApplicationSource{
+		{RepoURL: "https://github.com/acme/widgets.git", TargetRevision: "main", Path: "apps/web"},
+		{RepoURL: "https://github.com/acme/widgets.git", TargetRevision: "main", Path: "apps/api"},
+	}}}
+	app.SetAnnotations(map[string]string{"argocd.argoproj.io/manifest-generate-paths": ".;../shared;/charts/**/values-prod.yaml;../../../outside"})
+	if got, want := manifestPathPatterns(app.GetAnnotations()["argocd.argoproj.io/manifest-generate-paths"], app.Spec.Sources[0]), []string{"apps/web", "apps/shared", "charts/**/values-prod.yaml", "outside"}; !slices.Equal(got, want) {
+		t.Errorf("manifestPathPatterns() = %v, want %v", got, want)
+	}
+	matches, filtered := manifestPathMatches(app, []string{"apps/api/deploy.yaml", "/charts/web/values-prod.yaml", "README.md"})
+	want := []PathMatch{
+		{Source: 1, Pattern: "charts/**/values-prod.yaml", File: "/charts/web/values-prod.yaml"},
+		{Source: 2, Pattern: "apps/api", File: "apps/api/deploy.yaml"},
+		{Source: 2, Pattern: "charts/**/values-prod.yaml", File: "/charts/web/values-prod.yaml"},
+	}
+	if !filtered || !slices.Equal(matches, want) {
+		t.Errorf("manifestPathMatches() = %+v, %t; want %+v", matches, filtered, want)
+	}
+	if matches, _ := manifestPathMatches(app, []string{"README.md"}); len(matches) != 0 {
+		t.Errorf("Expected no matches for README.md, got %+v", matches)
+	}
+	app.SetAnnotations(nil)
+	if _, filtered := manifestPathMatches(app, []string{"README.md"}); filtered {
+		t.Error("Expected an app without the annotation not to be filtered")
+	}
 }
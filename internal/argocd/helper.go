@@ -12,6 +12,8 @@ import (
 	"github.com/rs/zerolog/log"
 	"sigs.k8s.io/yaml"
 
+	"github.com/vince-riv/argo-diff/internal/metrics"
+	"github.com/vince-riv/argo-diff/internal/repoconfig"
 	"github.com/vince-riv/argo-diff/internal/webhook"
 )
 
@@ -53,7 +55,8 @@ func ConnectivityCheck() error {
 	if err != nil {
 		return err
 	}
-	if versionCheck(clientV) && versionCheck(serverV) {
+	// the api backend has no client version to check
+	if (clientV == "" || versionCheck(clientV)) && versionCheck(serverV) {
 		return nil
 	}
 	return fmt.Errorf("client (%s) or Server (%s) version is not %s or greater", clientV, serverV, minVersion)
@@ -67,74 +70,30 @@ func appListToMap(appList []Application) map[string]Application {
 	return argoAppMap
 }
 
-func getApplicationChanges(ctx context.Context, app *Application, revision string, revs []string, pos []int) (ApplicationResourcesWithChanges, error) {
+// getApplicationChanges diffs an application rendered at head. Under DiffModeDesired and
+// DiffModeBoth, with a base to compare to (the merge-base, or a zero appRevisions when there isn't
+// one), that's a desired-state diff; otherwise, and alongside it under DiffModeBoth, it's diffed
+// against the live state, with any pre-existing drift labelled (see labelDrift).
+func getApplicationChanges(ctx context.Context, app *Application, head, base appRevisions) (ApplicationResourcesWithChanges, error) {
 	var appResChanges ApplicationResourcesWithChanges
 	var err error
 	appResChanges.ArgoApp = app
-	if revision != "" {
-		appResChanges.ChangedResources, err = diffApplication(ctx, app.ObjectMeta.Name, revision, nil, nil)
-	} else {
-		if len(revs) < 1 || len(revs) != len(pos) {
-			return appResChanges, fmt.Errorf("getApplicationChanges() called as multi-src with bad revs/pos count [%d/%d]", len(revs), len(pos))
-		}
-		appResChanges.ChangedResources, err = diffApplication(ctx, app.ObjectMeta.Name, "", revs, pos)
+	if head.revision == "" && (len(head.revisions) < 1 || len(head.revisions) != len(head.srcPos)) {
+		return appResChanges, fmt.Errorf("getApplicationChanges() called as multi-src with bad revs/pos count [%d/%d]", len(head.revisions), len(head.srcPos))
 	}
-	return appResChanges, err
-}
-
-func getMultiSrcAppChanges(ctx context.Context, appCur *Application, appNew *Application, repoOwner, repoName, revision string) (ApplicationResourcesWithChanges, error) {
-	var appResChanges ApplicationResourcesWithChanges
-	appName := appCur.ObjectMeta.Name
-	curSources := appCur.Spec.GetSources()
-	newSources := appNew.Spec.GetSources()
-	if len(curSources) != len(newSources) {
-		return appResChanges, fmt.Errorf("number of sources for %s changing: %d -> %d", appName, len(curSources), len(newSources))
-	}
-	if len(curSources) < 1 {
-		return appResChanges, fmt.Errorf("%s has no sources configured", appName)
-	}
-	revisions := []string{}
-	positions := []int{}
-	for i, curSrc := range curSources {
-		newRevision := newSources[i].TargetRevision
-		if curSrc.RepoURL != newSources[i].RepoURL {
-			return appResChanges, fmt.Errorf("source URL is changing in %s", appName)
-		}
-		if gitRepoMatch(curSrc, repoOwner, repoName) {
-			newRevision = revision
-		}
-		revisions = append(revisions, newRevision)
-		positions = append(positions, i+1)
+	mode := DiffModeFor(ctx)
+	if mode == DiffModeLive || base.isZero() {
+		appResChanges.ChangedResources, err = diffWithDrift(ctx, app, head, base)
+		return appResChanges, err
 	}
-	return getApplicationChanges(ctx, appCur, "", revisions, positions)
-}
-
-// nestedJob is a queued diff of an app-of-apps' nested Application, discovered
-// while diffing its parent in wave 1 and executed in wave 2. parentIdx is the
-// index into wave 1's apps slice of the parent that queued this job, so wave
-// 2's results can be merged back next to their parent's entry in appResList.
-type nestedJob struct {
-	appCur    *Application
-	appNew    *Application
-	parentIdx int
-}
-
-// wave1Result is one top-level app's outcome from processTopLevelApp(). No
-// field here is written by more than one goroutine: GetApplicationChanges()
-// merges these sequentially, in original apps order, after the wave-1 pool
-// drains.
-type wave1Result struct {
-	diffResult       *ApplicationResourcesWithChanges
-	notDiffed        []string
-	multiSrcAppNames []string
-	nestedJobs       []nestedJob
-}
-
-// diffJobResult is the shared shape for wave-2 (nested app) and wave-3
-// (multi-source app) worker outcomes.
-type diffJobResult struct {
-	diffResult *ApplicationResourcesWithChanges
-	notDiffed  []string
+	if appResChanges.ChangedResources, err = desiredStateDiff(ctx, app.ObjectMeta.Name, base, head); err != nil {
+		return appResChanges, err
+	}
+	if mode == DiffModeBoth {
+		appResChanges.LiveResources, err = diffWithDrift(ctx, app, head, base)
+		return appResChanges, err
+	}
+	return appResChanges, nil
 }
 
 // processTopLevelApp diffs one single-source top-level app and, if it has
@@ -142,14 +101,15 @@ type diffJobResult struct {
 // queuing them as nestedJobs for wave 2 rather than diffing them inline. It
 // takes only read-only inputs and returns a private result, so it's safe to
 // run from any of runWithLimit's worker goroutines.
-func processTopLevelApp(ctx context.Context, app Application, appLookup map[string]Application, eventInfo webhook.EventInfo) wave1Result {
-	var res wave1Result
+func processTopLevelApp(ctx context.Context, app Application, appLookup map[string]Application, eventInfo webhook.EventInfo) appTreeResult {
+	var res appTreeResult
 	if ctx.Err() != nil {
 		res.notDiffed = append(res.notDiffed, app.Name)
 		return res
 	}
 	log.Info().Msgf("Generating application diff for ArgoCD App '%s' w/ revision %s", app.Name, eventInfo.Sha)
-	appResChanges, err := getApplicationChanges(ctx, &app, eventInfo.Sha, nil, nil)
+	head := appRevisions{revision: eventInfo.Sha}
+	appResChanges, err := getApplicationChanges(ctx, &app, head, appRevisions{revision: eventInfo.MergeBase})
 	if err != nil {
 		if ctx.Err() != nil {
 			// the diff was interrupted by the deadline, so this isn't an
@@ -165,80 +125,32 @@ func processTopLevelApp(ctx context.Context, app Application, appLookup map[stri
 		return res
 	}
 	res.diffResult = &appResChanges
-	appsWithChanges, err := argoAppsWithChanges(ctx, app.Name, appResChanges.ChangedResources, eventInfo.Sha)
-	if err != nil {
-		if ctx.Err() != nil {
-			// This app's diff turned up nested Applications but we ran out of
-			// time enumerating them, so they can't be named individually. Record
-			// one entry anyway: without it the run reports as complete while
-			// every nested application diff is missing.
-			res.notDiffed = append(res.notDiffed, fmt.Sprintf("nested apps of %s", app.Name))
-		}
-		log.Warn().Err(err).Msgf("Unable to determine if argo app %s has other argo apps with changes", app.Name)
-		return res
-	}
-	// diff matching multi-source application
-	log.Info().Msgf("Found %d nested ArgoCD Application(s) with changes within '%s'", len(appsWithChanges), app.Name)
-	for _, subApp := range appsWithChanges {
-		subAppCur, ok := appLookup[subApp.Name]
-		if !ok {
-			log.Info().Msgf("Application %s not found in current ArgoCD app list", subApp.Name)
-			continue
-		}
-		res.multiSrcAppNames = append(res.multiSrcAppNames, subApp.Name)
-		if ctx.Err() != nil {
-			res.notDiffed = append(res.notDiffed, subApp.Name)
-			continue
-		}
-		res.nestedJobs = append(res.nestedJobs, nestedJob{appCur: &subAppCur, appNew: &subApp})
-	}
+	queueNestedApps(ctx, &res, &app, appResChanges.ChangedResources, head, appLookup, nil)
 	return res
 }
 
-// processNestedJob diffs one nested app-of-apps Application queued by wave 1.
-//
-// NOTE: on a non-timeout error, this intentionally does not surface WarnStr
-// in the returned diffResult (only the len(ChangedResources) > 0 success
-// branch below sets it) — matching the pre-existing behavior of the loop this
-// was extracted from. That looks like an inconsistency with the top-level
-// loop, which does append its WarnStr case; flagged to the user as a possible
-// follow-up rather than silently changed here (see issue #273 design notes).
-func processNestedJob(ctx context.Context, job nestedJob, eventInfo webhook.EventInfo) diffJobResult {
-	var res diffJobResult
-	if ctx.Err() != nil {
-		res.notDiffed = append(res.notDiffed, job.appNew.Name)
-		return res
-	}
-	subAppResChanges, err := getMultiSrcAppChanges(ctx, job.appCur, job.appNew, eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.Sha)
-	if err != nil {
-		if ctx.Err() != nil {
-			res.notDiffed = append(res.notDiffed, job.appNew.Name)
-		}
-		return res
-	}
-	if len(subAppResChanges.ChangedResources) > 0 {
-		res.diffResult = &subAppResChanges
-	}
-	return res
-}
-
-// processMultiSrcApp diffs one wave-3 multi-source app.
-func processMultiSrcApp(ctx context.Context, app Application, eventInfo webhook.EventInfo) diffJobResult {
-	var res diffJobResult
+// processMultiSrcApp diffs one wave-3 multi-source app and, like processTopLevelApp(), queues the
+// nested app-of-apps Applications its diff changes (eg: a chart of Applications whose values are in
+// the repository).
+func processMultiSrcApp(ctx context.Context, app Application, appLookup map[string]Application, eventInfo webhook.EventInfo) appTreeResult {
+	var res appTreeResult
 	if ctx.Err() != nil {
 		res.notDiffed = append(res.notDiffed, app.Name)
 		return res
 	}
 	log.Info().Msgf("Generating application diff for multi-source ArgoCD App '%s' w/ revision %s", app.Name, eventInfo.Sha)
-	revList := []string{}
-	srcPos := []int{}
+	var head, base appRevisions
 	for i, appSrc := range app.Spec.GetSources() {
-		if gitRepoMatch(appSrc, eventInfo.RepoOwner, eventInfo.RepoName) {
-			revList = append(revList, eventInfo.Sha)
-			srcPos = append(srcPos, i+1)
+		if sourceMatches(app, appSrc, eventInfo) {
+			head.revisions = append(head.revisions, eventInfo.Sha)
+			head.srcPos = append(head.srcPos, i+1)
+			if eventInfo.MergeBase != "" {
+				base.revisions = append(base.revisions, eventInfo.MergeBase)
+				base.srcPos = append(base.srcPos, i+1)
+			}
 		}
 	}
-	appResChanges, err := getApplicationChanges(ctx, &app, "", revList, srcPos)
+	appResChanges, err := getApplicationChanges(ctx, &app, head, base)
 	if err != nil {
 		if ctx.Err() != nil {
 			res.notDiffed = append(res.notDiffed, app.Name)
@@ -248,9 +160,11 @@ func processMultiSrcApp(ctx context.Context, app Application, eventInfo webhook.
 		res.diffResult = &appResChanges
 		return res
 	}
-	if len(appResChanges.ChangedResources) > 0 {
-		res.diffResult = &appResChanges
+	if len(appResChanges.ChangedResources) == 0 {
+		return res
 	}
+	res.diffResult = &appResChanges
+	queueNestedApps(ctx, &res, &app, appResChanges.ChangedResources, head, appLookup, nil)
 	return res
 }
 
@@ -263,15 +177,18 @@ func processMultiSrcApp(ctx context.Context, app Application, eventInfo webhook.
 // far are returned so the caller can still report them.
 //
 // Diffing runs in three sequential, bounded waves (top-level single-source
-// apps, then their nested app-of-apps children, then multi-source apps),
-// each capped at maxWorkers() concurrent `argocd` CLI calls. Each wave runs
-// to completion before the next starts, so at most maxWorkers() diffs are
-// ever in flight system-wide. Wave 2 (nested apps) runs as one flattened,
-// pool-bounded batch across all parents rather than per-parent, but results
-// are merged back next to their parent's entry afterward, so both
-// appResList and notDiffed still read "parent, its nested apps, next
-// parent, ..." — the same order this produced when the loop ran
-// sequentially.
+// apps, then their nested app-of-apps children, then multi-source apps,
+// whose own nested children get a second run of wave 2), each capped at
+// maxWorkers() concurrent diffs. Between waves 1 and 2, the ApplicationSets
+// whose git generators read the change are generated, and the Applications
+// they'd add or alter are diffed in wave 2 as their nested apps. Each wave
+// runs to completion before the next starts, so at most maxWorkers() diffs
+// are ever in flight system-wide. Wave 2 (nested apps) runs a level of the
+// app-of-apps tree at a time, each level one flattened, pool-bounded batch
+// across all parents, but results are merged back under their parent
+// afterward, so both appResList and notDiffed still read "parent, its nested
+// apps (and theirs), next parent, ..." — the same order this produced when
+// the loop ran sequentially.
 func GetApplicationChanges(ctx context.Context, eventInfo webhook.EventInfo) ([]ApplicationResourcesWithChanges, []string, error) {
 	log.Trace().Msgf("GetApplicationChanges(%+v)", eventInfo)
 	var appResList []ApplicationResourcesWithChanges
@@ -289,6 +206,7 @@ func GetApplicationChanges(ctx context.Context, eventInfo webhook.EventInfo) ([]
 	if err != nil {
 		return appResList, notDiffed, err
 	}
+	apps = includedApps(ctx, apps)
 	log.Debug().Msgf("Matching apps: %s", func() (s string) {
 		for _, app := range apps {
 			if s != "" {
@@ -300,50 +218,125 @@ func GetApplicationChanges(ctx context.Context, eventInfo webhook.EventInfo) ([]
 		return
 	}())
 
+	matchLog := matchLogFrom(ctx)
+	for _, app := range apps {
+		matchLog.addDirect(app, eventInfo, false)
+	}
+
 	limit := maxWorkers()
 
 	// Wave 1: top-level single-source apps.
-	wave1Results := make([]wave1Result, len(apps))
+	waveStart := time.Now()
+	wave1Results := make([]appTreeResult, len(apps))
 	runWithLimit(len(apps), limit, func(i int) {
-		res := processTopLevelApp(ctx, apps[i], appLookup, eventInfo)
-		for j := range res.nestedJobs {
-			res.nestedJobs[j].parentIdx = i
-		}
-		wave1Results[i] = res
+		wave1Results[i] = processTopLevelApp(ctx, apps[i], appLookup, eventInfo)
 	})
+	metrics.ObserveWave("single_source", time.Since(waveStart))
 	multiSrcAppNamesDiffed := []string{}
-	// nestedJobs accumulates in wave1Results order, so it comes out grouped
-	// by parentIdx (ascending, contiguous per parent) without extra sorting.
+	// nestedJobs accumulates in wave1Results order, so each level comes out
+	// grouped by parent without extra sorting. An Application reachable from
+	// more than one parent is only diffed under the first.
+	queued := make(map[string]bool)
 	var nestedJobs []nestedJob
-	for _, r := range wave1Results {
-		multiSrcAppNamesDiffed = append(multiSrcAppNamesDiffed, r.multiSrcAppNames...)
-		nestedJobs = append(nestedJobs, r.nestedJobs...)
+	queue := func(parent *appTreeResult) {
+		multiSrcAppNamesDiffed = append(multiSrcAppNamesDiffed, parent.multiSrcAppNames...)
+		byAppSet := parent.diffResult != nil && parent.diffResult.ApplicationSet != nil
+		for _, c := range parent.children {
+			if removed := c.diffResult; removed.Removal != nil {
+				if byAppSet {
+					matchLog.add(removed.ArgoApp.ObjectMeta.Name, fmt.Sprintf("Application no longer generated by ApplicationSet %s", removed.Parent))
+				} else {
+					matchLog.add(removed.ArgoApp.ObjectMeta.Name, fmt.Sprintf("nested Application deleted by the diff of %s", removed.Parent))
+				}
+			}
+		}
+		for _, job := range parent.nestedJobs {
+			if queued[job.appNew.Name] {
+				log.Debug().Msgf("Nested Application %s of %s is already queued under another parent", job.appNew.Name, job.parentName())
+				continue
+			}
+			queued[job.appNew.Name] = true
+			job.parent = parent
+			nestedJobs = append(nestedJobs, job)
+			var reason string
+			if byAppSet {
+				reason = fmt.Sprintf("Application generated by ApplicationSet %s, which the change adds or alters", job.parentName())
+			} else if job.appCur == nil {
+				reason = fmt.Sprintf("new nested Application added by the diff of %s", job.parentName())
+			} else {
+				reason = fmt.Sprintf("nested Application changed by the diff of %s", job.parentName())
+			}
+			if bumps := chartBumps(job.appCur, job.appNew); len(bumps) > 0 {
+				reason += " (" + strings.Join(bumps, ", ") + ")"
+			}
+			matchLog.add(job.appNew.Name, reason)
+		}
+	}
+	for i := range wave1Results {
+		queue(&wave1Results[i])
 	}
 
-	// Wave 2: nested app-of-apps children queued by wave 1, flattened across
-	// all parents.
-	wave2Results := make([]diffJobResult, len(nestedJobs))
-	runWithLimit(len(nestedJobs), limit, func(i int) {
-		wave2Results[i] = processNestedJob(ctx, nestedJobs[i], eventInfo)
-	})
-
-	// Merge wave 1 and wave 2 results so each parent's entry (in both
-	// appResList and notDiffed) is immediately followed by its own nested
-	// apps' entries, matching the pre-parallelization "parent, its children,
-	// next parent" order that app-of-apps users see in the PR comment.
-	nestedIdx := 0
-	for i, r := range wave1Results {
-		if r.diffResult != nil {
-			appResList = append(appResList, *r.diffResult)
+	// ApplicationSets whose git generators read the change: the Applications
+	// they'd add or alter join wave 2 as their nested Applications, except
+	// those wave 1 already diffed. Failing to list them isn't fatal, since
+	// the token may not be allowed to.
+	var appSets []ApplicationSet
+	if allAppSets, err := listApplicationSets(ctx); err != nil {
+		log.Warn().Err(err).Msg("Unable to list ApplicationSets; the Applications they generate won't be diffed")
+	} else {
+		matched, reasons := matchingAppSets(allAppSets, eventInfo)
+		for i, appSet := range matched {
+			if !repoconfig.FromContext(ctx).IncludesApp(appSet.ObjectMeta.Name) {
+				log.Debug().Msgf("Skipping ApplicationSet %s: excluded by %s", appSet.ObjectMeta.Name, repoconfig.Path)
+				continue
+			}
+			appSets = append(appSets, appSet)
+			matchLog.add(appSet.ObjectMeta.Name, reasons[i])
 		}
-		notDiffed = append(notDiffed, r.notDiffed...)
-		for nestedIdx < len(nestedJobs) && nestedJobs[nestedIdx].parentIdx == i {
-			if wave2Results[nestedIdx].diffResult != nil {
-				appResList = append(appResList, *wave2Results[nestedIdx].diffResult)
+	}
+	waveStart = time.Now()
+	appSetResults := make([]appTreeResult, len(appSets))
+	runWithLimit(len(appSets), limit, func(i int) {
+		appSetResults[i] = processAppSet(ctx, appSets[i], appLookup, eventInfo)
+	})
+	metrics.ObserveWave("applicationset", time.Since(waveStart))
+	wave1Apps := apps
+	for i := range appSetResults {
+		appSetResults[i].dropJobsFor(wave1Apps)
+		queue(&appSetResults[i])
+	}
+
+	// Wave 2: nested app-of-apps Applications, a level at a time: those
+	// queued by wave 1, then those queued by their diffs, and so on down to
+	// maxAppDepth(). Each level is flattened across all parents. It runs
+	// again after wave 3, for the nested apps of multi-source apps.
+	diffNested := func() {
+		waveStart := time.Now()
+		for len(nestedJobs) > 0 {
+			levelJobs := nestedJobs
+			levelResults := make([]appTreeResult, len(levelJobs))
+			runWithLimit(len(levelJobs), limit, func(i int) {
+				levelResults[i] = processNestedJob(ctx, levelJobs[i], appLookup, eventInfo)
+			})
+			nestedJobs = nil
+			for i := range levelResults {
+				levelJobs[i].parent.children = append(levelJobs[i].parent.children, &levelResults[i])
+				queue(&levelResults[i])
 			}
-			notDiffed = append(notDiffed, wave2Results[nestedIdx].notDiffed...)
-			nestedIdx++
 		}
+		metrics.ObserveWave("nested", time.Since(waveStart))
+	}
+	diffNested()
+
+	// Flatten the tree so each parent's entry (in both appResList and
+	// notDiffed) is immediately followed by its own nested apps' entries,
+	// matching the pre-parallelization "parent, its children, next parent"
+	// order that app-of-apps users see in the PR comment.
+	for i := range wave1Results {
+		appResList, notDiffed = wave1Results[i].flatten(appResList, notDiffed)
+	}
+	for i := range appSetResults {
+		appResList, notDiffed = appSetResults[i].flatten(appResList, notDiffed)
 	}
 
 	// re-filter applications, except this time with multi-source
@@ -351,6 +344,7 @@ func GetApplicationChanges(ctx context.Context, eventInfo webhook.EventInfo) ([]
 	if err != nil {
 		return appResList, notDiffed, err
 	}
+	apps = includedApps(ctx, apps)
 	log.Debug().Msgf("Matching multi-source apps: %s", func() (s string) {
 		for _, app := range apps {
 			if s != "" {
@@ -368,18 +362,52 @@ func GetApplicationChanges(ctx context.Context, eventInfo webhook.EventInfo) ([]
 			continue
 		}
 		wave3Apps = append(wave3Apps, app)
-	}
-
-	// Wave 3: multi-source apps not already covered by wave 1/2.
-	wave3Results := make([]diffJobResult, len(wave3Apps))
+		matchLog.addDirect(app, eventInfo, true)
+	}
+
+	// Wave 3: multi-source apps not already covered by wave 1/2. The nested
+	// apps their diffs change then get a second run of wave 2, except those
+	// wave 1 already diffed. One that was also diffed in wave 3 is diffed
+	// again as a nested app, at the new spec its parent gives it (eg: a chart
+	// version bump), and that replaces its wave-3 result: such results are
+	// held back, so their own nested apps are queued under the replacement
+	// rather than under a result that's never reported. Any that no parent
+	// ends up re-diffing are queued after all.
+	waveStart = time.Now()
+	wave3Results := make([]appTreeResult, len(wave3Apps))
 	runWithLimit(len(wave3Apps), limit, func(i int) {
-		wave3Results[i] = processMultiSrcApp(ctx, wave3Apps[i], eventInfo)
+		wave3Results[i] = processMultiSrcApp(ctx, wave3Apps[i], appLookup, eventInfo)
 	})
-	for _, r := range wave3Results {
-		if r.diffResult != nil {
-			appResList = append(appResList, *r.diffResult)
+	metrics.ObserveWave("multi_source", time.Since(waveStart))
+	nestedInWave3 := make(map[string]bool)
+	for i := range wave3Results {
+		wave3Results[i].dropJobsFor(wave1Apps)
+		for _, job := range wave3Results[i].nestedJobs {
+			if job.appNew.Name != wave3Apps[i].ObjectMeta.Name && slices.ContainsFunc(wave3Apps, func(app Application) bool { return app.ObjectMeta.Name == job.appNew.Name }) {
+				nestedInWave3[job.appNew.Name] = true
+			}
+		}
+	}
+	for i := range wave3Results {
+		if !nestedInWave3[wave3Apps[i].ObjectMeta.Name] {
+			queue(&wave3Results[i])
+		}
+	}
+	diffNested()
+	for i := range wave3Results {
+		if name := wave3Apps[i].ObjectMeta.Name; nestedInWave3[name] {
+			if queued[name] {
+				log.Debug().Msgf("Multi-source %s is a nested app of another; replaced its diff with one at its new spec", name)
+				continue
+			}
+			queue(&wave3Results[i])
+		}
+	}
+	diffNested()
+	for i := range wave3Results {
+		if name := wave3Apps[i].ObjectMeta.Name; !nestedInWave3[name] || !queued[name] {
+			appResList, notDiffed = wave3Results[i].flatten(appResList, notDiffed)
 		}
-		notDiffed = append(notDiffed, r.notDiffed...)
 	}
 
 	if len(notDiffed) > 0 {
@@ -388,6 +416,20 @@ func GetApplicationChanges(ctx context.Context, eventInfo webhook.EventInfo) ([]
 	return appResList, notDiffed, nil
 }
 
+// includedApps drops the applications the repository's config (see internal/repoconfig) leaves out
+func includedApps(ctx context.Context, apps []Application) []Application {
+	cfg := repoconfig.FromContext(ctx)
+	var res []Application
+	for _, app := range apps {
+		if cfg.IncludesApp(app.ObjectMeta.Name) {
+			res = append(res, app)
+		} else {
+			log.Debug().Msgf("Skipping application %s: excluded by %s", app.ObjectMeta.Name, repoconfig.Path)
+		}
+	}
+	return res
+}
+
 // Returns a list of Applications whose git URLs match repo owner & name
 // eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.RepoDefaultRef, eventInfo.ChangeRef, eventInfo.BaseRef string
 func filterApplications(a []Application, eventInfo webhook.EventInfo, multiSource bool) ([]Application, error) {
@@ -406,7 +448,7 @@ func filterApplications(a []Application, eventInfo webhook.EventInfo, multiSourc
 			sources = []ApplicationSource{singleSrc}
 		}
 		for _, appSpecSource := range sources {
-			if checkSource(appSpecSource, app.ObjectMeta.Name, eventInfo, app.Spec.SyncPolicy != nil && app.Spec.SyncPolicy.Automated != nil) {
+			if sourceMatches(app, appSpecSource, eventInfo) {
 				// Stop at the first matching source: an app is only diffed once, no
 				// matter how many of its sources point at the changed repo. A
 				// multi-source app in a monorepo commonly matches twice (eg: a chart
@@ -474,6 +516,24 @@ func gitRepoMatch(appSrc ApplicationSource, repoOwner, repoName string) bool {
 	return false
 }
 
+// sourceMatches returns true when a change affects one of app's sources: it's in the repository, at
+// the change's base (see checkSource()). A ref-only source supplies nothing but the value files
+// other sources read through it, so when the changed files are known, one of those must be among
+// them.
+func sourceMatches(app Application, src ApplicationSource, eventInfo webhook.EventInfo) bool {
+	if !checkSource(src, app.ObjectMeta.Name, eventInfo, app.Spec.AutoSync()) {
+		return false
+	}
+	if !src.refOnly() || len(eventInfo.ChangedFiles) == 0 {
+		return true
+	}
+	if f, ok := refSourceFile(app, src, eventInfo.ChangedFiles); ok && f == "" {
+		log.Debug().Msgf("Filtering source $%s of %s: none of the value files read through it changed", src.Ref, app.ObjectMeta.Name)
+		return false
+	}
+	return true
+}
+
 // normalizeBranchRef strips the fully-qualified refs/heads/ prefix so a
 // fully-qualified targetRevision (refs/heads/main) — ArgoCD's recommended
 // form per its high-availability guide — compares equal to the short
@@ -554,12 +614,15 @@ func genericManifestToArgoApplication(manifest K8sManifest) (Application, error)
 	if err != nil {
 		return app, err
 	}
+	app.manifest = manifest.Unstruct.Object
 	log.Trace().Msgf("genericManifestToArgoApplication() returning Application: %+v", app)
 	return app, nil
 }
 
-func argoAppsWithChanges(ctx context.Context, appName string, appResources []AppResource, revision string) ([]Application, error) {
-	log.Trace().Msgf("argoAppsWithChanges() scanning %s at %s for argo apps", appName, revision)
+// argoAppsWithChanges returns the new specs of the Applications among an application's changed
+// resources, from its manifests rendered at revisions
+func argoAppsWithChanges(ctx context.Context, appName string, appResources []AppResource, revisions appRevisions) ([]Application, error) {
+	log.Trace().Msgf("argoAppsWithChanges() scanning %s at %s for argo apps", appName, revisions)
 	argoAppNamesFound := []string{}
 	argoApps := []Application{}
 	// look through app resource changes for argoproj.io Applications
@@ -576,10 +639,10 @@ func argoAppsWithChanges(ctx context.Context, appName string, appResources []App
 		return argoApps, nil
 	}
 	// generate full manifests for our application at the specified revision
-	log.Debug().Msgf("argoAppsWithChanges(%s) - getting manifests at revision %s", appName, revision)
-	manifests, err := getApplicationManifests(ctx, appName, revision)
+	log.Debug().Msgf("argoAppsWithChanges(%s) - getting manifests at revision %s", appName, revisions)
+	manifests, err := getApplicationManifests(ctx, appName, revisions.revision, revisions.revisions, revisions.srcPos)
 	if err != nil {
-		log.Debug().Err(err).Msgf("argoAppsWithChanges() - getApplicationManifests(%s, %s) failed", appName, revision)
+		log.Debug().Err(err).Msgf("argoAppsWithChanges() - getApplicationManifests(%s, %s) failed", appName, revisions)
 		return argoApps, err
 	}
 	// look through resulting manifests for the argo apps found above
@@ -597,7 +660,7 @@ func argoAppsWithChanges(ctx context.Context, appName string, appResources []App
 			numSrcs := len(app.Spec.GetSources())
 			log.Trace().Msgf("argoAppsWithChanges(%s): argoApp %s w/ %d sources", appName, name, numSrcs)
 			if slices.Contains(argoAppNamesFound, name) && numSrcs > 0 {
-				// only return multi-source apps that have changes
+				// only return the apps that have changes
 				argoApps = append(argoApps, app)
 			}
 		}
@@ -7,12 +7,14 @@ import (
 	"os"
 	"path/filepath"
 	"slices"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
+	"github.com/vince-riv/argo-diff/internal/repoconfig"
 	wh "github.com/vince-riv/argo-diff/internal/webhook"
 )
 
@@ -177,6 +179,25 @@ func TestFilterApplicationsFullyQualifiedRefs(t *testing.T) {
 	}
 }
 
+func TestIncludedApps(t *testing.T) {
+	apps := []Application{
+		{ObjectMeta: metav1.ObjectMeta{Name: "guestbook"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "guestbook-canary"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "api"}},
+	}
+	if got := includedApps(context.Background(), apps); len(got) != 3 {
+		t.Errorf("Expected every app without a repository config, got %+v", got)
+	}
+	cfg, err := repoconfig.Parse([]byte("apps:\n  include: ['guestbook*']\n  exclude: ['*-canary']\n"))
+	if err != nil {
+		t.Fatalf("repoconfig.Parse() failed: %s", err)
+	}
+	got := includedApps(repoconfig.NewContext(context.Background(), cfg), apps)
+	if len(got) != 1 || got[0].Name != "guestbook" {
+		t.Errorf("includedApps() = %+v, want only guestbook", got)
+	}
+}
+
 func TestNormalizeBranchRef(t *testing.T) {
 	cases := map[string]string{
 		"refs/heads/main": "main",
@@ -254,6 +275,55 @@ func TestFilterApplicationsMultiSourceMatchesOnce(t *testing.T) {
 	}
 }
 
+// A ref-only source matches only through the value files the app's other sources read from it,
+// and only the sources the change affects are diffed at its sha.
+func TestGetApplicationChangesMultiSourceRef(t *testing.T) {
+	const repoURL = "https://github.com/acme/widgets.git"
+	apps := []Application{
+		{ObjectMeta: metav1.ObjectMeta{Name: "widgets"}, Spec: ApplicationSpec{Sources: []ApplicationSource{
+			{RepoURL: "https://charts.acme.dev", TargetRevision: "1.0.0", Chart: "widgets", Helm: &ApplicationSourceHelm{ValueFiles: []string{"values.yaml", "$values/envs/prod/widgets.yaml"}}},
+			{RepoURL: repoURL, TargetRevision: "main", Ref: "values"},
+			{RepoURL: repoURL, TargetRevision: "release", Path: "extras"},
+		}}},
+	}
+	appListJSON, err := json.Marshal(apps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls []string
+	originalExecArgoCdCli := execArgoCdCli
+	t.Cleanup(func() { execArgoCdCli = originalExecArgoCdCli })
+	execArgoCdCli = func(ctx context.Context, args []string) ([]byte, error) {
+		switch args[0] + " " + args[1] {
+		case "app list":
+			return appListJSON, nil
+		case "appset list":
+			return []byte("[]"), nil
+		case "app diff":
+			calls = append(calls, strings.Join(args[1:], " "))
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unexpected argocd args: %v", args)
+	}
+
+	evtInfo := wh.EventInfo{RepoOwner: "acme", RepoName: "widgets", RepoDefaultRef: "main", ChangeRef: "tune", BaseRef: "main", Sha: "abcdef", ChangedFiles: []string{"envs/dev/widgets.yaml"}}
+	if _, _, err := GetApplicationChanges(context.Background(), evtInfo); err != nil || len(calls) != 0 {
+		t.Fatalf("Expected a change to another value file not to match, got %v, %v", calls, err)
+	}
+
+	evtInfo.ChangedFiles = []string{"envs/prod/widgets.yaml"}
+	var matchLog MatchLog
+	if _, _, err := GetApplicationChanges(NewMatchContext(context.Background(), &matchLog), evtInfo); err != nil {
+		t.Fatalf("GetApplicationChanges() err'd: %v", err)
+	}
+	if want := "diff widgets --revisions abcdef --source-positions 2"; len(calls) != 1 || !strings.HasPrefix(calls[0], want) {
+		t.Errorf("Expected a single call to %q, got %v", want, calls)
+	}
+	if reason := matchLog.Reason("widgets"); !strings.Contains(reason, "sources 2 of 3") || !strings.Contains(reason, "$values/envs/prod/widgets.yaml") {
+		t.Errorf("Unexpected match reason: %q", reason)
+	}
+}
+
 // When the context is out of time, matching applications are reported as
 // not diffed instead of each one firing an `argocd app diff` that can only fail.
 func TestGetApplicationChangesOutOfTime(t *testing.T) {
@@ -714,7 +784,7 @@ func TestArgoAppsWithChanges(t *testing.T) {
 		AppResource{ApiVersion: "v1", Group: "apps", Kind: "Deployment", Namespace: "test", Name: "testdeploy"},
 		AppResource{ApiVersion: "v1", Group: "", Kind: "ConfigMap", Namespace: "test", Name: "testcm"},
 	}
-	result, err := argoAppsWithChanges(ctx, "testapp", appResources, "abcdef")
+	result, err := argoAppsWithChanges(ctx, "testapp", appResources, appRevisions{revision: "abcdef"})
 	if err != nil {
 		t.Errorf("argoAppsWithChanges() erroed: %v", err)
 	}
@@ -0,0 +1,124 @@
+package argocd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/vince-riv/argo-diff/internal/webhook"
+)
+
+// Match is an application GetApplicationChanges matched to a change, and why
+type Match struct {
+	App    string `json:"app"`
+	Reason string `json:"reason"`
+	// PathMatches are the changed files that satisfied the app's manifest-generate-paths, and the
+	// patterns they matched
+	PathMatches []PathMatch `json:"pathMatches,omitempty"`
+}
+
+// MatchLog collects the applications GetApplicationChanges matches, including those that turn out
+// to have no changes, for callers that report on them. Only GetApplicationChanges' own goroutine
+// writes to it.
+type MatchLog struct {
+	matches []Match
+}
+
+// Matches returns the matched applications in the order they were matched
+func (l *MatchLog) Matches() []Match {
+	if l == nil {
+		return nil
+	}
+	return l.matches
+}
+
+// Lookup returns what the log has on an application: the zero Match if it didn't match
+func (l *MatchLog) Lookup(app string) Match {
+	for _, m := range l.Matches() {
+		if m.App == app {
+			return m
+		}
+	}
+	return Match{}
+}
+
+// Reason returns why an application matched, or "" if it didn't
+func (l *MatchLog) Reason(app string) string {
+	return l.Lookup(app).Reason
+}
+
+// add records why app matched. A later reason replaces an earlier one, in place: eg: a multi-source
+// app that turns out to be another's nested app too is diffed as that.
+func (l *MatchLog) add(app, reason string) {
+	l.set(Match{App: app, Reason: reason})
+}
+
+// addDirect records why filterApplications matched app, with its manifest-generate-paths trace
+func (l *MatchLog) addDirect(app Application, eventInfo webhook.EventInfo, multiSource bool) {
+	if l == nil {
+		return
+	}
+	paths, _ := manifestPathMatches(app, eventInfo.ChangedFiles)
+	l.set(Match{App: app.ObjectMeta.Name, Reason: matchReason(app, eventInfo, multiSource), PathMatches: paths})
+}
+
+func (l *MatchLog) set(m Match) {
+	if l == nil {
+		return
+	}
+	for i := range l.matches {
+		if l.matches[i].App == m.App {
+			l.matches[i] = m
+			return
+		}
+	}
+	l.matches = append(l.matches, m)
+}
+
+type matchLogKey struct{}
+
+// NewMatchContext returns a copy of ctx that has GetApplicationChanges record its matches in l
+func NewMatchContext(ctx context.Context, l *MatchLog) context.Context {
+	return context.WithValue(ctx, matchLogKey{}, l)
+}
+
+func matchLogFrom(ctx context.Context) *MatchLog {
+	l, _ := ctx.Value(matchLogKey{}).(*MatchLog)
+	return l
+}
+
+// matchReason explains why filterApplications matched app: the source(s) pointing at the
+// repository, and the changed file that satisfied its manifest-generate-paths annotation
+func matchReason(app Application, eventInfo webhook.EventInfo, multiSource bool) string {
+	var reason string
+	if multiSource {
+		var positions []string
+		var refFiles []string
+		for i, src := range app.Spec.GetSources() {
+			if sourceMatches(app, src, eventInfo) {
+				positions = append(positions, fmt.Sprint(i+1))
+				if f, _ := refSourceFile(app, src, eventInfo.ChangedFiles); src.refOnly() && f != "" {
+					refFiles = append(refFiles, fmt.Sprintf("$%s/%s", src.Ref, f))
+				}
+			}
+		}
+		reason = fmt.Sprintf("sources %s of %d point at %s/%s", strings.Join(positions, ","), len(app.Spec.GetSources()), eventInfo.RepoOwner, eventInfo.RepoName)
+		if len(refFiles) > 0 {
+			reason += "; value files " + strings.Join(refFiles, ", ") + " changed"
+		}
+	} else {
+		src := app.Spec.GetSource()
+		reason = fmt.Sprintf("source %s (path %s, targetRevision %s)", src.RepoURL, src.Path, src.TargetRevision)
+	}
+	if len(eventInfo.ChangedFiles) == 0 {
+		return reason
+	}
+	paths, filtered := manifestPathMatches(app, eventInfo.ChangedFiles)
+	if !filtered {
+		return reason + "; no manifest-generate-paths filter"
+	}
+	if len(paths) > 0 {
+		return reason + "; manifest-generate-paths matched " + cleanChangedFile(paths[0].File)
+	}
+	return reason
+}
@@ -0,0 +1,78 @@
+package argocd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	wh "github.com/vince-riv/argo-diff/internal/webhook"
+)
+
+func TestMatchLog(t *testing.T) {
+	repoURL := "https://github.com/acme/widgets.git"
+	apps := buildTestApps(2, repoURL)
+	apps[0].Spec.Source.Path = "apps/one"
+	apps[1].Spec.Source.Path = "apps/two"
+	apps[1].ObjectMeta.Annotations = map[string]string{"argocd.argoproj.io/manifest-generate-paths": "."}
+	apps = append(apps, Application{
+		ObjectMeta: metav1.ObjectMeta{Name: "multi"},
+		Spec: ApplicationSpec{Sources: []ApplicationSource{
+			{RepoURL: "https://charts.example.com", Chart: "widgets", TargetRevision: "1.0.0"},
+			{RepoURL: repoURL, TargetRevision: "main", Ref: "values"},
+		}},
+	})
+	appListJSON, err := json.Marshal(apps)
+	if err != nil {
+		t.Fatalf("failed to marshal test apps: %v", err)
+	}
+	originalExecArgoCdCli := execArgoCdCli
+	defer func() { execArgoCdCli = originalExecArgoCdCli }()
+	execArgoCdCli = func(ctx context.Context, args []string) ([]byte, error) {
+		switch args[1] {
+		case "list":
+			return appListJSON, nil
+		case "diff":
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unexpected argocd args: %v", args)
+	}
+
+	evtInfo := wh.EventInfo{
+		RepoOwner:      "acme",
+		RepoName:       "widgets",
+		RepoDefaultRef: "main",
+		BaseRef:        "main",
+		Sha:            "abcdef",
+		ChangedFiles:   []string{"README.md", "apps/two/deployment.yaml"},
+	}
+	var matchLog MatchLog
+	if _, _, err := GetApplicationChanges(NewMatchContext(context.Background(), &matchLog), evtInfo); err != nil {
+		t.Fatalf("GetApplicationChanges() err'd: %v", err)
+	}
+	matches := matchLog.Matches()
+	if len(matches) != 3 {
+		t.Fatalf("Expected 3 matches, got %+v", matches)
+	}
+	for _, c := range []struct{ app, want string }{
+		{"pool-app-0", "source " + repoURL + " (path apps/one, targetRevision main); no manifest-generate-paths filter"},
+		{"pool-app-1", "manifest-generate-paths matched apps/two/deployment.yaml"},
+		{"multi", "sources 2 of 2 point at acme/widgets"},
+	} {
+		if got := matchLog.Reason(c.app); !strings.Contains(got, c.want) {
+			t.Errorf("Reason(%s) = %q, want it to contain %q", c.app, got, c.want)
+		}
+	}
+	if paths := matchLog.Lookup("pool-app-1").PathMatches; len(paths) != 1 || paths[0] != (PathMatch{Source: 1, Pattern: "apps/two", File: "apps/two/deployment.yaml"}) {
+		t.Errorf("Unexpected manifest-generate-paths trace for pool-app-1: %+v", paths)
+	}
+	if paths := matchLog.Lookup("pool-app-0").PathMatches; len(paths) != 0 {
+		t.Errorf("Expected no manifest-generate-paths trace for pool-app-0, got %+v", paths)
+	}
+	if got := (*MatchLog)(nil).Reason("pool-app-0"); got != "" {
+		t.Errorf("A nil MatchLog should have no reasons, got %q", got)
+	}
+}
@@ -0,0 +1,310 @@
+package argocd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	wh "github.com/vince-riv/argo-diff/internal/webhook"
+)
+
+// setupAppTree mocks the cli for a three-level app-of-apps: root (in the pull request's
+// repository) renders env-prod, whose chart version the change bumps, and env-prod renders svc-a,
+// whose revision and path that bump changes. svc-a's diff also touches root's Application, a
+// cycle. Previewing svc-a's new path renders its Deployment with another replica count, and no
+// Service. It returns the args of each call after the app list.
+func setupAppTree(t *testing.T) *[][]string {
+	const repoURL = "https://github.com/acme/widgets.git"
+	const chartRepo = "https://charts.acme.dev"
+	apps := []Application{
+		{ObjectMeta: metav1.ObjectMeta{Name: "root"}, Spec: ApplicationSpec{Source: &ApplicationSource{RepoURL: repoURL, TargetRevision: "main", Path: "root"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "env-prod"}, Spec: ApplicationSpec{Source: &ApplicationSource{RepoURL: chartRepo, TargetRevision: "1.0.0", Chart: "env"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "svc-a"}, Spec: ApplicationSpec{Source: &ApplicationSource{RepoURL: "https://github.com/acme/svc-a.git", TargetRevision: "v1", Path: "deploy"}}},
+	}
+	appListJSON, err := json.Marshal(apps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appManifest := func(name, source string) string {
+		return fmt.Sprintf("apiVersion: argoproj.io/v1alpha1\nkind: Application\nmetadata:\n  name: %s\n  namespace: argocd\nspec:\n  source:\n%s\n", name, source)
+	}
+	appDiff := func(names ...string) string {
+		var diff string
+		for _, name := range names {
+			diff += fmt.Sprintf("===== argoproj.io/Application argocd/%s ======\n--- a\n+++ b\n@@ -1 +1 @@\n-old\n+new\n\n", name)
+		}
+		return diff
+	}
+
+	var calls [][]string
+	originalExecArgoCdCli := execArgoCdCli
+	t.Cleanup(func() { execArgoCdCli = originalExecArgoCdCli })
+	execArgoCdCli = func(ctx context.Context, args []string) ([]byte, error) {
+		if args[1] == "list" {
+			return appListJSON, nil
+		}
+		calls = append(calls, args[1:])
+		switch {
+		case args[1] == "create" || args[1] == "delete":
+			return nil, nil
+		case args[1] == "manifests" && strings.HasPrefix(args[2], previewAppPrefix):
+			return []byte("apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: svc-a\nspec:\n  replicas: 2\n"), nil
+		case slices.Equal(args[1:], []string{"manifests", "svc-a", "--source", "live"}):
+			return []byte("apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: svc-a\n  namespace: default\n  uid: 1234\nspec:\n  replicas: 1\nstatus:\n  readyReplicas: 1\n---\napiVersion: v1\nkind: Service\nmetadata:\n  name: svc-a\n  namespace: default\nspec:\n  type: ClusterIP\n"), nil
+		}
+		switch args[1] + " " + args[2] {
+		case "diff root":
+			return []byte(appDiff("env-prod")), makeExitError(t, nil)
+		case "manifests root":
+			return []byte(appManifest("env-prod", "    repoURL: "+chartRepo+"\n    chart: env\n    targetRevision: 2.0.0")), nil
+		case "diff env-prod":
+			return []byte(appDiff("svc-a")), makeExitError(t, nil)
+		case "manifests env-prod":
+			return []byte(appManifest("svc-a", "    repoURL: https://github.com/acme/svc-a.git\n    path: deploy/v2\n    targetRevision: v2")), nil
+		case "diff svc-a":
+			return []byte(appDiff("root") + "===== apps/Deployment default/svc-a ======\n--- a\n+++ b\n@@ -1 +1 @@\n-old\n+new\n"), makeExitError(t, nil)
+		}
+		return nil, fmt.Errorf("unexpected argocd args: %v", args)
+	}
+	return &calls
+}
+
+func TestGetApplicationChangesNestedAppTree(t *testing.T) {
+	calls := setupAppTree(t)
+	evtInfo := wh.EventInfo{RepoOwner: "acme", RepoName: "widgets", RepoDefaultRef: "main", ChangeRef: "bump", BaseRef: "main", Sha: "abcdef"}
+	appResList, notDiffed, err := GetApplicationChanges(context.Background(), evtInfo)
+	if err != nil || len(notDiffed) != 0 {
+		t.Fatalf("GetApplicationChanges() = %v, %v", notDiffed, err)
+	}
+	var got []string
+	for _, r := range appResList {
+		got = append(got, r.ArgoApp.Name+"<"+r.Parent)
+	}
+	if want := []string{"root<", "env-prod<root", "svc-a<env-prod"}; !slices.Equal(got, want) {
+		t.Fatalf("apps = %v, want %v", got, want)
+	}
+	// both nested children are single-source, so they're diffed at their new targetRevision
+	for _, want := range []string{"diff env-prod --revision 2.0.0", "diff svc-a --revision v2"} {
+		if !slices.ContainsFunc(*calls, func(c []string) bool { return strings.HasPrefix(strings.Join(c, " "), want) }) {
+			t.Errorf("Expected a call to %q, got %v", want, *calls)
+		}
+	}
+	// svc-a's diff changes root, which is above it, so that's not followed
+	if slices.ContainsFunc(*calls, func(c []string) bool { return c[0] == "manifests" && c[1] == "svc-a" }) {
+		t.Errorf("Expected the cycle back to root not to be followed: %v", *calls)
+	}
+	if notes := appResList[2].Notes; len(notes) != 1 || !strings.Contains(notes[0], "from path deploy to path deploy/v2") {
+		t.Errorf("Expected a note about svc-a's path changing, got %v", notes)
+	}
+}
+
+// With ARGO_DIFF_PREVIEW_NEW_APPS, svc-a's new path is rendered in a temporary Application and
+// diffed against svc-a's live resources, rather than diffing its current path
+func TestGetApplicationChangesNestedMovedSource(t *testing.T) {
+	t.Setenv("ARGO_DIFF_PREVIEW_NEW_APPS", "true")
+	calls := setupAppTree(t)
+	evtInfo := wh.EventInfo{RepoOwner: "acme", RepoName: "widgets", RepoDefaultRef: "main", ChangeRef: "bump", BaseRef: "main", Sha: "abcdef"}
+	appResList, notDiffed, err := GetApplicationChanges(context.Background(), evtInfo)
+	if err != nil || len(notDiffed) != 0 {
+		t.Fatalf("GetApplicationChanges() = %v, %v", notDiffed, err)
+	}
+	if len(appResList) != 3 || appResList[2].ArgoApp.Name != "svc-a" || appResList[2].NewApp {
+		t.Fatalf("Expected root, env-prod and svc-a, got %+v", appResList)
+	}
+	svcA := appResList[2]
+	if slices.ContainsFunc(*calls, func(c []string) bool { return c[0] == "diff" && c[1] == "svc-a" }) {
+		t.Errorf("Expected svc-a's current path not to be diffed: %v", *calls)
+	}
+	if !slices.ContainsFunc(*calls, func(c []string) bool {
+		return c[0] == "manifests" && strings.HasPrefix(c[1], previewAppPrefix) && slices.Equal(c[2:], []string{"--revision", "v2"})
+	}) {
+		t.Errorf("Expected the new path to be rendered at v2, got %v", *calls)
+	}
+	var got []string
+	for _, ar := range svcA.ChangedResources {
+		got = append(got, ar.Kind+" "+ar.Namespace+"/"+ar.Name+" "+ar.Action())
+	}
+	// the rendered Deployment has no namespace, so it's matched to the live one; server-populated
+	// fields aren't changes
+	if want := []string{"Deployment default/svc-a " + ActionModified, "Service default/svc-a " + ActionDeleted}; !slices.Equal(got, want) {
+		t.Errorf("changed resources = %v, want %v", got, want)
+	}
+	if diff := svcA.ChangedResources[0].DiffStr; !strings.Contains(diff, "-  replicas: 1") || !strings.Contains(diff, "+  replicas: 2") || strings.Contains(diff, "uid") || strings.Contains(diff, "readyReplicas") {
+		t.Errorf("Unexpected Deployment diff: %s", diff)
+	}
+	if len(svcA.Notes) != 1 || !strings.Contains(svcA.Notes[0], "from path deploy to path deploy/v2; this diff renders the new one") {
+		t.Errorf("Expected a note about svc-a's path changing, got %v", svcA.Notes)
+	}
+}
+
+func TestGetApplicationChangesNestedAppDepth(t *testing.T) {
+	t.Setenv("ARGO_DIFF_MAX_APP_DEPTH", "1")
+	calls := setupAppTree(t)
+	evtInfo := wh.EventInfo{RepoOwner: "acme", RepoName: "widgets", RepoDefaultRef: "main", ChangeRef: "bump", BaseRef: "main", Sha: "abcdef"}
+	appResList, _, err := GetApplicationChanges(context.Background(), evtInfo)
+	if err != nil {
+		t.Fatalf("GetApplicationChanges() err'd: %v", err)
+	}
+	if len(appResList) != 2 || appResList[1].ArgoApp.Name != "env-prod" {
+		t.Fatalf("Expected only root and env-prod, got %+v", appResList)
+	}
+	if notes := appResList[1].Notes; len(notes) != 1 || !strings.Contains(notes[0], "svc-a") || !strings.Contains(notes[0], "ARGO_DIFF_MAX_APP_DEPTH") {
+		t.Errorf("Expected a note that svc-a is too deep, got %v", notes)
+	}
+	if len(*calls) != 3 {
+		t.Errorf("Expected env-prod's manifests not to be rendered, got calls %v", *calls)
+	}
+}
+
+func TestMaxAppDepth(t *testing.T) {
+	for val, want := range map[string]int{"": defaultMaxAppDepth, "3": 3, "0": defaultMaxAppDepth, "x": defaultMaxAppDepth, "100": hardMaxAppDepth} {
+		t.Setenv("ARGO_DIFF_MAX_APP_DEPTH", val)
+		if got := maxAppDepth(); got != want {
+			t.Errorf("maxAppDepth() with %q = %d, want %d", val, got, want)
+		}
+	}
+}
+
+// A multi-source app whose values are in the pull request's repository renders an Application with
+// an OCI chart source; the change bumps that chart, so the nested app is diffed at the new version
+// for that source position, and at the pull request's sha for its values.
+func TestGetApplicationChangesNestedChartBump(t *testing.T) {
+	const repoURL = "https://github.com/acme/widgets.git"
+	const ociRepo = "oci://ghcr.io/acme/charts"
+	apps := []Application{
+		{ObjectMeta: metav1.ObjectMeta{Name: "platform"}, Spec: ApplicationSpec{Sources: []ApplicationSource{
+			{RepoURL: "https://charts.acme.dev", TargetRevision: "3.0.0", Chart: "platform"},
+			{RepoURL: repoURL, TargetRevision: "main", Ref: "values"},
+		}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "ingress"}, Spec: ApplicationSpec{Sources: []ApplicationSource{
+			{RepoURL: ociRepo, TargetRevision: "1.4.0", Chart: "ingress-nginx"},
+			{RepoURL: repoURL, TargetRevision: "main", Ref: "values"},
+		}}},
+	}
+	appListJSON, err := json.Marshal(apps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls []string
+	originalExecArgoCdCli := execArgoCdCli
+	t.Cleanup(func() { execArgoCdCli = originalExecArgoCdCli })
+	execArgoCdCli = func(ctx context.Context, args []string) ([]byte, error) {
+		if args[0] == "appset" {
+			return nil, fmt.Errorf("permission denied")
+		}
+		if args[1] == "list" {
+			return appListJSON, nil
+		}
+		calls = append(calls, strings.Join(args[1:], " "))
+		switch args[1] + " " + args[2] {
+		case "diff platform":
+			return []byte("===== argoproj.io/Application argocd/ingress ======\n--- a\n+++ b\n@@ -1 +1 @@\n-old\n+new\n"), makeExitError(t, nil)
+		case "manifests platform":
+			return []byte("apiVersion: argoproj.io/v1alpha1\nkind: Application\nmetadata:\n  name: ingress\n  namespace: argocd\nspec:\n  sources:\n  - repoURL: " + ociRepo + "\n    chart: ingress-nginx\n    targetRevision: 1.5.0\n  - repoURL: " + repoURL + "\n    targetRevision: main\n    ref: values\n"), nil
+		case "diff ingress":
+			return []byte("===== apps/Deployment ingress/ingress-nginx-controller ======\n--- a\n+++ b\n@@ -1 +1 @@\n-old\n+new\n"), makeExitError(t, nil)
+		}
+		return nil, fmt.Errorf("unexpected argocd args: %v", args)
+	}
+	evtInfo := wh.EventInfo{RepoOwner: "acme", RepoName: "widgets", RepoDefaultRef: "main", ChangeRef: "bump", BaseRef: "main", Sha: "abcdef"}
+	var matchLog MatchLog
+	appResList, notDiffed, err := GetApplicationChanges(NewMatchContext(context.Background(), &matchLog), evtInfo)
+	if err != nil || len(notDiffed) != 0 {
+		t.Fatalf("GetApplicationChanges() = %v, %v", notDiffed, err)
+	}
+	var got []string
+	for _, r := range appResList {
+		got = append(got, r.ArgoApp.Name+"<"+r.Parent)
+	}
+	if want := []string{"platform<", "ingress<platform"}; !slices.Equal(got, want) {
+		t.Fatalf("apps = %v, want %v", got, want)
+	}
+	if want := "diff ingress --revisions 1.5.0 --revisions abcdef --source-positions 1 --source-positions 2"; !slices.ContainsFunc(calls, func(c string) bool { return strings.HasPrefix(c, want) }) {
+		t.Errorf("Expected a call to %q, got %v", want, calls)
+	}
+	if reason := matchLog.Reason("ingress"); !strings.Contains(reason, "chart ingress-nginx 1.4.0 -> 1.5.0") {
+		t.Errorf("Expected the match reason to name the chart bump, got %q", reason)
+	}
+}
+
+// A wave-3 app that's also another wave-3 app's nested app is reported once, under its parent,
+// with its own nested apps after it; and a nested app that wave 1 diffed isn't diffed again.
+func TestGetApplicationChangesWave3NestedOrder(t *testing.T) {
+	const repoURL = "https://github.com/acme/widgets.git"
+	multiSource := func(name, chart string) Application {
+		return Application{ObjectMeta: metav1.ObjectMeta{Name: name}, Spec: ApplicationSpec{Sources: []ApplicationSource{
+			{RepoURL: "https://charts.acme.dev", TargetRevision: "1.0.0", Chart: chart},
+			{RepoURL: repoURL, TargetRevision: "main", Ref: "values"},
+		}}}
+	}
+	apps := []Application{
+		multiSource("ingress", "ingress-nginx"),
+		multiSource("platform", "platform"),
+		{ObjectMeta: metav1.ObjectMeta{Name: "web"}, Spec: ApplicationSpec{Source: &ApplicationSource{RepoURL: repoURL, TargetRevision: "main", Path: "web"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "extras"}, Spec: ApplicationSpec{Source: &ApplicationSource{RepoURL: "https://github.com/acme/extras.git", TargetRevision: "v1", Path: "deploy"}}},
+	}
+	appListJSON, err := json.Marshal(apps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appDiff := func(names ...string) []byte {
+		var diff string
+		for _, name := range names {
+			diff += fmt.Sprintf("===== argoproj.io/Application argocd/%s ======\n--- a\n+++ b\n@@ -1 +1 @@\n-old\n+new\n\n", name)
+		}
+		return []byte(diff)
+	}
+	appManifest := func(name, sources string) string {
+		return fmt.Sprintf("apiVersion: argoproj.io/v1alpha1\nkind: Application\nmetadata:\n  name: %s\n  namespace: argocd\nspec:\n%s\n---\n", name, sources)
+	}
+	var calls []string
+	originalExecArgoCdCli := execArgoCdCli
+	t.Cleanup(func() { execArgoCdCli = originalExecArgoCdCli })
+	execArgoCdCli = func(ctx context.Context, args []string) ([]byte, error) {
+		if args[0] == "appset" {
+			return nil, fmt.Errorf("permission denied")
+		}
+		if args[1] == "list" {
+			return appListJSON, nil
+		}
+		calls = append(calls, strings.Join(args[1:3], " "))
+		switch args[1] + " " + args[2] {
+		case "diff web":
+			return nil, nil
+		case "diff platform":
+			return appDiff("ingress", "web"), makeExitError(t, nil)
+		case "manifests platform":
+			return []byte(appManifest("ingress", "  sources:\n  - repoURL: https://charts.acme.dev\n    chart: ingress-nginx\n    targetRevision: 1.5.0\n  - repoURL: "+repoURL+"\n    targetRevision: main\n    ref: values") +
+				appManifest("web", "  source:\n    repoURL: "+repoURL+"\n    targetRevision: main\n    path: web/v2")), nil
+		case "diff ingress":
+			return appDiff("extras"), makeExitError(t, nil)
+		case "manifests ingress":
+			return []byte(appManifest("extras", "  source:\n    repoURL: https://github.com/acme/extras.git\n    targetRevision: v2\n    path: deploy")), nil
+		case "diff extras":
+			return []byte("===== apps/Deployment default/extras ======\n--- a\n+++ b\n@@ -1 +1 @@\n-old\n+new\n"), makeExitError(t, nil)
+		}
+		return nil, fmt.Errorf("unexpected argocd args: %v", args)
+	}
+	evtInfo := wh.EventInfo{RepoOwner: "acme", RepoName: "widgets", RepoDefaultRef: "main", ChangeRef: "bump", BaseRef: "main", Sha: "abcdef"}
+	appResList, notDiffed, err := GetApplicationChanges(context.Background(), evtInfo)
+	if err != nil || len(notDiffed) != 0 {
+		t.Fatalf("GetApplicationChanges() = %v, %v", notDiffed, err)
+	}
+	var got []string
+	for _, r := range appResList {
+		got = append(got, r.ArgoApp.Name+"<"+r.Parent)
+	}
+	if want := []string{"platform<", "ingress<platform", "extras<ingress"}; !slices.Equal(got, want) {
+		t.Fatalf("apps = %v, want %v", got, want)
+	}
+	for name, want := range map[string]int{"diff web": 1, "diff extras": 1} {
+		if n := len(slices.DeleteFunc(slices.Clone(calls), func(c string) bool { return c != name })); n != want {
+			t.Errorf("Expected %d %q call(s), got %d: %v", want, name, n, calls)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package argocd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// Temporary Applications that previewNewApplication creates are named previewAppPrefix and a
+// random suffix, and annotated with previewOfAnnotation: the name of the Application they preview
+const previewAppPrefix = "argo-diff-preview-"
+const previewOfAnnotation = "argo-diff.vince-riv.io/preview-of"
+
+// how long deleting a temporary Application may take, even once the run's ctx has expired
+const previewCleanupTimeout = 30 * time.Second
+
+// previewNewApps returns true when ARGO_DIFF_PREVIEW_NEW_APPS is set, allowing argo-diff to create
+// temporary Applications in ArgoCD to render the manifests of ones that don't exist yet
+func previewNewApps() bool {
+	return strings.ToLower(os.Getenv("ARGO_DIFF_PREVIEW_NEW_APPS")) == "true"
+}
+
+// previewAppName returns a name for a temporary Application that won't collide with another run's
+func previewAppName() (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return previewAppPrefix + hex.EncodeToString(suffix), nil
+}
+
+// previewManifest is the manifest of the temporary Application that renders appNew: its spec with
+// no sync policy, so ArgoCD never deploys it, in ArgoCD's own namespace and without finalizers, so
+// deleting it can't touch anything in the cluster
+func previewManifest(appNew *Application, name string) (map[string]any, error) {
+	var manifest map[string]any
+	if appNew.manifest != nil {
+		manifest = runtime.DeepCopyJSON(appNew.manifest)
+	} else {
+		obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(appNew)
+		if err != nil {
+			return nil, err
+		}
+		manifest = obj
+	}
+	manifest["apiVersion"] = argoApplicationApiGroup + "/v1alpha1"
+	manifest["kind"] = argoApplicationApiKind
+	manifest["metadata"] = map[string]any{
+		"name":        name,
+		"annotations": map[string]any{previewOfAnnotation: appNew.ObjectMeta.Name},
+	}
+	delete(manifest, "status")
+	spec, ok := manifest["spec"].(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s has no spec", appNew.ObjectMeta.Name)
+	}
+	delete(spec, "syncPolicy")
+	return manifest, nil
+}
+
+// SweepPreviewApps deletes the temporary Applications renderPreview creates that are older than
+// staleAfter. Each run deletes its own, but one that's killed first (eg: its pod restarts) leaves
+// them behind, so this runs at startup. Only with ARGO_DIFF_PREVIEW_NEW_APPS set, as that's what
+// the token is granted delete permission for; failures are just logged.
+func SweepPreviewApps(ctx context.Context, staleAfter time.Duration) {
+	if !previewNewApps() {
+		return
+	}
+	apps, err := listApplications(ctx)
+	if err != nil {
+		log.Warn().Err(err).Msg("Unable to list ArgoCD Apps to sweep stale temporary ones")
+		return
+	}
+	for _, app := range stalePreviewApps(apps.Items, time.Now().Add(-staleAfter)) {
+		log.Info().Msgf("Deleting stale temporary ArgoCD App '%s' (a preview of %s, created %s)", app.Name, app.Annotations[previewOfAnnotation], app.CreationTimestamp)
+		if err := deleteApplication(ctx, app.Name); err != nil {
+			log.Error().Err(err).Msgf("Unable to delete stale temporary ArgoCD App '%s'; delete it by hand", app.Name)
+		}
+	}
+}
+
+// stalePreviewApps returns the temporary Applications created before cutoff: named with
+// previewAppPrefix and annotated with previewOfAnnotation, so no other Application is touched
+func stalePreviewApps(apps []Application, cutoff time.Time) []Application {
+	var stale []Application
+	for _, app := range apps {
+		if !strings.HasPrefix(app.Name, previewAppPrefix) || app.Annotations[previewOfAnnotation] == "" {
+			continue
+		}
+		if app.CreationTimestamp.IsZero() || !app.CreationTimestamp.Time.Before(cutoff) {
+			continue
+		}
+		stale = append(stale, app)
+	}
+	return stale
+}
+
+// previewNewApplication renders a nested Application that doesn't exist in ArgoCD yet at head, so
+// reviewers see what it will deploy: all of its manifests, as additions (see renderPreview).
+func previewNewApplication(ctx context.Context, appNew *Application, head appRevisions) (ApplicationResourcesWithChanges, error) {
+	preview := *appNew
+	preview.Status = ApplicationStatus{Sync: SyncStatus{Status: syncOutOfSync}, Health: HealthStatus{Status: "Missing"}}
+	res := ApplicationResourcesWithChanges{ArgoApp: &preview, NewApp: true}
+	manifests, err := renderPreview(ctx, appNew, head)
+	if err != nil {
+		return res, err
+	}
+	appResList, err := manifestsDiff(nil, manifests)
+	if err != nil {
+		return res, err
+	}
+	log.Debug().Msgf("New Application %s renders %d resource(s) at %s", appNew.ObjectMeta.Name, len(appResList), head)
+	res.ChangedResources = redactResources(appResList)
+	return res, nil
+}
+
+// previewMovedApplication diffs a nested Application whose source the change moves to another path
+// or chart. ArgoCD renders an existing Application from the spec it has, so the new source is
+// rendered the way a new Application's is (see renderPreview) and diffed against the live objects
+// of the current Application's resources.
+func previewMovedApplication(ctx context.Context, appCur *Application, appNew *Application, head appRevisions) (ApplicationResourcesWithChanges, error) {
+	appName := appCur.ObjectMeta.Name
+	res := ApplicationResourcesWithChanges{ArgoApp: appCur}
+	live, err := liveManifests(ctx, appName)
+	if err != nil {
+		return res, fmt.Errorf("fetching the live resources of %s: %w", appName, err)
+	}
+	manifests, err := renderPreview(ctx, appNew, head)
+	if err != nil {
+		return res, err
+	}
+	appResList, err := liveManifestsDiff(live, manifests)
+	if err != nil {
+		return res, err
+	}
+	log.Debug().Msgf("Moved source of Application %s renders %d changed resource(s) at %s", appName, len(appResList), head)
+	res.ChangedResources = redactResources(appResList)
+	return res, nil
+}
+
+// renderPreview renders appNew's manifests at head. ArgoCD can only render an Application it knows
+// about, so this creates a temporary copy that never syncs, renders that, and deletes it again
+// (without cascading, and even when ctx has expired).
+func renderPreview(ctx context.Context, appNew *Application, head appRevisions) ([]K8sManifest, error) {
+	appName := appNew.ObjectMeta.Name
+	tmpName, err := previewAppName()
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := previewManifest(appNew, tmpName)
+	if err != nil {
+		return nil, err
+	}
+	log.Info().Msgf("Creating temporary ArgoCD App '%s' to preview Application %s", tmpName, appName)
+	if err := createApplication(ctx, manifest); err != nil {
+		return nil, fmt.Errorf("creating temporary application %s: %w", tmpName, err)
+	}
+	defer func() {
+		cleanupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), previewCleanupTimeout)
+		defer cancel()
+		if err := deleteApplication(cleanupCtx, tmpName); err != nil {
+			log.Error().Err(err).Msgf("Unable to delete temporary ArgoCD App '%s' (a preview of %s); delete it by hand", tmpName, appName)
+		}
+	}()
+	manifests, err := getApplicationManifests(ctx, tmpName, head.revision, head.revisions, head.srcPos)
+	if err != nil {
+		return nil, fmt.Errorf("rendering manifests at %s: %w", head, err)
+	}
+	return manifests, nil
+}
+
+// liveManifestsDiff diffs rendered manifests against the live objects of an application's resources
+// the way the api backend's diff does (see resourceDiff): resources are matched on
+// group/kind/namespace/name, with a manifest that has no namespace falling back to the only live
+// resource with its group/kind/name, and live resources that aren't rendered any more are deleted.
+func liveManifestsDiff(live, head []K8sManifest) ([]AppResource, error) {
+	var appResList []AppResource
+	liveObjs := make(map[string]map[string]any)
+	var liveOrder []managedResource
+	for _, m := range live {
+		u := m.Unstruct
+		gvk := u.GroupVersionKind()
+		liveObjs[resourceKey(gvk.Group, gvk.Kind, u.GetNamespace(), u.GetName())] = u.Object
+		liveOrder = append(liveOrder, managedResource{Group: gvk.Group, Kind: gvk.Kind, Namespace: u.GetNamespace(), Name: u.GetName()})
+	}
+	seen := make(map[string]bool)
+	for _, m := range head {
+		u := m.Unstruct
+		gvk := u.GroupVersionKind()
+		ns := u.GetNamespace()
+		key := resourceKey(gvk.Group, gvk.Kind, ns, u.GetName())
+		if _, ok := liveObjs[key]; !ok && ns == "" {
+			if found, ok := findByName(liveOrder, gvk.Group, gvk.Kind, u.GetName()); ok {
+				key = found
+				ns = strings.Split(key, "/")[2]
+			}
+		}
+		seen[key] = true
+		appRes, changed, err := resourceDiff(gvk.Group, gvk.Kind, ns, u.GetName(), liveObjs[key], u.Object)
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			appRes.ApiVersion = u.GetAPIVersion()
+			appResList = append(appResList, appRes)
+		}
+	}
+	for _, m := range live {
+		u := m.Unstruct
+		gvk := u.GroupVersionKind()
+		key := resourceKey(gvk.Group, gvk.Kind, u.GetNamespace(), u.GetName())
+		if seen[key] {
+			continue
+		}
+		appRes, changed, err := resourceDiff(gvk.Group, gvk.Kind, u.GetNamespace(), u.GetName(), u.Object, nil)
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			appRes.ApiVersion = u.GetAPIVersion()
+			appResList = append(appResList, appRes)
+		}
+	}
+	return appResList, nil
+}
@@ -0,0 +1,185 @@
+package argocd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+
+	wh "github.com/vince-riv/argo-diff/internal/webhook"
+)
+
+// setupNewApp mocks the cli for an app-of-apps, root, whose change adds svc-new: an Application
+// that auto-syncs and doesn't exist in ArgoCD yet. It returns the args of each call after the app
+// list, and the manifest of each Application created.
+func setupNewApp(t *testing.T) (*[][]string, *[]map[string]any) {
+	apps := []Application{
+		{ObjectMeta: metav1.ObjectMeta{Name: "root"}, Spec: ApplicationSpec{Source: &ApplicationSource{RepoURL: "https://github.com/acme/widgets.git", TargetRevision: "main", Path: "root"}}},
+	}
+	appListJSON, err := json.Marshal(apps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls [][]string
+	var created []map[string]any
+	originalExecArgoCdCli := execArgoCdCli
+	t.Cleanup(func() { execArgoCdCli = originalExecArgoCdCli })
+	execArgoCdCli = func(ctx context.Context, args []string) ([]byte, error) {
+		if args[1] == "list" {
+			return appListJSON, nil
+		}
+		calls = append(calls, args[1:])
+		switch {
+		case args[1] == "diff" && args[2] == "root":
+			return []byte("===== argoproj.io/Application argocd/svc-new ======\n--- a\n+++ b\n@@ -0,0 +1 @@\n+new\n"), makeExitError(t, nil)
+		case args[1] == "manifests" && args[2] == "root":
+			return []byte("apiVersion: argoproj.io/v1alpha1\nkind: Application\nmetadata:\n  name: svc-new\n  namespace: argocd\n  finalizers:\n  - resources-finalizer.argocd.argoproj.io\nspec:\n  project: default\n  source:\n    repoURL: https://github.com/acme/widgets.git\n    path: svc-new\n    targetRevision: main\n    helm:\n      valueFiles:\n      - values-prod.yaml\n  syncPolicy:\n    automated:\n      prune: true\n"), nil
+		case args[1] == "create":
+			manifestYaml, err := os.ReadFile(args[3])
+			if err != nil {
+				t.Fatal(err)
+			}
+			var manifest map[string]any
+			if err := yaml.Unmarshal(manifestYaml, &manifest); err != nil {
+				t.Fatal(err)
+			}
+			created = append(created, manifest)
+			return nil, nil
+		case args[1] == "manifests" && strings.HasPrefix(args[2], previewAppPrefix):
+			return []byte("apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: svc-new\n  namespace: default\nspec:\n  replicas: 2\n"), nil
+		case args[1] == "delete":
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unexpected argocd args: %v", args)
+	}
+	return &calls, &created
+}
+
+func TestGetApplicationChangesNewApp(t *testing.T) {
+	calls, created := setupNewApp(t)
+	evtInfo := wh.EventInfo{RepoOwner: "acme", RepoName: "widgets", RepoDefaultRef: "main", ChangeRef: "add-svc", BaseRef: "main", Sha: "abcdef"}
+
+	// without ARGO_DIFF_PREVIEW_NEW_APPS, the parent notes that the new Application wasn't previewed
+	appResList, _, err := GetApplicationChanges(context.Background(), evtInfo)
+	if err != nil {
+		t.Fatalf("GetApplicationChanges() err'd: %v", err)
+	}
+	if len(appResList) != 1 || len(appResList[0].Notes) != 1 || !strings.Contains(appResList[0].Notes[0], "svc-new") {
+		t.Fatalf("Expected only root, noting svc-new, got %+v", appResList)
+	}
+	if len(*created) != 0 {
+		t.Fatalf("Expected no Application to be created, got %v", *created)
+	}
+
+	t.Setenv("ARGO_DIFF_PREVIEW_NEW_APPS", "true")
+	*calls = nil
+	appResList, _, err = GetApplicationChanges(context.Background(), evtInfo)
+	if err != nil {
+		t.Fatalf("GetApplicationChanges() err'd: %v", err)
+	}
+	if len(appResList) != 2 {
+		t.Fatalf("Expected root and svc-new, got %+v", appResList)
+	}
+	preview := appResList[1]
+	if !preview.NewApp || preview.Parent != "root" || preview.ArgoApp.Name != "svc-new" || preview.WarnStr != "" {
+		t.Errorf("Unexpected preview of svc-new: %+v", preview)
+	}
+	if len(preview.ChangedResources) != 1 || preview.ChangedResources[0].Action() != ActionAdded {
+		t.Errorf("Expected svc-new's Deployment as an addition, got %+v", preview.ChangedResources)
+	}
+
+	// the temporary Application keeps the new one's source, but can't sync or cascade
+	if len(*created) != 1 {
+		t.Fatalf("Expected one Application to be created, got %v", *created)
+	}
+	tmp := (*created)[0]
+	tmpName := tmp["metadata"].(map[string]any)["name"].(string)
+	if !strings.HasPrefix(tmpName, previewAppPrefix) {
+		t.Errorf("Unexpected temporary Application name %s", tmpName)
+	}
+	spec := tmp["spec"].(map[string]any)
+	if _, ok := spec["syncPolicy"]; ok {
+		t.Errorf("Expected the temporary Application to have no sync policy: %v", spec)
+	}
+	if _, ok := tmp["metadata"].(map[string]any)["finalizers"]; ok {
+		t.Errorf("Expected the temporary Application to have no finalizers: %v", tmp["metadata"])
+	}
+	if _, ok := spec["source"].(map[string]any)["helm"]; !ok {
+		t.Errorf("Expected the temporary Application to keep the source's helm settings: %v", spec)
+	}
+	for _, want := range []string{"manifests " + tmpName + " --revision abcdef", "delete " + tmpName + " --cascade=false --yes"} {
+		if !slices.ContainsFunc(*calls, func(c []string) bool { return strings.Join(c, " ") == want }) {
+			t.Errorf("Expected a call to %q, got %v", want, *calls)
+		}
+	}
+}
+
+func TestPreviewNewApplicationCleanup(t *testing.T) {
+	calls, _ := setupNewApp(t)
+	originalExecArgoCdCli := execArgoCdCli
+	execArgoCdCli = func(ctx context.Context, args []string) ([]byte, error) {
+		if args[1] == "manifests" {
+			*calls = append(*calls, args[1:])
+			return nil, fmt.Errorf("helm template failed")
+		}
+		return originalExecArgoCdCli(ctx, args)
+	}
+	appNew := &Application{ObjectMeta: metav1.ObjectMeta{Name: "svc-new"}, Spec: ApplicationSpec{Source: &ApplicationSource{Path: "svc-new"}}}
+	if _, err := previewNewApplication(context.Background(), appNew, appRevisions{revision: "abcdef"}); err == nil {
+		t.Fatal("Expected previewNewApplication() to fail")
+	}
+	// the temporary Application is deleted even though rendering it failed
+	if last := (*calls)[len(*calls)-1]; last[0] != "delete" {
+		t.Errorf("Expected the temporary Application to be deleted, got calls %v", *calls)
+	}
+}
+
+func TestSweepPreviewApps(t *testing.T) {
+	old := metav1.NewTime(time.Now().Add(-2 * time.Hour))
+	recent := metav1.NewTime(time.Now().Add(-time.Minute))
+	previewOf := map[string]string{previewOfAnnotation: "svc-new"}
+	apps := []Application{
+		{ObjectMeta: metav1.ObjectMeta{Name: previewAppPrefix + "0a1b2c3d", Annotations: previewOf, CreationTimestamp: old}},
+		// still in use by a run that hasn't finished
+		{ObjectMeta: metav1.ObjectMeta{Name: previewAppPrefix + "4e5f6a7b", Annotations: previewOf, CreationTimestamp: recent}},
+		// not one of ours: no annotation, or not named like one
+		{ObjectMeta: metav1.ObjectMeta{Name: previewAppPrefix + "mine", CreationTimestamp: old}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "svc-new", Annotations: previewOf, CreationTimestamp: old}},
+	}
+	appListJSON, err := json.Marshal(apps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var deleted []string
+	originalExecArgoCdCli := execArgoCdCli
+	t.Cleanup(func() { execArgoCdCli = originalExecArgoCdCli })
+	execArgoCdCli = func(ctx context.Context, args []string) ([]byte, error) {
+		switch args[1] {
+		case "list":
+			return appListJSON, nil
+		case "delete":
+			deleted = append(deleted, args[2])
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unexpected argocd args: %v", args)
+	}
+
+	// without ARGO_DIFF_PREVIEW_NEW_APPS, there's nothing of ours to sweep
+	SweepPreviewApps(context.Background(), time.Hour)
+	if len(deleted) != 0 {
+		t.Fatalf("Expected nothing to be deleted, got %v", deleted)
+	}
+
+	t.Setenv("ARGO_DIFF_PREVIEW_NEW_APPS", "true")
+	SweepPreviewApps(context.Background(), time.Hour)
+	if want := []string{previewAppPrefix + "0a1b2c3d"}; !slices.Equal(deleted, want) {
+		t.Errorf("deleted = %v, want %v", deleted, want)
+	}
+}
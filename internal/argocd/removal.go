@@ -0,0 +1,47 @@
+package argocd
+
+import (
+	"slices"
+
+	"github.com/rs/zerolog/log"
+)
+
+// resourcesFinalizer is the finalizer on an Application that has ArgoCD delete its resources when
+// the Application is deleted; the /background and /foreground forms pick how the deletion propagates
+const resourcesFinalizer = "resources-finalizer.argocd.argoproj.io"
+const resourcesFinalizerBackground = "resources-finalizer.argocd.argoproj.io/background"
+const resourcesFinalizerForeground = "resources-finalizer.argocd.argoproj.io/foreground"
+
+// removedApps returns the nested Applications parent's diff deletes, as results listing the live
+// resources each manages and what becomes of them. prune says when parent deletes each one (for an
+// application, its PruneOutcome()); preserve is set when deleting them never deletes their
+// resources, whatever their finalizers. Applications ArgoCD doesn't know about have nothing to
+// remove and are left out.
+func removedApps(parent string, changes []AppResource, appLookup map[string]Application, prune func(AppResource) string, preserve bool) []ApplicationResourcesWithChanges {
+	var removed []ApplicationResourcesWithChanges
+	for _, r := range changes {
+		if r.Group != argoApplicationApiGroup || r.Kind != argoApplicationApiKind || r.Action() != ActionDeleted {
+			continue
+		}
+		app, ok := appLookup[r.Name]
+		if !ok {
+			log.Debug().Msgf("Deleted Application %s not found in current ArgoCD app list", r.Name)
+			continue
+		}
+		removal := &AppRemoval{
+			Prune:     prune(r),
+			Cascade:   !preserve && hasResourcesFinalizer(app),
+			Resources: app.Status.Resources,
+		}
+		log.Info().Msgf("Nested Application %s is deleted by the diff of %s (prune %s, cascade %t, %d resource(s))", r.Name, parent, removal.Prune, removal.Cascade, len(removal.Resources))
+		removed = append(removed, ApplicationResourcesWithChanges{ArgoApp: &app, Parent: parent, Removal: removal})
+	}
+	return removed
+}
+
+// hasResourcesFinalizer returns true when deleting app deletes the resources it manages
+func hasResourcesFinalizer(app Application) bool {
+	return slices.ContainsFunc(app.ObjectMeta.Finalizers, func(f string) bool {
+		return f == resourcesFinalizer || f == resourcesFinalizerBackground || f == resourcesFinalizerForeground
+	})
+}
@@ -0,0 +1,93 @@
+package argocd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	wh "github.com/vince-riv/argo-diff/internal/webhook"
+)
+
+func TestGetApplicationChangesRemovedApp(t *testing.T) {
+	root := Application{ObjectMeta: metav1.ObjectMeta{Name: "root"}, Spec: ApplicationSpec{Source: &ApplicationSource{RepoURL: "https://github.com/acme/widgets.git", TargetRevision: "main", Path: "root"}}}
+	root.Spec.SyncPolicy = &SyncPolicy{Automated: &SyncPolicyAutomated{Prune: true}}
+	svcOld := Application{ObjectMeta: metav1.ObjectMeta{Name: "svc-old", Finalizers: []string{resourcesFinalizer}}, Spec: ApplicationSpec{Source: &ApplicationSource{RepoURL: "https://github.com/acme/svc-old.git", Path: "deploy"}}}
+	svcOld.Status.Resources = []ResourceStatus{{Group: "apps", Kind: "Deployment", Namespace: "default", Name: "svc-old"}, {Kind: "Service", Namespace: "default", Name: "svc-old"}}
+	appListJSON, err := json.Marshal([]Application{root, svcOld})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls [][]string
+	originalExecArgoCdCli := execArgoCdCli
+	t.Cleanup(func() { execArgoCdCli = originalExecArgoCdCli })
+	execArgoCdCli = func(ctx context.Context, args []string) ([]byte, error) {
+		if args[1] == "list" {
+			return appListJSON, nil
+		}
+		calls = append(calls, args[1:])
+		if args[1] == "diff" && args[2] == "root" {
+			return []byte("===== argoproj.io/Application argocd/svc-old ======\n--- a\n+++ b\n@@ -1,2 +0,0 @@\n-metadata:\n-  name: svc-old\n"), makeExitError(t, nil)
+		}
+		return nil, fmt.Errorf("unexpected argocd args: %v", args)
+	}
+
+	evtInfo := wh.EventInfo{RepoOwner: "acme", RepoName: "widgets", RepoDefaultRef: "main", ChangeRef: "drop-svc", BaseRef: "main", Sha: "abcdef"}
+	appResList, notDiffed, err := GetApplicationChanges(context.Background(), evtInfo)
+	if err != nil || len(notDiffed) != 0 {
+		t.Fatalf("GetApplicationChanges() = %v, %v", notDiffed, err)
+	}
+	if len(appResList) != 2 {
+		t.Fatalf("Expected root and svc-old, got %+v", appResList)
+	}
+	removed := appResList[1]
+	if removed.ArgoApp.Name != "svc-old" || removed.Parent != "root" || removed.Removal == nil {
+		t.Fatalf("Expected svc-old's removal, got %+v", removed)
+	}
+	if r := removed.Removal; r.Prune != PruneAutomatic || !r.Cascade || len(r.Resources) != 2 {
+		t.Errorf("Unexpected removal %+v", r)
+	}
+	// the only nested Application change is a deletion, so root's manifests aren't rendered
+	if len(calls) != 1 {
+		t.Errorf("Expected only root's diff, got calls %v", calls)
+	}
+}
+
+func TestRemovedApps(t *testing.T) {
+	parent := &ApplicationResourcesWithChanges{ArgoApp: &Application{ObjectMeta: metav1.ObjectMeta{Name: "root"}}}
+	appLookup := map[string]Application{
+		"orphaned": {ObjectMeta: metav1.ObjectMeta{Name: "orphaned"}},
+		"kept":     {ObjectMeta: metav1.ObjectMeta{Name: "kept", Finalizers: []string{resourcesFinalizerBackground}}},
+	}
+	deleted := func(name, diff string) AppResource {
+		return AppResource{Group: argoApplicationApiGroup, Kind: argoApplicationApiKind, Name: name, DiffStr: "@@ -1,3 +0,0 @@\n" + diff}
+	}
+	removed := removedApps("root", []AppResource{
+		deleted("orphaned", "-metadata:\n"),
+		deleted("kept", "-  annotations:\n-    argocd.argoproj.io/sync-options: Prune=false\n"),
+		deleted("unknown", "-metadata:\n"),
+		{Group: argoApplicationApiGroup, Kind: argoApplicationApiKind, Name: "kept", DiffStr: "@@ -1 +1 @@\n-a\n+b\n"},
+	}, appLookup, parent.PruneOutcome, false)
+	if len(removed) != 2 {
+		t.Fatalf("Expected the two known, deleted Applications, got %+v", removed)
+	}
+	if r := removed[0].Removal; r.Prune != PruneManual || r.Cascade {
+		t.Errorf("Expected orphaned to be pruned manually, without cascading: %+v", r)
+	}
+	if r := removed[1].Removal; r.Prune != PruneDisabled || !r.Cascade {
+		t.Errorf("Expected kept to have pruning disabled, with cascading: %+v", r)
+	}
+}
+
+func TestResourceStatusString(t *testing.T) {
+	for r, want := range map[ResourceStatus]string{
+		{Group: "apps", Kind: "Deployment", Namespace: "default", Name: "api"}: "apps/Deployment default/api",
+		{Kind: "Namespace", Name: "api"}:                                       "Namespace api",
+	} {
+		if got := r.String(); got != want {
+			t.Errorf("%+v.String() = %q, want %q", r, got, want)
+		}
+	}
+}
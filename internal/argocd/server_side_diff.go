@@ -0,0 +1,285 @@
+package argocd
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/protobuf/encoding/protowire"
+	"sigs.k8s.io/yaml"
+
+	"github.com/vince-riv/argo-diff/internal/gendiff"
+)
+
+// The grpc-gateway only maps ServerSideDiff to a GET, which would carry every live and target
+// object in the query string (and so in access logs), so it's called over gRPC-web instead, the
+// transport `argocd --grpc-web` uses. The messages are small enough to encode by hand.
+const serverSideDiffMethod = "/application.ApplicationService/ServerSideDiff"
+
+// field numbers from ArgoCD's application.proto and ResourceDiff in generated.proto
+const (
+	ssdQueryAppName         protowire.Number = 1
+	ssdQueryLiveResources   protowire.Number = 4
+	ssdQueryTargetManifests protowire.Number = 5
+
+	ssdResponseItems protowire.Number = 1
+
+	resourceDiffGroup              protowire.Number = 1
+	resourceDiffKind               protowire.Number = 2
+	resourceDiffNamespace          protowire.Number = 3
+	resourceDiffName               protowire.Number = 4
+	resourceDiffLiveState          protowire.Number = 6
+	resourceDiffPredictedLiveState protowire.Number = 10
+	resourceDiffModified           protowire.Number = 12
+)
+
+// serverSideDiffResource is a resource that exists both live and in the rendered manifests
+type serverSideDiffResource struct {
+	group, kind, namespace, name string
+	apiVersion                   string
+	live                         managedResource
+	target                       map[string]any
+}
+
+// isSecret reports whether group/kind is a core Secret, which is never sent to ArgoCD for a
+// server-side diff
+func isSecret(group, kind string) bool {
+	return group == "" && kind == "Secret"
+}
+
+// serverSideDiff diffs resources the way `argocd app diff --server-side-diff` does, in one call for
+// the application: ArgoCD dry-run applies each target manifest to its live object and returns the
+// object that would result. Both sides are stripped of server-managed fields before comparing,
+// since the predicted state has them too. Only changed resources are returned, in the order given.
+func (b *apiBackend) serverSideDiff(ctx context.Context, appName string, resources []serverSideDiffResource) ([]AppResource, error) {
+	query := protowire.AppendTag(nil, ssdQueryAppName, protowire.BytesType)
+	query = protowire.AppendString(query, appName)
+	for _, r := range resources {
+		liveState := r.live.LiveState
+		if liveState == "" {
+			liveState = r.live.NormalizedLiveState
+		}
+		var rd []byte
+		for _, f := range []struct {
+			num protowire.Number
+			val string
+		}{
+			{resourceDiffGroup, r.live.Group},
+			{resourceDiffKind, r.live.Kind},
+			{resourceDiffNamespace, r.live.Namespace},
+			{resourceDiffName, r.live.Name},
+			{resourceDiffLiveState, liveState},
+		} {
+			rd = protowire.AppendTag(rd, f.num, protowire.BytesType)
+			rd = protowire.AppendString(rd, f.val)
+		}
+		query = protowire.AppendTag(query, ssdQueryLiveResources, protowire.BytesType)
+		query = protowire.AppendBytes(query, rd)
+	}
+	for _, r := range resources {
+		target, err := json.Marshal(r.target)
+		if err != nil {
+			return nil, err
+		}
+		query = protowire.AppendTag(query, ssdQueryTargetManifests, protowire.BytesType)
+		query = protowire.AppendBytes(query, target)
+	}
+	resp, err := b.grpcWeb(ctx, serverSideDiffMethod, query)
+	if err != nil {
+		return nil, err
+	}
+	items, err := decodeServerSideDiffResponse(resp)
+	if err != nil {
+		return nil, fmt.Errorf("decoding server-side diff response: %w", err)
+	}
+	// ArgoCD diffs live and target states pairwise, so items line up with resources
+	if len(items) != len(resources) {
+		return nil, fmt.Errorf("server-side diff returned %d items for %d resources", len(items), len(resources))
+	}
+	var appResList []AppResource
+	for i, item := range items {
+		r := resources[i]
+		if !item.Modified {
+			continue
+		}
+		appRes := AppResource{ApiVersion: r.apiVersion, Group: r.group, Kind: r.kind, Namespace: r.namespace, Name: r.name, Target: resourceObject(r.target)}
+		liveObj, err := decodeState(item.LiveState)
+		if err != nil {
+			return nil, fmt.Errorf("decoding live state of %s/%s %s/%s: %w", r.group, r.kind, r.namespace, r.name, err)
+		}
+		predicted, err := decodeState(item.PredictedLiveState)
+		if err != nil {
+			return nil, fmt.Errorf("decoding predicted state of %s/%s %s/%s: %w", r.group, r.kind, r.namespace, r.name, err)
+		}
+		var liveYaml, predictedYaml []byte
+		if liveObj != nil {
+			liveObj = resourceObject(liveObj)
+			appRes.Live = liveObj
+			if liveYaml, err = yaml.Marshal(liveObj); err != nil {
+				return nil, err
+			}
+		}
+		if predicted != nil {
+			predicted = resourceObject(predicted)
+			if predictedYaml, err = yaml.Marshal(predicted); err != nil {
+				return nil, err
+			}
+		}
+		if string(liveYaml) == string(predictedYaml) {
+			continue
+		}
+		appRes.DiffStr = gendiff.UnifiedDiff(r.name+"-live.yaml", r.name, string(liveYaml), string(predictedYaml))
+		appRes.Changes = gendiff.StructuredDiff(liveObj, predicted)
+		appResList = append(appResList, appRes)
+	}
+	return appResList, nil
+}
+
+// decodeServerSideDiffResponse decodes the items of an ApplicationServerSideDiffResponse
+func decodeServerSideDiffResponse(msg []byte) ([]managedResource, error) {
+	var items []managedResource
+	err := consumeFields(msg, func(num protowire.Number, v []byte) error {
+		if num != ssdResponseItems {
+			return nil
+		}
+		var item managedResource
+		err := consumeFields(v, func(num protowire.Number, v []byte) error {
+			switch num {
+			case resourceDiffGroup:
+				item.Group = string(v)
+			case resourceDiffKind:
+				item.Kind = string(v)
+			case resourceDiffNamespace:
+				item.Namespace = string(v)
+			case resourceDiffName:
+				item.Name = string(v)
+			case resourceDiffLiveState:
+				item.LiveState = string(v)
+			case resourceDiffPredictedLiveState:
+				item.PredictedLiveState = string(v)
+			}
+			return nil
+		}, func(num protowire.Number, v uint64) {
+			if num == resourceDiffModified {
+				item.Modified = v != 0
+			}
+		})
+		items = append(items, item)
+		return err
+	}, nil)
+	return items, err
+}
+
+// consumeFields walks the fields of a protobuf message, handing length-delimited ones to bytesFn
+// and varints to varintFn (when not nil); other wire types are skipped
+func consumeFields(msg []byte, bytesFn func(protowire.Number, []byte) error, varintFn func(protowire.Number, uint64)) error {
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		msg = msg[n:]
+		switch typ {
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(msg)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			if err := bytesFn(num, v); err != nil {
+				return err
+			}
+			msg = msg[n:]
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(msg)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			if varintFn != nil {
+				varintFn(num, v)
+			}
+			msg = msg[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, msg)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			msg = msg[n:]
+		}
+	}
+	return nil
+}
+
+// grpcWeb makes a unary gRPC-web call to the ArgoCD server and returns the response message
+func (b *apiBackend) grpcWeb(ctx context.Context, method string, msg []byte) ([]byte, error) {
+	reqUrl := strings.TrimSuffix(b.baseUrl, "/api") + method
+	log.Info().Msgf("Calling ArgoCD API: POST %s", reqUrl)
+	body := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(msg)))
+	body = append(body, msg...)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, reqUrl, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+b.token)
+	req.Header.Set("Content-Type", "application/grpc-web+proto")
+	req.Header.Set("X-Grpc-Web", "1")
+	resp, err := b.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("POST %s: %w", method, err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("POST %s: %w", method, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("POST %s: %s", method, resp.Status)
+	}
+	// a trailers-only response carries the status in the headers
+	status, message := resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	var data []byte
+	for len(respBody) > 0 {
+		if len(respBody) < 5 {
+			return nil, fmt.Errorf("POST %s: truncated gRPC-web frame", method)
+		}
+		flag, size := respBody[0], binary.BigEndian.Uint32(respBody[1:5])
+		if uint64(len(respBody)-5) < uint64(size) {
+			return nil, fmt.Errorf("POST %s: truncated gRPC-web frame", method)
+		}
+		frame := respBody[5 : 5+size]
+		respBody = respBody[5+size:]
+		if flag&0x80 == 0 {
+			data = frame
+			continue
+		}
+		for _, line := range strings.Split(string(frame), "\r\n") {
+			k, v, _ := strings.Cut(line, ":")
+			switch strings.ToLower(strings.TrimSpace(k)) {
+			case "grpc-status":
+				status = strings.TrimSpace(v)
+			case "grpc-message":
+				message = strings.TrimSpace(v)
+			}
+		}
+	}
+	if status != "" && status != "0" {
+		if m, err := url.PathUnescape(message); err == nil {
+			message = m
+		}
+		code, _ := strconv.Atoi(status)
+		return nil, fmt.Errorf("POST %s: gRPC status %d: %s", method, code, message)
+	}
+	if data == nil && status == "" {
+		return nil, errors.New("POST " + method + ": empty gRPC-web response")
+	}
+	return data, nil
+}
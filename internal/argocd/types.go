@@ -1,7 +1,13 @@
 package argocd
 
 import (
+	"fmt"
+	"regexp"
+	"strings"
+
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/vince-riv/argo-diff/internal/gendiff"
 )
 
 type AppResource struct {
@@ -11,12 +17,153 @@ type AppResource struct {
 	Namespace  string
 	Name       string
 	DiffStr    string
+	// Live and Target are the resource's live and desired objects (nil when it doesn't exist on
+	// that side), normalized by resourceObject. The api backend always fills them in; the cli
+	// backend only once FetchResourceObjects has been called, and not when it can't find them. In
+	// a desired-state diff they're the objects rendered at the merge-base and head.
+	Live   map[string]any
+	Target map[string]any
+	// Changes are the field-level changes between the live and target states. The api backend
+	// always fills them in; the cli only does when the diff format is structured.
+	Changes []gendiff.Change
+	// Origin says whether a live diff is the change's, pre-existing drift, or both (one of the
+	// Origin* constants); it's only set when the application was OutOfSync
+	Origin string
+}
+
+// resourceObject is an object as AppResource.Live/Target hold it, whichever backend fetched it:
+// without ArgoCD's tracking label and annotation, the fields the API server manages, or nulls
+func resourceObject(obj map[string]any) map[string]any {
+	if obj == nil {
+		return nil
+	}
+	res, _ := compact(stripServerFields(stripTracking(obj))).(map[string]any)
+	return res
+}
+
+// DisplayDiff returns the resource's diff in format (DiffFormatUnified or DiffFormatStructured),
+// falling back to the unified diff when there are no structured changes to show
+func (r AppResource) DisplayDiff(format string) string {
+	if format == DiffFormatStructured && len(r.Changes) > 0 {
+		return gendiff.FormatChanges(r.Changes)
+	}
+	return r.DiffStr
+}
+
+// String identifies the resource and what the change does to it, leaving out the objects and
+// diffs, which can hold Secret data
+func (r AppResource) String() string {
+	return fmt.Sprintf("%s %s/%s (%s)", r.Kind, r.Namespace, r.Name, r.Action())
+}
+
+// What a change does to a resource
+const ActionAdded = "added"
+const ActionModified = "modified"
+const ActionDeleted = "deleted"
+
+var hunkHeaderRe = regexp.MustCompile(`(?m)^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// Action classifies a changed resource as added, modified or deleted. With the live and target
+// objects to hand that's which of them exist; otherwise it's read off the diff, where a resource
+// that's new (or going away) has a single hunk against an empty file.
+func (r AppResource) Action() string {
+	if r.Live != nil || r.Target != nil {
+		switch {
+		case r.Live == nil:
+			return ActionAdded
+		case r.Target == nil:
+			return ActionDeleted
+		}
+		return ActionModified
+	}
+	m := hunkHeaderRe.FindStringSubmatch(r.DiffStr)
+	if m == nil {
+		return ActionModified
+	}
+	if m[1] == "0" && m[2] == "0" {
+		return ActionAdded
+	}
+	if m[3] == "0" && m[4] == "0" {
+		return ActionDeleted
+	}
+	return ActionModified
 }
 
 type ApplicationResourcesWithChanges struct {
-	ArgoApp          *Application
+	ArgoApp *Application
+	// ChangedResources is the desired-state diff under DiffModeDesired and DiffModeBoth, else the
+	// live diff
 	ChangedResources []AppResource
-	WarnStr          string
+	// LiveResources is the live diff shown alongside the desired-state diff under DiffModeBoth
+	LiveResources []AppResource
+	WarnStr       string
+	// Parent is the Application whose diff changed this one's spec, for a nested app-of-apps
+	// Application ("" for one that matched the change itself)
+	Parent string
+	// Notes are caveats about the diff, such as nested Applications it didn't follow
+	Notes []string
+	// NewApp is set for a nested Application that doesn't exist in ArgoCD yet: ChangedResources
+	// are all of its manifests, as additions (see previewNewApplication)
+	NewApp bool
+	// Removal is set for a nested Application its parent's diff deletes; it has no
+	// ChangedResources (see removedApps)
+	Removal *AppRemoval
+	// ApplicationSet is set when this is an ApplicationSet rather than an Application (ArgoApp then
+	// has only its metadata): ChangedResources are the Applications it generates that the change
+	// adds, removes or alters (see processAppSet)
+	ApplicationSet *ApplicationSet
+}
+
+// AppRemoval is what deleting an Application from its app-of-apps does to the resources it manages
+type AppRemoval struct {
+	// Prune is when the parent deletes the Application: PruneAutomatic, PruneManual, PruneDisabled
+	// or (for an ApplicationSet) PruneRetained, as for any other resource its diff deletes
+	Prune string
+	// Cascade is set when the Application has ArgoCD's resources finalizer, so deleting it deletes
+	// its resources too; otherwise they're orphaned, and stay in the cluster unmanaged
+	Cascade bool
+	// Resources are the live resources the Application manages
+	Resources []ResourceStatus
+}
+
+// What happens to a resource a change deletes from an application
+const PruneAutomatic = "automatic" // auto-sync with pruning deletes it once the change merges
+const PruneManual = "manual"       // it stays (and the app OutOfSync) until a sync with pruning
+const PruneDisabled = "disabled"   // its Prune=false sync option means ArgoCD never deletes it
+const PruneRetained = "retained"   // its ApplicationSet's applicationsSync policy never deletes it
+
+// a Prune=false sync option, as it appears among the removed lines of a unified diff
+var pruneDisabledRe = regexp.MustCompile(`(?m)^-\s*argocd\.argoproj\.io/sync-options:.*\bPrune=false\b`)
+
+// PruneOutcome says whether ArgoCD will actually delete r from the cluster (one of the Prune*
+// constants), or "" when r isn't being deleted. Without the live object (the cli backend when
+// no policy is loaded, or when it couldn't find the object), the sync options are read off the
+// diff. An ApplicationSet's Applications are deleted by
+// its controller as soon as it stops generating them, unless its policy retains them.
+func (a ApplicationResourcesWithChanges) PruneOutcome(r AppResource) string {
+	if r.Action() != ActionDeleted {
+		return ""
+	}
+	if a.ApplicationSet != nil {
+		if a.ApplicationSet.deletesApplications() {
+			return PruneAutomatic
+		}
+		return PruneRetained
+	}
+	if r.Live != nil {
+		annotations, _, _ := unstructured.NestedStringMap(r.Live, "metadata", "annotations")
+		for _, opt := range strings.Split(annotations["argocd.argoproj.io/sync-options"], ",") {
+			if strings.TrimSpace(opt) == "Prune=false" {
+				return PruneDisabled
+			}
+		}
+	} else if pruneDisabledRe.MatchString(r.DiffStr) {
+		return PruneDisabled
+	}
+	if a.ArgoApp != nil && a.ArgoApp.Spec.AutoSync() && a.ArgoApp.Spec.SyncPolicy.Automated.Prune {
+		return PruneAutomatic
+	}
+	return PruneManual
 }
 
 type K8sManifest struct {
@@ -0,0 +1,58 @@
+package argocd
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPruneOutcome(t *testing.T) {
+	deleted := AppResource{Kind: "ConfigMap", Name: "cm", Live: map[string]any{"kind": "ConfigMap"}}
+	unprunable := AppResource{Kind: "ConfigMap", Name: "cm", Live: map[string]any{
+		"metadata": map[string]any{"annotations": map[string]any{"argocd.argoproj.io/sync-options": "Replace=true, Prune=false"}},
+	}}
+	// the cli backend only gives us the diff
+	unprunableDiff := AppResource{Kind: "ConfigMap", Name: "cm", DiffStr: "--- live\n+++ /dev/null\n@@ -1,4 +0,0 @@\n-metadata:\n-  annotations:\n-    argocd.argoproj.io/sync-options: Prune=false\n-data: {}\n"}
+	added := AppResource{Kind: "ConfigMap", Name: "cm", Target: map[string]any{"kind": "ConfigMap"}}
+
+	app := func(policy *SyncPolicy) ApplicationResourcesWithChanges {
+		a := &Application{}
+		a.Spec.SyncPolicy = policy
+		return ApplicationResourcesWithChanges{ArgoApp: a}
+	}
+	manual := app(nil)
+	autoSync := app(&SyncPolicy{Automated: &SyncPolicyAutomated{SelfHeal: true}})
+	autoPrune := app(&SyncPolicy{Automated: &SyncPolicyAutomated{Prune: true}})
+
+	for _, tc := range []struct {
+		name string
+		app  ApplicationResourcesWithChanges
+		r    AppResource
+		want string
+	}{
+		{"not deleted", autoPrune, added, ""},
+		{"no auto-sync", manual, deleted, PruneManual},
+		{"auto-sync without prune", autoSync, deleted, PruneManual},
+		{"auto-sync with prune", autoPrune, deleted, PruneAutomatic},
+		{"Prune=false", autoPrune, unprunable, PruneDisabled},
+		{"Prune=false in the diff", autoPrune, unprunableDiff, PruneDisabled},
+	} {
+		if got := tc.app.PruneOutcome(tc.r); got != tc.want {
+			t.Errorf("%s: PruneOutcome() = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestAppResourceString(t *testing.T) {
+	r := AppResource{
+		Kind:      "Secret",
+		Namespace: "ns",
+		Name:      "creds",
+		Live:      map[string]any{"data": map[string]any{"password": "aHVudGVyMg=="}},
+		Target:    map[string]any{"data": map[string]any{"password": "c3dvcmRmaXNo"}},
+		DiffStr:   "-  password: aHVudGVyMg==\n+  password: c3dvcmRmaXNo\n",
+	}
+	got := fmt.Sprintf("%+v", []AppResource{r})
+	if got != "[Secret ns/creds (modified)]" {
+		t.Errorf("Unexpected formatting: %s", got)
+	}
+}
@@ -0,0 +1,308 @@
+package gendiff
+
+/*
+ * Field-level diffs of two Kubernetes objects: instead of lines of YAML, a list of the fields that
+ * were added, removed or changed, each named by its path. List items are matched by a key field
+ * (eg: a container's name) when the list has one, so reordering or inserting an item doesn't show
+ * up as every following item changing.
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Change operations
+const ChangeAdded = "added"
+const ChangeRemoved = "removed"
+const ChangeModified = "changed"
+
+// Change is one field that differs between two objects
+type Change struct {
+	// Path names the field for display, eg: spec.template.spec.containers[name=api].image
+	Path string `json:"path"`
+	// Keys is the path as a list of map keys, with "[*]" standing in for each list item
+	Keys []string `json:"-"`
+	Op   string   `json:"op"`
+	Old  any      `json:"old,omitempty"`
+	New  any      `json:"new,omitempty"`
+}
+
+// Fields that identify an item in a list, in order of preference. A list is matched by the first
+// one every item (on both sides) has, with no duplicates; otherwise it's matched by position.
+var listKeyFields = []string{"name", "containerPort", "port", "mountPath", "devicePath", "key"}
+
+type pathElem struct {
+	key  string
+	item string // set for list items: "name=api", or an index
+}
+
+// StructuredDiff returns the field-level changes between two objects (either may be nil), ordered
+// by path
+func StructuredDiff(from, to map[string]any) []Change {
+	var changes []Change
+	diffMaps(nil, from, to, &changes)
+	return changes
+}
+
+func diffValues(path []pathElem, from, to any, changes *[]Change) {
+	switch f := from.(type) {
+	case map[string]any:
+		if t, ok := to.(map[string]any); ok {
+			diffMaps(path, f, t, changes)
+			return
+		}
+	case []any:
+		if t, ok := to.([]any); ok {
+			diffLists(path, f, t, changes)
+			return
+		}
+	}
+	if scalarString(from) != scalarString(to) {
+		*changes = append(*changes, newChange(path, ChangeModified, from, to))
+	}
+}
+
+func diffMaps(path []pathElem, from, to map[string]any, changes *[]Change) {
+	keys := make([]string, 0, len(from)+len(to))
+	for k := range from {
+		keys = append(keys, k)
+	}
+	for k := range to {
+		if _, ok := from[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		p := appendPath(path, pathElem{key: k})
+		f, inFrom := from[k]
+		t, inTo := to[k]
+		switch {
+		case !inFrom:
+			*changes = append(*changes, newChange(p, ChangeAdded, nil, t))
+		case !inTo:
+			*changes = append(*changes, newChange(p, ChangeRemoved, f, nil))
+		default:
+			diffValues(p, f, t, changes)
+		}
+	}
+}
+
+func diffLists(path []pathElem, from, to []any, changes *[]Change) {
+	field := listKey(from, to)
+	if field == "" {
+		for i := 0; i < len(from) || i < len(to); i++ {
+			p := appendPath(path, pathElem{item: strconv.Itoa(i)})
+			switch {
+			case i >= len(from):
+				*changes = append(*changes, newChange(p, ChangeAdded, nil, to[i]))
+			case i >= len(to):
+				*changes = append(*changes, newChange(p, ChangeRemoved, from[i], nil))
+			default:
+				diffValues(p, from[i], to[i], changes)
+			}
+		}
+		return
+	}
+	fromByKey := make(map[string]any, len(from))
+	for _, item := range from {
+		fromByKey[scalarString(item.(map[string]any)[field])] = item
+	}
+	toKeys := make(map[string]bool, len(to))
+	for _, item := range to {
+		k := scalarString(item.(map[string]any)[field])
+		toKeys[k] = true
+		p := appendPath(path, pathElem{item: field + "=" + k})
+		if f, ok := fromByKey[k]; ok {
+			diffValues(p, f, item, changes)
+		} else {
+			*changes = append(*changes, newChange(p, ChangeAdded, nil, item))
+		}
+	}
+	for _, item := range from {
+		k := scalarString(item.(map[string]any)[field])
+		if !toKeys[k] {
+			*changes = append(*changes, newChange(appendPath(path, pathElem{item: field + "=" + k}), ChangeRemoved, item, nil))
+		}
+	}
+}
+
+// listKey picks the field to match the items of two lists by, or "" to match them by position
+func listKey(from, to []any) string {
+	for _, field := range listKeyFields {
+		if uniqueKeys(from, field) && uniqueKeys(to, field) {
+			return field
+		}
+	}
+	return ""
+}
+
+func uniqueKeys(items []any, field string) bool {
+	seen := make(map[string]bool, len(items))
+	for _, item := range items {
+		m, ok := item.(map[string]any)
+		if !ok {
+			return false
+		}
+		v, ok := m[field]
+		if !ok || !isScalar(v) {
+			return false
+		}
+		k := scalarString(v)
+		if seen[k] {
+			return false
+		}
+		seen[k] = true
+	}
+	return true
+}
+
+func appendPath(path []pathElem, e pathElem) []pathElem {
+	return append(append(make([]pathElem, 0, len(path)+1), path...), e)
+}
+
+var plainKeyRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+
+func newChange(path []pathElem, op string, from, to any) Change {
+	c := Change{Op: op, Old: from, New: to}
+	var sb strings.Builder
+	for _, e := range path {
+		switch {
+		case e.item != "":
+			sb.WriteString("[" + e.item + "]")
+			c.Keys = append(c.Keys, "[*]")
+			continue
+		case !plainKeyRe.MatchString(e.key):
+			sb.WriteString("[" + strconv.Quote(e.key) + "]")
+		case sb.Len() > 0:
+			sb.WriteString("." + e.key)
+		default:
+			sb.WriteString(e.key)
+		}
+		c.Keys = append(c.Keys, e.key)
+	}
+	c.Path = sb.String()
+	return c
+}
+
+func isScalar(v any) bool {
+	switch v.(type) {
+	case map[string]any, []any:
+		return false
+	}
+	return true
+}
+
+// scalarString renders a scalar the way it's compared and displayed. Numbers go through JSON so
+// that an int64 from YAML equals the float64 the same number decodes to from JSON.
+func scalarString(v any) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// displayScalar quotes strings that would otherwise be ambiguous in a change line
+func displayScalar(v any) string {
+	s, ok := v.(string)
+	if !ok {
+		return scalarString(v)
+	}
+	if s == "" || s != strings.TrimSpace(s) || strings.Contains(s, " -> ") || strings.ContainsAny(s, "\"\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// FormatChanges renders changes for a ```diff code block: '+' and '-' lines for added and removed
+// fields, '!' lines for changed ones (`path: old -> new`). Maps, lists and multi-line strings are
+// shown indented under their path; a changed multi-line string as a unified diff of its lines.
+func FormatChanges(changes []Change) string {
+	var sb strings.Builder
+	for _, c := range changes {
+		switch c.Op {
+		case ChangeAdded:
+			writeValue(&sb, '+', c.Path, c.New)
+		case ChangeRemoved:
+			writeValue(&sb, '-', c.Path, c.Old)
+		default:
+			oldStr, oldOk := c.Old.(string)
+			newStr, newOk := c.New.(string)
+			switch {
+			case oldOk && newOk && (strings.Contains(oldStr, "\n") || strings.Contains(newStr, "\n")):
+				fmt.Fprintf(&sb, "! %s:\n", c.Path)
+				writeLinesDiff(&sb, oldStr, newStr)
+			case isScalar(c.Old) && isScalar(c.New):
+				fmt.Fprintf(&sb, "! %s: %s -> %s\n", c.Path, displayScalar(c.Old), displayScalar(c.New))
+			default:
+				// the field changed type (eg: a string became a map)
+				writeValue(&sb, '-', c.Path, c.Old)
+				writeValue(&sb, '+', c.Path, c.New)
+			}
+		}
+	}
+	return sb.String()
+}
+
+func writeValue(sb *strings.Builder, prefix byte, path string, v any) {
+	var block string
+	switch val := v.(type) {
+	case map[string]any, []any:
+		b, err := yaml.Marshal(val)
+		if err != nil {
+			block = fmt.Sprint(val)
+		} else {
+			block = string(b)
+		}
+	case string:
+		if strings.Contains(val, "\n") {
+			fmt.Fprintf(sb, "%c %s: |\n", prefix, path)
+			writeIndented(sb, prefix, val)
+			return
+		}
+	}
+	if block == "" {
+		fmt.Fprintf(sb, "%c %s: %s\n", prefix, path, displayScalar(v))
+		return
+	}
+	fmt.Fprintf(sb, "%c %s:\n", prefix, path)
+	writeIndented(sb, prefix, block)
+}
+
+func writeIndented(sb *strings.Builder, prefix byte, text string) {
+	for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		fmt.Fprintf(sb, "%c   %s\n", prefix, line)
+	}
+}
+
+// writeLinesDiff writes the hunks of a unified diff of two multi-line strings, indented under
+// their change line
+func writeLinesDiff(sb *strings.Builder, from, to string) {
+	for _, line := range strings.Split(strings.TrimSuffix(UnifiedDiff("old", "new", ensureNewline(from), ensureNewline(to)), "\n"), "\n") {
+		switch {
+		case strings.HasPrefix(line, "---"), strings.HasPrefix(line, "+++"), line == "":
+		case strings.HasPrefix(line, "@@"):
+			fmt.Fprintf(sb, "    %s\n", line)
+		default:
+			fmt.Fprintf(sb, "%c   %s\n", line[0], line[1:])
+		}
+	}
+}
+
+func ensureNewline(s string) string {
+	if s != "" && !strings.HasSuffix(s, "\n") {
+		return s + "\n"
+	}
+	return s
+}
@@ -0,0 +1,135 @@
+package gendiff
+
+import (
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+)
+
+const oldDeployment = `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: api
+  labels:
+    app.kubernetes.io/version: "1.0"
+spec:
+  replicas: 2
+  template:
+    spec:
+      containers:
+      - name: api
+        image: api:v1
+        ports:
+        - containerPort: 8080
+        - containerPort: 9090
+      - name: sidecar
+        image: envoy:1.29
+      tolerations:
+      - key: dedicated
+        effect: NoSchedule
+      - key: dedicated
+        effect: NoExecute
+`
+
+// the containers swap places, one port goes and the sidecar gets a config file
+const newDeployment = `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: api
+  labels:
+    app.kubernetes.io/version: "1.1"
+spec:
+  replicas: 3
+  template:
+    spec:
+      containers:
+      - name: sidecar
+        image: envoy:1.29
+        args: ["--config", "/etc/envoy.yaml"]
+      - name: api
+        image: api:v2
+        ports:
+        - containerPort: 8080
+      tolerations:
+      - key: dedicated
+        effect: NoSchedule
+      - key: dedicated
+        effect: PreferNoSchedule
+`
+
+func mustParse(t *testing.T, doc string) map[string]any {
+	t.Helper()
+	var obj map[string]any
+	if err := yaml.Unmarshal([]byte(doc), &obj); err != nil {
+		t.Fatalf("Failed to parse test manifest: %s", err)
+	}
+	return obj
+}
+
+func TestStructuredDiff(t *testing.T) {
+	changes := StructuredDiff(mustParse(t, oldDeployment), mustParse(t, newDeployment))
+	want := []struct{ path, op string }{
+		{`metadata.labels["app.kubernetes.io/version"]`, ChangeModified},
+		{"spec.replicas", ChangeModified},
+		{"spec.template.spec.containers[name=sidecar].args", ChangeAdded},
+		{"spec.template.spec.containers[name=api].image", ChangeModified},
+		{"spec.template.spec.containers[name=api].ports[containerPort=9090]", ChangeRemoved},
+		// tolerations have no unique key, so they're matched by position
+		{"spec.template.spec.tolerations[1].effect", ChangeModified},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("Expected %d changes, got %+v", len(want), changes)
+	}
+	for i, w := range want {
+		if changes[i].Path != w.path || changes[i].Op != w.op {
+			t.Errorf("Change %d = %s %s, want %s %s", i, changes[i].Op, changes[i].Path, w.op, w.path)
+		}
+	}
+	if keys := strings.Join(changes[3].Keys, "|"); keys != "spec|template|spec|containers|[*]|image" {
+		t.Errorf("Unexpected Keys %s", keys)
+	}
+	if changes[3].Old != "api:v1" || changes[3].New != "api:v2" {
+		t.Errorf("Unexpected image change %+v", changes[3])
+	}
+}
+
+func TestStructuredDiffNumbers(t *testing.T) {
+	// YAML decodes to int64 and JSON to float64; the same number mustn't show as a change
+	from := map[string]any{"spec": map[string]any{"replicas": int64(3)}}
+	to := map[string]any{"spec": map[string]any{"replicas": float64(3)}}
+	if changes := StructuredDiff(from, to); len(changes) != 0 {
+		t.Errorf("Expected no changes, got %+v", changes)
+	}
+}
+
+func TestStructuredDiffNewObject(t *testing.T) {
+	changes := StructuredDiff(nil, map[string]any{"kind": "ConfigMap", "data": map[string]any{"a": "b"}})
+	if len(changes) != 2 || changes[0].Path != "data" || changes[0].Op != ChangeAdded || changes[1].Path != "kind" {
+		t.Errorf("Expected each top-level field to be added, got %+v", changes)
+	}
+}
+
+func TestFormatChanges(t *testing.T) {
+	changes := StructuredDiff(mustParse(t, oldDeployment), mustParse(t, newDeployment))
+	changes = append(changes,
+		Change{Path: `data["nginx.conf"]`, Op: ChangeModified, Old: "worker_processes 1;\nerror_log stderr;\n", New: "worker_processes 4;\nerror_log stderr;\n"},
+		Change{Path: "data.empty", Op: ChangeAdded, New: ""},
+	)
+	got := FormatChanges(changes)
+	for _, want := range []string{
+		"! metadata.labels[\"app.kubernetes.io/version\"]: 1.0 -> 1.1\n",
+		"! spec.replicas: 2 -> 3\n",
+		"+ spec.template.spec.containers[name=sidecar].args:\n+   - --config\n+   - /etc/envoy.yaml\n",
+		"! spec.template.spec.containers[name=api].image: api:v1 -> api:v2\n",
+		"- spec.template.spec.containers[name=api].ports[containerPort=9090]:\n-   containerPort: 9090\n",
+		"! data[\"nginx.conf\"]:\n    @@ -1,2 +1,2 @@\n-   worker_processes 1;\n+   worker_processes 4;\n    error_log stderr;\n",
+		"+ data.empty: \"\"\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("FormatChanges() is missing %q:\n%s", want, got)
+		}
+	}
+}
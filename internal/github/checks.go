@@ -0,0 +1,174 @@
+package github
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/go-github/v89/github"
+	"github.com/rs/zerolog/log"
+)
+
+// Check run conclusions reported by argo-diff
+const ConclusionSuccess = "success"
+const ConclusionFailure = "failure"
+const ConclusionNeutral = "neutral"
+const ConclusionTimedOut = "timed_out"
+const ConclusionActionRequired = "action_required"
+
+// GitHub's limit on each of a check run's summary and text
+const checkRunOutputMaxLen = 65535
+
+// ChecksEnabled returns true when results are reported as check runs rather than commit statuses
+// (ARGO_DIFF_GITHUB_CHECKS=true, with GitHub App credentials)
+func ChecksEnabled() bool {
+	return useChecks
+}
+
+// CheckRunName is the name of argo-diff's check run; it's the same as the commit status context
+func CheckRunName() string {
+	return statusContextStr
+}
+
+// CheckRun reports one argo-diff run on a commit via the Checks API
+type CheckRun struct {
+	owner  string
+	repo   string
+	sha    string
+	dryRun bool
+	id     int64 // 0 until the check run has been created
+}
+
+func NewCheckRun(owner, repo, sha string, dryRun bool) *CheckRun {
+	return &CheckRun{owner: owner, repo: repo, sha: sha, dryRun: dryRun}
+}
+
+// Start creates the check run, marked in progress
+func (c *CheckRun) Start(ctx context.Context) error {
+	opts := github.CreateCheckRunOptions{
+		Name:      CheckRunName(),
+		HeadSHA:   c.sha,
+		Status:    github.Ptr("in_progress"),
+		StartedAt: &github.Timestamp{Time: time.Now()},
+	}
+	if c.dryRun {
+		log.Info().Msgf("DRY RUN: statusClient.Checks.CreateCheckRun(_, %s, %s, %+v)", c.owner, c.repo, opts)
+		return nil
+	}
+	if statusClient == nil {
+		log.Error().Msg("Cannot call github API - I don't have a client set")
+		return fmt.Errorf("no github status client")
+	}
+	checkRun, resp, err := statusClient.Checks.CreateCheckRun(ctx, c.owner, c.repo, opts)
+	observe("checks.create_check_run", resp)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to create check run %s for %s/%s@%s", opts.Name, c.owner, c.repo, c.sha)
+		return err
+	}
+	c.id = checkRun.GetID()
+	log.Info().Msgf("%s - created check run %d for %s/%s@%s", resp.Status, c.id, c.owner, c.repo, c.sha)
+	return nil
+}
+
+// Complete concludes the check run, with title as the one-liner and the results in md (which may be
+// nil) as its summary and details. If the check run was never started, it's created completed.
+func (c *CheckRun) Complete(ctx context.Context, conclusion, title string, md *CommentMarkdown) error {
+	output := &github.CheckRunOutput{
+		Title:   github.Ptr(title),
+		Summary: github.Ptr(title),
+	}
+	if md != nil {
+		output.Summary = github.Ptr(checkRunSummary(*md))
+		output.Text = github.Ptr(checkRunText(*md))
+	}
+	status := "completed"
+	completedAt := &github.Timestamp{Time: time.Now()}
+	if c.dryRun {
+		log.Info().Msgf("DRY RUN: completing check run for %s/%s@%s: %s '%s'", c.owner, c.repo, c.sha, conclusion, title)
+		return nil
+	}
+	if statusClient == nil {
+		log.Error().Msg("Cannot call github API - I don't have a client set")
+		return fmt.Errorf("no github status client")
+	}
+	var resp *github.Response
+	var err error
+	if c.id == 0 {
+		_, resp, err = statusClient.Checks.CreateCheckRun(ctx, c.owner, c.repo, github.CreateCheckRunOptions{
+			Name:        CheckRunName(),
+			HeadSHA:     c.sha,
+			Status:      &status,
+			Conclusion:  &conclusion,
+			CompletedAt: completedAt,
+			Output:      output,
+		})
+		observe("checks.create_check_run", resp)
+	} else {
+		_, resp, err = statusClient.Checks.UpdateCheckRun(ctx, c.owner, c.repo, c.id, github.UpdateCheckRunOptions{
+			Name:        CheckRunName(),
+			Status:      &status,
+			Conclusion:  &conclusion,
+			CompletedAt: completedAt,
+			Output:      output,
+		})
+		observe("checks.update_check_run", resp)
+	}
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to complete check run for %s/%s@%s: %s '%s'", c.owner, c.repo, c.sha, conclusion, title)
+		return err
+	}
+	log.Info().Msgf("%s - check run for %s/%s@%s: %s '%s'", resp.Status, c.owner, c.repo, c.sha, conclusion, title)
+	return nil
+}
+
+// checkRunSummary renders the comment preamble followed by its summary table, or a simpler table of
+// the applications in md when it has none
+func checkRunSummary(md CommentMarkdown) string {
+	if md.Summary != "" {
+		return truncateOutput(md.Preamble+"\n"+md.Summary, "")
+	}
+	return truncateOutput(md.Preamble+"\n"+appTable(md), "")
+}
+
+// appTable renders a table of the applications in md: their status and how many resources changed
+func appTable(md CommentMarkdown) string {
+	var summary string
+	if len(md.ArgoApps) > 0 {
+		summary += "| Application | Sync Status | Health | Changed Resources |\n"
+		summary += "| ----------- | ----------- | ------ | ----------------- |\n"
+		for _, a := range md.ArgoApps {
+			changes := fmt.Sprintf("%d", len(a.Resources))
+			if a.WarnStr != "" {
+				changes = ":x: error"
+			}
+			summary += fmt.Sprintf("| %s | %s | %s | %s |\n", a.AppName, syncString(a.SyncStatus), healthString(a.HealthStatus, ""), changes)
+		}
+	}
+	return summary
+}
+
+// checkRunText renders the per-application diffs, as they appear in the PR comment
+func checkRunText(md CommentMarkdown) string {
+	md.Preamble, md.Summary = "", ""
+	return truncateOutput(strings.Join(md.String(), ""), "\n\n`<<< TRUNCATED - see the pull request comment for the full diff >>>`\n")
+}
+
+// truncateOutput cuts s down to the check run output limit, ending it with suffix when it's cut
+func truncateOutput(s, suffix string) string {
+	return truncateBytes(s, checkRunOutputMaxLen, suffix)
+}
+
+// truncateBytes cuts s down to at most maxLen bytes, ending it with suffix when it's cut. The cut
+// backs off to the start of a rune, so a multi-byte character is never split into invalid UTF-8.
+func truncateBytes(s string, maxLen int, suffix string) string {
+	if len(s) <= maxLen {
+		return s
+	}
+	cut := maxLen - len(suffix)
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + suffix
+}
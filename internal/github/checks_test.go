@@ -0,0 +1,124 @@
+package github
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/google/go-github/v89/github"
+)
+
+type checkRunRequest struct {
+	method string
+	path   string
+	body   map[string]any
+}
+
+// newChecksTestServer stands in for the check runs API, recording each request it receives
+func newChecksTestServer(t *testing.T, requests *[]checkRunRequest) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := checkRunRequest{method: r.Method, path: r.URL.Path}
+		reqBody, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(reqBody, &req.body); err != nil {
+			t.Errorf("Failed to decode request body %s: %s", reqBody, err)
+		}
+		*requests = append(*requests, req)
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/repos/vince-riv/argo-diff/check-runs":
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == "PATCH" && r.URL.Path == "/repos/vince-riv/argo-diff/check-runs/4242":
+			w.WriteHeader(http.StatusOK)
+		default:
+			t.Errorf("Mock server not configured to serve %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"id": 4242, "name": "argo-diff", "head_sha": "` + prHeadSha + `"}`))
+	}))
+}
+
+func setChecksTestClient(t *testing.T, server *httptest.Server) {
+	baseURL := server.URL + "/"
+	var err error
+	statusClient, err = github.NewClient(github.WithAuthToken("test1234"), github.WithURLs(&baseURL, &baseURL))
+	if err != nil {
+		t.Fatalf("Failed to create github client: %s", err)
+	}
+}
+
+func TestCheckRunStartAndComplete(t *testing.T) {
+	var requests []checkRunRequest
+	server := newChecksTestServer(t, &requests)
+	defer server.Close()
+	setChecksTestClient(t, server)
+
+	c := NewCheckRun("vince-riv", "argo-diff", prHeadSha, false)
+	if err := c.Start(context.Background()); err != nil {
+		t.Fatalf("Start() failed: %s", err)
+	}
+	md := CommentMarkdown{Preamble: "1 of 2 apps with changes compared to live state\n"}
+	a := md.AppMarkdown("guestbook", "", "OutOfSync", "Healthy", "")
+	a.AddResourceDiff("apps", "Deployment", "guestbook-ui", "default", ResourceModified, "", "-image: v1\n+image: v2\n")
+	md.AppMarkdown("broken", "rpc error", "Unknown", "Missing", "")
+	if err := c.Complete(context.Background(), ConclusionFailure, "1 of 2 apps with changes; 1 had an error", &md); err != nil {
+		t.Fatalf("Complete() failed: %s", err)
+	}
+
+	if len(requests) != 2 {
+		t.Fatalf("Expected a create then an update, got %d requests", len(requests))
+	}
+	if requests[0].method != "POST" || requests[0].body["status"] != "in_progress" || requests[0].body["head_sha"] != prHeadSha {
+		t.Errorf("Unexpected create request %+v", requests[0])
+	}
+	update := requests[1]
+	if update.method != "PATCH" || update.body["status"] != "completed" || update.body["conclusion"] != ConclusionFailure {
+		t.Errorf("Unexpected update request %+v", update)
+	}
+	output, _ := update.body["output"].(map[string]any)
+	summary, _ := output["summary"].(string)
+	for _, want := range []string{"1 of 2 apps with changes", "| guestbook | OutOfSync", "| 1 |", "| broken |", ":x: error"} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("Check run summary is missing %q:\n%s", want, summary)
+		}
+	}
+	text, _ := output["text"].(string)
+	if !strings.Contains(text, "+image: v2") || strings.Contains(text, "1 of 2 apps with changes") {
+		t.Errorf("Expected the check run text to hold the diffs without the preamble:\n%s", text)
+	}
+}
+
+func TestCheckRunCompleteWithoutStart(t *testing.T) {
+	var requests []checkRunRequest
+	server := newChecksTestServer(t, &requests)
+	defer server.Close()
+	setChecksTestClient(t, server)
+
+	c := NewCheckRun("vince-riv", "argo-diff", prHeadSha, false)
+	if err := c.Complete(context.Background(), ConclusionNeutral, "superseded", nil); err != nil {
+		t.Fatalf("Complete() failed: %s", err)
+	}
+	if len(requests) != 1 || requests[0].method != "POST" || requests[0].body["conclusion"] != ConclusionNeutral {
+		t.Errorf("Expected a single completed check run to be created, got %+v", requests)
+	}
+}
+
+func TestTruncateOutput(t *testing.T) {
+	suffix := "[truncated]"
+	if s := truncateOutput("short", suffix); s != "short" {
+		t.Errorf("truncateOutput() changed a short string: %s", s)
+	}
+	s := truncateOutput(strings.Repeat("x", checkRunOutputMaxLen+1), suffix)
+	if len(s) != checkRunOutputMaxLen || !strings.HasSuffix(s, suffix) {
+		t.Errorf("truncateOutput() returned %d chars, want %d ending in %s", len(s), checkRunOutputMaxLen, suffix)
+	}
+	// a cut through a multi-byte character backs off to its start
+	s = truncateOutput(strings.Repeat("x", checkRunOutputMaxLen-len(suffix)-1)+"é"+strings.Repeat("x", 100), suffix)
+	if !utf8.ValidString(s) || len(s) != checkRunOutputMaxLen-1 || !strings.HasSuffix(s, "x"+suffix) {
+		t.Errorf("truncateOutput() split a rune: %d bytes ending in %q", len(s), s[len(s)-len(suffix)-2:])
+	}
+}
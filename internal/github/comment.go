@@ -14,6 +14,8 @@ import (
 	ghinstallation "github.com/bradleyfalzon/ghinstallation/v2"
 	"github.com/google/go-github/v89/github"
 	"github.com/rs/zerolog/log"
+
+	"github.com/vince-riv/argo-diff/internal/metrics"
 )
 
 var (
@@ -119,6 +121,15 @@ func IsRefreshComment(comment string) bool {
 	return false
 }
 
+// observe counts a GitHub API call for the metrics endpoint; resp is nil when the call got no response
+func observe(endpoint string, resp *github.Response) {
+	statusCode := 0
+	if resp != nil && resp.Response != nil {
+		statusCode = resp.StatusCode
+	}
+	metrics.GithubApiCall(endpoint, statusCode)
+}
+
 // Populates commentLogin singleton with the Github user associated with our github client
 func getCommentUser(ctx context.Context) error {
 	if commentClient == nil {
@@ -134,6 +145,7 @@ func getCommentUser(ctx context.Context) error {
 	mux.RUnlock()
 	if commentClientIsApp {
 		app, resp, err := appsClient.Apps.Get(ctx, "")
+		observe("apps.get", resp)
 		if resp != nil {
 			log.Info().Msgf("%s received when calling client.Apps.Get() via go-github", resp.Status)
 		}
@@ -151,6 +163,7 @@ func getCommentUser(ctx context.Context) error {
 		mux.Unlock()
 	} else {
 		user, resp, err := commentClient.Users.Get(ctx, "")
+		observe("users.get", resp)
 		if resp != nil {
 			log.Info().Msgf("%s received when calling client.Users.Get() via go-github", resp.Status)
 		}
@@ -173,6 +186,7 @@ func getCommentUser(ctx context.Context) error {
 // Gets the specified pull request
 func GetPullRequest(ctx context.Context, owner, repo string, prNum int) (*github.PullRequest, error) {
 	pr, resp, err := commentClient.PullRequests.Get(ctx, owner, repo, prNum)
+	observe("pulls.get", resp)
 	if resp != nil {
 		log.Info().Msgf("%s received when calling commentClient.PullRequests.Get() via go-github", resp.Status)
 	}
@@ -183,24 +197,91 @@ func GetPullRequest(ctx context.Context, owner, repo string, prNum int) (*github
 	return pr, nil
 }
 
-// Returns list of files in a pull request
+// maxPullRequestFiles is the most files GitHub lists for a pull request; a larger pull request's
+// list stops there
+const maxPullRequestFiles = 3000
+
+// ErrTooManyFiles is returned by ListPullRequestFiles when a pull request changes more files than
+// GitHub lists, so the list is incomplete
+var ErrTooManyFiles = errors.New("pull request changes more files than GitHub lists")
+
+// Returns list of files in a pull request, page by page. A renamed file is listed under its
+// previous name too, so moving a file out of a directory changes that directory. When GitHub's
+// list is cut off, it returns what it listed along with ErrTooManyFiles.
 func ListPullRequestFiles(ctx context.Context, owner, repo string, prNum int) ([]string, error) {
 	var fileList []string
-	cfs, resp, err := commentClient.PullRequests.ListFiles(ctx, owner, repo, prNum, nil)
+	listed := 0
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		cfs, resp, err := commentClient.PullRequests.ListFiles(ctx, owner, repo, prNum, opts)
+		observe("pulls.list_files", resp)
+		if resp != nil {
+			log.Info().Msgf("%s received when calling commentClient.PullRequests.ListFiles() (page %d) via go-github", resp.Status, max(opts.Page, 1))
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, cf := range cfs {
+			if cf == nil || cf.Filename == nil {
+				log.Warn().Msgf("nil value found in call to list files in pull request %s/%s#%d", owner, repo, prNum)
+				continue
+			}
+			listed++
+			fileList = append(fileList, *cf.Filename)
+			if prev := cf.GetPreviousFilename(); prev != "" {
+				fileList = append(fileList, prev)
+			}
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	if listed >= maxPullRequestFiles {
+		return fileList, fmt.Errorf("%w: listed the first %d", ErrTooManyFiles, listed)
+	}
+	return fileList, nil
+}
+
+// Returns the contents of the file at path in a repository at ref, or nil when there's no such file
+func GetFileContents(ctx context.Context, owner, repo, path, ref string) ([]byte, error) {
+	file, _, resp, err := commentClient.Repositories.GetContents(ctx, owner, repo, path, &github.RepositoryContentGetOptions{Ref: ref})
+	observe("repos.get_content", resp)
 	if resp != nil {
-		log.Info().Msgf("%s received when calling commentClient.PullRequests.ListFiles() via go-github", resp.Status)
+		log.Info().Msgf("%s received when calling commentClient.Repositories.GetContents(%s) via go-github", resp.Status, path)
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, nil
+		}
 	}
 	if err != nil {
 		return nil, err
 	}
-	for _, cf := range cfs {
-		if cf != nil && cf.Filename != nil {
-			fileList = append(fileList, *cf.Filename)
-		} else {
-			log.Warn().Msgf("nil value found in call to list files in pull request %s/%s#%d", owner, repo, prNum)
-		}
+	if file == nil {
+		return nil, fmt.Errorf("%s in %s/%s@%s is a directory, not a file", path, owner, repo, ref)
 	}
-	return fileList, nil
+	content, err := file.GetContent()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(content), nil
+}
+
+// Returns the merge-base of base and head: the commit a pull request from head into base branched
+// off, which the base branch may have moved on from since
+func MergeBase(ctx context.Context, owner, repo, base, head string) (string, error) {
+	comparison, resp, err := commentClient.Repositories.CompareCommits(ctx, owner, repo, base, head, &github.ListOptions{PerPage: 1})
+	observe("repos.compare_commits", resp)
+	if resp != nil {
+		log.Info().Msgf("%s received when calling commentClient.Repositories.CompareCommits() via go-github", resp.Status)
+	}
+	if err != nil {
+		return "", err
+	}
+	sha := comparison.GetMergeBaseCommit().GetSHA()
+	if sha == "" {
+		return "", fmt.Errorf("no merge-base of %s and %s in %s/%s", base, head, owner, repo)
+	}
+	return sha, nil
 }
 
 // Returns true if sha is HEAD of the pull request
@@ -263,6 +344,7 @@ func getExistingComments(ctx context.Context, owner, repo string, prNum int) ([]
 	for i, checkComments := 0, true; checkComments; i++ {
 		checkComments = false
 		comments, resp, err := commentClient.Issues.ListComments(ctx, owner, repo, prNum, &issueListCommentsOpts)
+		observe("issues.list_comments", resp)
 		if resp != nil {
 			log.Info().Msgf("%s received when calling commentClient.PullRequest.ListComments(%s, %s, %d, %v) via go-github", resp.Status, owner, repo, prNum, issueListCommentsOpts)
 			//saveResponse(resp.Header, fmt.Sprintf("comments-header-%d.json", i))
@@ -318,8 +400,10 @@ func Comment(ctx context.Context, owner, repo string, prNum int, sha string, com
 			nextExistingCommentIdx = i + 1
 			existingComment = existingComments[i]
 			issueComment, resp, err = commentClient.Issues.EditComment(ctx, owner, repo, *existingComment.ID, &newComment)
+			observe("issues.edit_comment", resp)
 		} else {
 			issueComment, resp, err = commentClient.Issues.CreateComment(ctx, owner, repo, prNum, &newComment)
+			observe("issues.create_comment", resp)
 		}
 		if resp != nil {
 			log.Info().Msgf("%s received from %s", resp.Status, resp.Request.URL.String())
@@ -344,6 +428,7 @@ func Comment(ctx context.Context, owner, repo string, prNum int, sha string, com
 		truncateCommentBody := "[Outdated argo-diff content]\n\n" + commentIdentifier + "\n"
 		newComment := github.IssueComment{Body: &truncateCommentBody}
 		issueComment, resp, err := commentClient.Issues.EditComment(ctx, owner, repo, *existingComment.ID, &newComment)
+		observe("issues.edit_comment", resp)
 		if resp != nil {
 			log.Info().Msgf("%s received from %s", resp.Status, resp.Request.URL.String())
 		}
@@ -4,12 +4,14 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
 
@@ -28,6 +30,8 @@ const payloadPr2CreateComment = "payload-pr-2-create-comment.json"
 // const payloadPr3UpdateComment = "payload-pr-3-update-comment.json"
 const payloadPatchComment = "payload-pr-patch-comment.json"
 const payloadPullRequest = "payload-pr-get.json"
+const payloadContents = "payload-contents-argo-diff-yaml.json"
+const payloadCompare = "payload-compare.json"
 
 const prHeadSha = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
 
@@ -156,6 +160,17 @@ func newHttpTestServer(t *testing.T) *httptest.Server {
 			case "/repos/vince-riv/argo-diff/issues/4/comments":
 				statusCode = http.StatusOK
 				payload, filePath, err = readFileToByteArray(payloadPr4Comments)
+			case "/repos/vince-riv/argo-diff/contents/.argo-diff.yaml":
+				if r.URL.Query().Get("ref") != "main" {
+					t.Errorf("Expected contents to be fetched at ref main, got %s", r.URL.RawQuery)
+				}
+				statusCode = http.StatusOK
+				payload, filePath, err = readFileToByteArray(payloadContents)
+			case "/repos/vince-riv/argo-diff/contents/missing.yaml":
+				// 404 is the default
+			case "/repos/vince-riv/argo-diff/compare/main..." + prHeadSha:
+				statusCode = http.StatusOK
+				payload, filePath, err = readFileToByteArray(payloadCompare)
 			default:
 				t.Errorf("Mock server not configured to serve path %s", r.URL.Path)
 			}
@@ -349,3 +364,109 @@ func TestCommentNotHead(t *testing.T) {
 		t.Error("Not expecting to comment")
 	}
 }
+
+func TestGetFileContents(t *testing.T) {
+	server := newHttpTestServer(t)
+	defer server.Close()
+	baseURL := server.URL + "/"
+	var err error
+	commentClient, err = github.NewClient(github.WithAuthToken("test1234"), github.WithURLs(&baseURL, &baseURL))
+	if err != nil {
+		t.Fatalf("Failed to create github client: %s", err)
+	}
+
+	content, err := GetFileContents(context.Background(), "vince-riv", "argo-diff", ".argo-diff.yaml", "main")
+	if err != nil {
+		t.Fatalf("GetFileContents() failed: %s", err)
+	}
+	if !strings.HasPrefix(string(content), "apps:\n  exclude:") {
+		t.Errorf("Unexpected file contents: %s", content)
+	}
+
+	content, err = GetFileContents(context.Background(), "vince-riv", "argo-diff", "missing.yaml", "main")
+	if err != nil || content != nil {
+		t.Errorf("Expected no contents and no error for a missing file, got %q, %v", content, err)
+	}
+}
+
+func TestMergeBase(t *testing.T) {
+	server := newHttpTestServer(t)
+	defer server.Close()
+	baseURL := server.URL + "/"
+	var err error
+	commentClient, err = github.NewClient(github.WithAuthToken("test1234"), github.WithURLs(&baseURL, &baseURL))
+	if err != nil {
+		t.Fatalf("Failed to create github client: %s", err)
+	}
+
+	// the merge-base, not the tip of the base branch
+	sha, err := MergeBase(context.Background(), "vince-riv", "argo-diff", "main", prHeadSha)
+	if err != nil || sha != "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb" {
+		t.Errorf("MergeBase() = %s, %v", sha, err)
+	}
+}
+
+// newFilesTestServer lists total files for pull request 5, a page at a time; file-1 is a rename
+func newFilesTestServer(t *testing.T, total int) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/vince-riv/argo-diff/pulls/5/files" {
+			t.Errorf("Mock server not configured to serve path %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		perPage, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		page = max(page, 1)
+		var files []map[string]string
+		for i := (page-1)*perPage + 1; i <= min(page*perPage, total); i++ {
+			f := map[string]string{"filename": fmt.Sprintf("apps/file-%d.yaml", i), "status": "modified"}
+			if i == 1 {
+				f["status"] = "renamed"
+				f["previous_filename"] = "old/file-1.yaml"
+			}
+			files = append(files, f)
+		}
+		if page*perPage < total {
+			w.Header().Set("Link", fmt.Sprintf(`<%s%s?per_page=%d&page=%d>; rel="next"`, server.URL, r.URL.Path, perPage, page+1))
+		}
+		json.NewEncoder(w).Encode(files)
+	}))
+	return server
+}
+
+func TestListPullRequestFiles(t *testing.T) {
+	server := newFilesTestServer(t, 250)
+	defer server.Close()
+	baseURL := server.URL + "/"
+	var err error
+	commentClient, err = github.NewClient(github.WithAuthToken("test1234"), github.WithURLs(&baseURL, &baseURL))
+	if err != nil {
+		t.Fatalf("Failed to create github client: %s", err)
+	}
+
+	files, err := ListPullRequestFiles(context.Background(), "vince-riv", "argo-diff", 5)
+	if err != nil {
+		t.Fatalf("ListPullRequestFiles() failed: %s", err)
+	}
+	// every page, and the rename's previous name
+	if len(files) != 251 || files[0] != "apps/file-1.yaml" || files[1] != "old/file-1.yaml" || files[250] != "apps/file-250.yaml" {
+		t.Errorf("Unexpected files (%d): %v", len(files), files)
+	}
+}
+
+func TestListPullRequestFilesCapped(t *testing.T) {
+	server := newFilesTestServer(t, maxPullRequestFiles)
+	defer server.Close()
+	baseURL := server.URL + "/"
+	var err error
+	commentClient, err = github.NewClient(github.WithAuthToken("test1234"), github.WithURLs(&baseURL, &baseURL))
+	if err != nil {
+		t.Fatalf("Failed to create github client: %s", err)
+	}
+
+	files, err := ListPullRequestFiles(context.Background(), "vince-riv", "argo-diff", 5)
+	if !errors.Is(err, ErrTooManyFiles) || len(files) != maxPullRequestFiles+1 {
+		t.Errorf("ListPullRequestFiles() = %d files, %v; want %d and ErrTooManyFiles", len(files), err, maxPullRequestFiles+1)
+	}
+}
@@ -116,23 +116,34 @@ type ArgoAppMarkdown struct {
 	HealthStatus string
 	HealthMsg    string
 	Preamble     string
+	Callouts     []string
 	Resources    []string
 	Closing      string
+	// CollapseDiffs renders resource diffs collapsed (copied from CommentMarkdown)
+	CollapseDiffs bool
+	// ApplicationSet is set when this is an ApplicationSet, which has no sync or health status, and
+	// no page of its own in the ArgoCD UI
+	ApplicationSet bool
 }
 
 type CommentMarkdown struct {
 	Preamble string
+	// Summary follows the preamble atop the first comment: a table of the applications (SummaryTable)
+	Summary  string
 	ArgoApps []ArgoAppMarkdown
 	Closing  string
+	// CollapseDiffs renders resource diffs collapsed rather than expanded
+	CollapseDiffs bool
 }
 
 func (c *CommentMarkdown) AppMarkdown(appName, warnStr string, syncStatus string, healthStatus string, healthMsg string) *ArgoAppMarkdown {
 	a := ArgoAppMarkdown{
-		AppName:      appName,
-		WarnStr:      warnStr,
-		SyncStatus:   syncStatus,
-		HealthStatus: healthStatus,
-		HealthMsg:    healthMsg,
+		AppName:       appName,
+		WarnStr:       warnStr,
+		SyncStatus:    syncStatus,
+		HealthStatus:  healthStatus,
+		HealthMsg:     healthMsg,
+		CollapseDiffs: c.CollapseDiffs,
 	}
 	c.ArgoApps = append(c.ArgoApps, a)
 	return &c.ArgoApps[len(c.ArgoApps)-1]
@@ -140,7 +151,7 @@ func (c *CommentMarkdown) AppMarkdown(appName, warnStr string, syncStatus string
 
 func (c CommentMarkdown) String() []string {
 	var res []string
-	md := c.Preamble
+	md := c.Preamble + c.Summary
 
 	for _, a := range c.ArgoApps {
 		newMd := a.OverviewStr(false)
@@ -173,13 +184,78 @@ func (c CommentMarkdown) String() []string {
 		}
 		md += "</details>\n\n"
 	}
+	if c.Closing != "" {
+		if len(md+c.Closing) > maxCommentLen {
+			res = append(res, md)
+			md = ""
+		}
+		md += c.Closing
+	}
 	res = append(res, md)
 	return res
 }
 
-func (a *ArgoAppMarkdown) AddResourceDiff(group, kind, name, ns, diffStr string) {
+// jobSummaryMaxLen is the most a GitHub Actions step can write to $GITHUB_STEP_SUMMARY
+const jobSummaryMaxLen = 1024 * 1024
+
+// JobSummary renders md for a GitHub Actions job summary: the preamble and the check run's table of
+// applications, then every diff as one document rather than split into comments
+func JobSummary(md CommentMarkdown) string {
+	summary := md.Preamble + "\n" + md.Summary
+	if md.Summary == "" {
+		summary += appTable(md) + "\n"
+	}
+	md.Preamble, md.Summary = "", ""
+	summary += strings.Join(md.String(), "")
+	return truncateBytes(summary, jobSummaryMaxLen, "\n\n`<<< TRUNCATED - see the pull request comment for the full diff >>>`\n")
+}
+
+// Resource actions, as classified by argocd.AppResource.Action()
+const ResourceAdded = "added"
+const ResourceModified = "modified"
+const ResourceDeleted = "deleted"
+
+// actionMarker is what a resource's summary line says it will do ("" for an unknown action)
+func actionMarker(action string) string {
+	switch action {
+	case ResourceAdded:
+		return ":heavy_plus_sign: create"
+	case ResourceModified:
+		return ":pencil2: update"
+	case ResourceDeleted:
+		return ":wastebasket: delete"
+	}
+	return ""
+}
+
+// AddResourceDiff adds a resource's diff to the application. action is one of the Resource*
+// constants (or "" when unknown); note, when set, is shown above the diff (eg: that a deletion
+// won't be pruned).
+func (a *ArgoAppMarkdown) AddResourceDiff(group, kind, name, ns, action, note, diffStr string) {
+	data := ResourceData{App: a.AppName, Group: group, Kind: kind, Namespace: ns, Name: name, Action: action, Note: note, Collapsed: a.CollapseDiffs}
+	if diffStr != "" {
+		data.Diff = truncateLines(strings.TrimSuffix(diffStr, "\n"), commentLineMaxChar)
+	}
+	if md, ok := ExecuteCommentTemplate(TemplateResource, data); ok {
+		if len(md) > maxResourceDiffLen {
+			data.Diff, data.TooLarge = "", true
+			md, _ = ExecuteCommentTemplate(TemplateResource, data)
+		}
+		a.Resources = append(a.Resources, md)
+		return
+	}
 	md := "\n<details open>\n"
-	md += fmt.Sprintf("  <summary>===== %s/%s %s/%s =====</summary>\n\n", group, kind, ns, name)
+	if a.CollapseDiffs {
+		md = "\n<details>\n"
+	}
+	marker := ""
+	if m := actionMarker(action); m != "" {
+		marker = " (" + m + ")"
+	}
+	md += fmt.Sprintf("  <summary>===== %s/%s %s/%s%s =====</summary>\n\n", group, kind, ns, name, marker)
+	if note != "" {
+		md += "> " + note + "\n\n"
+	}
 	diffMd := ""
 	if diffStr != "" {
 		diffMd += "```diff\n"
@@ -198,25 +274,173 @@ func (a *ArgoAppMarkdown) AddResourceDiff(group, kind, name, ns, diffStr string)
 	a.Resources = append(a.Resources, md)
 }
 
+// Callout types (GitHub alert syntax)
+const CalloutNote = "NOTE"
+const CalloutWarning = "WARNING"
+const CalloutCaution = "CAUTION"
+
+// AddCallout adds an alert block (eg: a policy warning) shown under the application's status
+func (a *ArgoAppMarkdown) AddCallout(calloutType, msg string) {
+	md := fmt.Sprintf("> [!%s]\n", calloutType)
+	for _, line := range strings.Split(strings.TrimRight(msg, "\n"), "\n") {
+		md += "> " + line + "\n"
+	}
+	a.Callouts = append(a.Callouts, md+"\n")
+}
+
 func (a ArgoAppMarkdown) OverviewStr(continued bool) string {
+	data := AppData{
+		Name:           a.AppName,
+		URL:            a.URL(),
+		ApplicationSet: a.ApplicationSet,
+		Sync:           a.SyncStatus,
+		Health:         a.HealthStatus,
+		HealthMessage:  a.HealthMsg,
+		Error:          a.WarnStr,
+		Resources:      len(a.Resources),
+		Continued:      continued,
+	}
+	if !continued {
+		data.Anchor = AppAnchor(a.AppName)
+		data.Callouts = a.Callouts
+	}
+	if md, ok := ExecuteCommentTemplate(TemplateApp, data); ok {
+		return md
+	}
 	md := "\n"
 	if !continued {
 		md += "---\n"
+		md += fmt.Sprintf("<a id=\"%s\"></a>\n", data.Anchor)
 	}
 	md += "<details open>\n"
+	title := capitalizeWords(a.AppName)
+	if a.ApplicationSet {
+		title += " (ApplicationSet)"
+	}
 	if continued {
-		md += fmt.Sprintf("<summary>=== %s (cont.) ===</summary>\n\n", capitalizeWords(a.AppName))
+		md += fmt.Sprintf("<summary>=== %s (cont.) ===</summary>\n\n", title)
 	} else {
-		md += fmt.Sprintf("<summary>=== %s ===</summary>\n\n", capitalizeWords(a.AppName))
+		md += fmt.Sprintf("<summary>=== %s ===</summary>\n\n", title)
 	}
-	if argocdUiUrl != "" {
-		applicationUrl := fmt.Sprintf("%s/applications/argocd/%s", argocdUiUrl, a.AppName)
-		md += fmt.Sprintf("[%s](%s)\n", applicationUrl, applicationUrl)
+	if data.URL != "" {
+		md += fmt.Sprintf("[%s](%s)\n", data.URL, data.URL)
+	}
+	if !a.ApplicationSet {
+		md += syncString(a.SyncStatus) + "\n"
+		md += healthString(a.HealthStatus, a.HealthMsg) + "\n\n"
+	}
+	if !continued {
+		for _, c := range a.Callouts {
+			md += c
+		}
 	}
-	md += syncString(a.SyncStatus) + "\n"
-	md += healthString(a.HealthStatus, a.HealthMsg) + "\n\n"
 	if a.WarnStr != "" {
 		md += "```\n" + a.WarnStr + "```\n\n"
 	}
 	return md
 }
+
+// URL returns the application's page in the ArgoCD UI, or "" when ARGOCD_UI_BASE_URL isn't set (or
+// it's an ApplicationSet)
+func (a ArgoAppMarkdown) URL() string {
+	if a.ApplicationSet {
+		return ""
+	}
+	return AppURL(a.AppName)
+}
+
+// AppURL returns an application's page in the ArgoCD UI, or "" when ARGOCD_UI_BASE_URL isn't set
+func AppURL(appName string) string {
+	if argocdUiUrl == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/applications/argocd/%s", argocdUiUrl, appName)
+}
+
+// AppAnchor returns the id of an application's section of the comment, so the summary table can
+// link to it. It includes ARGO_DIFF_CONTEXT_STR, since several instances may comment on one PR.
+func AppAnchor(appName string) string {
+	anchor := "argo-diff-"
+	if contextStr != "" {
+		anchor += contextStr + "-"
+	}
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' || r == '.' {
+			return unicode.ToLower(r)
+		}
+		return '-'
+	}, anchor+appName)
+}
+
+// AppSummary is one application's row in the summary table. Every application in the table must
+// have a section in the comment for its link to land on.
+type AppSummary struct {
+	Name string
+	// Depth is how many levels of app-of-apps parents are above the application; the table indents
+	// nested applications under their parents, which must come right before them
+	Depth int
+	// New is set for an application that doesn't exist in ArgoCD yet
+	New bool
+	// Removed is set for an application the change deletes
+	Removed bool
+	// ApplicationSet is set for an ApplicationSet, whose rows leave out the status and UI link; the
+	// applications it generates are indented under it
+	ApplicationSet bool
+	Sync           string
+	Health         string
+	Error          bool
+	Added          int
+	Modified       int
+	Deleted        int
+	AutoSync       bool
+}
+
+// How many applications the summary table lists before eliding the rest
+const maxSummaryRows = 100
+
+// SummaryTable renders a table of the applications atop the comment: each one's status, how many
+// resources it adds, modifies and deletes, whether ArgoCD will sync it automatically once the pull
+// request merges, and a link to its section of the comment (which may be in a later comment).
+// Nested app-of-apps applications are indented under their parents, so the table reads as a tree.
+func SummaryTable(apps []AppSummary) string {
+	if len(apps) == 0 {
+		return ""
+	}
+	md := "\n| Application | Sync | Health | Added | Modified | Deleted | Auto-sync on merge | |\n"
+	md += "| ----------- | ---- | ------ | ----: | -------: | ------: | ------------------ | - |\n"
+	for i, a := range apps {
+		if i == maxSummaryRows {
+			md += fmt.Sprintf("| _and %d more_ | | | | | | | |\n", len(apps)-maxSummaryRows)
+			break
+		}
+		name := a.Name
+		if url := AppURL(a.Name); url != "" && !a.ApplicationSet {
+			name = fmt.Sprintf("[%s](%s)", a.Name, url)
+		}
+		sync, health := syncString(a.Sync), healthString(a.Health, "")
+		if a.ApplicationSet {
+			name += " _(ApplicationSet)_"
+			sync, health = "", ""
+		}
+		if a.New {
+			name += " :new:"
+		}
+		if a.Removed {
+			name += " :wastebasket:"
+		}
+		if a.Depth > 0 {
+			name = strings.Repeat("&nbsp;&nbsp;&nbsp;", a.Depth-1) + "&nbsp;↳ " + name
+		}
+		counts := fmt.Sprintf("%d | %d | %d", a.Added, a.Modified, a.Deleted)
+		if a.Error {
+			counts = ":x: error | |"
+		}
+		autoSync := "no"
+		if a.AutoSync {
+			autoSync = ":rocket: yes"
+		}
+		link := fmt.Sprintf("[diff](#%s)", AppAnchor(a.Name))
+		md += fmt.Sprintf("| %s | %s | %s | %s | %s | %s |\n", name, sync, health, counts, autoSync, link)
+	}
+	return md
+}
@@ -0,0 +1,116 @@
+package github
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSummaryTable(t *testing.T) {
+	if SummaryTable(nil) != "" {
+		t.Error("Expected no table without applications")
+	}
+	table := SummaryTable([]AppSummary{
+		{Name: "guestbook", Sync: "OutOfSync", Health: "Healthy", Added: 1, Modified: 2, AutoSync: true},
+		{Name: "broken", Sync: "Unknown", Health: "Missing", Error: true},
+		{Name: "svc-a", Sync: "Synced", Health: "Healthy", Modified: 1, Depth: 2},
+	})
+	for _, want := range []string{
+		"| guestbook | OutOfSync :warning: | Healthy :green_heart: | 1 | 2 | 0 | :rocket: yes | [diff](#argo-diff-guestbook) |\n",
+		"| broken | Unknown :question: | Missing :ghost: | :x: error | | | no | [diff](#argo-diff-broken) |\n",
+		"| &nbsp;&nbsp;&nbsp;&nbsp;↳ svc-a | Synced",
+	} {
+		if !strings.Contains(table, want) {
+			t.Errorf("SummaryTable() is missing %q:\n%s", want, table)
+		}
+	}
+
+	many := make([]AppSummary, maxSummaryRows+5)
+	for i := range many {
+		many[i] = AppSummary{Name: fmt.Sprintf("app-%03d", i)}
+	}
+	table = SummaryTable(many)
+	if !strings.Contains(table, "_and 5 more_") || strings.Contains(table, fmt.Sprintf("app-%03d", maxSummaryRows)) {
+		t.Errorf("Expected SummaryTable() to elide rows past %d", maxSummaryRows)
+	}
+}
+
+func TestAppAnchor(t *testing.T) {
+	if got := AppAnchor("Guestbook.UI"); got != "argo-diff-guestbook.ui" {
+		t.Errorf("AppAnchor() = %s", got)
+	}
+	contextStr = "Prod Cluster"
+	defer func() { contextStr = "" }()
+	if got := AppAnchor("guestbook"); got != "argo-diff-prod-cluster-guestbook" {
+		t.Errorf("AppAnchor() with a context = %s", got)
+	}
+}
+
+// TestSummaryTableSplit checks the table stays whole atop the first comment, and that every section
+// it links to is still in exactly one of the comments once they're split
+func TestSummaryTableSplit(t *testing.T) {
+	c := CommentMarkdown{Preamble: "preamble\n"}
+	var rows []AppSummary
+	diff := strings.Repeat("+"+strings.Repeat("x", 100)+"\n", 1000)
+	for i := 0; i < 8; i++ {
+		name := fmt.Sprintf("app-%d", i)
+		a := c.AppMarkdown(name, "", "OutOfSync", "Healthy", "")
+		a.AddResourceDiff("", "ConfigMap", "cm-1", "default", ResourceAdded, "", diff)
+		a.AddResourceDiff("", "ConfigMap", "cm-2", "default", ResourceAdded, "", diff)
+		rows = append(rows, AppSummary{Name: name, Modified: 2})
+	}
+	c.Summary = SummaryTable(rows)
+
+	comments := c.String()
+	if len(comments) < 2 {
+		t.Fatalf("Expected the comment to be split, got %d", len(comments))
+	}
+	if !strings.HasPrefix(comments[0], c.Preamble+c.Summary) {
+		t.Errorf("Expected the first comment to start with the preamble and table:\n%.500s", comments[0])
+	}
+	for _, r := range rows {
+		anchor := fmt.Sprintf(`<a id="%s"></a>`, AppAnchor(r.Name))
+		found := 0
+		for i, comment := range comments {
+			found += strings.Count(comment, anchor)
+			if i > 0 && strings.Contains(comment, "| Application |") {
+				t.Errorf("Comment %d repeats the table", i)
+			}
+			if len(comment) > maxCommentLen {
+				t.Errorf("Comment %d is %d long, over %d", i, len(comment), maxCommentLen)
+			}
+		}
+		if found != 1 {
+			t.Errorf("Expected the section %s exactly once, found %d", anchor, found)
+		}
+	}
+}
+
+func TestAddResourceDiffMarkers(t *testing.T) {
+	c := CommentMarkdown{}
+	a := c.AppMarkdown("guestbook", "", "OutOfSync", "Healthy", "")
+	a.AddResourceDiff("", "ConfigMap", "new", "default", ResourceAdded, "", "+a: b\n")
+	a.AddResourceDiff("apps", "Deployment", "web", "default", ResourceModified, "", "-replicas: 2\n+replicas: 3\n")
+	a.AddResourceDiff("", "Secret", "old", "default", ResourceDeleted, "Won't be pruned", "-a: b\n")
+	a.AddResourceDiff("", "Service", "svc", "default", "", "", "-a: b\n+a: c\n")
+	for i, want := range []string{
+		"===== /ConfigMap default/new (:heavy_plus_sign: create) =====",
+		"===== apps/Deployment default/web (:pencil2: update) =====",
+		"===== /Secret default/old (:wastebasket: delete) =====</summary>\n\n> Won't be pruned\n\n",
+		"===== /Service default/svc =====",
+	} {
+		if !strings.Contains(a.Resources[i], want) {
+			t.Errorf("Resource %d is missing %q:\n%s", i, want, a.Resources[i])
+		}
+	}
+}
+
+func TestJobSummaryTruncated(t *testing.T) {
+	// two-byte characters, so the cut falls inside one unless it backs off
+	md := CommentMarkdown{Preamble: strings.Repeat("é", jobSummaryMaxLen/2+10)}
+	s := JobSummary(md)
+	if len(s) > jobSummaryMaxLen || !utf8.ValidString(s) || !strings.HasSuffix(s, "<<< TRUNCATED - see the pull request comment for the full diff >>>`\n") {
+		t.Errorf("JobSummary() returned %d bytes (valid UTF-8: %t) ending in %q", len(s), utf8.ValidString(s), s[len(s)-20:])
+	}
+}
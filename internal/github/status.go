@@ -17,6 +17,7 @@ var (
 	statusClient     *github.Client
 	statusContextStr = "argo-diff"
 	skipCommitStatus = false
+	useChecks        = false
 )
 
 const statusDescriptionMaxLen = 140
@@ -35,6 +36,7 @@ func init() {
 		log.Info().Msg("GITHUB_ACTIONS env var is 'true' - will skip setting commit statuses")
 		skipCommitStatus = true
 	}
+	useChecks = os.Getenv("ARGO_DIFF_GITHUB_CHECKS") == "true"
 	// Create Github API client
 	if githubPAT := os.Getenv("GITHUB_PERSONAL_ACCESS_TOKEN"); githubPAT != "" {
 		var err error
@@ -42,6 +44,7 @@ func init() {
 		if err != nil {
 			log.Error().Err(err).Msg("Failed to create github status client")
 		}
+		disableChecksForToken()
 		return
 	}
 	if githubToken := os.Getenv("GITHUB_TOKEN"); githubToken != "" {
@@ -50,6 +53,7 @@ func init() {
 		if err != nil {
 			log.Error().Err(err).Msg("Failed to create github status client")
 		}
+		disableChecksForToken()
 		return
 	}
 	tr := http.DefaultTransport
@@ -75,6 +79,14 @@ func init() {
 	}
 }
 
+// Only GitHub Apps can create check runs, so token auth falls back to commit statuses
+func disableChecksForToken() {
+	if useChecks {
+		log.Warn().Msg("ARGO_DIFF_GITHUB_CHECKS requires GitHub App credentials; using commit statuses instead")
+		useChecks = false
+	}
+}
+
 // Helper that sets commit status for the request commit sha
 func Status(ctx context.Context, status, description, repoOwner, repoName, commitSha string, dryRun bool) error {
 	if skipCommitStatus {
@@ -106,6 +118,7 @@ func Status(ctx context.Context, status, description, repoOwner, repoName, commi
 		return fmt.Errorf("no github status client")
 	}
 	_, resp, err := statusClient.Repositories.CreateStatus(ctx, repoOwner, repoName, commitSha, repoStatus)
+	observe("repos.create_status", resp)
 	if err != nil {
 		log.Error().Err(err).Msgf("Failed to create repo status %s/%s@%s: %s %s '%s'", repoOwner, repoName, commitSha, contextStr, status, description)
 		return err
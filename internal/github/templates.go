@@ -0,0 +1,189 @@
+package github
+
+/*
+ * User-defined comment templates. ARGO_DIFF_COMMENT_TEMPLATES names a file, or a directory such as a
+ * mounted ConfigMap, of Go text/template templates that replace parts of the built-in comment
+ * layout: "preamble", "app", "resource" and "footer". A template that isn't defined keeps the
+ * built-in layout for that part. Comments are still split at maxCommentLen between the rendered
+ * parts, so templated comments paginate the same as the built-in ones.
+ */
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Comment template names
+const TemplatePreamble = "preamble"
+const TemplateApp = "app"
+const TemplateResource = "resource"
+const TemplateFooter = "footer"
+
+// CommentData is what the preamble and footer templates are executed with
+type CommentData struct {
+	// Summary is the headline, eg: "2 of 5 apps with changes"
+	Summary string
+	// ComparedTo is what the head's manifests were compared to, eg: "live state" or "merge-base
+	// abc1234 (desired-state diff)"
+	ComparedTo string
+	// Time is when the results were complete
+	Time    time.Time
+	Owner   string
+	Repo    string
+	PR      int
+	Sha     string
+	BaseRef string
+	// Apps is how many applications matched; AppsWithChanges and AppsWithErrors are subsets of them
+	Apps            int
+	AppsWithChanges int
+	AppsWithErrors  int
+	// Resources is how many resources changed across every application
+	Resources int
+	// NotDiffed are the applications that ran out of time
+	NotDiffed []string
+	// Warnings are the built-in warning blocks (applications not diffed, an invalid repository
+	// config) as markdown, or ""
+	Warnings string
+}
+
+// AppData is what the app template is executed with. Its output opens an application's section,
+// which is closed with "</details>" after its resources, so it should open a <details> element.
+type AppData struct {
+	Name string
+	// URL is the application in the ArgoCD UI ("" without ARGOCD_UI_BASE_URL)
+	URL string
+	// ApplicationSet is true for an ApplicationSet, which has no Sync, Health or URL
+	ApplicationSet bool
+	Sync           string
+	Health         string
+	HealthMessage  string
+	// Error is why the application failed to diff
+	Error string
+	// Callouts are policy warnings and the like, each rendered as a GitHub alert; empty when
+	// Continued
+	Callouts []string
+	// Resources is how many resources changed
+	Resources int
+	// Continued is true when the header is repeated atop the next comment
+	Continued bool
+	// Anchor is the id the summary table links to; put it on an element (eg: <a id="{{ .Anchor }}">).
+	// It's "" when Continued.
+	Anchor string
+}
+
+// ResourceData is what the resource template is executed with
+type ResourceData struct {
+	App       string
+	Group     string
+	Kind      string
+	Namespace string
+	Name      string
+	// Action is "added", "modified" or "deleted" ("" when unknown)
+	Action string
+	// Note is a remark about the change, eg: that a deleted resource won't be pruned by auto-sync
+	Note string
+	// Diff ends in a newline and has its long lines truncated to COMMENT_LINE_MAX_CHARS; it's "" when
+	// TooLarge
+	Diff string
+	// TooLarge is true when the rendered resource wouldn't fit in a comment with its diff
+	TooLarge bool
+	// Collapsed is true when the repository config asks for collapsed diffs
+	Collapsed bool
+}
+
+var templateFuncs = template.FuncMap{
+	"title":        capitalizeWords,
+	"syncStatus":   syncString,
+	"healthStatus": healthString,
+	"join":         strings.Join,
+	"trim":         strings.TrimSpace,
+}
+
+var commentTemplates *template.Template
+
+func init() {
+	templatesPath := strings.TrimSpace(os.Getenv("ARGO_DIFF_COMMENT_TEMPLATES"))
+	if templatesPath == "" {
+		return
+	}
+	var err error
+	commentTemplates, err = LoadCommentTemplates(templatesPath)
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Failed to load ARGO_DIFF_COMMENT_TEMPLATES %s", templatesPath)
+	}
+	log.Info().Msgf("Loaded comment templates from %s", templatesPath)
+}
+
+// LoadCommentTemplates parses the templates in path: a file defining them with {{define}}, or a
+// directory of *.tmpl files, each named for its file (eg: app.tmpl) and free to {{define}} more.
+// Every template it defines is executed once against sample data, so a mistake fails here rather
+// than in a comment.
+func LoadCommentTemplates(path string) (*template.Template, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{path}
+	if fi.IsDir() {
+		if files, err = filepath.Glob(filepath.Join(path, "*.tmpl")); err != nil {
+			return nil, err
+		}
+		sort.Strings(files)
+	}
+	tmpl := template.New("").Funcs(templateFuncs)
+	for _, f := range files {
+		content, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tmpl.New(strings.TrimSuffix(filepath.Base(f), ".tmpl")).Parse(string(content)); err != nil {
+			return nil, err
+		}
+	}
+	samples := map[string]any{
+		TemplatePreamble: CommentData{Summary: "1 of 1 apps with changes", Time: time.Now(), Apps: 1, AppsWithChanges: 1, Resources: 1},
+		TemplateApp:      AppData{Name: "app", Sync: "OutOfSync", Health: "Healthy", Resources: 1},
+		TemplateResource: ResourceData{App: "app", Kind: "ConfigMap", Namespace: "default", Name: "app", Action: ResourceAdded, Diff: "+a: b\n"},
+		TemplateFooter:   CommentData{Summary: "1 of 1 apps with changes", Time: time.Now(), Apps: 1, AppsWithChanges: 1, Resources: 1},
+	}
+	defined := 0
+	for _, name := range []string{TemplatePreamble, TemplateApp, TemplateResource, TemplateFooter} {
+		if !isDefined(tmpl, name) {
+			continue
+		}
+		defined++
+		if err := tmpl.ExecuteTemplate(&strings.Builder{}, name, samples[name]); err != nil {
+			return nil, err
+		}
+	}
+	if defined == 0 {
+		return nil, fmt.Errorf("%s defines none of the %s, %s, %s or %s templates", path, TemplatePreamble, TemplateApp, TemplateResource, TemplateFooter)
+	}
+	return tmpl, nil
+}
+
+func isDefined(tmpl *template.Template, name string) bool {
+	t := tmpl.Lookup(name)
+	return t != nil && t.Tree != nil
+}
+
+// ExecuteCommentTemplate renders the named comment template. It returns false when no such template
+// is defined, or when it fails (which is logged), so the caller falls back to the built-in layout.
+func ExecuteCommentTemplate(name string, data any) (string, bool) {
+	if commentTemplates == nil || !isDefined(commentTemplates, name) {
+		return "", false
+	}
+	var sb strings.Builder
+	if err := commentTemplates.ExecuteTemplate(&sb, name, data); err != nil {
+		log.Error().Err(err).Msgf("Comment template %s failed; using the built-in layout", name)
+		return "", false
+	}
+	return sb.String(), true
+}
@@ -0,0 +1,122 @@
+package github
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const commentTemplatesFile = "comment-templates.tmpl"
+
+func useCommentTemplates(t *testing.T, path string) {
+	tmpl, err := LoadCommentTemplates(path)
+	if err != nil {
+		t.Fatalf("LoadCommentTemplates(%s) err'd: %v", path, err)
+	}
+	commentTemplates = tmpl
+	t.Cleanup(func() { commentTemplates = nil })
+}
+
+func TestCommentTemplates(t *testing.T) {
+	useCommentTemplates(t, filepath.Join(testDataDir, commentTemplatesFile))
+
+	c := CommentMarkdown{Preamble: "preamble\n"}
+	a := c.AppMarkdown("guestbook", "", "OutOfSync", "Healthy", "")
+	a.AddCallout(CalloutWarning, "Policy warning")
+	a.AddResourceDiff("apps", "Deployment", "guestbook", "default", ResourceModified, "", "-replicas: 2\n+replicas: 3\n")
+	_ = c.AppMarkdown("broken", "manifest generation failed\n", "Unknown", "Degraded", "")
+	footer, ok := ExecuteCommentTemplate(TemplateFooter, CommentData{Owner: "vince-riv", Repo: "argo-diff", PR: 7, Apps: 2, AppsWithChanges: 1, Resources: 1})
+	if !ok {
+		t.Fatal("Expected the footer template to be defined")
+	}
+	c.Closing = footer
+
+	comments := c.String()
+	if len(comments) != 1 {
+		t.Fatalf("Expected one comment, got %d", len(comments))
+	}
+	for _, want := range []string{
+		"preamble\n",
+		"<details open><summary>guestbook</summary>\n\nOutOfSync :warning: · Healthy :green_heart: · 1 changed\n> [!WARNING]\n> Policy warning\n",
+		"#### apps/Deployment default/guestbook\n```diff\n-replicas: 2\n+replicas: 3\n```\n",
+		"**Error:** `manifest generation failed`",
+		"</details>\n\n\n<sub>1/2 apps, 1 resources changed in vince-riv/argo-diff#7</sub>\n",
+	} {
+		if !strings.Contains(comments[0], want) {
+			t.Errorf("Templated comment is missing %q:\n%s", want, comments[0])
+		}
+	}
+	if _, ok := ExecuteCommentTemplate(TemplatePreamble, CommentData{}); ok {
+		t.Error("Expected no preamble template, so the built-in one is kept")
+	}
+}
+
+func TestCommentTemplatesSplit(t *testing.T) {
+	useCommentTemplates(t, filepath.Join(testDataDir, commentTemplatesFile))
+
+	// enough resources to fill several comments; each must still fit, with the footer on the last
+	c := CommentMarkdown{Preamble: "preamble\n", Closing: "footer\n"}
+	a := c.AppMarkdown("big", "", "OutOfSync", "Healthy", "")
+	diff := strings.Repeat("+"+strings.Repeat("x", 100)+"\n", 1000)
+	for i := 0; i < 6; i++ {
+		a.AddResourceDiff("", "ConfigMap", "cm", "default", ResourceAdded, "", diff)
+	}
+	comments := c.String()
+	if len(comments) < 2 {
+		t.Fatalf("Expected the comment to be split, got %d", len(comments))
+	}
+	for i, comment := range comments {
+		if len(comment) > maxCommentLen {
+			t.Errorf("Comment %d is %d long, over %d", i, len(comment), maxCommentLen)
+		}
+	}
+	if !strings.Contains(comments[1], "<summary>big (continued)</summary>") {
+		t.Errorf("Expected the app header to be repeated:\n%.200s", comments[1])
+	}
+	if last := comments[len(comments)-1]; !strings.HasSuffix(last, "footer\n") {
+		t.Errorf("Expected the footer at the end of the last comment:\n%s", last[len(last)-200:])
+	}
+
+	// a resource too large for a comment renders without its diff
+	a.AddResourceDiff("", "ConfigMap", "huge", "default", ResourceAdded, "", strings.Repeat("+"+strings.Repeat("x", 100)+"\n", 3000))
+	if got := a.Resources[len(a.Resources)-1]; !strings.Contains(got, "_diff too large to display_") {
+		t.Errorf("Expected the too large resource to render without its diff, got %.200s", got)
+	}
+}
+
+func TestLoadCommentTemplatesDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "preamble.tmpl"), []byte("{{ .Summary }} at {{ .Time.Format \"15:04\" }}\n{{ .Warnings }}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	useCommentTemplates(t, dir)
+	md, ok := ExecuteCommentTemplate(TemplatePreamble, CommentData{Summary: "1 of 1 apps with changes"})
+	if !ok || md != "1 of 1 apps with changes at 00:00\n" {
+		t.Errorf("Unexpected preamble %q, %t", md, ok)
+	}
+	if _, ok := ExecuteCommentTemplate(TemplateApp, AppData{}); ok {
+		t.Error("Expected no app template")
+	}
+}
+
+func TestLoadCommentTemplatesInvalid(t *testing.T) {
+	dir := t.TempDir()
+	cases := map[string]string{
+		"unknown field": `{{ define "app" }}{{ .Nmae }}{{ end }}`,
+		"syntax":        `{{ define "app" }}{{ .Name }{{ end }}`,
+		"nothing":       `{{ define "header" }}{{ .Name }}{{ end }}`,
+	}
+	for name, content := range cases {
+		path := filepath.Join(dir, strings.ReplaceAll(name, " ", "-")+".tmpl")
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadCommentTemplates(path); err == nil {
+			t.Errorf("Expected LoadCommentTemplates() to reject %s", name)
+		}
+	}
+	if _, err := LoadCommentTemplates(filepath.Join(dir, "missing.tmpl")); err == nil {
+		t.Error("Expected LoadCommentTemplates() to fail on a missing file")
+	}
+}
@@ -0,0 +1,281 @@
+package gitlab
+
+/*
+ * Minimal GitLab REST (v4) client - only the handful of endpoints argo-diff needs
+ */
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const defaultBaseUrl = "https://gitlab.com"
+
+// Client is a GitLab API client authenticated with a personal, group, or project access token
+type Client struct {
+	baseUrl    string // eg: https://gitlab.example.com/api/v4
+	token      string
+	httpClient *http.Client
+}
+
+var (
+	// Set as variable so it can be swapped for an httptest-backed client in tests
+	client            *Client
+	contextStr        string
+	commentPreamble   string
+	commentIdentifier string
+	commentLogin      string
+	mux               *sync.RWMutex
+)
+
+func init() {
+	mux = &sync.RWMutex{}
+	contextStr = strings.TrimSpace(os.Getenv("ARGO_DIFF_CONTEXT_STR"))
+	commentPreamble = strings.TrimSpace(os.Getenv("ARGO_DIFF_COMMENT_PREAMBLE"))
+	if commentPreamble == "" {
+		commentPreamble = contextStr
+	}
+	commentIdentifier = fmt.Sprintf("<!-- comment produced by argo-diff[%s] -->", contextStr)
+	statusContextStr = "argo-diff"
+	if contextStr != "" {
+		statusContextStr = "argo-diff/" + contextStr
+	}
+	token := os.Getenv("GITLAB_TOKEN")
+	if token == "" {
+		log.Debug().Msg("GITLAB_TOKEN is not set - GitLab support is disabled")
+		return
+	}
+	client = NewClient(os.Getenv("GITLAB_BASE_URL"), token)
+}
+
+// NewClient returns a client for the GitLab instance at baseUrl (eg: https://gitlab.example.com).
+// An empty baseUrl means gitlab.com.
+func NewClient(baseUrl, token string) *Client {
+	baseUrl = strings.TrimRight(strings.TrimSpace(baseUrl), "/")
+	if baseUrl == "" {
+		baseUrl = defaultBaseUrl
+	}
+	if !strings.HasSuffix(baseUrl, "/api/v4") {
+		baseUrl += "/api/v4"
+	}
+	return &Client{
+		baseUrl:    baseUrl,
+		token:      token,
+		httpClient: &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+// Configured returns true when a GitLab token has been supplied
+func Configured() bool {
+	return client != nil
+}
+
+// projectPath returns the url-encoded project id that GitLab accepts in place of a numeric id.
+// owner is the full namespace (eg: group/subgroup), so it can contain slashes of its own.
+func projectPath(owner, repo string) string {
+	return "/projects/" + url.PathEscape(owner+"/"+repo)
+}
+
+// do sends a request to the GitLab API and decodes a JSON response into out (when non-nil).
+// Non-2xx responses are returned as errors.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body any, out any) (*http.Response, error) {
+	reqUrl := c.baseUrl + path
+	if len(query) > 0 {
+		reqUrl += "?" + query.Encode()
+	}
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, reqUrl, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("PRIVATE-TOKEN", c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	log.Info().Msgf("%s received from %s %s", resp.Status, method, path)
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	if out != nil {
+		if err := json.Unmarshal(respBody, out); err != nil {
+			return resp, fmt.Errorf("decoding response of %s %s: %w", method, path, err)
+		}
+	}
+	return resp, nil
+}
+
+type user struct {
+	Id       int64  `json:"id"`
+	Username string `json:"username"`
+}
+
+// Populates commentLogin singleton with the GitLab user associated with our token
+func getCommentUser(ctx context.Context) error {
+	if client == nil {
+		log.Error().Msg("Cannot call gitlab API - I don't have a client set")
+		return fmt.Errorf("no gitlab client")
+	}
+	mux.RLock()
+	if commentLogin != "" {
+		mux.RUnlock()
+		return nil
+	}
+	mux.RUnlock()
+	log.Debug().Msg("Calling GitLab API to determine comment user")
+	var u user
+	if _, err := client.do(ctx, http.MethodGet, "/user", nil, nil, &u); err != nil {
+		log.Error().Err(err).Msg("Unable to determine my gitlab user")
+		return err
+	}
+	if u.Username == "" {
+		log.Error().Msg("Empty user returned - not sure how I got here")
+		return fmt.Errorf("empty user info")
+	}
+	mux.Lock()
+	commentLogin = u.Username
+	mux.Unlock()
+	log.Info().Msgf("GitLab Comment user name: %s", commentLogin)
+	return nil
+}
+
+func ConnectivityCheck() error {
+	if client == nil {
+		return errors.New("gitlab client is not initialized")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	log.Info().Msg("Calling GitLab API for a connectivity test")
+	return getCommentUser(ctx)
+}
+
+// MergeRequest holds the fields of a GitLab merge request that argo-diff uses
+type MergeRequest struct {
+	Iid          int    `json:"iid"`
+	Sha          string `json:"sha"`
+	SourceBranch string `json:"source_branch"`
+	TargetBranch string `json:"target_branch"`
+	State        string `json:"state"`
+	DiffRefs     struct {
+		// BaseSha is the merge-base of the source and target branches
+		BaseSha  string `json:"base_sha"`
+		StartSha string `json:"start_sha"`
+		HeadSha  string `json:"head_sha"`
+	} `json:"diff_refs"`
+}
+
+// Gets the specified merge request
+func GetMergeRequest(ctx context.Context, owner, repo string, iid int) (*MergeRequest, error) {
+	if client == nil {
+		return nil, fmt.Errorf("no gitlab client")
+	}
+	var mr MergeRequest
+	path := fmt.Sprintf("%s/merge_requests/%d", projectPath(owner, repo), iid)
+	if _, err := client.do(ctx, http.MethodGet, path, nil, nil, &mr); err != nil {
+		log.Error().Err(err).Msgf("Unable to fetch merge request %s/%s!%d", owner, repo, iid)
+		return nil, err
+	}
+	return &mr, nil
+}
+
+type mergeRequestDiff struct {
+	OldPath string `json:"old_path"`
+	NewPath string `json:"new_path"`
+}
+
+// Returns list of files in a merge request
+func ListMergeRequestFiles(ctx context.Context, owner, repo string, iid int) ([]string, error) {
+	if client == nil {
+		return nil, fmt.Errorf("no gitlab client")
+	}
+	var fileList []string
+	path := fmt.Sprintf("%s/merge_requests/%d/diffs", projectPath(owner, repo), iid)
+	query := url.Values{"per_page": []string{"100"}, "page": []string{"1"}}
+	for {
+		var diffs []mergeRequestDiff
+		resp, err := client.do(ctx, http.MethodGet, path, query, nil, &diffs)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range diffs {
+			fileList = append(fileList, d.NewPath)
+			// a renamed file counts under its old name too, like on github
+			if d.OldPath != "" && d.OldPath != d.NewPath {
+				fileList = append(fileList, d.OldPath)
+			}
+		}
+		nextPage := resp.Header.Get("X-Next-Page")
+		if nextPage == "" {
+			break
+		}
+		query.Set("page", nextPage)
+	}
+	return fileList, nil
+}
+
+type repositoryFile struct {
+	Encoding string `json:"encoding"`
+	Content  string `json:"content"`
+}
+
+// Returns the contents of the file at path in a project at ref, or nil when there's no such file
+func GetFile(ctx context.Context, owner, repo, path, ref string) ([]byte, error) {
+	if client == nil {
+		return nil, fmt.Errorf("no gitlab client")
+	}
+	var file repositoryFile
+	reqPath := fmt.Sprintf("%s/repository/files/%s", projectPath(owner, repo), url.PathEscape(path))
+	resp, err := client.do(ctx, http.MethodGet, reqPath, url.Values{"ref": []string{ref}}, nil, &file)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if file.Encoding != "base64" {
+		return []byte(file.Content), nil
+	}
+	return base64.StdEncoding.DecodeString(file.Content)
+}
+
+// Returns true if sha is HEAD of the merge request
+func isMrHead(ctx context.Context, sha, owner, repo string, iid int) bool {
+	mr, err := GetMergeRequest(ctx, owner, repo, iid)
+	if err != nil {
+		log.Warn().Msgf("GetMergeRequest() err'd - assuming %s is HEAD of %s/%s!%d", sha, owner, repo, iid)
+		return true
+	}
+	if mr.Sha == "" {
+		log.Warn().Msgf("%s/%s!%d has no HEAD - assuming %s is not HEAD", owner, repo, iid, sha)
+		return false
+	}
+	return sha == mr.Sha
+}
@@ -0,0 +1,136 @@
+package gitlab
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Note is a GitLab merge request note (comment)
+type Note struct {
+	Id     int64  `json:"id"`
+	Body   string `json:"body"`
+	System bool   `json:"system"`
+	Author user   `json:"author"`
+}
+
+type noteBody struct {
+	Body string `json:"body"`
+}
+
+// Returns a list of merge request notes previously generated by argo-diff.
+// Returns an empty list if there is no matching note
+func getExistingNotes(ctx context.Context, owner, repo string, iid int) ([]*Note, error) {
+	var res []*Note
+	if client == nil {
+		log.Error().Msg("Cannot call gitlab API - I don't have a client set")
+		return nil, fmt.Errorf("no gitlab client")
+	}
+	if err := getCommentUser(ctx); err != nil {
+		return nil, err
+	}
+	path := fmt.Sprintf("%s/merge_requests/%d/notes", projectPath(owner, repo), iid)
+	query := url.Values{
+		"sort":     []string{"asc"},
+		"order_by": []string{"created_at"},
+		"per_page": []string{"100"},
+		"page":     []string{"1"},
+	}
+	for {
+		var notes []*Note
+		resp, err := client.do(ctx, http.MethodGet, path, query, nil, &notes)
+		if err != nil {
+			log.Error().Err(err).Msgf("Unable to fetch MR notes %s/%s!%d", owner, repo, iid)
+			return nil, err
+		}
+		log.Debug().Msgf("Checking %d notes in %s/%s!%d", len(notes), owner, repo, iid)
+		for _, n := range notes {
+			if n == nil || n.System {
+				continue
+			}
+			if strings.Contains(n.Body, commentIdentifier) && n.Author.Username == commentLogin {
+				res = append(res, n)
+			}
+		}
+		nextPage := resp.Header.Get("X-Next-Page")
+		if nextPage == "" {
+			break
+		}
+		query.Set("page", nextPage)
+	}
+	return res, nil
+}
+
+func createNote(ctx context.Context, owner, repo string, iid int, body string) (*Note, error) {
+	var n Note
+	path := fmt.Sprintf("%s/merge_requests/%d/notes", projectPath(owner, repo), iid)
+	_, err := client.do(ctx, http.MethodPost, path, nil, noteBody{Body: body}, &n)
+	return &n, err
+}
+
+func editNote(ctx context.Context, owner, repo string, iid int, noteId int64, body string) (*Note, error) {
+	var n Note
+	path := fmt.Sprintf("%s/merge_requests/%d/notes/%d", projectPath(owner, repo), iid, noteId)
+	_, err := client.do(ctx, http.MethodPut, path, nil, noteBody{Body: body}, &n)
+	return &n, err
+}
+
+// Creates or updates notes on the specified merge request. Behaves like github.Comment(): bodies
+// reuse existing argo-diff notes in order, and leftover notes are marked as outdated.
+func Comment(ctx context.Context, owner, repo string, iid int, sha string, commentBodies []string) ([]*Note, error) {
+	var res []*Note
+	if !isMrHead(ctx, sha, owner, repo, iid) {
+		log.Info().Msgf("%s is not HEAD for %s/%s!%d - skipping comment", sha, owner, repo, iid)
+		return res, nil
+	}
+	existingNotes, err := getExistingNotes(ctx, owner, repo, iid)
+	if err != nil {
+		return res, err
+	}
+	nextExistingNoteIdx := 0
+	for i, commentBody := range commentBodies {
+		newNoteBody := commentPreamble
+		if newNoteBody != "" {
+			newNoteBody += "\n\n"
+		}
+		newNoteBody += commentBody
+		newNoteBody += "\n\n"
+		newNoteBody += commentIdentifier
+		newNoteBody += "\n"
+		var existingNote *Note
+		var note *Note
+		if i < len(existingNotes) {
+			nextExistingNoteIdx = i + 1
+			existingNote = existingNotes[i]
+			note, err = editNote(ctx, owner, repo, iid, existingNote.Id, newNoteBody)
+		} else {
+			note, err = createNote(ctx, owner, repo, iid, newNoteBody)
+		}
+		if err != nil {
+			if existingNote != nil {
+				log.Error().Err(err).Msgf("Failed to update note %d for %s/%s!%d", existingNote.Id, owner, repo, iid)
+			} else {
+				log.Error().Err(err).Msgf("Failed to create note for %s/%s!%d", owner, repo, iid)
+			}
+			return res, err
+		}
+		log.Info().Msgf("Created or Updated note ID %d in %s/%s!%d", note.Id, owner, repo, iid)
+		res = append(res, note)
+	}
+	for nextExistingNoteIdx < len(existingNotes) {
+		existingNote := existingNotes[nextExistingNoteIdx]
+		truncateNoteBody := "[Outdated argo-diff content]\n\n" + commentIdentifier + "\n"
+		note, err := editNote(ctx, owner, repo, iid, existingNote.Id, truncateNoteBody)
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed to update note %d for %s/%s!%d", existingNote.Id, owner, repo, iid)
+		} else {
+			res = append(res, note)
+		}
+		nextExistingNoteIdx++
+	}
+	return res, nil
+}
@@ -0,0 +1,292 @@
+package gitlab
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const testDataDir = "gitlab_testdata"
+const payloadUser = "payload-user.json"
+const payloadMergeRequest = "payload-mr-get.json"
+const payloadMr1Notes = "payload-mr-1-notes.json"
+const payloadMr2Notes = "payload-mr-2-notes.json"
+const payloadMr2NotesPage2 = "payload-mr-2-notes-page-2.json"
+const payloadMr1Diffs = "payload-mr-1-diffs.json"
+const payloadMr1DiffsPage2 = "payload-mr-1-diffs-page-2.json"
+const payloadNote = "payload-note.json"
+const payloadRepositoryFile = "payload-repository-file.json"
+
+const mrHeadSha = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+
+// nested namespace, so every project path exercises url-encoding of the owner
+const testOwner = "platform/gitops"
+const testRepo = "deployments"
+const testProjectPrefix = "/api/v4/projects/platform%2Fgitops%2Fdeployments"
+
+func readFileToByteArray(fileName string) ([]byte, string, error) {
+	workingDir, err := os.Getwd()
+	if err != nil {
+		return nil, "", fmt.Errorf("Error getting current working directory: %w", err)
+	}
+
+	filePath := filepath.Join(workingDir, testDataDir, fileName)
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, filePath, fmt.Errorf("error reading file '%s': %w", filePath, err)
+	}
+
+	return data, filePath, nil
+}
+
+// mockGitlab records the write requests made against it
+type mockGitlab struct {
+	statuses []commitStatus
+	edited   []int64
+	created  int
+}
+
+// withBody replaces the body field in a fixture with the one from the request
+func withBody(fixture []byte, reqBody []byte) ([]byte, error) {
+	var req noteBody
+	if err := json.Unmarshal(reqBody, &req); err != nil {
+		return nil, err
+	}
+	var note map[string]any
+	if err := json.Unmarshal(fixture, &note); err != nil {
+		return nil, err
+	}
+	note["body"] = req.Body
+	return json.Marshal(note)
+}
+
+func newHttpTestServer(t *testing.T, m *mockGitlab) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("PRIVATE-TOKEN") != "test1234" {
+			t.Errorf("Missing PRIVATE-TOKEN header on %s", r.URL)
+		}
+		statusCode := http.StatusOK
+		var payload []byte
+		var fileName string
+		path := r.URL.EscapedPath()
+		page := r.URL.Query().Get("page")
+		parts := strings.Split(strings.TrimPrefix(path, testProjectPrefix+"/"), "/")
+		switch {
+		case path == "/api/v4/user":
+			fileName = payloadUser
+		case !strings.HasPrefix(path, testProjectPrefix+"/"):
+			t.Errorf("Mock server not configured to serve path %s", path)
+			statusCode = http.StatusNotFound
+		case parts[0] == "statuses" && r.Method == http.MethodPost:
+			var cs commitStatus
+			reqBody, _ := io.ReadAll(r.Body)
+			if err := json.Unmarshal(reqBody, &cs); err != nil {
+				t.Errorf("Bad commit status body: %s", reqBody)
+			}
+			m.statuses = append(m.statuses, cs)
+			statusCode = http.StatusCreated
+			payload = []byte(`{}`)
+		case len(parts) == 3 && parts[1] == "files" && parts[2] == ".argo-diff.yaml":
+			if r.URL.Query().Get("ref") != "main" {
+				t.Errorf("Expected the file to be fetched at ref main, got %s", r.URL.RawQuery)
+			}
+			fileName = payloadRepositoryFile
+		case len(parts) == 3 && parts[1] == "files":
+			statusCode = http.StatusNotFound
+			payload = []byte(`{"message":"404 File Not Found"}`)
+		case len(parts) == 2 && parts[0] == "merge_requests":
+			fileName = payloadMergeRequest
+		case len(parts) == 3 && parts[2] == "diffs":
+			if page == "2" {
+				fileName = payloadMr1DiffsPage2
+			} else {
+				w.Header().Set("X-Next-Page", "2")
+				fileName = payloadMr1Diffs
+			}
+		case len(parts) == 3 && parts[2] == "notes" && r.Method == http.MethodGet:
+			switch {
+			case parts[1] == "2" && page == "2":
+				fileName = payloadMr2NotesPage2
+			case parts[1] == "2":
+				w.Header().Set("X-Next-Page", "2")
+				fileName = payloadMr2Notes
+			default:
+				fileName = payloadMr1Notes
+			}
+		case len(parts) == 3 && parts[2] == "notes" && r.Method == http.MethodPost:
+			m.created++
+			statusCode = http.StatusCreated
+			fileName = payloadNote
+		case len(parts) == 4 && parts[2] == "notes" && r.Method == http.MethodPut:
+			var id int64
+			fmt.Sscanf(parts[3], "%d", &id)
+			m.edited = append(m.edited, id)
+			fileName = payloadNote
+		default:
+			t.Errorf("Mock server not configured to serve %s %s", r.Method, path)
+			statusCode = http.StatusNotFound
+		}
+		if fileName != "" {
+			var err error
+			payload, _, err = readFileToByteArray(fileName)
+			if err != nil {
+				t.Errorf("readFileToByteArray() failed: %s", err)
+			}
+			if len(parts) > 1 {
+				payload = bytes.ReplaceAll(payload, []byte("%%_MR_IID_%%"), []byte(parts[1]))
+			}
+			noteId := "9999"
+			if len(parts) == 4 {
+				noteId = parts[3]
+			}
+			payload = bytes.ReplaceAll(payload, []byte("%%_NOTE_ID_%%"), []byte(noteId))
+			if fileName == payloadNote {
+				reqBody, _ := io.ReadAll(r.Body)
+				if payload, err = withBody(payload, reqBody); err != nil {
+					t.Errorf("withBody() failed: %s", err)
+				}
+			}
+		}
+		w.WriteHeader(statusCode)
+		w.Write(payload)
+	}))
+}
+
+func setupTestClient(t *testing.T) *mockGitlab {
+	m := &mockGitlab{}
+	server := newHttpTestServer(t, m)
+	t.Cleanup(server.Close)
+	client = NewClient(server.URL, "test1234")
+	commentLogin = ""
+	return m
+}
+
+func TestListMergeRequestFiles(t *testing.T) {
+	setupTestClient(t)
+	files, err := ListMergeRequestFiles(context.Background(), testOwner, testRepo, 1)
+	if err != nil {
+		t.Fatalf("ListMergeRequestFiles() failed: %s", err)
+	}
+	want := []string{"apps/api/values.yaml", "apps/web/new.yaml", "apps/web/old.yaml", "README.md"}
+	if !slices.Equal(files, want) {
+		t.Errorf("ListMergeRequestFiles() = %v, want %v", files, want)
+	}
+}
+
+func TestGetMergeRequest(t *testing.T) {
+	setupTestClient(t)
+	mr, err := GetMergeRequest(context.Background(), testOwner, testRepo, 1)
+	if err != nil {
+		t.Fatalf("GetMergeRequest() failed: %s", err)
+	}
+	if mr.Iid != 1 || mr.TargetBranch != "main" || mr.DiffRefs.BaseSha != "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb" {
+		t.Errorf("Unexpected merge request %+v", mr)
+	}
+}
+
+func TestGetFile(t *testing.T) {
+	setupTestClient(t)
+	content, err := GetFile(context.Background(), testOwner, testRepo, ".argo-diff.yaml", "main")
+	if err != nil {
+		t.Fatalf("GetFile() failed: %s", err)
+	}
+	if !strings.HasPrefix(string(content), "apps:\n  exclude:") {
+		t.Errorf("Unexpected file contents: %s", content)
+	}
+	content, err = GetFile(context.Background(), testOwner, testRepo, "missing.yaml", "main")
+	if err != nil || content != nil {
+		t.Errorf("Expected no contents and no error for a missing file, got %q, %v", content, err)
+	}
+}
+
+func TestCommentNoExistingNotes(t *testing.T) {
+	m := setupTestClient(t)
+	notes, err := Comment(context.Background(), testOwner, testRepo, 1, mrHeadSha, []string{"argo-diff test comment"})
+	if err != nil {
+		t.Fatalf("Comment() failed: %s", err)
+	}
+	if len(notes) != 1 || notes[0].Id != 9999 {
+		t.Fatalf("Expected one new note, got %+v", notes)
+	}
+	if !strings.Contains(notes[0].Body, "argo-diff test comment") || !strings.Contains(notes[0].Body, commentIdentifier) {
+		t.Errorf("Unexpected note body: %s", notes[0].Body)
+	}
+	if m.created != 1 || len(m.edited) != 0 {
+		t.Errorf("Expected 1 create and 0 edits, got %d and %v", m.created, m.edited)
+	}
+}
+
+func TestCommentExistingNotes(t *testing.T) {
+	m := setupTestClient(t)
+	existing, err := getExistingNotes(context.Background(), testOwner, testRepo, 2)
+	if err != nil {
+		t.Fatalf("getExistingNotes() failed: %s", err)
+	}
+	// note 601 carries the marker but was written by someone else
+	if len(existing) != 2 || existing[0].Id != 602 || existing[1].Id != 603 {
+		t.Fatalf("Unexpected existing notes: %+v", existing)
+	}
+
+	notes, err := Comment(context.Background(), testOwner, testRepo, 2, mrHeadSha, []string{"argo-diff test comment update"})
+	if err != nil {
+		t.Fatalf("Comment() failed: %s", err)
+	}
+	if !slices.Equal(m.edited, []int64{602, 603}) || m.created != 0 {
+		t.Errorf("Expected edits of 602 and 603 without creates, got %v and %d", m.edited, m.created)
+	}
+	if len(notes) != 2 {
+		t.Fatalf("Expected 2 notes, got %d", len(notes))
+	}
+	if !strings.Contains(notes[0].Body, "argo-diff test comment update") {
+		t.Errorf("1st note body doesn't match: %s", notes[0].Body)
+	}
+	if !strings.Contains(notes[1].Body, "[Outdated argo-diff content]") {
+		t.Errorf("2nd note body doesn't match '[Outdated argo-diff content]': %s", notes[1].Body)
+	}
+}
+
+func TestCommentNotHead(t *testing.T) {
+	m := setupTestClient(t)
+	notes, err := Comment(context.Background(), testOwner, testRepo, 1, "1111111111111111111111111111111111111111", []string{"argo-diff test comment"})
+	if err != nil {
+		t.Errorf("Comment() failed: %s", err)
+	}
+	if len(notes) > 0 || m.created > 0 {
+		t.Error("Not expecting to comment")
+	}
+}
+
+func TestStatus(t *testing.T) {
+	m := setupTestClient(t)
+	cases := map[string]string{
+		StatusPending: "pending",
+		StatusSuccess: "success",
+		StatusFailure: "failed",
+		StatusError:   "failed",
+	}
+	for status, want := range cases {
+		m.statuses = nil
+		if err := Status(context.Background(), status, strings.Repeat("x", 300), testOwner, testRepo, mrHeadSha, false); err != nil {
+			t.Fatalf("Status(%s) failed: %s", status, err)
+		}
+		if len(m.statuses) != 1 {
+			t.Fatalf("Status(%s) sent %d requests", status, len(m.statuses))
+		}
+		if got := m.statuses[0]; got.State != want || got.Name != statusContextStr || len(got.Description) != statusDescriptionMaxLen {
+			t.Errorf("Status(%s) sent %+v", status, got)
+		}
+	}
+	if err := Status(context.Background(), "bogus", "", testOwner, testRepo, mrHeadSha, false); err == nil {
+		t.Error("Expected an error for an unknown status")
+	}
+}
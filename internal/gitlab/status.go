@@ -0,0 +1,73 @@
+package gitlab
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+var statusContextStr string
+
+// GitLab commit status descriptions are capped at 255 characters
+const statusDescriptionMaxLen = 255
+
+// Status strings accepted by Status(); they match the github package's so callers can treat the
+// two providers alike
+const StatusPending = "pending"
+const StatusSuccess = "success"
+const StatusFailure = "failure"
+const StatusError = "error"
+
+type commitStatus struct {
+	State       string `json:"state"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// gitlabState maps a github-style status string to a GitLab commit status state. GitLab has no
+// separate "error" state, so both failure and error become "failed".
+func gitlabState(status string) (string, error) {
+	switch status {
+	case StatusPending:
+		return "pending", nil
+	case StatusSuccess:
+		return "success", nil
+	case StatusFailure, StatusError:
+		return "failed", nil
+	}
+	return "", fmt.Errorf("unknown status string '%s'", status)
+}
+
+// Helper that sets commit status for the request commit sha
+func Status(ctx context.Context, status, description, repoOwner, repoName, commitSha string, dryRun bool) error {
+	state, err := gitlabState(status)
+	if err != nil {
+		log.Error().Err(err).Msg("Cannot create gitlab commit status")
+		return err
+	}
+	if len(description) > statusDescriptionMaxLen {
+		description = description[:statusDescriptionMaxLen-3] + "..."
+	}
+	cs := commitStatus{
+		State:       state,
+		Name:        statusContextStr,
+		Description: description,
+	}
+	if dryRun {
+		log.Info().Msgf("DRY RUN: gitlab commit status %s/%s@%s: %+v", repoOwner, repoName, commitSha, cs)
+		return nil
+	}
+	if client == nil {
+		log.Error().Msg("Cannot call gitlab API - I don't have a client set")
+		return fmt.Errorf("no gitlab client")
+	}
+	path := fmt.Sprintf("%s/statuses/%s", projectPath(repoOwner, repoName), commitSha)
+	if _, err := client.do(ctx, http.MethodPost, path, nil, cs, nil); err != nil {
+		log.Error().Err(err).Msgf("Failed to create commit status %s/%s@%s: %s %s '%s'", repoOwner, repoName, commitSha, statusContextStr, state, description)
+		return err
+	}
+	log.Info().Msgf("commit status %s/%s@%s: %s %s '%s'", repoOwner, repoName, commitSha, statusContextStr, state, description)
+	return nil
+}
@@ -0,0 +1,148 @@
+package metrics
+
+/*
+ * Prometheus metrics for argo-diff. Recorded in every mode, but only served (at /metrics) by the
+ * webhook server.
+ */
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "argo_diff"
+
+// Webhook event outcomes
+const OutcomeAccepted = "accepted"
+const OutcomeIgnored = "ignored"
+const OutcomeUnauthorized = "unauthorized"
+const OutcomeError = "error"
+
+// Our own registry rather than prometheus' global one, so nothing else can register into it
+var registry = prometheus.NewRegistry()
+
+// Buckets for diff timings: ArgoCD calls take anywhere from well under a second to the several
+// minutes ARGO_DIFF_TIMEOUT allows
+var durationBuckets = []float64{0.5, 1, 2.5, 5, 10, 20, 30, 60, 120, 180, 300, 600}
+
+var (
+	webhookEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhook_events_total",
+		Help:      "Webhook events received, by provider, event type and outcome.",
+	}, []string{"provider", "event", "outcome"})
+
+	processDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "process_duration_seconds",
+		Help:      "Time taken to process one event end to end, by the commit status it ended with.",
+		Buckets:   durationBuckets,
+	}, []string{"status"})
+
+	waveDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "diff_wave_duration_seconds",
+		Help:      "Time taken by each wave of application diffs.",
+		Buckets:   durationBuckets,
+	}, []string{"wave"})
+
+	notDiffed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "apps_not_diffed_total",
+		Help:      "Applications skipped because processing ran out of time (ARGO_DIFF_TIMEOUT).",
+	})
+
+	workersBusy = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "diff_workers_busy",
+		Help:      "Diff worker pool slots currently in use.",
+	})
+
+	workersLimit = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "diff_workers_limit",
+		Help:      "Size of the most recently started diff worker pool (ARGO_DIFF_MAX_WORKERS).",
+	})
+
+	argocdCliCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "argocd_cli_invocations_total",
+		Help:      "argocd cli invocations, by subcommand and exit code (-1 when it couldn't be run).",
+	}, []string{"subcommand", "exit_code"})
+
+	githubCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "github_api_calls_total",
+		Help:      "GitHub API calls, by endpoint and HTTP status (\"error\" when there was no response).",
+	}, []string{"endpoint", "status"})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		webhookEvents,
+		processDuration,
+		waveDuration,
+		notDiffed,
+		workersBusy,
+		workersLimit,
+		argocdCliCalls,
+		githubCalls,
+	)
+}
+
+// Handler serves the metrics in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{Registry: registry})
+}
+
+// WebhookEvent counts a webhook event received from provider
+func WebhookEvent(provider, event, outcome string) {
+	webhookEvents.WithLabelValues(provider, event, outcome).Inc()
+}
+
+// ObserveProcess records how long an event took to process, and the commit status it ended with
+func ObserveProcess(status string, d time.Duration) {
+	processDuration.WithLabelValues(status).Observe(d.Seconds())
+}
+
+// ObserveWave records how long a wave of application diffs took
+func ObserveWave(wave string, d time.Duration) {
+	waveDuration.WithLabelValues(wave).Observe(d.Seconds())
+}
+
+// NotDiffed counts applications that weren't diffed for lack of time
+func NotDiffed(n int) {
+	notDiffed.Add(float64(n))
+}
+
+// WorkerPoolStarted records the size of a diff worker pool that's starting
+func WorkerPoolStarted(limit int) {
+	workersLimit.Set(float64(limit))
+}
+
+// WorkerBusy marks a worker pool slot as in use; call the returned func when it's released
+func WorkerBusy() func() {
+	workersBusy.Inc()
+	return workersBusy.Dec
+}
+
+// ArgocdCliCall counts an argocd cli invocation
+func ArgocdCliCall(subcommand string, exitCode int) {
+	argocdCliCalls.WithLabelValues(subcommand, strconv.Itoa(exitCode)).Inc()
+}
+
+// GithubApiCall counts a GitHub API call; statusCode is 0 when no response was received
+func GithubApiCall(endpoint string, statusCode int) {
+	status := "error"
+	if statusCode > 0 {
+		status = strconv.Itoa(statusCode)
+	}
+	githubCalls.WithLabelValues(endpoint, status).Inc()
+}
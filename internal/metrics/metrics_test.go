@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestHandler(t *testing.T) {
+	WebhookEvent("github", "pull_request", OutcomeAccepted)
+	ObserveProcess("success", 3*time.Second)
+	ObserveWave("single_source", time.Second)
+	NotDiffed(2)
+	ArgocdCliCall("app diff", 1)
+	GithubApiCall("pulls.get", 200)
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	for _, want := range []string{
+		`argo_diff_webhook_events_total{event="pull_request",outcome="accepted",provider="github"} 1`,
+		`argo_diff_process_duration_seconds_count{status="success"} 1`,
+		`argo_diff_diff_wave_duration_seconds_count{wave="single_source"} 1`,
+		`argo_diff_apps_not_diffed_total 2`,
+		`argo_diff_argocd_cli_invocations_total{exit_code="1",subcommand="app diff"} 1`,
+		`argo_diff_github_api_calls_total{endpoint="pulls.get",status="200"} 1`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("/metrics output is missing %q", want)
+		}
+	}
+}
+
+func TestGithubApiCallNoResponse(t *testing.T) {
+	GithubApiCall("issues.create_comment", 0)
+	if got := testutil.ToFloat64(githubCalls.WithLabelValues("issues.create_comment", "error")); got != 1 {
+		t.Errorf("Expected a call without a response to be counted with status \"error\", got %v", got)
+	}
+}
+
+func TestWorkerBusy(t *testing.T) {
+	WorkerPoolStarted(4)
+	release := WorkerBusy()
+	WorkerBusy()()
+	if got := testutil.ToFloat64(workersBusy); got != 1 {
+		t.Errorf("diff_workers_busy = %v, want 1", got)
+	}
+	release()
+	if got := testutil.ToFloat64(workersBusy); got != 0 {
+		t.Errorf("diff_workers_busy = %v after release, want 0", got)
+	}
+	if got := testutil.ToFloat64(workersLimit); got != 4 {
+		t.Errorf("diff_workers_limit = %v, want 4", got)
+	}
+}
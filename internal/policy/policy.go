@@ -0,0 +1,226 @@
+package policy
+
+/*
+ * Policy rules evaluated over each changed resource. Rules are CEL expressions loaded from the
+ * YAML file named by ARGO_DIFF_POLICY_FILE; a rule whose expression is true for a resource either
+ * denies the change (failing the commit status) or warns about it in the PR comment.
+ */
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"cel.dev/cel-go/cel"
+	"github.com/rs/zerolog/log"
+	"sigs.k8s.io/yaml"
+
+	"github.com/vince-riv/argo-diff/internal/argocd"
+)
+
+// Rule actions
+const ActionDeny = "deny"
+const ActionWarn = "warn"
+
+// Operations a changed resource can undergo
+const OperationCreate = "create"
+const OperationUpdate = "update"
+const OperationDelete = "delete"
+
+// Rule is one policy rule as written in the policy file
+type Rule struct {
+	Name       string `json:"name"`
+	Action     string `json:"action"`
+	Expression string `json:"expression"`
+	Message    string `json:"message,omitempty"`
+	program    cel.Program
+}
+
+// Policy is a parsed and compiled policy file
+type Policy struct {
+	Rules []Rule `json:"rules"`
+}
+
+// Result is a rule that matched a changed resource
+type Result struct {
+	Rule     string
+	Action   string
+	Message  string
+	Resource argocd.AppResource
+}
+
+// Denied returns true when the result fails the run
+func (r Result) Denied() bool {
+	return r.Action == ActionDeny
+}
+
+// String renders the result for the PR comment and commit status
+func (r Result) String() string {
+	res := r.Resource
+	s := fmt.Sprintf("%s/%s %s/%s", res.Group, res.Kind, res.Namespace, res.Name)
+	if r.Message != "" {
+		s = r.Message + " (" + s + ")"
+	}
+	return fmt.Sprintf("[%s] %s", r.Rule, s)
+}
+
+var policy *Policy
+
+func init() {
+	policyFile := strings.TrimSpace(os.Getenv("ARGO_DIFF_POLICY_FILE"))
+	if policyFile == "" {
+		return
+	}
+	var err error
+	policy, err = Load(policyFile)
+	if err != nil {
+		// failing open would silently let through everything the policy is meant to stop
+		log.Fatal().Err(err).Msgf("Failed to load ARGO_DIFF_POLICY_FILE %s", policyFile)
+	}
+	log.Info().Msgf("Loaded %d policy rule(s) from %s", len(policy.Rules), policyFile)
+	// rules read old and new
+	argocd.FetchResourceObjects()
+}
+
+// Enabled returns true when a policy file was loaded
+func Enabled() bool {
+	return policy != nil
+}
+
+// Evaluate runs the loaded policy (if any) over an application's changed resources
+func Evaluate(app argocd.ApplicationResourcesWithChanges) []Result {
+	if policy == nil {
+		return nil
+	}
+	return policy.Evaluate(app)
+}
+
+// Load reads and compiles a policy file
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+var ruleNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Parse parses and compiles a policy document
+func Parse(data []byte) (*Policy, error) {
+	var p Policy
+	if err := yaml.UnmarshalStrict(data, &p); err != nil {
+		return nil, fmt.Errorf("parsing policy: %w", err)
+	}
+	env, err := newEnv()
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if !ruleNameRe.MatchString(r.Name) {
+			return nil, fmt.Errorf("rule %d: invalid name '%s'", i+1, r.Name)
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("rule %s: duplicate name", r.Name)
+		}
+		names[r.Name] = true
+		if r.Action != ActionDeny && r.Action != ActionWarn {
+			return nil, fmt.Errorf("rule %s: action must be '%s' or '%s', not '%s'", r.Name, ActionDeny, ActionWarn, r.Action)
+		}
+		ast, issues := env.Compile(r.Expression)
+		if issues != nil && issues.Err() != nil {
+			return nil, fmt.Errorf("rule %s: %w", r.Name, issues.Err())
+		}
+		if !ast.OutputType().IsExactType(cel.BoolType) && !ast.OutputType().IsExactType(cel.DynType) {
+			return nil, fmt.Errorf("rule %s: expression must be a bool, not %s", r.Name, ast.OutputType())
+		}
+		if r.program, err = env.Program(ast); err != nil {
+			return nil, fmt.Errorf("rule %s: %w", r.Name, err)
+		}
+	}
+	return &p, nil
+}
+
+// newEnv declares the variables rule expressions can use
+func newEnv() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("app", cel.MapType(cel.StringType, cel.StringType)),
+		cel.Variable("resource", cel.MapType(cel.StringType, cel.StringType)),
+		cel.Variable("operation", cel.StringType),
+		cel.Variable("old", cel.DynType),
+		cel.Variable("new", cel.DynType),
+	)
+}
+
+// Evaluate runs every rule over each of an application's changed resources. A rule that fails to
+// evaluate is logged. When the resource is missing an object (`old` on a create, `new` on a delete,
+// or both when the cli backend couldn't find them) the error is taken to be a read of that null
+// and the rule doesn't match; otherwise a deny rule fails closed and denies, and a warn rule
+// doesn't match.
+func (p *Policy) Evaluate(app argocd.ApplicationResourcesWithChanges) []Result {
+	var results []Result
+	if app.ArgoApp == nil {
+		return results
+	}
+	appVars := map[string]string{
+		"name":                 app.ArgoApp.ObjectMeta.Name,
+		"namespace":            app.ArgoApp.ObjectMeta.Namespace,
+		"project":              app.ArgoApp.Spec.Project,
+		"destinationServer":    app.ArgoApp.Spec.Destination.Server,
+		"destinationName":      app.ArgoApp.Spec.Destination.Name,
+		"destinationNamespace": app.ArgoApp.Spec.Destination.Namespace,
+	}
+	for _, res := range app.ChangedResources {
+		vars := map[string]any{
+			"app": appVars,
+			"resource": map[string]string{
+				"apiVersion": res.ApiVersion,
+				"group":      res.Group,
+				"kind":       res.Kind,
+				"namespace":  res.Namespace,
+				"name":       res.Name,
+			},
+			"operation": Operation(res),
+			"old":       nullable(res.Live),
+			"new":       nullable(res.Target),
+		}
+		for _, r := range p.Rules {
+			out, _, err := r.program.Eval(vars)
+			if err != nil {
+				log.Warn().Err(err).Msgf("Policy rule %s failed to evaluate for %s %s/%s %s/%s", r.Name, appVars["name"], res.Group, res.Kind, res.Namespace, res.Name)
+				if r.Action == ActionDeny && res.Live != nil && res.Target != nil {
+					// a deny rule that can't tell fails closed, like a policy file that can't load
+					results = append(results, Result{Rule: r.Name, Action: r.Action, Message: "rule failed to evaluate: " + err.Error(), Resource: res})
+				}
+				continue
+			}
+			if matched, ok := out.Value().(bool); ok && matched {
+				log.Debug().Msgf("Policy rule %s (%s) matched %s %s/%s %s/%s", r.Name, r.Action, appVars["name"], res.Group, res.Kind, res.Namespace, res.Name)
+				results = append(results, Result{Rule: r.Name, Action: r.Action, Message: r.Message, Resource: res})
+			}
+		}
+	}
+	return results
+}
+
+// nullable maps an absent object to CEL's null rather than an empty map
+func nullable(obj map[string]any) any {
+	if obj == nil {
+		return nil
+	}
+	return obj
+}
+
+// Operation classifies a changed resource as created, updated or deleted (see AppResource.Action)
+func Operation(res argocd.AppResource) string {
+	switch res.Action() {
+	case argocd.ActionAdded:
+		return OperationCreate
+	case argocd.ActionDeleted:
+		return OperationDelete
+	}
+	return OperationUpdate
+}
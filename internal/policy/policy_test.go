@@ -0,0 +1,180 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/vince-riv/argo-diff/internal/argocd"
+)
+
+const testPolicy = `
+rules:
+- name: no-pvc-deletion
+  action: deny
+  message: PersistentVolumeClaims must not be deleted
+  expression: operation == "delete" && resource.kind == "PersistentVolumeClaim"
+- name: no-namespace-deletion-in-prod
+  action: deny
+  expression: >-
+    operation == "delete" && resource.kind == "Namespace" && app.project == "production"
+- name: replicas-scaled-down
+  action: warn
+  message: Replicas reduced
+  expression: >-
+    operation == "update" && resource.kind == "Deployment" &&
+    new.spec.replicas < old.spec.replicas
+`
+
+const pvcDeletionDiff = `--- /tmp/argocd-diff1/data-live.yaml	2026-03-02 14:01:12
++++ /tmp/argocd-diff1/data	2026-03-02 14:01:12
+@@ -1,7 +0,0 @@
+-apiVersion: v1
+-kind: PersistentVolumeClaim
+-metadata:
+-  name: data
+-spec:
+-  resources:
+-    requests: {storage: 10Gi}
+`
+
+func testApp(project string, resources ...argocd.AppResource) argocd.ApplicationResourcesWithChanges {
+	return argocd.ApplicationResourcesWithChanges{
+		ArgoApp: &argocd.Application{
+			ObjectMeta: metav1.ObjectMeta{Name: "guestbook", Namespace: "argocd"},
+			Spec:       argocd.ApplicationSpec{Project: project},
+		},
+		ChangedResources: resources,
+	}
+}
+
+func deployment(replicas int64) map[string]any {
+	return map[string]any{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata":   map[string]any{"name": "guestbook-ui"},
+		"spec":       map[string]any{"replicas": replicas},
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	p, err := Parse([]byte(testPolicy))
+	if err != nil {
+		t.Fatalf("Parse() failed: %s", err)
+	}
+	pvc := argocd.AppResource{Kind: "PersistentVolumeClaim", Namespace: "default", Name: "data", DiffStr: pvcDeletionDiff}
+	ns := argocd.AppResource{Kind: "Namespace", Name: "guestbook", Live: map[string]any{"kind": "Namespace"}}
+	scaledDown := argocd.AppResource{Group: "apps", Kind: "Deployment", Namespace: "default", Name: "guestbook-ui", Live: deployment(3), Target: deployment(1)}
+	scaledUp := argocd.AppResource{Group: "apps", Kind: "Deployment", Namespace: "default", Name: "guestbook-ui", Live: deployment(1), Target: deployment(3)}
+	// the cli backend has no objects to compare; the replicas rule can't evaluate and doesn't match
+	cliUpdate := argocd.AppResource{Group: "apps", Kind: "Deployment", Namespace: "default", Name: "guestbook-ui", DiffStr: "@@ -5,1 +5,1 @@\n-  replicas: 3\n+  replicas: 1\n"}
+
+	results := p.Evaluate(testApp("production", pvc, ns, scaledDown, scaledUp, cliUpdate))
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 results, got %+v", results)
+	}
+	want := []struct{ rule, action, name string }{
+		{"no-pvc-deletion", ActionDeny, "data"},
+		{"no-namespace-deletion-in-prod", ActionDeny, "guestbook"},
+		{"replicas-scaled-down", ActionWarn, "guestbook-ui"},
+	}
+	for i, w := range want {
+		r := results[i]
+		if r.Rule != w.rule || r.Action != w.action || r.Resource.Name != w.name {
+			t.Errorf("Result %d = %s %s %s, want %s %s %s", i, r.Rule, r.Action, r.Resource.Name, w.rule, w.action, w.name)
+		}
+	}
+	if !results[0].Denied() || results[2].Denied() {
+		t.Error("Denied() should only be true for deny rules")
+	}
+	if s := results[0].String(); s != "[no-pvc-deletion] PersistentVolumeClaims must not be deleted (/PersistentVolumeClaim default/data)" {
+		t.Errorf("Unexpected String(): %s", s)
+	}
+
+	if results := p.Evaluate(testApp("staging", ns)); len(results) != 0 {
+		t.Errorf("Expected a namespace deletion outside production to pass, got %+v", results)
+	}
+}
+
+// A deny rule that errors over a resource with both objects denies rather than fail open; one that
+// errors reading an object the resource doesn't have doesn't match
+func TestEvaluateFailsClosed(t *testing.T) {
+	p, err := Parse([]byte(`
+rules:
+- name: min-replicas
+  action: deny
+  expression: resource.kind == "Deployment" && new.spec.replicas < 2
+- name: replicas-scaled-down
+  action: warn
+  expression: new.spec.replicas < old.spec.replicas
+`))
+	if err != nil {
+		t.Fatalf("Parse() failed: %s", err)
+	}
+	noReplicas := argocd.AppResource{
+		Group: "apps", Kind: "Deployment", Namespace: "default", Name: "guestbook-ui",
+		Live:   map[string]any{"spec": map[string]any{"replicas": 3}},
+		Target: map[string]any{"spec": map[string]any{}},
+	}
+	results := p.Evaluate(testApp("production", noReplicas))
+	if len(results) != 1 || !results[0].Denied() || results[0].Rule != "min-replicas" || !strings.HasPrefix(results[0].Message, "rule failed to evaluate: ") {
+		t.Errorf("Expected only the deny rule to deny, got %+v", results)
+	}
+
+	noObjects := argocd.AppResource{Group: "apps", Kind: "Deployment", Namespace: "default", Name: "guestbook-ui", DiffStr: "@@ -5,1 +5,1 @@\n-  replicas: 3\n+  replicas: 1\n"}
+	if results := p.Evaluate(testApp("production", noObjects)); len(results) != 0 {
+		t.Errorf("Expected no results without the objects, got %+v", results)
+	}
+	deleted := argocd.AppResource{Group: "apps", Kind: "Deployment", Namespace: "default", Name: "guestbook-ui", Live: map[string]any{"spec": map[string]any{"replicas": 3}}}
+	if results := p.Evaluate(testApp("production", deleted)); len(results) != 0 {
+		t.Errorf("Expected no results reading new on a delete, got %+v", results)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := map[string]string{
+		"bad action":     "rules:\n- name: a\n  action: block\n  expression: 'true'\n",
+		"bad expression": "rules:\n- name: a\n  action: deny\n  expression: 'operation =='\n",
+		"not a bool":     "rules:\n- name: a\n  action: deny\n  expression: 'resource.kind'\n",
+		"unknown var":    "rules:\n- name: a\n  action: deny\n  expression: 'cluster == \"prod\"'\n",
+		"duplicate name": "rules:\n- name: a\n  action: deny\n  expression: 'true'\n- name: a\n  action: warn\n  expression: 'true'\n",
+		"missing name":   "rules:\n- action: deny\n  expression: 'true'\n",
+		"unknown field":  "rules:\n- name: a\n  action: deny\n  expr: 'true'\n",
+	}
+	for desc, doc := range cases {
+		if _, err := Parse([]byte(doc)); err == nil {
+			t.Errorf("%s: expected Parse() to fail", desc)
+		}
+	}
+}
+
+func TestOperation(t *testing.T) {
+	cases := []struct {
+		res  argocd.AppResource
+		want string
+	}{
+		{argocd.AppResource{Target: map[string]any{}}, OperationCreate},
+		{argocd.AppResource{Live: map[string]any{}}, OperationDelete},
+		{argocd.AppResource{Live: map[string]any{}, Target: map[string]any{}}, OperationUpdate},
+		{argocd.AppResource{DiffStr: "--- a\n+++ b\n@@ -0,0 +1,4 @@\n+apiVersion: v1\n"}, OperationCreate},
+		{argocd.AppResource{DiffStr: pvcDeletionDiff}, OperationDelete},
+		{argocd.AppResource{DiffStr: "@@ -5,9 +5,9 @@\n-a\n+b\n"}, OperationUpdate},
+		{argocd.AppResource{DiffStr: "no hunks"}, OperationUpdate},
+	}
+	for _, c := range cases {
+		if got := Operation(c.res); got != c.want {
+			t.Errorf("Operation(%+v) = %s, want %s", c.res, got, c.want)
+		}
+	}
+}
+
+func TestEvaluateNoPolicy(t *testing.T) {
+	if Enabled() {
+		t.Skip("ARGO_DIFF_POLICY_FILE is set")
+	}
+	pvc := argocd.AppResource{Kind: "PersistentVolumeClaim", Name: "data", DiffStr: pvcDeletionDiff}
+	if results := Evaluate(testApp("production", pvc)); len(results) != 0 {
+		t.Errorf("Expected no results without a policy file, got %+v", results)
+	}
+}
@@ -2,6 +2,7 @@ package process_event
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"strconv"
@@ -12,6 +13,10 @@ import (
 	"github.com/rs/zerolog/log"
 	"github.com/vince-riv/argo-diff/internal/argocd"
 	"github.com/vince-riv/argo-diff/internal/github"
+	"github.com/vince-riv/argo-diff/internal/metrics"
+	"github.com/vince-riv/argo-diff/internal/render"
+	"github.com/vince-riv/argo-diff/internal/repoconfig"
+	"github.com/vince-riv/argo-diff/internal/results"
 	"github.com/vince-riv/argo-diff/internal/webhook"
 )
 
@@ -56,19 +61,46 @@ func reportReserve(timeout time.Duration) time.Duration {
 	return defaultReportReserve
 }
 
-// timeoutMarkdown renders the PR comment warning about applications that
-// weren't diffed. The list of names is capped so a change matching hundreds of
-// applications can't crowd the diffs out of the comment.
-func timeoutMarkdown(timeout time.Duration, notDiffed []string) string {
-	const maxNames = 20
-	names := strings.Join(notDiffed, ", ")
-	if len(notDiffed) > maxNames {
-		names = fmt.Sprintf("%s and %d more", strings.Join(notDiffed[:maxNames], ", "), len(notDiffed)-maxNames)
-	}
-	md := "\n> [!WARNING]\n"
-	md += fmt.Sprintf("> argo-diff ran out of time, so %d application(s) were **not** diffed: %s\n", len(notDiffed), names)
-	md += fmt.Sprintf(">\n> Raise the timeout (currently %s, set via `ARGO_DIFF_TIMEOUT` or the `timeout` input in GitHub Actions) to diff them.\n", timeout)
-	return md
+// SweepPreviewApps deletes the temporary Applications that previews of new applications left
+// behind (see argocd.SweepPreviewApps): those older than the longest a run can take, which is
+// ARGO_DIFF_TIMEOUT or the most a repository can raise it to, plus the time reporting gets
+func SweepPreviewApps(ctx context.Context) {
+	argocd.SweepPreviewApps(ctx, max(processTimeout(), repoconfig.MaxTimeout)+defaultReportReserve)
+}
+
+// loadRepoConfig reads the repository's config from the base branch. A file that's missing or
+// can't be fetched means no config; one that doesn't validate is returned as an error, to be
+// reported in the comment.
+func loadRepoConfig(ctx context.Context, scm scmProvider, eventInfo webhook.EventInfo) (*repoconfig.Config, error) {
+	if !repoconfig.Enabled() || eventInfo.BaseRef == "" {
+		return nil, nil
+	}
+	data, err := scm.getFile(ctx, eventInfo, repoconfig.Path, eventInfo.BaseRef)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Unable to fetch %s from %s/%s@%s; using the defaults", repoconfig.Path, eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.BaseRef)
+		return nil, nil
+	}
+	if data == nil {
+		return nil, nil
+	}
+	cfg, err := repoconfig.Parse(data)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Invalid %s in %s/%s@%s; using the defaults", repoconfig.Path, eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.BaseRef)
+		return nil, err
+	}
+	log.Debug().Msgf("Loaded %s from %s/%s@%s: %+v", repoconfig.Path, eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.BaseRef, cfg)
+	return cfg, nil
+}
+
+// withoutIgnoredKinds drops the resources of kinds the repository's config ignores
+func withoutIgnoredKinds(resources []argocd.AppResource, cfg *repoconfig.Config) []argocd.AppResource {
+	var res []argocd.AppResource
+	for _, r := range resources {
+		if !cfg.IgnoresKind(r.Group, r.Kind) {
+			res = append(res, r)
+		}
+	}
+	return res
 }
 
 // Returns first 7 characters of a string (to produce a short commit sha)
@@ -82,15 +114,26 @@ func shortSha(str string) string {
 }
 */
 
-// Processes github webhook event data by getting a list of matching argo applications & their manifests and generating diffs
-// Sets Github status checks for the relevant commit sha and posts a Github comment it is a pull-request event
+// Processes github/gitlab webhook event data by getting a list of matching argo applications &
+// their manifests and generating diffs
+// Sets commit status checks for the relevant commit sha and posts a comment on the pull (or
+// merge) request
 // Designed to run within a gorouting to decouple from the webhook response
 func ProcessCodeChange(eventInfo webhook.EventInfo, devMode bool, wg *sync.WaitGroup, callerErr *error) {
 	defer wg.Done()
+	processCodeChange(context.Background(), eventInfo, devMode, callerErr)
+}
+
+// processCodeChange is ProcessCodeChange on a cancellable parent context; the JobManager cancels
+// it with ErrSuperseded when the pull request gets a newer head commit
+func processCodeChange(parent context.Context, eventInfo webhook.EventInfo, devMode bool, callerErr *error) {
 	// TODO figure out how to call github.Status() with an error status when there's a timeout
+	start := time.Now()
+	finalStatus := github.StatusError // the commit status this run ends with, for metrics
+	defer func() { metrics.ObserveProcess(finalStatus, time.Since(start)) }()
 	timeout := processTimeout()
 	log.Debug().Msgf("Processing event with a %s timeout", timeout)
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	ctx, cancel := context.WithTimeout(parent, timeout)
 	defer cancel()
 
 	// Validate this is a PR event (required for PR-only support)
@@ -100,37 +143,57 @@ func ProcessCodeChange(eventInfo webhook.EventInfo, devMode bool, wg *sync.WaitG
 		return
 	}
 
+	scm := providerFor(eventInfo)
+
 	// Get PR details if this is a refresh event
 	if eventInfo.Refresh {
-		pull, err := github.GetPullRequest(ctx, eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.PrNum)
-		if err != nil {
-			log.Error().Err(err).Msgf("github.GetPullRequest(%s, %s, %d) failed", eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.PrNum)
+		if err := scm.refresh(ctx, &eventInfo); err != nil {
+			log.Error().Err(err).Msgf("Failed to refresh %s %s/%s#%d", eventInfo.Provider, eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.PrNum)
 			*callerErr = err
 			return
 		}
-		base := pull.GetBase()
-		head := pull.GetHead()
-		if base == nil || head == nil {
-			log.Error().Msgf("Empty branch information when refreshing %s/%s#%d", eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.PrNum)
-			*callerErr = fmt.Errorf("empty branch information when refreshing %s/%s#%d", eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.PrNum)
-			return
-		}
-		eventInfo.Sha = *head.SHA
-		eventInfo.ChangeRef = *head.Ref
-		eventInfo.BaseRef = *base.Ref
+	}
+
+	// the repository's own config, from the base branch, overrides the defaults for this run
+	repoCfg, repoCfgErr := loadRepoConfig(ctx, scm, eventInfo)
+	if t := repoCfg.TimeoutOr(timeout); t != timeout {
+		log.Debug().Msgf("Using %s's %s timeout", repoconfig.Path, t)
+		timeout = t
+		var repoCancel context.CancelFunc
+		ctx, repoCancel = context.WithDeadline(parent, start.Add(timeout))
+		defer repoCancel()
 	}
 
 	// Get list of changed files in the PR
-	changedFiles, err := github.ListPullRequestFiles(ctx, eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.PrNum)
-	if err != nil {
+	var warnings []string // problems with the run as a whole, for the results document
+	changedFiles, err := scm.listChangedFiles(ctx, eventInfo)
+	filesTruncated := errors.Is(err, github.ErrTooManyFiles)
+	if filesTruncated {
+		// an incomplete list would filter out apps whose files it doesn't reach: match them all
+		log.Warn().Err(err).Msgf("Not applying manifest-generate-paths to %s/%s#%d", eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.PrNum)
+		warnings = append(warnings, fmt.Sprintf("%s, so manifest-generate-paths wasn't applied: every application the repository matches was diffed", err))
+	} else if err != nil {
 		*callerErr = err
+		warnings = append(warnings, fmt.Sprintf("unable to list changed files, so manifest-generate-paths wasn't applied: %s", err))
+		changedFiles = nil
 		log.Error().Err(err).Msgf("Failed to list pull request files for %s/%s#%d", eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.PrNum)
 	} else {
 		eventInfo.ChangedFiles = changedFiles
 	}
 
-	// set commit status to PENDING
-	err = github.Status(ctx, github.StatusPending, "", eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.Sha, devMode)
+	// a desired-state diff renders the manifests at the merge-base too; without one, the live state
+	// is all there is to diff against
+	diffMode := repoCfg.DiffModeOr(argocd.DiffMode())
+	if diffMode != argocd.DiffModeLive {
+		if eventInfo.MergeBase, err = scm.mergeBase(ctx, eventInfo); err != nil {
+			log.Warn().Err(err).Msgf("Unable to find the merge-base of %s/%s#%d; diffing against the live state", eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.PrNum)
+			warnings = append(warnings, fmt.Sprintf("unable to find the merge-base, so the live state was diffed instead of the desired state: %s", err))
+			diffMode = argocd.DiffModeLive
+		}
+	}
+
+	// set commit status to PENDING (or start the check run)
+	err = scm.pending(ctx, eventInfo, devMode)
 	if err != nil {
 		log.Warn().Err(err).Msgf("Failed to set commit status %s for %s/%s@%s", github.StatusPending, eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.Sha)
 	}
@@ -141,104 +204,89 @@ func ProcessCodeChange(eventInfo webhook.EventInfo, devMode bool, wg *sync.WaitG
 	// eaten the reserve, diffing gets whatever is left of the budget instead. Reporting survives
 	// either way, because the context it uses below doesn't derive from this one.
 	reserve := reportReserve(timeout)
-	diffCtx, diffCancel := context.WithTimeout(ctx, timeout-reserve)
+	matchLog := &argocd.MatchLog{}
+	diffCtx, diffCancel := context.WithTimeout(argocd.NewMatchContext(repoconfig.NewContext(ctx, repoCfg), matchLog), timeout-reserve)
 	defer diffCancel()
+	diffStart := time.Now()
 	appResList, notDiffed, err := argocd.GetApplicationChanges(diffCtx, eventInfo)
+	diffDuration := time.Since(diffStart)
 
 	// report on a context of its own: the one above may be at or past its
 	// deadline, and a partial comment is far more useful than no comment
 	reportCtx, reportCancel := context.WithTimeout(context.Background(), reserve)
 	defer reportCancel()
 
+	if errors.Is(context.Cause(ctx), ErrSuperseded) {
+		// the newer commit's run will comment; just don't leave this commit's status pending (nor
+		// failed, since nothing went wrong)
+		log.Info().Msgf("Run for %s/%s#%d@%s was superseded by a newer commit", eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.PrNum, eventInfo.Sha)
+		_ = scm.finish(reportCtx, eventInfo, runResult{status: github.StatusSuccess, conclusion: github.ConclusionNeutral, description: ErrSuperseded.Error()}, devMode)
+		*callerErr = ErrSuperseded
+		finalStatus = "superseded"
+		return
+	}
+
 	if err != nil {
 		log.Error().Err(err).Msg("argocd.GetApplicationChanges() failed")
-		_ = github.Status(reportCtx, github.StatusError, err.Error(), eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.Sha, devMode)
+		res := runResult{status: github.StatusError, conclusion: github.ConclusionFailure, description: err.Error()}
+		_ = scm.finish(reportCtx, eventInfo, res, devMode)
+		results.Record(failedDocument(eventInfo, res, err, start))
 		*callerErr = err
 		return // we're done due to a processing error
 	}
+	metrics.NotDiffed(len(notDiffed))
 	log.Debug().Msgf("argocd.GetApplicationChanges() returned %d results", len(appResList))
-	log.Trace().Msgf("argocd.GetApplicationChanges() returned: %+v", appResList)
-
-	errorCount := 0   // keep track of the number of errors
-	changeCount := 0  // how many apps have changes
-	unknownCount := 0 // how many apps we can't determine if there's changes (usually when we can new manifests but not current ones)
-	firstError := ""  // string of the first error we receive - used in commit status message
-	cMarkdown := github.CommentMarkdown{}
 	for _, a := range appResList {
-		appName := a.ArgoApp.ObjectMeta.Name
-		appSyncStatus := a.ArgoApp.Status.Sync.Status
-		appHealthStatus := a.ArgoApp.Status.Health.Status
-		appHealthMsg := a.ArgoApp.Status.Health.Message
-		// appNs := a.ArgoApp.ObjectMeta.Namespance
-		if a.WarnStr != "" {
-			log.Trace().Msgf("%s has WarnStr %s", appName, a.WarnStr)
-			errorCount++
-			_ = cMarkdown.AppMarkdown(appName, "Error: "+a.WarnStr, appSyncStatus, appHealthStatus, appHealthMsg)
-			if firstError == "" {
-				firstError = a.WarnStr
-			}
-		} else {
-			log.Trace().Msgf("%s has %d Changed Resources", appName, len(a.ChangedResources))
-			if len(a.ChangedResources) > 0 {
-				changeCount++
-				appMarkdown := cMarkdown.AppMarkdown(appName, "", appSyncStatus, appHealthStatus, appHealthMsg)
-				for _, ar := range a.ChangedResources {
-					appMarkdown.AddResourceDiff(ar.Group, ar.Kind, ar.Name, ar.Namespace, ar.DiffStr)
-				}
-			}
+		name := ""
+		if a.ArgoApp != nil {
+			name = a.ArgoApp.ObjectMeta.Name
 		}
+		log.Trace().Msgf("argocd.GetApplicationChanges() returned %s: %d changed %v, %d live", name, len(a.ChangedResources), a.ChangedResources, len(a.LiveResources))
 	}
 
-	// commit status is currently pending, newStatus will be the updated status (default to error)
-	newStatus := github.StatusError //nolint:ineffassign
-	statusDescription := "Unknown"  //nolint:ineffassign
-	changeCountStr := fmt.Sprintf("%d of %d apps with changes", changeCount, len(appResList))
-	if unknownCount > 0 {
-		changeCountStr += fmt.Sprintf(" [%d apps unknown]", unknownCount)
+	s := summarize(appResList, repoCfg)
+	diffFormat := repoCfg.DiffFormatOr(argocd.DiffFormat())
+	res := s.outcome(len(appResList), notDiffed, timeout)
+	if res.err != nil && (*callerErr == nil || s.errorCount > 0) {
+		// a failed diff outranks a failure to list the changed files
+		*callerErr = res.err
 	}
+	statusDescription := res.description
 	if len(notDiffed) > 0 {
-		changeCountStr += fmt.Sprintf(" [%d apps not diffed]", len(notDiffed))
-	}
-	markdownStart := changeCountStr // markdownStart is the pre-amble of the github comment
-
-	if errorCount > 0 {
-		// if we had errors, commit status should be a failure
-		newStatus = github.StatusFailure
-		statusDescription = fmt.Sprintf("%s; %d had an error; first error: %s", changeCountStr, errorCount, firstError)
-		*callerErr = fmt.Errorf("%d application(s) failed to generate a diff; first error: %s", errorCount, firstError)
-	} else if firstError != "" {
-		// if we had a recoverable error, commit status can be a success (but let's give them the first error)
-		newStatus = github.StatusSuccess
-		statusDescription = fmt.Sprintf("%s; diff generator failed; first error: %s", changeCountStr, firstError)
-	} else {
-		// else everything is happy - commit status success
-		newStatus = github.StatusSuccess
-		statusDescription = fmt.Sprintf("%s - no errors", changeCountStr)
+		warnings = append(warnings, fmt.Sprintf("ran out of time (timeout %s); %d application(s) were not diffed", timeout, len(notDiffed)))
 	}
-	if len(notDiffed) > 0 {
-		// results are incomplete - fail rather than report success on a partial diff
-		newStatus = github.StatusFailure
-		statusDescription = fmt.Sprintf("%d app(s) not diffed (timed out); %s", len(notDiffed), statusDescription)
-		if *callerErr == nil {
-			*callerErr = fmt.Errorf("timed out (ARGO_DIFF_TIMEOUT is %s); %d application(s) were not diffed", timeout, len(notDiffed))
-		}
+	if repoCfgErr != nil {
+		statusDescription = fmt.Sprintf("invalid %s ignored; %s", repoconfig.Path, statusDescription)
+		warnings = append(warnings, fmt.Sprintf("invalid %s on %s ignored: %s", repoconfig.Path, eventInfo.BaseRef, repoCfgErr))
 	}
-	// send the commit status
-	_ = github.Status(reportCtx, newStatus, statusDescription, eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.Sha, devMode)
 
-	// Post PR comment when something has happened
-	t := time.Now()
-	tStr := t.Format("3:04PM MST, 2 Jan 2006")
-	markdownStart += " compared to live state\n"
-	markdownStart += "\n" + tStr + "\n"
-	if len(notDiffed) > 0 {
-		markdownStart += timeoutMarkdown(timeout, notDiffed)
+	// the PR comment and check run are rendered from the results document, the same as `argo-diff render`
+	doc := s.document(eventInfo, res, notDiffed, diffFormat, matchLog)
+	doc.DiffMode = diffMode
+	if diffMode != argocd.DiffModeLive {
+		doc.MergeBase = eventInfo.MergeBase
+	}
+	doc.ChangedFiles, doc.ChangedFilesTruncated = changedFiles, filesTruncated
+	doc.Status.Description = statusDescription
+	doc.Warnings = append(doc.Warnings, warnings...)
+	if repoCfgErr != nil {
+		doc.RepoConfigError = repoCfgErr.Error()
 	}
-	cMarkdown.Preamble = markdownStart
-	if changeCount == 0 && firstError == "" && len(notDiffed) == 0 {
+	doc.Timings = results.Timings{Started: start, Finished: time.Now(), DiffMs: diffDuration.Milliseconds(), TimeoutMs: timeout.Milliseconds()}
+	doc.Timings.DurationMs = doc.Timings.Finished.Sub(start).Milliseconds()
+	cMarkdown := render.Markdown(doc, render.Options{CollapseDiffs: repoCfg.CollapseDiffs()})
+
+	// send the commit status (or complete the check run, which carries the diffs too)
+	finalStatus = res.status
+	_ = scm.finish(reportCtx, eventInfo, runResult{status: res.status, conclusion: res.conclusion, description: statusDescription, markdown: &cMarkdown}, devMode)
+
+	// Post PR comment when something has happened
+	if s.changeCount == 0 && s.firstError == "" && len(notDiffed) == 0 && repoCfgErr == nil {
 		// if there are no changes or warnings, don't comment (but clear out any existing comments)
-		_, _ = github.Comment(reportCtx, eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.PrNum, eventInfo.Sha, []string{})
+		_ = scm.comment(reportCtx, eventInfo, []string{})
 	} else {
-		_, _ = github.Comment(reportCtx, eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.PrNum, eventInfo.Sha, cMarkdown.String())
+		_ = scm.comment(reportCtx, eventInfo, cMarkdown.String())
 	}
+
+	results.Record(doc)
 }
@@ -1,11 +1,18 @@
 package process_event
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"os"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/vince-riv/argo-diff/internal/argocd"
+	"github.com/vince-riv/argo-diff/internal/render"
+	"github.com/vince-riv/argo-diff/internal/repoconfig"
+	"github.com/vince-riv/argo-diff/internal/results"
+	"github.com/vince-riv/argo-diff/internal/webhook"
 )
 
 func TestProcessTimeout(t *testing.T) {
@@ -50,38 +57,77 @@ func TestReportReserve(t *testing.T) {
 	}
 }
 
-func TestTimeoutMarkdown(t *testing.T) {
-	md := timeoutMarkdown(3*time.Minute, []string{"app-a", "app-b"})
-	for _, want := range []string{"[!WARNING]", "3m0s", "2 application(s)", "app-a, app-b", "ARGO_DIFF_TIMEOUT"} {
-		if !strings.Contains(md, want) {
-			t.Errorf("timeoutMarkdown() = %q, missing %q", md, want)
-		}
+func TestProcessTimeoutUnset(t *testing.T) {
+	// t.Setenv registers the restore of any pre-existing value for us
+	t.Setenv("ARGO_DIFF_TIMEOUT", "")
+	if err := os.Unsetenv("ARGO_DIFF_TIMEOUT"); err != nil {
+		t.Fatalf("os.Unsetenv() err'd: %v", err)
+	}
+	if got := processTimeout(); got != defaultProcessTimeout {
+		t.Errorf("processTimeout() with ARGO_DIFF_TIMEOUT unset = %s, want %s", got, defaultProcessTimeout)
+	}
+}
+
+// fileProvider serves getFile from a map; the rest of scmProvider isn't needed by loadRepoConfig
+type fileProvider struct {
+	scmProvider
+	files map[string]string
+	err   error
+}
+
+func (p fileProvider) getFile(ctx context.Context, eventInfo webhook.EventInfo, path, ref string) ([]byte, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	content, ok := p.files[ref+":"+path]
+	if !ok {
+		return nil, nil
 	}
+	return []byte(content), nil
+}
 
-	// long lists get capped so the diffs aren't crowded out of the comment
-	many := make([]string, 25)
-	for i := range many {
-		many[i] = fmt.Sprintf("app-%02d", i)
+func TestLoadRepoConfig(t *testing.T) {
+	eventInfo := webhook.EventInfo{RepoOwner: "vince-riv", RepoName: "argo-diff", BaseRef: "main"}
+	scm := fileProvider{files: map[string]string{
+		"main:" + repoconfig.Path:    "timeout: 10m\n",
+		"release:" + repoconfig.Path: "timeout: whenever\n",
+	}}
+	cfg, err := loadRepoConfig(context.Background(), scm, eventInfo)
+	if err != nil || cfg.TimeoutOr(time.Minute) != 10*time.Minute {
+		t.Errorf("Expected the base branch's config to load, got %+v, %v", cfg, err)
 	}
-	md = timeoutMarkdown(time.Minute, many)
-	if !strings.Contains(md, "and 5 more") {
-		t.Errorf("timeoutMarkdown() with 25 apps = %q, want it to cap the list", md)
+
+	eventInfo.BaseRef = "release"
+	if cfg, err = loadRepoConfig(context.Background(), scm, eventInfo); err == nil || cfg != nil {
+		t.Errorf("Expected an invalid config to be returned as an error, got %+v, %v", cfg, err)
 	}
-	if strings.Contains(md, "app-24") {
-		t.Errorf("timeoutMarkdown() with 25 apps = %q, want names past the cap omitted", md)
+	md := render.Markdown(results.Document{Event: eventInfo, RepoConfigError: err.Error()}, render.Options{}).Preamble
+	if !strings.Contains(md, "[!CAUTION]") || !strings.Contains(md, "`.argo-diff.yaml` on `release` is invalid") || !strings.Contains(md, "timeout") {
+		t.Errorf("Unexpected comment preamble: %s", md)
 	}
-	if !strings.Contains(md, "25 application(s)") {
-		t.Errorf("timeoutMarkdown() with 25 apps = %q, want the full count reported", md)
+
+	// a missing file, or one that can't be fetched, just means the defaults
+	eventInfo.BaseRef = "develop"
+	if cfg, err = loadRepoConfig(context.Background(), scm, eventInfo); err != nil || cfg != nil {
+		t.Errorf("Expected no config for a missing file, got %+v, %v", cfg, err)
+	}
+	scm.err = errors.New("403 Forbidden")
+	if cfg, err = loadRepoConfig(context.Background(), scm, eventInfo); err != nil || cfg != nil {
+		t.Errorf("Expected no config when the file can't be fetched, got %+v, %v", cfg, err)
 	}
 }
 
-func TestProcessTimeoutUnset(t *testing.T) {
-	// t.Setenv registers the restore of any pre-existing value for us
-	t.Setenv("ARGO_DIFF_TIMEOUT", "")
-	if err := os.Unsetenv("ARGO_DIFF_TIMEOUT"); err != nil {
-		t.Fatalf("os.Unsetenv() err'd: %v", err)
+func TestWithoutIgnoredKinds(t *testing.T) {
+	cfg, err := repoconfig.Parse([]byte("ignoreKinds: [Secret, apps/ReplicaSet]\n"))
+	if err != nil {
+		t.Fatalf("repoconfig.Parse() failed: %s", err)
 	}
-	if got := processTimeout(); got != defaultProcessTimeout {
-		t.Errorf("processTimeout() with ARGO_DIFF_TIMEOUT unset = %s, want %s", got, defaultProcessTimeout)
+	resources := []argocd.AppResource{{Kind: "Secret"}, {Group: "apps", Kind: "ReplicaSet"}, {Group: "apps", Kind: "Deployment"}}
+	got := withoutIgnoredKinds(resources, cfg)
+	if len(got) != 1 || got[0].Kind != "Deployment" {
+		t.Errorf("withoutIgnoredKinds() = %+v, want only the Deployment", got)
+	}
+	if got := withoutIgnoredKinds(resources, nil); len(got) != 3 {
+		t.Errorf("withoutIgnoredKinds() with no config dropped resources: %+v", got)
 	}
 }
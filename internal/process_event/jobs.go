@@ -0,0 +1,171 @@
+package process_event
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/vince-riv/argo-diff/internal/webhook"
+)
+
+// How long the webhook server waits for a pull request to go quiet before diffing it. A burst of
+// pushes (or a push followed by an `argo diff` comment) then costs one run instead of one each.
+const defaultDebounce = 5 * time.Second
+
+// debounce returns the debounce window from ARGO_DIFF_DEBOUNCE. The value is a Go duration string
+// (eg: "10s"); a bare integer is treated as seconds, and 0 disables debouncing. Invalid or negative
+// values fall back to the default.
+func debounce() time.Duration {
+	envVal := strings.TrimSpace(os.Getenv("ARGO_DIFF_DEBOUNCE"))
+	if envVal == "" {
+		return defaultDebounce
+	}
+	if d, err := time.ParseDuration(envVal); err == nil && d >= 0 {
+		return d
+	}
+	if secs, err := strconv.Atoi(envVal); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	log.Warn().Msgf("Invalid value for ARGO_DIFF_DEBOUNCE: %s; must be a duration (eg: '10s') or 0; using %s", envVal, defaultDebounce)
+	return defaultDebounce
+}
+
+// ErrSuperseded is the cancellation cause of a run whose pull request got a newer head commit
+var ErrSuperseded = errors.New("superseded by a newer commit")
+
+// prJob is the JobManager's state for one pull request
+type prJob struct {
+	pending    *webhook.EventInfo      // latest event not yet run; newer events replace it
+	timer      *time.Timer             // debounce timer for pending
+	waiting    bool                    // timer is scheduled and hasn't fired
+	running    bool                    // a run is in flight
+	runningSha string                  // head sha of the in-flight run ("" for an unresolved refresh)
+	cancel     context.CancelCauseFunc // cancels the in-flight run
+}
+
+// JobManager runs webhook events through ProcessCodeChange with at most one run per pull request at
+// a time. Events for the same pull request are debounced and coalesced (the latest one wins), and a
+// new head sha cancels the in-flight run for the old one. Each accepted event holds a slot in the
+// caller's WaitGroup until it has run (or been coalesced into a later event), so graceful shutdown
+// waits for queued events as well as running ones.
+type JobManager struct {
+	wg       *sync.WaitGroup
+	debounce time.Duration
+	// run processes one event; set as a field so tests can replace it
+	run func(ctx context.Context, eventInfo webhook.EventInfo)
+
+	mu   sync.Mutex
+	jobs map[string]*prJob
+}
+
+func NewJobManager(wg *sync.WaitGroup, devMode bool) *JobManager {
+	return &JobManager{
+		wg:       wg,
+		debounce: debounce(),
+		run: func(ctx context.Context, eventInfo webhook.EventInfo) {
+			var ignoredError error // nobody left to report it to
+			processCodeChange(ctx, eventInfo, devMode, &ignoredError)
+		},
+		jobs: make(map[string]*prJob),
+	}
+}
+
+func jobKey(eventInfo webhook.EventInfo) string {
+	return fmt.Sprintf("%s:%s/%s#%d", eventInfo.Provider, eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.PrNum)
+}
+
+// Submit queues an event for processing
+func (m *JobManager) Submit(eventInfo webhook.EventInfo) {
+	key := jobKey(eventInfo)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[key]
+	if !ok {
+		job = &prJob{}
+		m.jobs[key] = job
+	}
+	// a refresh (no sha yet) doesn't supersede anything; it runs once the current run is done
+	if job.running && eventInfo.Sha != "" && eventInfo.Sha != job.runningSha {
+		log.Info().Msgf("Cancelling in-flight run of %s@%s; superseded by %s", key, job.runningSha, eventInfo.Sha)
+		job.cancel(ErrSuperseded)
+	}
+	if job.pending == nil {
+		m.wg.Add(1) // released when this event (or one that replaces it) finishes running
+	} else {
+		log.Debug().Msgf("Coalescing queued event for %s@%s into %s", key, job.pending.Sha, eventInfo.Sha)
+		// an explicit refresh request survives being coalesced with a push
+		eventInfo.Refresh = eventInfo.Refresh || job.pending.Refresh
+	}
+	job.pending = &eventInfo
+	if m.debounce <= 0 {
+		if !job.running {
+			m.start(key, job)
+		}
+		return
+	}
+	if job.timer == nil {
+		job.timer = time.AfterFunc(m.debounce, func() { m.fire(key, job) })
+	} else {
+		job.timer.Reset(m.debounce)
+	}
+	job.waiting = true
+}
+
+// fire runs the pending event once its debounce window has passed
+func (m *JobManager) fire(key string, job *prJob) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.jobs[key] != job {
+		return // a stale timer; the job it was for has finished
+	}
+	job.waiting = false
+	if job.running || job.pending == nil {
+		return // done() picks the pending event up when the in-flight run finishes
+	}
+	m.start(key, job)
+}
+
+// start launches the pending event; m.mu must be held
+func (m *JobManager) start(key string, job *prJob) {
+	eventInfo := *job.pending
+	job.pending = nil
+	ctx, cancel := context.WithCancelCause(context.Background())
+	job.running = true
+	job.runningSha = eventInfo.Sha
+	job.cancel = cancel
+	log.Debug().Msgf("Starting run for %s@%s", key, eventInfo.Sha)
+	go func() {
+		defer m.done(key)
+		m.run(ctx, eventInfo)
+	}()
+}
+
+// done records the end of a run, and starts the next one if an event arrived meanwhile
+func (m *JobManager) done(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	defer m.wg.Done()
+	job := m.jobs[key]
+	job.cancel(nil)
+	job.running = false
+	job.runningSha = ""
+	switch {
+	case job.pending != nil && !job.waiting:
+		m.start(key, job)
+	case job.pending == nil:
+		delete(m.jobs, key)
+	}
+}
+
+// Active returns the number of pull requests with a queued or in-flight run
+func (m *JobManager) Active() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.jobs)
+}
@@ -0,0 +1,143 @@
+package process_event
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vince-riv/argo-diff/internal/webhook"
+)
+
+func TestDebounce(t *testing.T) {
+	cases := map[string]time.Duration{
+		"":      defaultDebounce,
+		"10s":   10 * time.Second,
+		"2":     2 * time.Second,
+		"0":     0,
+		"0s":    0,
+		"bogus": defaultDebounce,
+		"-1s":   defaultDebounce,
+	}
+	for envVal, want := range cases {
+		t.Setenv("ARGO_DIFF_DEBOUNCE", envVal)
+		if got := debounce(); got != want {
+			t.Errorf("ARGO_DIFF_DEBOUNCE=%q: debounce() = %s, want %s", envVal, got, want)
+		}
+	}
+}
+
+// recordingRuns returns a JobManager whose runs are recorded instead of processed. Each run blocks
+// until release is closed or its context is cancelled.
+type recordingRuns struct {
+	mu         sync.Mutex
+	shas       []string
+	causes     []error
+	active     int
+	maxActive  int
+	started    chan string
+	release    chan struct{}
+	releaseOne sync.Once
+}
+
+func newTestJobManager(wg *sync.WaitGroup, debounce time.Duration) (*JobManager, *recordingRuns) {
+	r := &recordingRuns{started: make(chan string, 10), release: make(chan struct{})}
+	m := &JobManager{wg: wg, debounce: debounce, jobs: make(map[string]*prJob)}
+	m.run = func(ctx context.Context, eventInfo webhook.EventInfo) {
+		r.mu.Lock()
+		r.shas = append(r.shas, eventInfo.Sha)
+		r.active++
+		r.maxActive = max(r.maxActive, r.active)
+		r.mu.Unlock()
+		r.started <- eventInfo.Sha
+		select {
+		case <-ctx.Done():
+		case <-r.release:
+		}
+		r.mu.Lock()
+		r.active--
+		r.causes = append(r.causes, context.Cause(ctx))
+		r.mu.Unlock()
+	}
+	return m, r
+}
+
+func (r *recordingRuns) finish() {
+	r.releaseOne.Do(func() { close(r.release) })
+}
+
+func prEvent(prNum int, sha string) webhook.EventInfo {
+	e := webhook.NewEventInfo()
+	e.RepoOwner = "owner"
+	e.RepoName = "repo"
+	e.PrNum = prNum
+	e.Sha = sha
+	return e
+}
+
+func TestJobManagerCoalescesBurst(t *testing.T) {
+	var wg sync.WaitGroup
+	m, r := newTestJobManager(&wg, 50*time.Millisecond)
+	r.finish()
+	for _, sha := range []string{"sha1", "sha2", "sha3"} {
+		m.Submit(prEvent(1, sha))
+	}
+	m.Submit(prEvent(2, "other"))
+	wg.Wait()
+	if len(r.shas) != 2 {
+		t.Fatalf("Expected 1 run per PR, got %v", r.shas)
+	}
+	for _, sha := range r.shas {
+		if sha != "sha3" && sha != "other" {
+			t.Errorf("Unexpected run for %s; the burst should coalesce into its latest event", sha)
+		}
+	}
+	if m.Active() != 0 {
+		t.Errorf("Active() = %d after all runs finished", m.Active())
+	}
+}
+
+func TestJobManagerCancelsSupersededRun(t *testing.T) {
+	var wg sync.WaitGroup
+	m, r := newTestJobManager(&wg, 0)
+	m.Submit(prEvent(1, "sha1"))
+	<-r.started
+	// a refresh has no sha yet and must not cancel the in-flight run
+	refresh := prEvent(1, "")
+	refresh.Refresh = true
+	m.Submit(refresh)
+	m.Submit(prEvent(1, "sha2"))
+	if sha := <-r.started; sha != "sha2" {
+		t.Fatalf("Expected the next run to be for sha2, got %s", sha)
+	}
+	r.finish()
+	wg.Wait()
+	if len(r.shas) != 2 {
+		t.Fatalf("Expected 2 runs, got %v", r.shas)
+	}
+	if !errors.Is(r.causes[0], ErrSuperseded) {
+		t.Errorf("First run's cause = %v, want ErrSuperseded", r.causes[0])
+	}
+	if r.maxActive != 1 {
+		t.Errorf("Expected at most one run per PR at a time, got %d", r.maxActive)
+	}
+}
+
+func TestJobManagerSameShaNotCancelled(t *testing.T) {
+	var wg sync.WaitGroup
+	m, r := newTestJobManager(&wg, 0)
+	m.Submit(prEvent(1, "sha1"))
+	<-r.started
+	m.Submit(prEvent(1, "sha1")) // eg: a redelivered webhook
+	r.mu.Lock()
+	if len(r.causes) != 0 {
+		t.Errorf("In-flight run was cancelled by an event for the same sha")
+	}
+	r.mu.Unlock()
+	r.finish()
+	wg.Wait()
+	if len(r.shas) != 2 || r.maxActive != 1 {
+		t.Errorf("Expected 2 sequential runs, got %v (max %d at once)", r.shas, r.maxActive)
+	}
+}
@@ -0,0 +1,72 @@
+package process_event
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/vince-riv/argo-diff/internal/argocd"
+	"github.com/vince-riv/argo-diff/internal/render"
+	"github.com/vince-riv/argo-diff/internal/repoconfig"
+	"github.com/vince-riv/argo-diff/internal/results"
+	"github.com/vince-riv/argo-diff/internal/webhook"
+)
+
+// LocalDiffOptions controls how ProcessLocalDiff renders its results
+type LocalDiffOptions struct {
+	// Format is render.FormatText, render.FormatMarkdown, render.FormatJSON or another of
+	// render.Formats
+	Format string
+	// Color highlights render.FormatText output with ANSI escape codes
+	Color bool
+	// RepoConfig stands in for the repository's .argo-diff.yaml (nil for the defaults)
+	RepoConfig *repoconfig.Config
+}
+
+// ProcessLocalDiff diffs the ArgoCD applications matching eventInfo, the same way ProcessCodeChange
+// does, and writes the results to w instead of reporting them to a pull request. It needs no
+// source control credentials: eventInfo must already carry the sha, refs and changed files. The
+// returned error is what would have failed the pull request's commit status.
+func ProcessLocalDiff(eventInfo webhook.EventInfo, opts LocalDiffOptions, w io.Writer) error {
+	start := time.Now()
+	timeout := opts.RepoConfig.TimeoutOr(processTimeout())
+	log.Debug().Msgf("Diffing %s/%s@%s with a %s timeout", eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.Sha, timeout)
+	// without a merge-base, the live state is all there is to diff against
+	diffMode := opts.RepoConfig.DiffModeOr(argocd.DiffMode())
+	if eventInfo.MergeBase == "" && diffMode != argocd.DiffModeLive {
+		log.Warn().Msgf("No merge-base to render the desired state at; diffing against the live state instead of %s", diffMode)
+		diffMode = argocd.DiffModeLive
+	}
+	matchLog := &argocd.MatchLog{}
+	ctx, cancel := context.WithTimeout(argocd.NewMatchContext(repoconfig.NewContext(context.Background(), opts.RepoConfig), matchLog), timeout)
+	defer cancel()
+	appResList, notDiffed, err := argocd.GetApplicationChanges(ctx, eventInfo)
+	diffDuration := time.Since(start)
+	if err != nil {
+		log.Error().Err(err).Msg("argocd.GetApplicationChanges() failed")
+		return err
+	}
+
+	s := summarize(appResList, opts.RepoConfig)
+	res := s.outcome(len(appResList), notDiffed, timeout)
+	doc := s.document(eventInfo, res, notDiffed, opts.RepoConfig.DiffFormatOr(argocd.DiffFormat()), matchLog)
+	doc.DiffMode = diffMode
+	if diffMode != argocd.DiffModeLive {
+		doc.MergeBase = eventInfo.MergeBase
+	}
+	if len(notDiffed) > 0 {
+		doc.Warnings = append(doc.Warnings, fmt.Sprintf("ran out of time (timeout %s); %d application(s) were not diffed", timeout, len(notDiffed)))
+	}
+	doc.Timings = results.Timings{Started: start, Finished: time.Now(), DiffMs: diffDuration.Milliseconds(), TimeoutMs: timeout.Milliseconds()}
+	doc.Timings.DurationMs = doc.Timings.Finished.Sub(start).Milliseconds()
+	out, err := render.Render(doc, opts.Format, render.Options{CollapseDiffs: opts.RepoConfig.CollapseDiffs(), Color: opts.Color})
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, out); err != nil {
+		return err
+	}
+	return res.err
+}
@@ -0,0 +1,392 @@
+package process_event
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/vince-riv/argo-diff/internal/argocd"
+	"github.com/vince-riv/argo-diff/internal/github"
+	"github.com/vince-riv/argo-diff/internal/policy"
+	"github.com/vince-riv/argo-diff/internal/repoconfig"
+	"github.com/vince-riv/argo-diff/internal/results"
+	"github.com/vince-riv/argo-diff/internal/webhook"
+)
+
+// callout is a note attached to an application's results (a github.Callout* type and its text)
+type callout struct {
+	kind string
+	msg  string
+}
+
+// appResult is one application's results with the repository config and policy rules applied
+type appResult struct {
+	argocd.ApplicationResourcesWithChanges
+	callouts []callout
+}
+
+// summary is the outcome of diffing every matching application, before it's rendered for a PR
+// comment or a terminal
+type summary struct {
+	apps         []appResult
+	errorCount   int    // apps that failed to diff
+	changeCount  int    // apps with changes
+	unknownCount int    // apps we can't tell whether there's changes for (usually when we get new manifests but not current ones)
+	firstError   string // the first error we receive - used in the commit status message
+	denyCount    int    // policy denials
+	firstDenial  policy.Result
+	added        int // resources to create
+	modified     int // resources to update
+	deleted      int // resources to delete
+	unpruned     int // deletions ArgoCD won't prune on its own (a subset of deleted)
+	removedApps  int // nested Applications the change deletes
+}
+
+// summarize tallies the results of argocd.GetApplicationChanges, dropping the resources of kinds
+// the repository's config ignores and evaluating the policy rules it doesn't turn off
+func summarize(appResList []argocd.ApplicationResourcesWithChanges, repoCfg *repoconfig.Config) summary {
+	var s summary
+	for _, a := range appResList {
+		appName := a.ArgoApp.ObjectMeta.Name
+		res := appResult{ApplicationResourcesWithChanges: a}
+		if a.WarnStr != "" {
+			log.Trace().Msgf("%s has WarnStr %s", appName, a.WarnStr)
+			s.errorCount++
+			if s.firstError == "" {
+				s.firstError = a.WarnStr
+			}
+			s.apps = append(s.apps, res)
+			continue
+		}
+		if a.NewApp {
+			res.callouts = append(res.callouts, callout{github.CalloutNote, appName + " is a new Application: it doesn't exist in ArgoCD yet, so these are all of the resources it will deploy"})
+		}
+		if a.Removal != nil {
+			s.changeCount++
+			s.removedApps++
+			if a.Removal.Cascade {
+				s.deleted += len(a.Removal.Resources)
+				if a.Removal.Prune != argocd.PruneAutomatic {
+					s.unpruned += len(a.Removal.Resources)
+				}
+			}
+			res.callouts = append(res.callouts, callout{github.CalloutCaution, removalMessage(appName, a.Parent, a.Removal)})
+			s.apps = append(s.apps, res)
+			continue
+		}
+		for _, note := range a.Notes {
+			res.callouts = append(res.callouts, callout{github.CalloutWarning, note})
+		}
+		res.ChangedResources = withoutIgnoredKinds(a.ChangedResources, repoCfg)
+		if a.LiveResources != nil {
+			res.LiveResources = withoutIgnoredKinds(a.LiveResources, repoCfg)
+		}
+		log.Trace().Msgf("%s has %d Changed Resources", appName, len(res.ChangedResources))
+		for _, r := range res.ChangedResources {
+			switch r.Action() {
+			case argocd.ActionAdded:
+				s.added++
+			case argocd.ActionDeleted:
+				s.deleted++
+				if res.PruneOutcome(r) != argocd.PruneAutomatic {
+					s.unpruned++
+				}
+			default:
+				s.modified++
+			}
+		}
+		if len(res.ChangedResources) > 0 {
+			s.changeCount++
+			// the policy judges the change, so drift it leaves alone isn't held against it
+			changeOnly := res.ApplicationResourcesWithChanges
+			changeOnly.ChangedResources = withoutDrift(res.ChangedResources)
+			for _, pr := range policy.Evaluate(changeOnly) {
+				if !repoCfg.PolicyApplies(pr.Rule) {
+					log.Debug().Msgf("Policy rule %s is turned off by %s", pr.Rule, repoconfig.Path)
+					continue
+				}
+				if pr.Denied() {
+					if s.denyCount == 0 {
+						s.firstDenial = pr
+					}
+					s.denyCount++
+					res.callouts = append(res.callouts, callout{github.CalloutCaution, "Denied by policy " + pr.String()})
+				} else {
+					res.callouts = append(res.callouts, callout{github.CalloutWarning, "Policy warning " + pr.String()})
+				}
+			}
+		}
+		s.apps = append(s.apps, res)
+	}
+	return s
+}
+
+// How many of a removed application's resources removalMessage lists
+const maxRemovedResources = 50
+
+// removalMessage warns what deleting a nested Application does to the resources it manages: when
+// its parent deletes it, and whether they go with it or are orphaned. It lists the resources.
+func removalMessage(appName, parent string, removal *argocd.AppRemoval) string {
+	n := len(removal.Resources)
+	var msg string
+	switch {
+	case removal.Prune == argocd.PruneRetained:
+		msg = fmt.Sprintf("This change stops ApplicationSet %s generating Application %s, but its applicationsSync policy means it won't delete it.", parent, appName)
+		if removal.Cascade {
+			msg += fmt.Sprintf(" If it's deleted by hand, its resources finalizer deletes all %d resource(s) it manages.", n)
+		}
+	case removal.Prune == argocd.PruneDisabled:
+		msg = fmt.Sprintf("This change removes Application %s from %s, but its Prune=false sync option means ArgoCD won't delete it.", appName, parent)
+		if removal.Cascade {
+			msg += fmt.Sprintf(" If it's deleted by hand, its resources finalizer deletes all %d resource(s) it manages.", n)
+		}
+	case removal.Cascade:
+		when := "once " + parent + " is synced with pruning"
+		if removal.Prune == argocd.PruneAutomatic {
+			when = "as soon as " + parent + " auto-syncs"
+		}
+		msg = fmt.Sprintf("This change deletes Application %s, and its resources finalizer deletes all %d resource(s) it manages along with it, %s.", appName, n, when)
+	default:
+		msg = fmt.Sprintf("This change deletes Application %s from %s. It has no resources finalizer, so its %d resource(s) are orphaned: they stay in the cluster, no longer managed by ArgoCD.", appName, parent, n)
+	}
+	if n > 0 {
+		msg += "\n"
+	}
+	for i, r := range removal.Resources {
+		if i == maxRemovedResources {
+			msg += fmt.Sprintf("\n- _and %d more_", n-maxRemovedResources)
+			break
+		}
+		msg += "\n- `" + r.String() + "`"
+	}
+	return msg
+}
+
+// withoutDrift drops the resources whose diff is only pre-existing drift (see argocd.OriginDrift)
+func withoutDrift(resources []argocd.AppResource) []argocd.AppResource {
+	var res []argocd.AppResource
+	for _, r := range resources {
+		if r.Origin != argocd.OriginDrift {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+// resourceCountStr counts the changed resources by what syncing them does, deletions first since
+// they're the riskiest, eg: "(2 to delete [1 not pruned], 1 to create)"; it's "" without changes
+func (s summary) resourceCountStr() string {
+	var counts []string
+	if s.deleted > 0 {
+		str := fmt.Sprintf("%d to delete", s.deleted)
+		if s.unpruned > 0 {
+			str += fmt.Sprintf(" [%d not pruned]", s.unpruned)
+		}
+		counts = append(counts, str)
+	}
+	if s.added > 0 {
+		counts = append(counts, fmt.Sprintf("%d to create", s.added))
+	}
+	if s.modified > 0 {
+		counts = append(counts, fmt.Sprintf("%d to update", s.modified))
+	}
+	if len(counts) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(counts, ", ") + ")"
+}
+
+// outcome is how a run ends, given its summary
+type outcome struct {
+	status         string // commit status
+	conclusion     string // the equivalent check run conclusion
+	description    string
+	changeCountStr string // eg: "2 of 5 apps with changes", which leads both the description and comment
+	err            error  // why the run failed, or nil
+}
+
+// removalStatus returns the commit status and check run conclusion for a run that would succeed
+// but removes applications, from ARGO_DIFF_REMOVALS_STATUS: `pending` (action_required for a check
+// run, which can't finish pending) or `failure` hold the pull request up (when it's a required
+// check) until someone overrides it, while the default `success` only changes the description.
+// Invalid values fall back to the default.
+func removalStatus() (string, string) {
+	envVal := strings.TrimSpace(os.Getenv("ARGO_DIFF_REMOVALS_STATUS"))
+	switch envVal {
+	case "", github.StatusSuccess:
+		return github.StatusSuccess, github.ConclusionSuccess
+	case github.StatusPending:
+		return github.StatusPending, github.ConclusionActionRequired
+	case github.StatusFailure:
+		return github.StatusFailure, github.ConclusionFailure
+	}
+	log.Warn().Msgf("Invalid value for ARGO_DIFF_REMOVALS_STATUS: %s; must be one of success, pending or failure; using success", envVal)
+	return github.StatusSuccess, github.ConclusionSuccess
+}
+
+// outcome decides a run's final status: a failure when an application failed to diff, some weren't
+// diffed in time, or a policy rule denied a change, else a success (or whatever removalStatus says
+// when the change removes applications)
+func (s summary) outcome(appCount int, notDiffed []string, timeout time.Duration) outcome {
+	var o outcome
+	o.changeCountStr = fmt.Sprintf("%d of %d apps with changes", s.changeCount, appCount)
+	if s.unknownCount > 0 {
+		o.changeCountStr += fmt.Sprintf(" [%d apps unknown]", s.unknownCount)
+	}
+	if len(notDiffed) > 0 {
+		o.changeCountStr += fmt.Sprintf(" [%d apps not diffed]", len(notDiffed))
+	}
+	// the description leads with the resource counts too, ahead of anything GitHub might truncate
+	countStr := o.changeCountStr + s.resourceCountStr()
+
+	if s.errorCount > 0 {
+		// if we had errors, commit status should be a failure
+		o.status = github.StatusFailure
+		o.conclusion = github.ConclusionFailure
+		o.description = fmt.Sprintf("%s; %d had an error; first error: %s", countStr, s.errorCount, s.firstError)
+		o.err = fmt.Errorf("%d application(s) failed to generate a diff; first error: %s", s.errorCount, s.firstError)
+	} else if s.firstError != "" {
+		// if we had a recoverable error, commit status can be a success (but let's give them the first error)
+		o.status = github.StatusSuccess
+		o.conclusion = github.ConclusionSuccess
+		o.description = fmt.Sprintf("%s; diff generator failed; first error: %s", countStr, s.firstError)
+	} else {
+		// else everything is happy - commit status success
+		o.status = github.StatusSuccess
+		o.conclusion = github.ConclusionSuccess
+		o.description = fmt.Sprintf("%s - no errors", countStr)
+	}
+	if len(notDiffed) > 0 {
+		// results are incomplete - fail rather than report success on a partial diff
+		o.status = github.StatusFailure
+		o.conclusion = github.ConclusionTimedOut
+		o.description = fmt.Sprintf("%d app(s) not diffed (timed out); %s", len(notDiffed), o.description)
+		if o.err == nil {
+			o.err = fmt.Errorf("timed out (ARGO_DIFF_TIMEOUT is %s); %d application(s) were not diffed", timeout, len(notDiffed))
+		}
+	}
+	if s.removedApps > 0 && o.conclusion == github.ConclusionSuccess {
+		// removing an application can take everything it manages with it, so it wants a second
+		// look even when the diffs went fine
+		o.status, o.conclusion = removalStatus()
+		o.description = fmt.Sprintf("removes %d app(s); %s", s.removedApps, o.description)
+	}
+	if s.denyCount > 0 {
+		// a change the policy denies fails the run regardless of how the diffs went
+		o.status = github.StatusFailure
+		o.conclusion = github.ConclusionFailure
+		o.description = fmt.Sprintf("denied by policy %s (%d denial(s)); %s", s.firstDenial.Rule, s.denyCount, o.description)
+		if o.err == nil {
+			o.err = fmt.Errorf("%d change(s) denied by policy; first: %s", s.denyCount, s.firstDenial)
+		}
+	}
+	return o
+}
+
+// document records the run for internal/results, which is also what's rendered for the PR comment
+// and the terminal. Applications are listed in the order they're reported, followed by those that
+// matched but have no results; the caller fills in Warnings, RepoConfigError and Timings.
+func (s summary) document(eventInfo webhook.EventInfo, o outcome, notDiffed []string, diffFormat string, matches *argocd.MatchLog) results.Document {
+	doc := results.Document{
+		SchemaVersion: results.SchemaVersion,
+		Event:         eventInfo,
+		Status:        results.Status{State: o.status, Conclusion: o.conclusion, Description: o.description},
+		Summary:       o.changeCountStr,
+		DiffFormat:    diffFormat,
+		Apps:          []results.App{},
+		NotDiffed:     append([]string{}, notDiffed...),
+		Warnings:      []string{},
+	}
+	if o.err != nil {
+		doc.Status.Error = o.err.Error()
+	}
+	listed := map[string]bool{}
+	for _, a := range s.apps {
+		appName := a.ArgoApp.ObjectMeta.Name
+		listed[appName] = true
+		doc.Apps = append(doc.Apps, a.resultsApp(matches.Lookup(appName), diffFormat))
+	}
+	for _, m := range matches.Matches() {
+		if !listed[m.App] {
+			listed[m.App] = true
+			doc.Apps = append(doc.Apps, results.App{Name: m.App, MatchReason: m.Reason, PathMatches: resultsPathMatches(m.PathMatches), Resources: []results.Resource{}})
+		}
+	}
+	return doc
+}
+
+func resultsPathMatches(paths []argocd.PathMatch) []results.PathMatch {
+	var res []results.PathMatch
+	for _, p := range paths {
+		res = append(res, results.PathMatch{Source: p.Source, Pattern: p.Pattern, File: p.File})
+	}
+	return res
+}
+
+func (a appResult) resultsApp(match argocd.Match, diffFormat string) results.App {
+	app := results.App{
+		Name:           a.ArgoApp.ObjectMeta.Name,
+		MatchReason:    match.Reason,
+		PathMatches:    resultsPathMatches(match.PathMatches),
+		Parent:         a.Parent,
+		New:            a.NewApp,
+		ApplicationSet: a.ApplicationSet != nil,
+		Sync:           a.ArgoApp.Status.Sync.Status,
+		Health:         a.ArgoApp.Status.Health.Status,
+		HealthMessage:  a.ArgoApp.Status.Health.Message,
+		AutoSync:       a.ArgoApp.Spec.AutoSync(),
+		Error:          a.WarnStr,
+	}
+	for _, c := range a.callouts {
+		app.Callouts = append(app.Callouts, results.Callout{Type: c.kind, Message: c.msg})
+	}
+	if a.Removal != nil {
+		app.Removal = &results.Removal{Prune: a.Removal.Prune, Cascade: a.Removal.Cascade, Resources: []results.ResourceRef{}}
+		for _, r := range a.Removal.Resources {
+			app.Removal.Resources = append(app.Removal.Resources, results.ResourceRef{Group: r.Group, Kind: r.Kind, Namespace: r.Namespace, Name: r.Name})
+		}
+	}
+	app.Resources = a.resultsResources(a.ChangedResources, diffFormat)
+	if a.LiveResources != nil {
+		app.LiveResources = a.resultsResources(a.LiveResources, diffFormat)
+	}
+	return app
+}
+
+func (a appResult) resultsResources(resources []argocd.AppResource, diffFormat string) []results.Resource {
+	res := []results.Resource{}
+	for _, ar := range resources {
+		res = append(res, results.Resource{
+			Group:     ar.Group,
+			Kind:      ar.Kind,
+			Namespace: ar.Namespace,
+			Name:      ar.Name,
+			Action:    ar.Action(),
+			Prune:     a.PruneOutcome(ar),
+			Origin:    ar.Origin,
+			Diff:      ar.DisplayDiff(diffFormat),
+			Changes:   ar.Changes,
+		})
+	}
+	return res
+}
+
+// failedDocument records a run that ended before it had any results
+func failedDocument(eventInfo webhook.EventInfo, res runResult, err error, start time.Time) results.Document {
+	doc := results.Document{
+		SchemaVersion: results.SchemaVersion,
+		Event:         eventInfo,
+		Status:        results.Status{State: res.status, Conclusion: res.conclusion, Description: res.description},
+		Apps:          []results.App{},
+		NotDiffed:     []string{},
+		Warnings:      []string{},
+	}
+	if err != nil {
+		doc.Status.Error = err.Error()
+	}
+	doc.Timings = results.Timings{Started: start, Finished: time.Now()}
+	doc.Timings.DurationMs = doc.Timings.Finished.Sub(start).Milliseconds()
+	return doc
+}
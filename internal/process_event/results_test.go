@@ -0,0 +1,177 @@
+package process_event
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/vince-riv/argo-diff/internal/argocd"
+	"github.com/vince-riv/argo-diff/internal/github"
+	"github.com/vince-riv/argo-diff/internal/results"
+	"github.com/vince-riv/argo-diff/internal/webhook"
+)
+
+func testSummary() summary {
+	app := func(name string) *argocd.Application {
+		a := &argocd.Application{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		a.Status.Sync.Status = "OutOfSync"
+		a.Status.Health.Status = "Healthy"
+		return a
+	}
+	return summary{
+		apps: []appResult{
+			{ApplicationResourcesWithChanges: argocd.ApplicationResourcesWithChanges{
+				ArgoApp: app("guestbook"),
+				ChangedResources: []argocd.AppResource{{
+					Group: "apps", Kind: "Deployment", Namespace: "default", Name: "guestbook",
+					DiffStr: "--- live\n+++ target\n@@ -1 +1 @@\n-replicas: 2\n+replicas: 3\n",
+				}},
+			}, callouts: []callout{{"WARNING", "Policy warning no-scale-down"}}},
+			{ApplicationResourcesWithChanges: argocd.ApplicationResourcesWithChanges{ArgoApp: app("unchanged")}},
+			{ApplicationResourcesWithChanges: argocd.ApplicationResourcesWithChanges{ArgoApp: app("broken"), WarnStr: "manifest generation failed"}},
+		},
+		changeCount: 1,
+		errorCount:  1,
+		firstError:  "manifest generation failed",
+	}
+}
+
+func TestDocument(t *testing.T) {
+	s := testSummary()
+	o := s.outcome(3, []string{"slow"}, 0)
+	doc := s.document(webhook.EventInfo{RepoOwner: "owner", RepoName: "repo", PrNum: 7}, o, []string{"slow"}, argocd.DiffFormatUnified, nil)
+	if doc.SchemaVersion != results.SchemaVersion || doc.Event.PrNum != 7 || doc.Summary != "1 of 3 apps with changes [1 apps not diffed]" {
+		t.Errorf("Unexpected document header %+v", doc)
+	}
+	if doc.Status.State != github.StatusFailure || doc.Status.Error == "" || len(doc.NotDiffed) != 1 {
+		t.Errorf("Expected a failed run, got %+v", doc.Status)
+	}
+	if len(doc.Apps) != 3 {
+		t.Fatalf("Expected every app in the document, got %+v", doc.Apps)
+	}
+	r := doc.Apps[0].Resources
+	if len(r) != 1 || r[0].Kind != "Deployment" || r[0].Action != argocd.ActionModified || !strings.Contains(r[0].Diff, "+replicas: 3") {
+		t.Errorf("Unexpected resources %+v", r)
+	}
+	if c := doc.Apps[0].Callouts; len(c) != 1 || c[0].Type != "WARNING" {
+		t.Errorf("Unexpected callouts %+v", c)
+	}
+	if doc.Apps[1].Resources == nil || doc.Apps[2].Error != "manifest generation failed" {
+		t.Errorf("Unexpected apps %+v", doc.Apps[1:])
+	}
+}
+
+func TestResourceCounts(t *testing.T) {
+	app := &argocd.Application{ObjectMeta: metav1.ObjectMeta{Name: "guestbook"}}
+	app.Spec.SyncPolicy = &argocd.SyncPolicy{Automated: &argocd.SyncPolicyAutomated{Prune: true}}
+	s := summarize([]argocd.ApplicationResourcesWithChanges{{
+		ArgoApp: app,
+		ChangedResources: []argocd.AppResource{
+			{Kind: "ConfigMap", Name: "new", Target: map[string]any{}},
+			{Kind: "ConfigMap", Name: "old", Live: map[string]any{}},
+			{Kind: "Secret", Name: "kept", Live: map[string]any{"metadata": map[string]any{"annotations": map[string]any{"argocd.argoproj.io/sync-options": "Prune=false"}}}},
+			{Group: "apps", Kind: "Deployment", Name: "web", Live: map[string]any{}, Target: map[string]any{}},
+		},
+	}}, nil)
+	if s.added != 1 || s.modified != 1 || s.deleted != 2 || s.unpruned != 1 {
+		t.Errorf("Unexpected counts %+v", s)
+	}
+	o := s.outcome(1, nil, 0)
+	if want := "1 of 1 apps with changes (2 to delete [1 not pruned], 1 to create, 1 to update) - no errors"; o.description != want {
+		t.Errorf("description = %q, want %q", o.description, want)
+	}
+	if o.changeCountStr != "1 of 1 apps with changes" {
+		t.Errorf("changeCountStr = %q", o.changeCountStr)
+	}
+}
+
+func TestWithoutDrift(t *testing.T) {
+	got := withoutDrift([]argocd.AppResource{
+		{Name: "changed", Origin: argocd.OriginChange},
+		{Name: "drifted", Origin: argocd.OriginDrift},
+		{Name: "both", Origin: argocd.OriginBoth},
+		{Name: "synced"},
+	})
+	if len(got) != 3 || got[1].Name != "both" {
+		t.Errorf("Expected every resource but the drifted one, got %+v", got)
+	}
+}
+
+func TestSummarizeNotes(t *testing.T) {
+	app := &argocd.Application{ObjectMeta: metav1.ObjectMeta{Name: "svc-new"}}
+	s := summarize([]argocd.ApplicationResourcesWithChanges{{
+		ArgoApp:          app,
+		ChangedResources: []argocd.AppResource{{Kind: "ConfigMap", Name: "cm", DiffStr: "@@ -0,0 +1 @@\n+data: {}\n"}},
+		Parent:           "root",
+		Notes:            []string{"The source of svc-new is moving"},
+		NewApp:           true,
+	}}, nil)
+	c := s.apps[0].callouts
+	if len(c) != 2 || c[0].kind != github.CalloutNote || c[1].kind != github.CalloutWarning || c[1].msg != "The source of svc-new is moving" {
+		t.Errorf("Expected a note that svc-new is new, then its notes as warnings, got %+v", c)
+	}
+	if a := s.apps[0].resultsApp(argocd.Match{}, argocd.DiffFormatUnified); !a.New || a.Parent != "root" {
+		t.Errorf("Unexpected results app %+v", a)
+	}
+}
+
+func TestSummarizeRemovedApp(t *testing.T) {
+	app := &argocd.Application{ObjectMeta: metav1.ObjectMeta{Name: "svc-old"}}
+	s := summarize([]argocd.ApplicationResourcesWithChanges{{
+		ArgoApp: app,
+		Parent:  "root",
+		Removal: &argocd.AppRemoval{Prune: argocd.PruneManual, Cascade: true, Resources: []argocd.ResourceStatus{
+			{Group: "apps", Kind: "Deployment", Namespace: "default", Name: "svc-old"},
+			{Kind: "Service", Namespace: "default", Name: "svc-old"},
+		}},
+	}}, nil)
+	if s.changeCount != 1 || s.deleted != 2 || s.unpruned != 2 || s.removedApps != 1 {
+		t.Errorf("Unexpected counts %+v", s)
+	}
+	c := s.apps[0].callouts
+	if len(c) != 1 || c[0].kind != github.CalloutCaution || !strings.Contains(c[0].msg, "once root is synced with pruning") || !strings.HasSuffix(c[0].msg, "\n- `Service default/svc-old`") {
+		t.Errorf("Unexpected callouts %+v", c)
+	}
+	o := s.outcome(1, nil, 0)
+	if o.status != github.StatusSuccess || o.conclusion != github.ConclusionSuccess || !strings.HasPrefix(o.description, "removes 1 app(s); ") {
+		t.Errorf("Unexpected outcome %+v", o)
+	}
+	t.Setenv("ARGO_DIFF_REMOVALS_STATUS", "pending")
+	if o := s.outcome(1, nil, 0); o.status != github.StatusPending || o.conclusion != github.ConclusionActionRequired {
+		t.Errorf("Expected a pending status with ARGO_DIFF_REMOVALS_STATUS=pending, got %+v", o)
+	}
+	t.Setenv("ARGO_DIFF_REMOVALS_STATUS", "failure")
+	if o := s.outcome(1, nil, 0); o.status != github.StatusFailure || o.conclusion != github.ConclusionFailure {
+		t.Errorf("Expected a failure with ARGO_DIFF_REMOVALS_STATUS=failure, got %+v", o)
+	}
+	t.Setenv("ARGO_DIFF_REMOVALS_STATUS", "bogus")
+	if o := s.outcome(1, nil, 0); o.status != github.StatusSuccess || o.conclusion != github.ConclusionSuccess {
+		t.Errorf("Expected an invalid ARGO_DIFF_REMOVALS_STATUS to fall back to success, got %+v", o)
+	}
+	if a := s.apps[0].resultsApp(argocd.Match{}, argocd.DiffFormatUnified); a.Removal == nil || !a.Removal.Cascade || len(a.Removal.Resources) != 2 || a.Removal.Resources[1].Kind != "Service" {
+		t.Errorf("Unexpected results app %+v", a)
+	}
+}
+
+func TestRemovalMessage(t *testing.T) {
+	resources := make([]argocd.ResourceStatus, maxRemovedResources+2)
+	for i := range resources {
+		resources[i] = argocd.ResourceStatus{Kind: "ConfigMap", Name: fmt.Sprintf("cm-%d", i)}
+	}
+	for removal, want := range map[*argocd.AppRemoval]string{
+		{Prune: argocd.PruneAutomatic, Cascade: true}: "as soon as root auto-syncs",
+		{Prune: argocd.PruneAutomatic}:                "are orphaned",
+		{Prune: argocd.PruneDisabled, Cascade: true}:  "If it's deleted by hand",
+		{Prune: argocd.PruneRetained}:                 "its applicationsSync policy",
+	} {
+		if msg := removalMessage("svc-old", "root", removal); !strings.Contains(msg, want) {
+			t.Errorf("removalMessage(%+v) = %q, expected it to contain %q", removal, msg, want)
+		}
+	}
+	msg := removalMessage("svc-old", "root", &argocd.AppRemoval{Prune: argocd.PruneManual, Resources: resources})
+	if !strings.HasSuffix(msg, "\n- _and 2 more_") || strings.Contains(msg, fmt.Sprintf("cm-%d`", maxRemovedResources)) {
+		t.Errorf("Expected the resource list to be capped: %q", msg)
+	}
+}
@@ -0,0 +1,152 @@
+package process_event
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/vince-riv/argo-diff/internal/github"
+	"github.com/vince-riv/argo-diff/internal/gitlab"
+	"github.com/vince-riv/argo-diff/internal/webhook"
+)
+
+// scmProvider is everything ProcessCodeChange needs from the source control host: refreshing a
+// pull/merge request's refs, listing its changed files, finding its merge-base, and reporting back
+// via commit status (or check run) and comments. Status strings are the github package's
+// (StatusPending etc); gitlab accepts the same values. A provider is created per run, so it may
+// keep state between pending() and finish().
+type scmProvider interface {
+	refresh(ctx context.Context, eventInfo *webhook.EventInfo) error
+	listChangedFiles(ctx context.Context, eventInfo webhook.EventInfo) ([]string, error)
+	// mergeBase returns the commit the pull request's head branched off its base branch at
+	mergeBase(ctx context.Context, eventInfo webhook.EventInfo) (string, error)
+	pending(ctx context.Context, eventInfo webhook.EventInfo, devMode bool) error
+	finish(ctx context.Context, eventInfo webhook.EventInfo, res runResult, devMode bool) error
+	comment(ctx context.Context, eventInfo webhook.EventInfo, commentBodies []string) error
+	// getFile returns a file's contents at ref, or nil when there's no such file
+	getFile(ctx context.Context, eventInfo webhook.EventInfo, path, ref string) ([]byte, error)
+}
+
+// runResult is how a run ended: a commit status and its description, the equivalent check run
+// conclusion, and the rendered results (nil when the run failed before producing any)
+type runResult struct {
+	status      string
+	conclusion  string
+	description string
+	markdown    *github.CommentMarkdown
+}
+
+// providerFor returns the scmProvider for an event.
+// Set as variable so it can be mocked in tests
+var providerFor = func(eventInfo webhook.EventInfo) scmProvider {
+	if eventInfo.IsGitlab() {
+		return gitlabProvider{}
+	}
+	return &githubProvider{}
+}
+
+// githubProvider reports via a check run when github.ChecksEnabled(), else via commit statuses
+type githubProvider struct {
+	check *github.CheckRun
+}
+
+func (*githubProvider) refresh(ctx context.Context, eventInfo *webhook.EventInfo) error {
+	pull, err := github.GetPullRequest(ctx, eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.PrNum)
+	if err != nil {
+		return err
+	}
+	base := pull.GetBase()
+	head := pull.GetHead()
+	if base == nil || head == nil {
+		return fmt.Errorf("empty branch information when refreshing %s/%s#%d", eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.PrNum)
+	}
+	eventInfo.Sha = head.GetSHA()
+	eventInfo.ChangeRef = head.GetRef()
+	eventInfo.BaseRef = base.GetRef()
+	return nil
+}
+
+func (*githubProvider) listChangedFiles(ctx context.Context, eventInfo webhook.EventInfo) ([]string, error) {
+	return github.ListPullRequestFiles(ctx, eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.PrNum)
+}
+
+func (*githubProvider) mergeBase(ctx context.Context, eventInfo webhook.EventInfo) (string, error) {
+	if eventInfo.BaseRef == "" {
+		return "", fmt.Errorf("no base ref for %s/%s#%d", eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.PrNum)
+	}
+	return github.MergeBase(ctx, eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.BaseRef, eventInfo.Sha)
+}
+
+func (p *githubProvider) pending(ctx context.Context, eventInfo webhook.EventInfo, devMode bool) error {
+	if github.ChecksEnabled() {
+		p.check = github.NewCheckRun(eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.Sha, devMode)
+		return p.check.Start(ctx)
+	}
+	return github.Status(ctx, github.StatusPending, "", eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.Sha, devMode)
+}
+
+func (p *githubProvider) finish(ctx context.Context, eventInfo webhook.EventInfo, res runResult, devMode bool) error {
+	if github.ChecksEnabled() {
+		if p.check == nil {
+			p.check = github.NewCheckRun(eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.Sha, devMode)
+		}
+		return p.check.Complete(ctx, res.conclusion, res.description, res.markdown)
+	}
+	return github.Status(ctx, res.status, res.description, eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.Sha, devMode)
+}
+
+func (*githubProvider) comment(ctx context.Context, eventInfo webhook.EventInfo, commentBodies []string) error {
+	_, err := github.Comment(ctx, eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.PrNum, eventInfo.Sha, commentBodies)
+	return err
+}
+
+func (*githubProvider) getFile(ctx context.Context, eventInfo webhook.EventInfo, path, ref string) ([]byte, error) {
+	return github.GetFileContents(ctx, eventInfo.RepoOwner, eventInfo.RepoName, path, ref)
+}
+
+type gitlabProvider struct{}
+
+func (gitlabProvider) refresh(ctx context.Context, eventInfo *webhook.EventInfo) error {
+	mr, err := gitlab.GetMergeRequest(ctx, eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.PrNum)
+	if err != nil {
+		return err
+	}
+	if mr.Sha == "" || mr.SourceBranch == "" || mr.TargetBranch == "" {
+		return fmt.Errorf("empty branch information when refreshing %s/%s!%d", eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.PrNum)
+	}
+	eventInfo.Sha = mr.Sha
+	eventInfo.ChangeRef = mr.SourceBranch
+	eventInfo.BaseRef = mr.TargetBranch
+	return nil
+}
+
+func (gitlabProvider) listChangedFiles(ctx context.Context, eventInfo webhook.EventInfo) ([]string, error) {
+	return gitlab.ListMergeRequestFiles(ctx, eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.PrNum)
+}
+
+func (gitlabProvider) mergeBase(ctx context.Context, eventInfo webhook.EventInfo) (string, error) {
+	mr, err := gitlab.GetMergeRequest(ctx, eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.PrNum)
+	if err != nil {
+		return "", err
+	}
+	if mr.DiffRefs.BaseSha == "" {
+		return "", fmt.Errorf("no merge-base for %s/%s!%d", eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.PrNum)
+	}
+	return mr.DiffRefs.BaseSha, nil
+}
+
+func (gitlabProvider) pending(ctx context.Context, eventInfo webhook.EventInfo, devMode bool) error {
+	return gitlab.Status(ctx, github.StatusPending, "", eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.Sha, devMode)
+}
+
+func (gitlabProvider) finish(ctx context.Context, eventInfo webhook.EventInfo, res runResult, devMode bool) error {
+	return gitlab.Status(ctx, res.status, res.description, eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.Sha, devMode)
+}
+
+func (gitlabProvider) comment(ctx context.Context, eventInfo webhook.EventInfo, commentBodies []string) error {
+	_, err := gitlab.Comment(ctx, eventInfo.RepoOwner, eventInfo.RepoName, eventInfo.PrNum, eventInfo.Sha, commentBodies)
+	return err
+}
+
+func (gitlabProvider) getFile(ctx context.Context, eventInfo webhook.EventInfo, path, ref string) ([]byte, error) {
+	return gitlab.GetFile(ctx, eventInfo.RepoOwner, eventInfo.RepoName, path, ref)
+}
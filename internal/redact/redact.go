@@ -0,0 +1,417 @@
+package redact
+
+/*
+ * Masks sensitive values in resource diffs before they reach a PR comment. Secrets and
+ * SealedSecrets are always covered; ARGO_DIFF_REDACTION_FILE adds rules for other kinds (eg: a
+ * ConfigMap carrying a connection string). Values are replaced on both sides of the diff, and a
+ * changed value shows as changed without revealing either version.
+ */
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"sigs.k8s.io/yaml"
+
+	"github.com/vince-riv/argo-diff/internal/gendiff"
+)
+
+// What masked values are replaced with
+const Placeholder = "<redacted>"
+const ChangedPlaceholder = "<redacted: value changed>"
+
+// The annotation kubectl (and ArgoCD, with client-side apply) stores the whole applied object in;
+// it's masked for every resource a path rule covers, since it repeats those values
+const lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
+// Rule masks values of resources of one kind: at paths (a JSONPath subset: `$.data.*`,
+// `$.spec.containers[*].env[*].value`, `$.metadata.annotations['example.com/token']`), and anywhere
+// a pattern matches. Kind "*" applies to every kind; an empty group matches any group.
+type Rule struct {
+	Group    string   `json:"group,omitempty"`
+	Kind     string   `json:"kind"`
+	Paths    []string `json:"paths,omitempty"`
+	Patterns []string `json:"patterns,omitempty"`
+	paths    [][]string
+	patterns []*regexp.Regexp
+}
+
+// Rules is a redaction rules file
+type Rules struct {
+	Rules []Rule `json:"rules"`
+}
+
+var defaultRules = []Rule{
+	{Kind: "Secret", Paths: []string{"$.data.*", "$.stringData.*"}},
+	{Group: "bitnami.com", Kind: "SealedSecret", Paths: []string{"$.spec.encryptedData.*", "$.spec.template.data.*"}},
+}
+
+var rules []Rule
+
+func init() {
+	var err error
+	rules, err = compile(defaultRules)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to compile default redaction rules")
+	}
+	rulesFile := strings.TrimSpace(os.Getenv("ARGO_DIFF_REDACTION_FILE"))
+	if rulesFile == "" {
+		return
+	}
+	extra, err := Load(rulesFile)
+	if err != nil {
+		// carrying on would put the values these rules are meant to hide in PR comments
+		log.Fatal().Err(err).Msgf("Failed to load ARGO_DIFF_REDACTION_FILE %s", rulesFile)
+	}
+	rules = append(rules, extra...)
+	log.Info().Msgf("Loaded %d redaction rule(s) from %s", len(extra), rulesFile)
+}
+
+// Load reads and compiles a redaction rules file
+func Load(path string) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse parses and compiles a redaction rules document
+func Parse(data []byte) ([]Rule, error) {
+	var r Rules
+	if err := yaml.UnmarshalStrict(data, &r); err != nil {
+		return nil, fmt.Errorf("parsing redaction rules: %w", err)
+	}
+	return compile(r.Rules)
+}
+
+func compile(in []Rule) ([]Rule, error) {
+	out := make([]Rule, 0, len(in))
+	for i, r := range in {
+		if r.Kind == "" {
+			return nil, fmt.Errorf("redaction rule %d: missing kind", i+1)
+		}
+		if len(r.Paths) == 0 && len(r.Patterns) == 0 {
+			return nil, fmt.Errorf("redaction rule %d (%s): needs paths or patterns", i+1, r.Kind)
+		}
+		r.paths, r.patterns = nil, nil
+		for _, p := range r.Paths {
+			segs, err := parsePath(p)
+			if err != nil {
+				return nil, fmt.Errorf("redaction rule %d (%s): %w", i+1, r.Kind, err)
+			}
+			r.paths = append(r.paths, segs)
+		}
+		if len(r.paths) > 0 {
+			r.paths = append(r.paths, []string{"metadata", "annotations", lastAppliedAnnotation})
+		}
+		for _, p := range r.Patterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return nil, fmt.Errorf("redaction rule %d (%s): %w", i+1, r.Kind, err)
+			}
+			r.patterns = append(r.patterns, re)
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+var pathSegmentRe = regexp.MustCompile(`^(?:\.([^.\[\]']+)|\[\*\]|\['([^']+)'\])`)
+
+// parsePath splits a JSONPath like $.a.*.b[*]['c.d'] into segments; `*` matches any key and
+// `[*]` any list item
+func parsePath(path string) ([]string, error) {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(path), "$")
+	if !ok {
+		return nil, fmt.Errorf("path '%s' must start with '$'", path)
+	}
+	var segs []string
+	for rest != "" {
+		m := pathSegmentRe.FindStringSubmatch(rest)
+		if m == nil {
+			return nil, fmt.Errorf("can't parse path '%s' at '%s'", path, rest)
+		}
+		switch {
+		case m[1] != "":
+			segs = append(segs, m[1])
+		case m[2] != "":
+			segs = append(segs, m[2])
+		default:
+			segs = append(segs, "[*]")
+		}
+		rest = rest[len(m[0]):]
+	}
+	if len(segs) == 0 {
+		return nil, fmt.Errorf("path '%s' is empty", path)
+	}
+	return segs, nil
+}
+
+// matchingRules returns the rules covering a resource of group/kind
+func matchingRules(group, kind string) []Rule {
+	var res []Rule
+	for _, r := range rules {
+		if (r.Kind == "*" || r.Kind == kind) && (r.Group == "" || r.Group == group) {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+// Diff masks the sensitive values in a unified diff of a group/kind resource's YAML
+func Diff(group, kind, diffStr string) string {
+	applicable := matchingRules(group, kind)
+	if len(applicable) == 0 || diffStr == "" {
+		return diffStr
+	}
+	var paths [][]string
+	var patterns []*regexp.Regexp
+	for _, r := range applicable {
+		paths = append(paths, r.paths...)
+		patterns = append(patterns, r.patterns...)
+	}
+	d := differ{paths: paths}
+	var out strings.Builder
+	inHunk := false
+	for _, line := range strings.SplitAfter(diffStr, "\n") {
+		if strings.HasPrefix(line, "@@") {
+			inHunk = true
+			d.startHunk(line)
+			out.WriteString(line)
+			continue
+		}
+		if !inHunk || line == "" || !strings.ContainsAny(line[:1], " -+") {
+			// file headers, and "\ No newline at end of file"
+			out.WriteString(line)
+			continue
+		}
+		content, eol := strings.CutSuffix(line[1:], "\n")
+		content = d.line(line[0], content)
+		for _, re := range patterns {
+			content = re.ReplaceAllString(content, Placeholder)
+		}
+		out.WriteString(line[:1] + content)
+		if eol {
+			out.WriteString("\n")
+		}
+	}
+	return out.String()
+}
+
+// Changes masks the sensitive values in a group/kind resource's structured changes. A masked value
+// covers everything under it, so a Secret's whole `data` map being added is masked key by key.
+func Changes(group, kind string, changes []gendiff.Change) []gendiff.Change {
+	applicable := matchingRules(group, kind)
+	if len(applicable) == 0 || len(changes) == 0 {
+		return changes
+	}
+	m := masker{}
+	for _, r := range applicable {
+		m.paths = append(m.paths, r.paths...)
+		m.patterns = append(m.patterns, r.patterns...)
+	}
+	res := make([]gendiff.Change, len(changes))
+	for i, c := range changes {
+		c.Old = m.value(c.Keys, c.Old)
+		c.New = m.value(c.Keys, c.New)
+		res[i] = c
+	}
+	return res
+}
+
+type masker struct {
+	paths    [][]string
+	patterns []*regexp.Regexp
+}
+
+// value returns a masked copy of v, found at keys
+func (m masker) value(keys []string, v any) any {
+	if v == nil {
+		return nil
+	}
+	for _, p := range m.paths {
+		if matchPath(p, keys) {
+			return Placeholder
+		}
+	}
+	switch val := v.(type) {
+	case map[string]any:
+		res := make(map[string]any, len(val))
+		for k, item := range val {
+			res[k] = m.value(append(keys[:len(keys):len(keys)], k), item)
+		}
+		return res
+	case []any:
+		res := make([]any, len(val))
+		for i, item := range val {
+			res[i] = m.value(append(keys[:len(keys):len(keys)], "[*]"), item)
+		}
+		return res
+	case string:
+		for _, re := range m.patterns {
+			val = re.ReplaceAllString(val, Placeholder)
+		}
+		return val
+	}
+	return v
+}
+
+// differ follows the YAML structure through a diff's lines well enough to know each line's path
+type differ struct {
+	paths [][]string
+	// the keys (or "[*]" list items) enclosing the current line, with their indentation
+	stack []frame
+	// false when a hunk starts partway into the document, until a top-level key is seen; the
+	// stack then only holds the tail of each path
+	anchored bool
+	// the indentation of the block scalar (`key: |`) whose lines are being read, or -1
+	blockIndent    int
+	blockSensitive bool
+	blockPath      string
+	// paths masked on '-' lines of the current change, so '+' lines can say the value changed
+	removed map[string]bool
+}
+
+type frame struct {
+	indent int
+	seg    string
+}
+
+var hunkHeaderRe = regexp.MustCompile(`^@@ -(\d+)(?:,\d+)? \+(\d+)(?:,\d+)? @@`)
+
+func (d *differ) startHunk(header string) {
+	d.stack = nil
+	d.blockIndent = -1
+	d.removed = map[string]bool{}
+	d.anchored = false
+	if m := hunkHeaderRe.FindStringSubmatch(header); m != nil {
+		oldStart, _ := strconv.Atoi(m[1])
+		newStart, _ := strconv.Atoi(m[2])
+		d.anchored = oldStart <= 1 && newStart <= 1
+	}
+}
+
+var keyRe = regexp.MustCompile(`^("(?:[^"\\]|\\.)*"|'[^']*'|[^\s#'"-][^:]*?|-[^\s:][^:]*?):(?:\s+(.*))?$`)
+
+// line returns content (one line of YAML, without its diff prefix) with any sensitive value masked
+func (d *differ) line(prefix byte, content string) string {
+	if prefix == ' ' {
+		d.removed = map[string]bool{}
+	}
+	trimmed := strings.TrimLeft(content, " ")
+	indent := len(content) - len(trimmed)
+	if d.blockIndent >= 0 {
+		if indent > d.blockIndent || trimmed == "" {
+			if d.blockSensitive && trimmed != "" {
+				return content[:indent] + d.placeholder(prefix, d.blockPath)
+			}
+			return content
+		}
+		d.blockIndent = -1
+	}
+	if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+		return content
+	}
+	isItem := strings.HasPrefix(trimmed, "- ") || trimmed == "-"
+	for len(d.stack) > 0 {
+		top := d.stack[len(d.stack)-1]
+		// a list item may sit at the same indentation as the key that holds the list
+		if top.indent < indent || (isItem && top.indent == indent && top.seg != "[*]") {
+			break
+		}
+		d.stack = d.stack[:len(d.stack)-1]
+	}
+	if indent == 0 {
+		d.anchored = true
+	}
+	rest := trimmed
+	valueStart := indent
+	for strings.HasPrefix(rest, "- ") || rest == "-" {
+		d.stack = append(d.stack, frame{indent: valueStart, seg: "[*]"})
+		after := strings.TrimLeft(strings.TrimPrefix(rest, "-"), " ")
+		valueStart += len(rest) - len(after)
+		rest = after
+	}
+	value := rest
+	if m := keyRe.FindStringSubmatch(rest); m != nil {
+		d.stack = append(d.stack, frame{indent: valueStart, seg: strings.Trim(m[1], `"'`)})
+		value = m[2]
+		valueStart = len(content) - len(value)
+	}
+	if value == "" {
+		return content
+	}
+	sensitive := d.sensitive()
+	if strings.HasPrefix(value, "|") || strings.HasPrefix(value, ">") {
+		// the value is on the lines that follow
+		d.blockIndent = indent
+		d.blockSensitive = sensitive
+		d.blockPath = d.pathKey()
+		return content
+	}
+	if !sensitive {
+		return content
+	}
+	return content[:valueStart] + d.placeholder(prefix, d.pathKey())
+}
+
+// placeholder picks the mask for a value at path; a '+' line for a path just masked on a '-' line
+// is the same value, changed
+func (d *differ) placeholder(prefix byte, path string) string {
+	switch prefix {
+	case '-':
+		d.removed[path] = true
+	case '+':
+		if d.removed[path] {
+			return ChangedPlaceholder
+		}
+	}
+	return Placeholder
+}
+
+func (d *differ) keys() []string {
+	segs := make([]string, len(d.stack))
+	for i, f := range d.stack {
+		segs[i] = f.seg
+	}
+	return segs
+}
+
+func (d *differ) pathKey() string {
+	return strings.Join(d.keys(), "\x00")
+}
+
+// sensitive reports whether the current path is covered by a rule. Without an anchor only the
+// path's tail is known, so it's matched against the tail of each rule's path: that masks a few
+// values needlessly when a hunk starts deep in a resource, but never misses one.
+func (d *differ) sensitive() bool {
+	keys := d.keys()
+	for _, p := range d.paths {
+		if d.anchored {
+			if matchPath(p, keys) {
+				return true
+			}
+		} else if len(keys) <= len(p) && matchPath(p[len(p)-len(keys):], keys) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPath reports whether a rule path matches keys, a path with "[*]" for each list item
+func matchPath(p []string, keys []string) bool {
+	if len(p) != len(keys) {
+		return false
+	}
+	for i, seg := range p {
+		if seg != keys[i] && (seg != "*" || keys[i] == "[*]") {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,202 @@
+package redact
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/vince-riv/argo-diff/internal/gendiff"
+)
+
+const newSecretDiff = `--- /tmp/argocd-diff1/db-creds-live.yaml	2026-03-02 14:01:12
++++ /tmp/argocd-diff1/db-creds	2026-03-02 14:01:12
+@@ -0,0 +1,12 @@
++apiVersion: v1
++data:
++  password: c3VwZXJzZWNyZXQ=
++  username: YWRtaW4=
++kind: Secret
++metadata:
++  name: db-creds
++  namespace: default
++stringData:
++  config.yaml: |
++    token: abc123
++type: Opaque
+`
+
+// a hunk starting partway into the resource, so the path above data's keys isn't in the diff
+const changedSecretDiff = `--- /tmp/argocd-diff1/db-creds-live.yaml	2026-03-02 14:01:12
++++ /tmp/argocd-diff1/db-creds	2026-03-02 14:01:12
+@@ -12,7 +12,7 @@
+   resourceVersion: "1234"
+   uid: 0ddd6462-a212-49f6-bd69-6903cd4b5d18
+ data:
+-  password: c3VwZXJzZWNyZXQ=
++  password: bmV3c2VjcmV0
+   username: YWRtaW4=
+ type: Opaque
+`
+
+const lastAppliedDiff = `@@ -1,6 +1,6 @@
+ apiVersion: v1
+ kind: Secret
+ metadata:
+   annotations:
+-    kubectl.kubernetes.io/last-applied-configuration: '{"data":{"password":"c3VwZXJzZWNyZXQ="}}'
++    kubectl.kubernetes.io/last-applied-configuration: '{"data":{"password":"bmV3c2VjcmV0"}}'
+`
+
+const deploymentDiff = `@@ -1,14 +1,14 @@
+ apiVersion: apps/v1
+ kind: Deployment
+ spec:
+   template:
+     spec:
+       containers:
+       - env:
+         - name: API_KEY
+-          value: old-key
++          value: new-key
+         - name: LOG_LEVEL
+           value: info
+         image: guestbook:v1
+         name: guestbook
+`
+
+const configMapDiff = `@@ -3,4 +3,4 @@
+ data:
+-  DATABASE_URL: postgres://app:hunter2@db:5432/app
++  DATABASE_URL: postgres://app:hunter3@db:5432/app
+   LOG_LEVEL: info
+-  settings.ini: password=hunter2
++  settings.ini: password=hunter3
+`
+
+const testRules = `
+rules:
+- kind: ConfigMap
+  paths: ["$.data.DATABASE_URL"]
+  patterns: ['password=\S+']
+- group: apps
+  kind: Deployment
+  paths: ["$.spec.template.spec.containers[*].env[*].value"]
+`
+
+func withRules(t *testing.T, doc string) {
+	extra, err := Parse([]byte(doc))
+	if err != nil {
+		t.Fatalf("Parse() failed: %s", err)
+	}
+	orig := rules
+	rules = append(append([]Rule{}, rules...), extra...)
+	t.Cleanup(func() { rules = orig })
+}
+
+func assertRedacted(t *testing.T, got string, leaked []string, kept []string) {
+	t.Helper()
+	for _, s := range leaked {
+		if strings.Contains(got, s) {
+			t.Errorf("Redacted diff still contains %q:\n%s", s, got)
+		}
+	}
+	for _, s := range kept {
+		if !strings.Contains(got, s) {
+			t.Errorf("Redacted diff is missing %q:\n%s", s, got)
+		}
+	}
+}
+
+func TestDiffNewSecret(t *testing.T) {
+	got := Diff("", "Secret", newSecretDiff)
+	assertRedacted(t, got,
+		[]string{"c3VwZXJzZWNyZXQ=", "YWRtaW4=", "abc123"},
+		[]string{"+  password: <redacted>\n", "+  config.yaml: |\n", "+    <redacted>\n", "+  name: db-creds\n", "+type: Opaque\n", "@@ -0,0 +1,12 @@"})
+}
+
+func TestDiffChangedSecret(t *testing.T) {
+	got := Diff("", "Secret", changedSecretDiff)
+	assertRedacted(t, got,
+		[]string{"c3VwZXJzZWNyZXQ=", "bmV3c2VjcmV0", "YWRtaW4="},
+		[]string{"-  password: <redacted>\n", "+  password: <redacted: value changed>\n", "   username: <redacted>\n", " type: Opaque\n"})
+}
+
+func TestDiffLastApplied(t *testing.T) {
+	got := Diff("", "Secret", lastAppliedDiff)
+	assertRedacted(t, got,
+		[]string{"c3VwZXJzZWNyZXQ=", "bmV3c2VjcmV0"},
+		[]string{"+    kubectl.kubernetes.io/last-applied-configuration: <redacted: value changed>\n"})
+}
+
+func TestDiffSealedSecret(t *testing.T) {
+	diff := "@@ -1,5 +1,5 @@\n apiVersion: bitnami.com/v1alpha1\n kind: SealedSecret\n spec:\n   encryptedData:\n-    password: AgBy3i4OJSWK+PiTySYZZA==\n+    password: AgCtr8CsTkoUt4jDAlyBkg==\n"
+	got := Diff("bitnami.com", "SealedSecret", diff)
+	assertRedacted(t, got, []string{"AgBy3i4OJSWK", "AgCtr8CsTkoU"}, []string{"+    password: <redacted: value changed>\n"})
+}
+
+func TestDiffCustomRules(t *testing.T) {
+	withRules(t, testRules)
+	got := Diff("apps", "Deployment", deploymentDiff)
+	assertRedacted(t, got,
+		[]string{"old-key", "new-key", "value: info"},
+		[]string{"         - name: API_KEY\n", "+          value: <redacted: value changed>\n", "         image: guestbook:v1\n"})
+
+	got = Diff("", "ConfigMap", configMapDiff)
+	assertRedacted(t, got,
+		[]string{"hunter2", "hunter3"},
+		[]string{"+  DATABASE_URL: <redacted: value changed>\n", "   LOG_LEVEL: info\n", "+  settings.ini: <redacted>\n"})
+}
+
+func TestDiffUnmatchedKind(t *testing.T) {
+	if got := Diff("", "ConfigMap", configMapDiff); got != configMapDiff {
+		t.Errorf("Expected a ConfigMap diff to be untouched without a rule for it:\n%s", got)
+	}
+	if got := Diff("apps", "Deployment", deploymentDiff); got != deploymentDiff {
+		t.Errorf("Expected a Deployment diff to be untouched without a rule for it:\n%s", got)
+	}
+}
+
+func TestChanges(t *testing.T) {
+	withRules(t, testRules)
+	// a new Secret: its whole data map is one added change
+	secret := gendiff.StructuredDiff(nil, map[string]any{"data": map[string]any{"password": "c3VwZXJzZWNyZXQ="}, "type": "Opaque"})
+	got := gendiff.FormatChanges(Changes("", "Secret", secret))
+	if strings.Contains(got, "c3VwZXJzZWNyZXQ=") || !strings.Contains(got, "+   password: <redacted>\n") || !strings.Contains(got, "+ type: Opaque\n") {
+		t.Errorf("Unexpected redacted Secret changes:\n%s", got)
+	}
+
+	from := map[string]any{"data": map[string]any{"DATABASE_URL": "postgres://app:hunter2@db/app", "settings.ini": "password=hunter2\nlevel=info\n"}}
+	to := map[string]any{"data": map[string]any{"DATABASE_URL": "postgres://app:hunter3@db/app", "settings.ini": "password=hunter3\nlevel=debug\n"}}
+	changes := gendiff.StructuredDiff(from, to)
+	got = gendiff.FormatChanges(Changes("", "ConfigMap", changes))
+	if strings.Contains(got, "hunter") || !strings.Contains(got, "! data.DATABASE_URL: <redacted> -> <redacted>\n") || !strings.Contains(got, "+   level=debug\n") {
+		t.Errorf("Unexpected redacted ConfigMap changes:\n%s", got)
+	}
+	if changes[0].New != "postgres://app:hunter3@db/app" {
+		t.Error("Changes() modified its input")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := map[string]string{
+		"missing kind":    "rules:\n- paths: ['$.data.*']\n",
+		"nothing to mask": "rules:\n- kind: ConfigMap\n",
+		"bad path":        "rules:\n- kind: ConfigMap\n  paths: ['data.*']\n",
+		"bad pattern":     "rules:\n- kind: ConfigMap\n  patterns: ['(unclosed']\n",
+		"unknown field":   "rules:\n- kind: ConfigMap\n  path: ['$.data.*']\n",
+	}
+	for desc, doc := range cases {
+		if _, err := Parse([]byte(doc)); err == nil {
+			t.Errorf("%s: expected Parse() to fail", desc)
+		}
+	}
+}
+
+func TestParsePath(t *testing.T) {
+	segs, err := parsePath("$.spec.containers[*].env[*]['value.from']")
+	if err != nil {
+		t.Fatalf("parsePath() failed: %s", err)
+	}
+	if got := strings.Join(segs, "|"); got != "spec|containers|[*]|env|[*]|value.from" {
+		t.Errorf("parsePath() = %s", got)
+	}
+}
@@ -0,0 +1,118 @@
+package render
+
+import (
+	"html/template"
+	"strings"
+
+	"github.com/vince-riv/argo-diff/internal/results"
+)
+
+// htmlDiffLine is one line of a diff and the CSS class it's highlighted with
+type htmlDiffLine struct {
+	Class string
+	Text  string
+}
+
+// htmlResource is a resource and the note shown above its diff
+type htmlResource struct {
+	Resource results.Resource
+	Note     string
+}
+
+var htmlTemplate = template.Must(template.New("results").Funcs(template.FuncMap{
+	"title": ResourceTitle,
+	"ancestors": func(doc results.Document, name string) string {
+		return strings.Join(appAncestors(doc)[name], " → ")
+	},
+	"comparedTo":   comparedTo,
+	"resourceNote": resourceNote,
+	"resource": func(diffMode string, live bool, r results.Resource) htmlResource {
+		return htmlResource{Resource: r, Note: resourceNote(diffMode, live, r)}
+	},
+	"lines": func(diff string) []htmlDiffLine {
+		var lines []htmlDiffLine
+		for _, line := range strings.Split(strings.TrimSuffix(diff, "\n"), "\n") {
+			class := ""
+			switch diffLineColor(line) {
+			case ansiBold:
+				class = "file"
+			case ansiCyan:
+				class = "hunk"
+			case ansiGreen:
+				class = "add"
+			case ansiRed:
+				class = "del"
+			case ansiYellow:
+				class = "change"
+			}
+			lines = append(lines, htmlDiffLine{Class: class, Text: line})
+		}
+		return lines
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>argo-diff: {{.Event.RepoOwner}}/{{.Event.RepoName}}{{if .Event.PrNum}} #{{.Event.PrNum}}{{end}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+pre { background: #f6f8fa; padding: 0.5em; overflow-x: auto; }
+.add { color: #116329; background: #dafbe1; }
+.del { color: #82071e; background: #ffebe9; }
+.hunk { color: #0550ae; }
+.file { font-weight: bold; }
+.change { color: #7d4e00; }
+.callout, .warning { border-left: 4px solid #d4a72c; padding-left: 0.5em; }
+.error { border-left: 4px solid #cf222e; padding-left: 0.5em; }
+</style>
+</head>
+<body>
+<h1>{{.Summary}} compared to {{comparedTo .}}</h1>
+<p>{{.Event.RepoOwner}}/{{.Event.RepoName}}@{{.Event.Sha}}{{if not .Timings.Finished.IsZero}} &middot; {{.Timings.Finished.Format "3:04PM MST, 2 Jan 2006"}}{{end}}</p>
+<p>{{.Status.Description}}</p>
+{{- range .Warnings}}
+<p class="warning">{{.}}</p>
+{{- end}}
+{{- if .NotDiffed}}
+<p class="warning">Not diffed: {{range $i, $a := .NotDiffed}}{{if $i}}, {{end}}{{$a}}{{end}}</p>
+{{- end}}
+{{- range .Apps}}
+{{- if or .Error .Resources}}
+<h2>{{.Name}}</h2>
+<p>{{if .ApplicationSet}}ApplicationSet{{else}}{{.Sync}}, {{.Health}}{{if .HealthMessage}} ({{.HealthMessage}}){{end}}{{end}}{{if .MatchReason}} &middot; matched by {{.MatchReason}}{{end}}{{with ancestors $ .Name}} &middot; nested in {{.}}{{end}}</p>
+{{- if .Error}}
+<p class="error">Error: {{.Error}}</p>
+{{- end}}
+{{- range .Callouts}}
+<p class="callout">{{.Type}}: {{.Message}}</p>
+{{- end}}
+{{- range .Resources}}
+{{- template "resource" (resource $.DiffMode false .)}}
+{{- end}}
+{{- range .LiveResources}}
+{{- template "resource" (resource $.DiffMode true .)}}
+{{- end}}
+{{- end}}
+{{- end}}
+</body>
+</html>
+{{- define "resource"}}
+<details open>
+<summary>{{title .Resource}} ({{.Resource.Action}})</summary>
+{{- with .Note}}
+<p class="warning">{{.}}</p>
+{{- end}}
+<pre>{{range lines .Resource.Diff}}<span{{if .Class}} class="{{.Class}}"{{end}}>{{.Text}}</span>
+{{end}}</pre>
+</details>
+{{- end}}
+`))
+
+// HTML renders doc as a standalone HTML page
+func HTML(doc results.Document) (string, error) {
+	var sb strings.Builder
+	if err := htmlTemplate.Execute(&sb, doc); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,279 @@
+package render
+
+/*
+ * Renders a results.Document for people: as the PR comment (GitHub markdown), for a terminal, as a
+ * standalone HTML page, or as a GitHub Actions job summary. Everything here works from the document
+ * alone, so a saved document renders the same without ArgoCD or GitHub.
+ */
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/vince-riv/argo-diff/internal/argocd"
+	"github.com/vince-riv/argo-diff/internal/github"
+	"github.com/vince-riv/argo-diff/internal/repoconfig"
+	"github.com/vince-riv/argo-diff/internal/results"
+)
+
+// Output formats
+const FormatMarkdown = "markdown"
+const FormatText = "text"
+const FormatHTML = "html"
+const FormatJobSummary = "job-summary"
+const FormatJSON = "json"
+
+// Formats lists the formats Render accepts
+var Formats = []string{FormatText, FormatMarkdown, FormatHTML, FormatJobSummary, FormatJSON}
+
+// Options adjusts rendering
+type Options struct {
+	// CollapseDiffs renders markdown resource diffs collapsed rather than expanded
+	CollapseDiffs bool
+	// Color highlights FormatText output with ANSI escape codes
+	Color bool
+}
+
+// Render renders doc in format (one of Formats). Markdown comes out as the comment bodies the bot
+// would post, separated by blank lines.
+func Render(doc results.Document, format string, opts Options) (string, error) {
+	switch format {
+	case FormatMarkdown:
+		return strings.Join(Markdown(doc, opts).String(), "\n"), nil
+	case FormatText:
+		return Text(doc, opts.Color), nil
+	case FormatHTML:
+		return HTML(doc)
+	case FormatJobSummary:
+		return github.JobSummary(Markdown(doc, opts)), nil
+	case FormatJSON:
+		return JSON(doc)
+	}
+	return "", fmt.Errorf("unknown format '%s'; must be one of %s", format, strings.Join(Formats, ", "))
+}
+
+// Markdown renders doc as the PR comment: a preamble with the change count, time and any warnings,
+// then each application that failed to diff or has changes
+func Markdown(doc results.Document, opts Options) github.CommentMarkdown {
+	cMarkdown := github.CommentMarkdown{CollapseDiffs: opts.CollapseDiffs, Preamble: preamble(doc)}
+	data := commentData(doc)
+	if md, ok := github.ExecuteCommentTemplate(github.TemplatePreamble, data); ok {
+		cMarkdown.Preamble = md
+	}
+	if md, ok := github.ExecuteCommentTemplate(github.TemplateFooter, data); ok {
+		cMarkdown.Closing = md
+	}
+	cMarkdown.Summary = github.SummaryTable(appSummaries(doc))
+	for _, a := range doc.Apps {
+		if a.Error != "" {
+			cMarkdown.AppMarkdown(a.Name, "Error: "+a.Error, a.Sync, a.Health, a.HealthMessage).ApplicationSet = a.ApplicationSet
+			continue
+		}
+		if len(a.Resources) == 0 && a.Removal == nil {
+			continue
+		}
+		appMarkdown := cMarkdown.AppMarkdown(a.Name, "", a.Sync, a.Health, a.HealthMessage)
+		appMarkdown.ApplicationSet = a.ApplicationSet
+		for _, c := range a.Callouts {
+			appMarkdown.AddCallout(c.Type, c.Message)
+		}
+		for _, r := range a.Resources {
+			appMarkdown.AddResourceDiff(r.Group, r.Kind, r.Name, r.Namespace, r.Action, resourceNote(doc.DiffMode, false, r), r.Diff)
+		}
+		for _, r := range a.LiveResources {
+			appMarkdown.AddResourceDiff(r.Group, r.Kind, r.Name, r.Namespace, r.Action, resourceNote(doc.DiffMode, true, r), r.Diff)
+		}
+	}
+	return cMarkdown
+}
+
+// preamble renders the top of the PR comment: the change count and time of the run, plus warnings
+// about applications that weren't diffed and an invalid repository config
+func preamble(doc results.Document) string {
+	md := doc.Summary + " compared to " + comparedTo(doc) + "\n"
+	md += "\n" + doc.Timings.Finished.Format("3:04PM MST, 2 Jan 2006") + "\n"
+	return md + warningsMarkdown(doc)
+}
+
+// warningsMarkdown renders the preamble's warnings about the run as a whole
+func warningsMarkdown(doc results.Document) string {
+	var md string
+	if len(doc.NotDiffed) > 0 {
+		md += timeoutMarkdown(time.Duration(doc.Timings.TimeoutMs)*time.Millisecond, doc.NotDiffed)
+	}
+	if doc.RepoConfigError != "" {
+		md += repoConfigMarkdown(doc.Event.BaseRef, doc.RepoConfigError)
+	}
+	return md
+}
+
+// comparedTo says what the head's manifests were compared to, for the headline: the live state, the
+// manifests at the merge-base (a desired-state diff), or both
+func comparedTo(doc results.Document) string {
+	desired := fmt.Sprintf("merge-base %s (desired-state diff)", shortRevision(doc.MergeBase))
+	switch doc.DiffMode {
+	case argocd.DiffModeDesired:
+		return desired
+	case argocd.DiffModeBoth:
+		return desired + " and live state"
+	}
+	return "live state"
+}
+
+// shortRevision abbreviates a commit sha to 7 characters; anything else (eg: a branch) is returned
+// as-is
+func shortRevision(rev string) string {
+	if len(rev) != 40 || strings.Trim(rev, "0123456789abcdef") != "" {
+		return rev
+	}
+	return rev[:7]
+}
+
+// resourceNote is the note shown above a resource's diff: under DiffModeBoth, which diff it's part
+// of (live is true for the application's LiveResources), then its originNote and pruneNote
+func resourceNote(diffMode string, live bool, r results.Resource) string {
+	var notes []string
+	if diffMode == argocd.DiffModeBoth {
+		if live {
+			notes = append(notes, "Live state diff: compared to the cluster, so it includes drift and changes not yet synced.")
+		} else {
+			notes = append(notes, "Desired-state diff: what this change does to the manifests rendered at the merge-base.")
+		}
+	}
+	for _, note := range []string{originNote(r.Origin), pruneNote(r.Prune)} {
+		if note != "" {
+			notes = append(notes, note)
+		}
+	}
+	return strings.Join(notes, " ")
+}
+
+// originNote says whether a resource's live diff is the change's or drift that was there before it
+// ("" when the application was Synced, so it's all the change's)
+func originNote(origin string) string {
+	switch origin {
+	case argocd.OriginChange:
+		return "Changed by this PR."
+	case argocd.OriginDrift:
+		return "Already drifted: the live state differed from the base branch before this PR, which doesn't change this resource."
+	case argocd.OriginBoth:
+		return "Changed by this PR, and already drifted: part of this diff was there before this PR."
+	}
+	return ""
+}
+
+// pruneNote explains what becomes of a deleted resource once the change merges ("" when it's not
+// being deleted)
+func pruneNote(prune string) string {
+	switch prune {
+	case argocd.PruneAutomatic:
+		return "Auto-sync will prune this resource from the cluster once the change merges."
+	case argocd.PruneManual:
+		return "Not pruned automatically: this resource stays in the cluster, and the application OutOfSync, until it's synced with pruning."
+	case argocd.PruneDisabled:
+		return "This resource has the Prune=false sync option, so ArgoCD won't delete it from the cluster."
+	case argocd.PruneRetained:
+		return "The ApplicationSet's applicationsSync policy keeps Applications it no longer generates, so this one won't be deleted."
+	}
+	return ""
+}
+
+// appSummaries are the summary table's rows: the applications that get a section in the comment
+// (those that failed to diff or have changes), with their changes counted by action
+func appSummaries(doc results.Document) []github.AppSummary {
+	var rows []github.AppSummary
+	ancestors := appAncestors(doc)
+	for _, a := range doc.Apps {
+		if a.Error == "" && len(a.Resources) == 0 && a.Removal == nil {
+			continue
+		}
+		row := github.AppSummary{Name: a.Name, Depth: len(ancestors[a.Name]), New: a.New, Removed: a.Removal != nil, ApplicationSet: a.ApplicationSet, Sync: a.Sync, Health: a.Health, Error: a.Error != "", AutoSync: a.AutoSync}
+		for _, r := range a.Resources {
+			switch r.Action {
+			case argocd.ActionAdded:
+				row.Added++
+			case argocd.ActionDeleted:
+				row.Deleted++
+			default:
+				row.Modified++
+			}
+		}
+		if a.Removal != nil && a.Removal.Cascade {
+			row.Deleted = len(a.Removal.Resources)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// appAncestors maps each nested application to the app-of-apps applications (or ApplicationSet)
+// above it, outermost first. The document lists nested applications right after their parents,
+// so in document order that's a tree.
+func appAncestors(doc results.Document) map[string][]string {
+	parents := make(map[string]string)
+	for _, a := range doc.Apps {
+		if a.Parent != "" {
+			parents[a.Name] = a.Parent
+		}
+	}
+	ancestors := make(map[string][]string)
+	for name := range parents {
+		var chain []string
+		// bounded, in case a hand-edited document has a cycle
+		for p, ok := parents[name]; ok && len(chain) < len(doc.Apps); p, ok = parents[p] {
+			chain = append([]string{p}, chain...)
+		}
+		ancestors[name] = chain
+	}
+	return ancestors
+}
+
+// commentData is what the preamble and footer comment templates are executed with
+func commentData(doc results.Document) github.CommentData {
+	data := github.CommentData{
+		Summary:    doc.Summary,
+		ComparedTo: comparedTo(doc),
+		Time:       doc.Timings.Finished,
+		Owner:      doc.Event.RepoOwner,
+		Repo:       doc.Event.RepoName,
+		PR:         doc.Event.PrNum,
+		Sha:        doc.Event.Sha,
+		BaseRef:    doc.Event.BaseRef,
+		Apps:       len(doc.Apps),
+		NotDiffed:  doc.NotDiffed,
+		Warnings:   warningsMarkdown(doc),
+	}
+	for _, a := range doc.Apps {
+		if a.Error != "" {
+			data.AppsWithErrors++
+		} else if len(a.Resources) > 0 {
+			data.AppsWithChanges++
+			data.Resources += len(a.Resources)
+		}
+	}
+	return data
+}
+
+// timeoutMarkdown renders the PR comment warning about applications that
+// weren't diffed. The list of names is capped so a change matching hundreds of
+// applications can't crowd the diffs out of the comment.
+func timeoutMarkdown(timeout time.Duration, notDiffed []string) string {
+	const maxNames = 20
+	names := strings.Join(notDiffed, ", ")
+	if len(notDiffed) > maxNames {
+		names = fmt.Sprintf("%s and %d more", strings.Join(notDiffed[:maxNames], ", "), len(notDiffed)-maxNames)
+	}
+	md := "\n> [!WARNING]\n"
+	md += fmt.Sprintf("> argo-diff ran out of time, so %d application(s) were **not** diffed: %s\n", len(notDiffed), names)
+	md += fmt.Sprintf(">\n> Raise the timeout (currently %s, set via `ARGO_DIFF_TIMEOUT`, the `timeout` input in GitHub Actions, or `timeout` in `%s`) to diff them.\n", timeout, repoconfig.Path)
+	return md
+}
+
+// repoConfigMarkdown renders the PR comment warning that the repository's config was ignored
+func repoConfigMarkdown(baseRef string, errStr string) string {
+	md := "\n> [!CAUTION]\n"
+	md += fmt.Sprintf("> `%s` on `%s` is invalid, so it was ignored and the defaults were used:\n", repoconfig.Path, baseRef)
+	md += "> `" + strings.ReplaceAll(errStr, "`", "'") + "`\n"
+	return md
+}
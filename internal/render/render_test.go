@@ -0,0 +1,130 @@
+package render
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vince-riv/argo-diff/internal/results"
+)
+
+// run `go test ./internal/render -update` to regenerate the golden files after an intended change
+var update = flag.Bool("update", false, "rewrite the golden files in render_testdata")
+
+// goldenExt is the extension of each format's golden file
+var goldenExt = map[string]string{
+	FormatMarkdown:   ".md",
+	FormatText:       ".txt",
+	FormatHTML:       ".html",
+	FormatJobSummary: ".summary.md",
+}
+
+// TestGolden renders each captured results document in render_testdata and compares it to the
+// golden files next to it
+func TestGolden(t *testing.T) {
+	docs, err := filepath.Glob(filepath.Join("render_testdata", "results-*.json"))
+	if err != nil || len(docs) == 0 {
+		t.Fatalf("No results documents in render_testdata: %v", err)
+	}
+	for _, docPath := range docs {
+		doc, err := results.ReadFile(docPath)
+		if err != nil {
+			t.Fatalf("results.ReadFile(%s) err'd: %v", docPath, err)
+		}
+		for format, ext := range goldenExt {
+			goldenPath := strings.TrimSuffix(docPath, ".json") + ext
+			t.Run(filepath.Base(goldenPath), func(t *testing.T) {
+				got, err := Render(*doc, format, Options{})
+				if err != nil {
+					t.Fatalf("Render(%s) err'd: %v", format, err)
+				}
+				if *update {
+					if err := os.WriteFile(goldenPath, []byte(got), 0o644); err != nil {
+						t.Fatal(err)
+					}
+					return
+				}
+				want, err := os.ReadFile(goldenPath)
+				if err != nil {
+					t.Fatalf("Missing golden file (run with -update to create it): %v", err)
+				}
+				if got != string(want) {
+					t.Errorf("Render(%s, %s) doesn't match %s:\n%s", filepath.Base(docPath), format, goldenPath, got)
+				}
+			})
+		}
+	}
+}
+
+func TestRenderUnknownFormat(t *testing.T) {
+	if _, err := Render(results.Document{}, "yaml", Options{}); err == nil || !strings.Contains(err.Error(), "job-summary") {
+		t.Errorf("Expected an error listing the formats, got %v", err)
+	}
+}
+
+func TestTextColor(t *testing.T) {
+	doc, err := results.ReadFile(filepath.Join("render_testdata", "results-changes.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := Text(*doc, true)
+	for _, want := range []string{ansiGreen + "+  replicas: 2" + ansiReset, ansiRed + "-  replicas: 3" + ansiReset, ansiCyan + "@@ -1,2 +1,2 @@" + ansiReset, "not diffed: slow"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("colored Text() is missing %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestCollapseDiffs(t *testing.T) {
+	doc, err := results.ReadFile(filepath.Join("render_testdata", "results-changes.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := strings.Join(Markdown(*doc, Options{CollapseDiffs: true}).String(), "")
+	if strings.Contains(md, "<details open>\n  <summary>=====") || !strings.Contains(md, "<details>\n  <summary>=====") {
+		t.Errorf("Expected collapsed diffs:\n%s", md)
+	}
+}
+
+func TestTimeoutMarkdown(t *testing.T) {
+	md := timeoutMarkdown(3*time.Minute, []string{"app-a", "app-b"})
+	for _, want := range []string{"[!WARNING]", "3m0s", "2 application(s)", "app-a, app-b", "ARGO_DIFF_TIMEOUT"} {
+		if !strings.Contains(md, want) {
+			t.Errorf("timeoutMarkdown() = %q, missing %q", md, want)
+		}
+	}
+
+	// long lists get capped so the diffs aren't crowded out of the comment
+	many := make([]string, 25)
+	for i := range many {
+		many[i] = fmt.Sprintf("app-%02d", i)
+	}
+	md = timeoutMarkdown(time.Minute, many)
+	if !strings.Contains(md, "and 5 more") {
+		t.Errorf("timeoutMarkdown() with 25 apps = %q, want it to cap the list", md)
+	}
+	if strings.Contains(md, "app-24") {
+		t.Errorf("timeoutMarkdown() with 25 apps = %q, want names past the cap omitted", md)
+	}
+	if !strings.Contains(md, "25 application(s)") {
+		t.Errorf("timeoutMarkdown() with 25 apps = %q, want the full count reported", md)
+	}
+}
+
+func TestCommentData(t *testing.T) {
+	doc, err := results.ReadFile(filepath.Join("render_testdata", "results-changes.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := commentData(*doc)
+	if data.Apps != 3 || data.AppsWithChanges != 1 || data.AppsWithErrors != 1 || data.Resources != 3 || data.PR != 42 {
+		t.Errorf("Unexpected counts in %+v", data)
+	}
+	if !strings.Contains(data.Warnings, "[!WARNING]") || !strings.Contains(data.Warnings, "[!CAUTION]") {
+		t.Errorf("Expected both warnings, got %q", data.Warnings)
+	}
+}
@@ -0,0 +1,111 @@
+package render
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/vince-riv/argo-diff/internal/results"
+)
+
+// ANSI escape codes for FormatText
+const (
+	ansiReset  = "\033[0m"
+	ansiBold   = "\033[1m"
+	ansiRed    = "\033[31m"
+	ansiGreen  = "\033[32m"
+	ansiYellow = "\033[33m"
+	ansiCyan   = "\033[36m"
+)
+
+// Text renders doc for a terminal: a header per application that errored or has changes, followed
+// by its callouts and each resource's diff, colored when color is set
+func Text(doc results.Document, color bool) string {
+	paint := func(code, str string) string {
+		if !color || str == "" {
+			return str
+		}
+		return code + str + ansiReset
+	}
+	var sb strings.Builder
+	sb.WriteString(paint(ansiBold, doc.Summary+" compared to "+comparedTo(doc)) + "\n")
+	if len(doc.NotDiffed) > 0 {
+		sb.WriteString(paint(ansiYellow, fmt.Sprintf("Ran out of time; not diffed: %s", strings.Join(doc.NotDiffed, ", "))) + "\n")
+	}
+	ancestors := appAncestors(doc)
+	for _, a := range doc.Apps {
+		if a.Error == "" && len(a.Resources) == 0 && a.Removal == nil {
+			continue
+		}
+		header := fmt.Sprintf("=== %s (%s, %s) ===", a.Name, a.Sync, a.Health)
+		if a.ApplicationSet {
+			header = fmt.Sprintf("=== %s (ApplicationSet) ===", a.Name)
+		}
+		sb.WriteString("\n" + paint(ansiBold, header) + "\n")
+		if chain := ancestors[a.Name]; len(chain) > 0 {
+			sb.WriteString("Nested in " + strings.Join(chain, " -> ") + "\n")
+		}
+		if a.Error != "" {
+			sb.WriteString(paint(ansiRed, "Error: "+a.Error) + "\n")
+			continue
+		}
+		for _, c := range a.Callouts {
+			sb.WriteString(paint(ansiYellow, c.Type+": "+c.Message) + "\n")
+		}
+		writeResource := func(r results.Resource, live bool) {
+			sb.WriteString("\n" + paint(ansiBold, ResourceTitle(r)+" ("+r.Action+")") + "\n")
+			if note := resourceNote(doc.DiffMode, live, r); note != "" {
+				sb.WriteString(paint(ansiYellow, note) + "\n")
+			}
+			for _, line := range strings.Split(strings.TrimSuffix(r.Diff, "\n"), "\n") {
+				sb.WriteString(paint(diffLineColor(line), line) + "\n")
+			}
+		}
+		for _, r := range a.Resources {
+			writeResource(r, false)
+		}
+		for _, r := range a.LiveResources {
+			writeResource(r, true)
+		}
+	}
+	return sb.String()
+}
+
+// diffLineColor picks the color of one line of a unified or structured diff ("" for none)
+func diffLineColor(line string) string {
+	switch {
+	case strings.HasPrefix(line, "+++"), strings.HasPrefix(line, "---"):
+		return ansiBold
+	case strings.HasPrefix(line, "@@"):
+		return ansiCyan
+	case strings.HasPrefix(line, "+"):
+		return ansiGreen
+	case strings.HasPrefix(line, "-"):
+		return ansiRed
+	case strings.HasPrefix(line, "!"):
+		return ansiYellow
+	}
+	return ""
+}
+
+// ResourceTitle names a resource as group/Kind namespace/name, leaving out an empty group or
+// namespace
+func ResourceTitle(r results.Resource) string {
+	kind := r.Kind
+	if r.Group != "" {
+		kind = r.Group + "/" + r.Kind
+	}
+	if r.Namespace != "" {
+		return kind + " " + r.Namespace + "/" + r.Name
+	}
+	return kind + " " + r.Name
+}
+
+// JSON renders doc as the indented JSON document
+func JSON(doc results.Document) (string, error) {
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(b) + "\n", nil
+}
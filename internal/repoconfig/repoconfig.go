@@ -0,0 +1,212 @@
+package repoconfig
+
+/*
+ * Per-repository configuration: a .argo-diff.yaml at the root of the repository, read from the
+ * pull request's base branch (so a pull request can't loosen its own checks). Every setting is
+ * optional and overrides the deployment-wide default from the environment for that repository
+ * only. All methods are safe to call on a nil *Config, which means "no repository config".
+ */
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Path is where the config file lives, relative to the repository root
+const Path = ".argo-diff.yaml"
+
+// A repository can raise its timeout, but not without limit
+const MaxTimeout = 30 * time.Minute
+
+// Config is a parsed and validated .argo-diff.yaml
+type Config struct {
+	Apps AppsConfig `json:"apps,omitempty"`
+	// IgnoreKinds are resource kinds left out of the results, as Kind or group/Kind
+	IgnoreKinds []string      `json:"ignoreKinds,omitempty"`
+	Comment     CommentConfig `json:"comment,omitempty"`
+	// Timeout replaces ARGO_DIFF_TIMEOUT, as a Go duration string
+	Timeout string `json:"timeout,omitempty"`
+	// DiffMode replaces ARGO_DIFF_DIFF_MODE: live, desired or both
+	DiffMode string       `json:"diffMode,omitempty"`
+	Policy   PolicyConfig `json:"policy,omitempty"`
+	timeout  time.Duration
+}
+
+// AppsConfig narrows the ArgoCD applications diffed, by name. Patterns are path.Match globs; an
+// application must match an include pattern (when there are any) and no exclude pattern.
+type AppsConfig struct {
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// CommentConfig controls how results are rendered
+type CommentConfig struct {
+	// DiffFormat replaces ARGO_DIFF_DIFF_FORMAT: unified or structured
+	DiffFormat string `json:"diffFormat,omitempty"`
+	// CollapseDiffs renders each resource's diff collapsed rather than expanded
+	CollapseDiffs bool `json:"collapseDiffs,omitempty"`
+}
+
+// PolicyConfig adjusts how the deployment's policy rules (ARGO_DIFF_POLICY_FILE) apply
+type PolicyConfig struct {
+	// Enabled set to false turns policy evaluation off
+	Enabled *bool `json:"enabled,omitempty"`
+	// SkipRules names rules that don't apply to this repository
+	SkipRules []string `json:"skipRules,omitempty"`
+}
+
+var enabled = true
+
+func init() {
+	if strings.ToLower(strings.TrimSpace(os.Getenv("ARGO_DIFF_REPO_CONFIG"))) == "false" {
+		enabled = false
+	}
+}
+
+// Enabled returns false when ARGO_DIFF_REPO_CONFIG=false turns repository config off
+func Enabled() bool {
+	return enabled
+}
+
+// Parse parses and validates a .argo-diff.yaml document
+func Parse(data []byte) (*Config, error) {
+	var c Config
+	if err := yaml.UnmarshalStrict(data, &c); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", Path, err)
+	}
+	for _, p := range append(append([]string{}, c.Apps.Include...), c.Apps.Exclude...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("apps: invalid pattern '%s'", p)
+		}
+	}
+	for _, k := range c.IgnoreKinds {
+		if k == "" || strings.Count(k, "/") > 1 || strings.HasSuffix(k, "/") {
+			return nil, fmt.Errorf("ignoreKinds: '%s' must be Kind or group/Kind", k)
+		}
+	}
+	// the same values as argocd.DiffFormatUnified/DiffFormatStructured, which can't be imported here
+	if f := c.Comment.DiffFormat; f != "" && f != "unified" && f != "structured" {
+		return nil, fmt.Errorf("comment.diffFormat must be 'unified' or 'structured', not '%s'", f)
+	}
+	// the same values as argocd.DiffModeLive/DiffModeDesired/DiffModeBoth
+	if m := c.DiffMode; m != "" && m != "live" && m != "desired" && m != "both" {
+		return nil, fmt.Errorf("diffMode must be 'live', 'desired' or 'both', not '%s'", m)
+	}
+	if c.Timeout != "" {
+		d, err := time.ParseDuration(c.Timeout)
+		if err != nil {
+			if secs, serr := strconv.Atoi(c.Timeout); serr == nil {
+				d, err = time.Duration(secs)*time.Second, nil
+			}
+		}
+		if err != nil || d <= 0 || d > MaxTimeout {
+			return nil, fmt.Errorf("timeout must be a positive duration of at most %s (eg: '5m'), not '%s'", MaxTimeout, c.Timeout)
+		}
+		c.timeout = d
+	}
+	return &c, nil
+}
+
+// IncludesApp returns false when the config leaves an application out
+func (c *Config) IncludesApp(name string) bool {
+	if c == nil {
+		return true
+	}
+	for _, p := range c.Apps.Exclude {
+		if ok, _ := path.Match(p, name); ok {
+			return false
+		}
+	}
+	if len(c.Apps.Include) == 0 {
+		return true
+	}
+	for _, p := range c.Apps.Include {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// IgnoresKind returns true when resources of group/kind are left out of the results
+func (c *Config) IgnoresKind(group, kind string) bool {
+	if c == nil {
+		return false
+	}
+	for _, k := range c.IgnoreKinds {
+		if g, kd, ok := strings.Cut(k, "/"); ok {
+			if g == group && kd == kind {
+				return true
+			}
+		} else if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// TimeoutOr returns the config's timeout, or def when it doesn't set one
+func (c *Config) TimeoutOr(def time.Duration) time.Duration {
+	if c == nil || c.timeout == 0 {
+		return def
+	}
+	return c.timeout
+}
+
+// DiffFormatOr returns the config's diff format, or def when it doesn't set one
+func (c *Config) DiffFormatOr(def string) string {
+	if c == nil || c.Comment.DiffFormat == "" {
+		return def
+	}
+	return c.Comment.DiffFormat
+}
+
+// DiffModeOr returns the config's diff mode, or def when it doesn't set one
+func (c *Config) DiffModeOr(def string) string {
+	if c == nil || c.DiffMode == "" {
+		return def
+	}
+	return c.DiffMode
+}
+
+// CollapseDiffs returns true when resource diffs should render collapsed
+func (c *Config) CollapseDiffs() bool {
+	return c != nil && c.Comment.CollapseDiffs
+}
+
+// PolicyApplies returns false when the config turns policy evaluation off, or skips the named rule
+func (c *Config) PolicyApplies(rule string) bool {
+	if c == nil {
+		return true
+	}
+	if c.Policy.Enabled != nil && !*c.Policy.Enabled {
+		return false
+	}
+	for _, r := range c.Policy.SkipRules {
+		if r == rule {
+			return false
+		}
+	}
+	return true
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying c, for code (like the argocd package) that only sees a
+// run's context
+func NewContext(ctx context.Context, c *Config) context.Context {
+	return context.WithValue(ctx, contextKey{}, c)
+}
+
+// FromContext returns the config carried by ctx, or nil
+func FromContext(ctx context.Context) *Config {
+	c, _ := ctx.Value(contextKey{}).(*Config)
+	return c
+}
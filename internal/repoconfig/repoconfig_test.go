@@ -0,0 +1,79 @@
+package repoconfig
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+const testConfig = `
+apps:
+  include: ["guestbook-*", "api"]
+  exclude: ["*-canary"]
+ignoreKinds: [Secret, apps/ReplicaSet]
+comment:
+  diffFormat: structured
+  collapseDiffs: true
+timeout: 10m
+diffMode: desired
+policy:
+  skipRules: [no-pvc-deletion]
+`
+
+func TestParse(t *testing.T) {
+	c, err := Parse([]byte(testConfig))
+	if err != nil {
+		t.Fatalf("Parse() failed: %s", err)
+	}
+	for name, want := range map[string]bool{"guestbook-ui": true, "api": true, "guestbook-canary": false, "web": false} {
+		if got := c.IncludesApp(name); got != want {
+			t.Errorf("IncludesApp(%s) = %v, want %v", name, got, want)
+		}
+	}
+	if !c.IgnoresKind("", "Secret") || !c.IgnoresKind("apps", "ReplicaSet") || c.IgnoresKind("", "ReplicaSet") || c.IgnoresKind("apps", "Deployment") {
+		t.Error("IgnoresKind() didn't match Kind and group/Kind entries as expected")
+	}
+	if c.TimeoutOr(time.Minute) != 10*time.Minute || c.DiffFormatOr("unified") != "structured" || !c.CollapseDiffs() || c.DiffModeOr("live") != "desired" {
+		t.Errorf("Unexpected settings: %+v", c)
+	}
+	if c.PolicyApplies("no-pvc-deletion") || !c.PolicyApplies("replicas-scaled-down") {
+		t.Error("PolicyApplies() didn't honor skipRules")
+	}
+	off, err := Parse([]byte("policy:\n  enabled: false\n"))
+	if err != nil || off.PolicyApplies("replicas-scaled-down") {
+		t.Errorf("Expected policy.enabled: false to turn every rule off (err: %v)", err)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := map[string]string{
+		"unknown field":    "app:\n  include: [a]\n",
+		"bad pattern":      "apps:\n  include: ['[a']\n",
+		"bad kind":         "ignoreKinds: [a/b/c]\n",
+		"bad diff format":  "comment:\n  diffFormat: sideBySide\n",
+		"bad timeout":      "timeout: soon\n",
+		"bad diff mode":    "diffMode: merge-base\n",
+		"timeout too long": "timeout: 2h\n",
+		"wrong type":       "ignoreKinds: Secret\n",
+	}
+	for desc, doc := range cases {
+		if _, err := Parse([]byte(doc)); err == nil {
+			t.Errorf("%s: expected Parse() to fail", desc)
+		}
+	}
+}
+
+func TestNilConfig(t *testing.T) {
+	var c *Config
+	if !c.IncludesApp("anything") || c.IgnoresKind("", "Secret") || c.TimeoutOr(time.Minute) != time.Minute ||
+		c.DiffFormatOr("unified") != "unified" || c.CollapseDiffs() || !c.PolicyApplies("rule") || c.DiffModeOr("live") != "live" {
+		t.Error("A nil config should leave every default alone")
+	}
+	if FromContext(context.Background()) != nil {
+		t.Error("Expected no config in an empty context")
+	}
+	c = &Config{}
+	if FromContext(NewContext(context.Background(), c)) != c {
+		t.Error("FromContext() didn't return the config from NewContext()")
+	}
+}
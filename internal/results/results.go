@@ -0,0 +1,303 @@
+package results
+
+/*
+ * A machine-readable record of one run: the event, every application that matched it and why, each
+ * changed resource, warnings, the final status and timings. process_event builds one per run; it's
+ * written to ARGO_DIFF_RESULTS_FILE when set, and the webhook server keeps the latest per pull
+ * request for its /results API (which needs ARGO_DIFF_RESULTS_TOKEN).
+ *
+ * The document is versioned by SchemaVersion. Adding fields is backwards compatible; renaming,
+ * removing or changing the meaning of one requires bumping it.
+ */
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/vince-riv/argo-diff/internal/gendiff"
+	"github.com/vince-riv/argo-diff/internal/webhook"
+)
+
+// SchemaVersion is the version of the Document format
+const SchemaVersion = 1
+
+// Document is the results of one run
+type Document struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	Event         webhook.EventInfo `json:"event"`
+	Status        Status            `json:"status"`
+	// Summary is the headline of the PR comment, eg: "2 of 3 apps with changes"
+	Summary    string `json:"summary"`
+	DiffFormat string `json:"diffFormat"`
+	Apps       []App  `json:"apps"`
+	// NotDiffed are the applications that matched but ran out of time
+	NotDiffed []string `json:"notDiffed"`
+	// Warnings are problems with the run as a whole (per-application ones are on the App)
+	Warnings []string `json:"warnings"`
+	// RepoConfigError is why the repository's .argo-diff.yaml was ignored, if it was
+	RepoConfigError string `json:"repoConfigError,omitempty"`
+	// DiffMode is what the head's manifests were compared to: live, desired (the manifests at
+	// MergeBase) or both
+	DiffMode  string `json:"diffMode,omitempty"`
+	MergeBase string `json:"mergeBase,omitempty"`
+	// ChangedFiles are the files the pull request changes, absent when they couldn't be listed.
+	// ChangedFilesTruncated is set when GitHub stopped listing them at its 3000-file cap, so the
+	// pull request changes more than these.
+	ChangedFiles          []string `json:"changedFiles,omitempty"`
+	ChangedFilesTruncated bool     `json:"changedFilesTruncated,omitempty"`
+	Timings               Timings  `json:"timings"`
+}
+
+// Status is how the run ended: the commit status it set, the equivalent check run conclusion, and
+// the error that failed it (if any)
+type Status struct {
+	State       string `json:"state"`
+	Conclusion  string `json:"conclusion"`
+	Description string `json:"description"`
+	Error       string `json:"error,omitempty"`
+}
+
+// App is one matching application
+type App struct {
+	Name string `json:"name"`
+	// MatchReason says why the application matched the change
+	MatchReason string `json:"matchReason,omitempty"`
+	// PathMatches explains a match through the application's manifest-generate-paths annotation:
+	// each changed file that satisfied it, and the pattern (resolved against the source at position
+	// source) it matched
+	PathMatches []PathMatch `json:"pathMatches,omitempty"`
+	// Parent is the app-of-apps Application whose diff changed this one, for a nested application
+	Parent string `json:"parent,omitempty"`
+	// New is set for a nested application that doesn't exist in ArgoCD yet; its resources are all of
+	// its manifests, as additions
+	New bool `json:"new,omitempty"`
+	// Removal is set for a nested application the change deletes
+	Removal *Removal `json:"removal,omitempty"`
+	// ApplicationSet is set when this is an ApplicationSet rather than an application: its resources
+	// are the Applications it generates that the change adds, removes or alters, and the
+	// applications it generates list it as their Parent
+	ApplicationSet bool   `json:"applicationSet,omitempty"`
+	Sync           string `json:"sync,omitempty"`
+	Health         string `json:"health,omitempty"`
+	HealthMessage  string `json:"healthMessage,omitempty"`
+	// AutoSync is true when ArgoCD will sync the application automatically once the change merges
+	AutoSync bool `json:"autoSync,omitempty"`
+	// Error is set when the application failed to diff
+	Error     string     `json:"error,omitempty"`
+	Callouts  []Callout  `json:"callouts,omitempty"`
+	Resources []Resource `json:"resources"`
+	// LiveResources is the diff against the live state when DiffMode is both (Resources is then
+	// the desired-state diff)
+	LiveResources []Resource `json:"liveResources,omitempty"`
+}
+
+// PathMatch is a changed file that matched a manifest-generate-paths pattern
+type PathMatch struct {
+	Source  int    `json:"source"`
+	Pattern string `json:"pattern"`
+	File    string `json:"file"`
+}
+
+// Removal is what deleting a nested application does to the live resources it manages. Prune is
+// when its parent deletes it (automatic, manual, disabled or retained, as for a deleted resource);
+// Cascade is set when its resources are deleted with it, rather than orphaned.
+type Removal struct {
+	Prune     string        `json:"prune"`
+	Cascade   bool          `json:"cascade"`
+	Resources []ResourceRef `json:"resources"`
+}
+
+// ResourceRef names a live resource
+type ResourceRef struct {
+	Group     string `json:"group,omitempty"`
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+}
+
+// Callout is a note on an application, such as a policy warning; Type is NOTE, WARNING or CAUTION
+type Callout struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// Resource is one changed resource. Action is added, modified or deleted; Diff is rendered in the
+// document's DiffFormat, and Changes are the field-level changes when they're known. Prune is set on
+// deletions: automatic, manual, disabled or retained (see argocd.PruneOutcome).
+type Resource struct {
+	Group     string `json:"group,omitempty"`
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	Action    string `json:"action"`
+	Prune     string `json:"prune,omitempty"`
+	// Origin is change, drift or both for a live diff of an OutOfSync application: whether the
+	// diff is the change's, pre-existing drift, or both
+	Origin  string           `json:"origin,omitempty"`
+	Diff    string           `json:"diff"`
+	Changes []gendiff.Change `json:"changes,omitempty"`
+}
+
+// Timings of the run, with durations in milliseconds. Finished is when the results were complete,
+// just before they were reported; TimeoutMs is the budget the run had.
+type Timings struct {
+	Started    time.Time `json:"started"`
+	Finished   time.Time `json:"finished"`
+	DurationMs int64     `json:"durationMs"`
+	DiffMs     int64     `json:"diffMs"`
+	TimeoutMs  int64     `json:"timeoutMs,omitempty"`
+}
+
+var resultsFile string
+var apiToken string
+
+func init() {
+	resultsFile = strings.TrimSpace(os.Getenv("ARGO_DIFF_RESULTS_FILE"))
+	apiToken = os.Getenv("ARGO_DIFF_RESULTS_TOKEN")
+}
+
+// APIEnabled returns true when ARGO_DIFF_RESULTS_TOKEN is set, so the webhook server should serve
+// Handler()
+func APIEnabled() bool {
+	return apiToken != ""
+}
+
+// Record keeps doc as its pull request's latest results when the results API is enabled, and
+// writes it to ARGO_DIFF_RESULTS_FILE when that's set. Failing to write is logged, not returned:
+// the run has already reported.
+func Record(doc Document) {
+	if APIEnabled() {
+		// nothing else reads the store, and documents hold diffs
+		store.put(doc)
+	}
+	if resultsFile == "" {
+		return
+	}
+	if err := WriteFile(resultsFile, doc); err != nil {
+		log.Error().Err(err).Msgf("Failed to write results to %s", resultsFile)
+		return
+	}
+	log.Info().Msgf("Wrote results to %s", resultsFile)
+}
+
+// WriteFile writes doc to path as indented JSON, replacing the file whole
+func WriteFile(path string, doc Document) error {
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".argo-diff-results-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// ReadFile reads a document written by WriteFile, refusing versions newer than this build knows
+func ReadFile(path string) (*Document, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc Document
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("parsing results document %s: %w", path, err)
+	}
+	if doc.SchemaVersion < 1 || doc.SchemaVersion > SchemaVersion {
+		return nil, fmt.Errorf("results document %s has schema version %d; this build supports 1 to %d", path, doc.SchemaVersion, SchemaVersion)
+	}
+	return &doc, nil
+}
+
+// How many pull requests' results the webhook server keeps
+const maxStored = 500
+
+// latest holds the most recent Document per pull request, forgetting the oldest beyond maxStored
+type latest struct {
+	mu    sync.Mutex
+	docs  map[string]Document
+	order []string
+}
+
+var store = &latest{docs: map[string]Document{}}
+
+func key(provider, owner, repo string, pr int) string {
+	if provider == "" {
+		provider = webhook.ProviderGithub
+	}
+	return fmt.Sprintf("%s/%s/%s#%d", provider, owner, repo, pr)
+}
+
+func (l *latest) put(doc Document) {
+	k := key(doc.Event.Provider, doc.Event.RepoOwner, doc.Event.RepoName, doc.Event.PrNum)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.docs[k]; ok {
+		for i, o := range l.order {
+			if o == k {
+				l.order = append(l.order[:i], l.order[i+1:]...)
+				break
+			}
+		}
+	}
+	l.docs[k] = doc
+	l.order = append(l.order, k)
+	if len(l.order) > maxStored {
+		delete(l.docs, l.order[0])
+		l.order = l.order[1:]
+	}
+}
+
+func (l *latest) get(k string) (Document, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	doc, ok := l.docs[k]
+	return doc, ok
+}
+
+// Handler serves the latest results for a pull request: GET /results?owner=&repo=&pr=, plus
+// provider=gitlab for a merge request. Requests must carry ARGO_DIFF_RESULTS_TOKEN as a bearer token.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || apiToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(apiToken)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		q := r.URL.Query()
+		pr, err := strconv.Atoi(q.Get("pr"))
+		if err != nil || q.Get("owner") == "" || q.Get("repo") == "" {
+			http.Error(w, "owner, repo and pr are required", http.StatusBadRequest)
+			return
+		}
+		doc, ok := store.get(key(q.Get("provider"), q.Get("owner"), q.Get("repo"), pr))
+		if !ok {
+			http.Error(w, "No results", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(doc)
+	})
+}
@@ -0,0 +1,116 @@
+package results
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vince-riv/argo-diff/internal/webhook"
+)
+
+func testDocument(pr int) Document {
+	return Document{
+		SchemaVersion: SchemaVersion,
+		Event:         webhook.EventInfo{RepoOwner: "owner", RepoName: "repo", PrNum: pr, Provider: webhook.ProviderGithub},
+		Status:        Status{State: "success", Conclusion: "success", Description: "1 of 1 apps with changes - no errors"},
+		Summary:       "1 of 1 apps with changes",
+		Apps: []App{{
+			Name:        "guestbook",
+			MatchReason: "source https://github.com/owner/repo.git (path guestbook, targetRevision main)",
+			Resources:   []Resource{{Group: "apps", Kind: "Deployment", Namespace: "default", Name: "guestbook", Action: "modified", Diff: "-a\n+b\n"}},
+		}},
+		NotDiffed:             []string{},
+		Warnings:              []string{},
+		ChangedFiles:          []string{"guestbook/deployment.yaml"},
+		ChangedFilesTruncated: true,
+	}
+}
+
+func TestWriteReadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.json")
+	if err := WriteFile(path, testDocument(1)); err != nil {
+		t.Fatalf("WriteFile() failed: %s", err)
+	}
+	doc, err := ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() failed: %s", err)
+	}
+	if doc.Apps[0].Resources[0].Action != "modified" || doc.Event.PrNum != 1 || len(doc.ChangedFiles) != 1 || !doc.ChangedFilesTruncated {
+		t.Errorf("Unexpected document read back: %+v", doc)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"schemaVersion": 99}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadFile(path); err == nil || !strings.Contains(err.Error(), "schema version 99") {
+		t.Errorf("Expected a newer schema version to be refused, got %v", err)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	originalToken := apiToken
+	defer func() { apiToken = originalToken }()
+	apiToken = "s3cret"
+	store.put(testDocument(42))
+
+	for _, c := range []struct {
+		name, query, auth string
+		status            int
+	}{
+		{"no token", "owner=owner&repo=repo&pr=42", "", http.StatusUnauthorized},
+		{"wrong token", "owner=owner&repo=repo&pr=42", "Bearer nope", http.StatusUnauthorized},
+		{"missing pr", "owner=owner&repo=repo", "Bearer s3cret", http.StatusBadRequest},
+		{"unknown pr", "owner=owner&repo=repo&pr=43", "Bearer s3cret", http.StatusNotFound},
+		{"gitlab", "owner=owner&repo=repo&pr=42&provider=gitlab", "Bearer s3cret", http.StatusNotFound},
+		{"found", "owner=owner&repo=repo&pr=42", "Bearer s3cret", http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/results?"+c.query, nil)
+		if c.auth != "" {
+			req.Header.Set("Authorization", c.auth)
+		}
+		rec := httptest.NewRecorder()
+		Handler().ServeHTTP(rec, req)
+		if rec.Code != c.status {
+			t.Errorf("%s: got status %d, want %d", c.name, rec.Code, c.status)
+		}
+		if c.status == http.StatusOK && !strings.Contains(rec.Body.String(), `"matchReason":"source`) {
+			t.Errorf("%s: unexpected body %s", c.name, rec.Body.String())
+		}
+	}
+}
+
+func TestRecordStoresOnlyWithAPI(t *testing.T) {
+	originalToken := apiToken
+	defer func() { apiToken = originalToken }()
+	apiToken = ""
+	Record(testDocument(77))
+	if _, ok := store.get(key("github", "owner", "repo", 77)); ok {
+		t.Errorf("Expected nothing stored with the results API off")
+	}
+	apiToken = "s3cret"
+	Record(testDocument(77))
+	if _, ok := store.get(key("github", "owner", "repo", 77)); !ok {
+		t.Errorf("Expected the document stored with the results API on")
+	}
+}
+
+func TestStoreEviction(t *testing.T) {
+	l := &latest{docs: map[string]Document{}}
+	for i := 1; i <= maxStored+1; i++ {
+		l.put(testDocument(i))
+	}
+	// a newer run for a stored PR replaces it rather than taking another slot
+	l.put(testDocument(maxStored + 1))
+	if len(l.docs) != maxStored || len(l.order) != maxStored {
+		t.Errorf("Expected %d stored documents, got %d (%d ordered)", maxStored, len(l.docs), len(l.order))
+	}
+	if _, ok := l.get(key("", "owner", "repo", 1)); ok {
+		t.Errorf("Expected the oldest document to be evicted")
+	}
+	if _, ok := l.get(key("github", "owner", "repo", 2)); !ok {
+		t.Errorf("Expected the second document to be kept")
+	}
+}
@@ -14,16 +14,25 @@ import (
 	"time"
 
 	"github.com/rs/zerolog/log"
+	"github.com/vince-riv/argo-diff/internal/metrics"
 	"github.com/vince-riv/argo-diff/internal/process_event"
+	"github.com/vince-riv/argo-diff/internal/results"
 	"github.com/vince-riv/argo-diff/internal/webhook"
 )
 
 const sigHeaderName = "X-Hub-Signature-256"
+const gitlabTokenHeaderName = "X-Gitlab-Token"
+
+// event label for webhook metrics recorded before the payload is verified; the event header of an
+// unverified request is caller-controlled, so it isn't used as a label value
+const unverifiedEvent = "unverified"
 
 type WebhookProcessor struct {
 	GithubWebhookSecret string
+	GitlabWebhookSecret string
 	DevMode             bool
 	Wg                  sync.WaitGroup
+	jobs                *process_event.JobManager // debounces and serializes runs per PR; holds slots in Wg
 }
 
 // HTTP Handler for futzing around locally
@@ -39,9 +48,7 @@ func (wp *WebhookProcessor) devHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Cannot unmarshal POST'ed json to webhook.EventInfo struct", http.StatusBadRequest)
 		return
 	}
-	wp.Wg.Add(1)
-	var ignoredError error
-	go process_event.ProcessCodeChange(evt, wp.DevMode, &wp.Wg, &ignoredError)
+	wp.jobs.Submit(evt)
 	_, _ = io.WriteString(w, "Event dispatched to process_event.ProcessCodeChange()\n")
 }
 
@@ -50,6 +57,7 @@ func (wp *WebhookProcessor) handleWebhook(w http.ResponseWriter, r *http.Request
 	payload, err := io.ReadAll(r.Body)
 	if err != nil {
 		log.Error().Err(err).Msg("Error reading request body")
+		metrics.WebhookEvent(webhook.ProviderGithub, unverifiedEvent, metrics.OutcomeError)
 		http.Error(w, "Error reading request body", http.StatusInternalServerError)
 		return
 	}
@@ -59,6 +67,7 @@ func (wp *WebhookProcessor) handleWebhook(w http.ResponseWriter, r *http.Request
 	} else {
 		signature := r.Header.Get(sigHeaderName)
 		if !webhook.VerifySignature(payload, signature, wp.GithubWebhookSecret) {
+			metrics.WebhookEvent(webhook.ProviderGithub, unverifiedEvent, metrics.OutcomeUnauthorized)
 			http.Error(w, "Invalid signature", http.StatusUnauthorized)
 			return
 		}
@@ -69,6 +78,7 @@ func (wp *WebhookProcessor) handleWebhook(w http.ResponseWriter, r *http.Request
 	switch event {
 	case "ping":
 		log.Info().Str("method", r.Method).Str("url", r.URL.String()).Msg("ping event received")
+		metrics.WebhookEvent(webhook.ProviderGithub, event, metrics.OutcomeAccepted)
 		_, err := io.WriteString(w, "ping event processed\n")
 		if err != nil {
 			log.Error().Err(err).Msg("io.WriteString() failed")
@@ -78,17 +88,27 @@ func (wp *WebhookProcessor) handleWebhook(w http.ResponseWriter, r *http.Request
 	case "pull_request":
 		eventInfo, err = webhook.ProcessPullRequest(payload)
 		if err != nil {
+			metrics.WebhookEvent(webhook.ProviderGithub, event, metrics.OutcomeError)
 			http.Error(w, "Could not process pull request event data", http.StatusInternalServerError)
 			return
 		}
 	case "issue_comment":
 		eventInfo, err = webhook.ProcessComment(payload)
 		if err != nil {
+			metrics.WebhookEvent(webhook.ProviderGithub, event, metrics.OutcomeError)
 			http.Error(w, "Could not process issue comment data", http.StatusInternalServerError)
 			return
 		}
+	case "check_run":
+		eventInfo, err = webhook.ProcessCheckRun(payload)
+		if err != nil {
+			metrics.WebhookEvent(webhook.ProviderGithub, event, metrics.OutcomeError)
+			http.Error(w, "Could not process check run data", http.StatusInternalServerError)
+			return
+		}
 	default:
 		log.Info().Str("method", r.Method).Str("url", r.URL.String()).Msgf("Ignoring X-GitHub-Event %s", event)
+		metrics.WebhookEvent(webhook.ProviderGithub, event, metrics.OutcomeIgnored)
 		_, err := io.WriteString(w, "event ignored\n")
 		if err != nil {
 			log.Error().Err(err).Msg("io.WriteString() failed")
@@ -98,6 +118,7 @@ func (wp *WebhookProcessor) handleWebhook(w http.ResponseWriter, r *http.Request
 	}
 	if eventInfo.Ignore {
 		log.Info().Msgf("Ignoring %s event. Event Info: %v", event, eventInfo)
+		metrics.WebhookEvent(webhook.ProviderGithub, event, metrics.OutcomeIgnored)
 		_, err := io.WriteString(w, fmt.Sprintf("%s event ignored\n%v\n", html.EscapeString(event), eventInfo))
 		if err != nil {
 			log.Error().Err(err).Msg("io.WriteString() failed")
@@ -106,10 +127,75 @@ func (wp *WebhookProcessor) handleWebhook(w http.ResponseWriter, r *http.Request
 		return // we're done when it's a PR/PUSH event we don't care about
 	}
 
-	// call processEvent in a new gorouting and send a 200 OK back to Github
-	wp.Wg.Add(1)
-	var ignoredError error
-	go process_event.ProcessCodeChange(eventInfo, wp.DevMode, &wp.Wg, &ignoredError)
+	// queue the event (it's processed in a goroutine) and send a 200 OK back to Github
+	metrics.WebhookEvent(webhook.ProviderGithub, event, metrics.OutcomeAccepted)
+	wp.jobs.Submit(eventInfo)
+	_, err = io.WriteString(w, "event accepted for processing\n")
+	if err != nil {
+		log.Error().Err(err).Msg("io.WriteString() failed")
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// HTTP handler for gitlab webhook events
+func (wp *WebhookProcessor) handleGitlabWebhook(w http.ResponseWriter, r *http.Request) {
+	payload, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Error().Err(err).Msg("Error reading request body")
+		metrics.WebhookEvent(webhook.ProviderGitlab, unverifiedEvent, metrics.OutcomeError)
+		http.Error(w, "Error reading request body", http.StatusInternalServerError)
+		return
+	}
+
+	if wp.DevMode {
+		log.Info().Msg("Running in dev mode - skipping token validation")
+	} else if !webhook.VerifyGitlabToken(r.Header.Get(gitlabTokenHeaderName), wp.GitlabWebhookSecret) {
+		metrics.WebhookEvent(webhook.ProviderGitlab, unverifiedEvent, metrics.OutcomeUnauthorized)
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	event := r.Header.Get("X-Gitlab-Event")
+	eventInfo := webhook.NewEventInfo()
+	switch event {
+	case "Merge Request Hook":
+		eventInfo, err = webhook.ProcessGitlabMergeRequest(payload)
+		if err != nil {
+			metrics.WebhookEvent(webhook.ProviderGitlab, event, metrics.OutcomeError)
+			http.Error(w, "Could not process merge request event data", http.StatusInternalServerError)
+			return
+		}
+	case "Note Hook":
+		eventInfo, err = webhook.ProcessGitlabNote(payload)
+		if err != nil {
+			metrics.WebhookEvent(webhook.ProviderGitlab, event, metrics.OutcomeError)
+			http.Error(w, "Could not process note event data", http.StatusInternalServerError)
+			return
+		}
+	default:
+		log.Info().Str("method", r.Method).Str("url", r.URL.String()).Msgf("Ignoring X-Gitlab-Event %s", event)
+		metrics.WebhookEvent(webhook.ProviderGitlab, event, metrics.OutcomeIgnored)
+		_, err := io.WriteString(w, "event ignored\n")
+		if err != nil {
+			log.Error().Err(err).Msg("io.WriteString() failed")
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return // we're done when it's an event we don't know about
+	}
+	if eventInfo.Ignore {
+		log.Info().Msgf("Ignoring %s event. Event Info: %v", event, eventInfo)
+		metrics.WebhookEvent(webhook.ProviderGitlab, event, metrics.OutcomeIgnored)
+		_, err := io.WriteString(w, fmt.Sprintf("%s event ignored\n%v\n", html.EscapeString(event), eventInfo))
+		if err != nil {
+			log.Error().Err(err).Msg("io.WriteString() failed")
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return // we're done when it's a MR/note event we don't care about
+	}
+
+	// queue the event (it's processed in a goroutine) and send a 200 OK back to Gitlab
+	metrics.WebhookEvent(webhook.ProviderGitlab, event, metrics.OutcomeAccepted)
+	wp.jobs.Submit(eventInfo)
 	_, err = io.WriteString(w, "event accepted for processing\n")
 	if err != nil {
 		log.Error().Err(err).Msg("io.WriteString() failed")
@@ -148,7 +234,7 @@ func (wp *WebhookProcessor) printWebHook(w http.ResponseWriter, r *http.Request)
 	}
 }
 
-func StartWebhookProcessor(addr string, webhook_secret string, devMode bool) {
+func StartWebhookProcessor(addr string, webhook_secret string, gitlabWebhookSecret string, devMode bool) {
 	log.Info().Msgf("Setting up listener on %s", addr)
 	if devMode {
 		log.Warn().Msg("Dev Mode is enabled - signature validations are disabled!")
@@ -157,13 +243,20 @@ func StartWebhookProcessor(addr string, webhook_secret string, devMode bool) {
 
 	wp := WebhookProcessor{
 		GithubWebhookSecret: webhook_secret,
+		GitlabWebhookSecret: gitlabWebhookSecret,
 		DevMode:             devMode,
 	}
+	wp.jobs = process_event.NewJobManager(&wp.Wg, devMode)
 
 	srv := &http.Server{Addr: addr}
 	http.HandleFunc("/webhook", wp.handleWebhook)
+	http.HandleFunc("/webhook/gitlab", wp.handleGitlabWebhook)
 	http.HandleFunc("/webhook_log", wp.printWebHook)
 	http.HandleFunc("/healthz", wp.healthZ)
+	http.Handle("/metrics", metrics.Handler())
+	if results.APIEnabled() {
+		http.Handle("/results", results.Handler())
+	}
 	if devMode {
 		http.HandleFunc("/dev", wp.devHandler)
 	}
@@ -184,7 +277,8 @@ func StartWebhookProcessor(addr string, webhook_secret string, devMode bool) {
 	if err := srv.Shutdown(ctx); err != nil {
 		log.Warn().Err(err).Msg("Server forced to shutdown")
 	}
-	// Wait for all processEvent() goroutines to finish
+	// Wait for all queued and in-flight events to finish
+	log.Info().Msgf("Waiting on %d pull request(s) with queued or in-flight events", wp.jobs.Active())
 	wp.Wg.Wait()
 	log.Info().Msg("Server gracefully stopped")
 }
@@ -43,6 +43,9 @@ func logEnvironmentVariables() {
 		"GITHUB_PERSONAL_ACCESS_TOKEN",
 		"GITHUB_TOKEN",
 		"GITHUB_APP_PRIVATE_KEY",
+		"GITLAB_TOKEN",
+		"GITLAB_WEBHOOK_SECRET",
+		"ARGO_DIFF_RESULTS_TOKEN",
 	}
 	for _, key := range sensitiveVars {
 		log.Debug().Str(key, redactEnvValue(key, true)).Msg("")
@@ -59,6 +62,7 @@ func logEnvironmentVariables() {
 		"ARGOCD_CLI_CMD_NAME",
 		"GITHUB_APP_ID",
 		"GITHUB_APP_INSTALLATION_ID",
+		"GITLAB_BASE_URL",
 		"APP_ENV",
 		"LOG_LEVEL",
 		"GITHUB_ACTIONS",
@@ -69,8 +73,20 @@ func logEnvironmentVariables() {
 		"GITHUB_HEAD_REF",
 		"GITHUB_BASE_REF",
 		"ARGO_DIFF_CONTEXT_STR",
+		"ARGO_DIFF_ARGOCD_BACKEND",
+		"ARGO_DIFF_DEBOUNCE",
+		"ARGO_DIFF_DIFF_FORMAT",
+		"ARGO_DIFF_DIFF_MODE",
+		"ARGO_DIFF_GITHUB_CHECKS",
+		"ARGO_DIFF_MAX_APP_DEPTH",
+		"ARGO_DIFF_POLICY_FILE",
+		"ARGO_DIFF_PREVIEW_NEW_APPS",
+		"ARGO_DIFF_REDACTION_FILE",
+		"ARGO_DIFF_REPO_CONFIG",
+		"ARGO_DIFF_RESULTS_FILE",
 		"ARGO_DIFF_CI",
 		"ARGO_DIFF_COMMENT_PREAMBLE",
+		"ARGO_DIFF_COMMENT_TEMPLATES",
 		"COMMENT_LINE_MAX_CHARS",
 	}
 	for _, key := range nonSensitiveVars {
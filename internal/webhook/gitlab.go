@@ -0,0 +1,125 @@
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	argoDiffGh "github.com/vince-riv/argo-diff/internal/github"
+)
+
+// Subset of the GitLab webhook payloads that argo-diff uses. GitLab has no Go types in our
+// dependency tree, so only the fields read below are declared.
+type gitlabProject struct {
+	PathWithNamespace string `json:"path_with_namespace"`
+	DefaultBranch     string `json:"default_branch"`
+}
+
+type gitlabMergeRequestAttributes struct {
+	Iid          int    `json:"iid"`
+	Action       string `json:"action"`
+	SourceBranch string `json:"source_branch"`
+	TargetBranch string `json:"target_branch"`
+	OldRev       string `json:"oldrev"`
+	LastCommit   struct {
+		Id string `json:"id"`
+	} `json:"last_commit"`
+}
+
+type gitlabMergeRequestEvent struct {
+	ObjectKind       string                       `json:"object_kind"`
+	Project          *gitlabProject               `json:"project"`
+	ObjectAttributes gitlabMergeRequestAttributes `json:"object_attributes"`
+}
+
+type gitlabNoteEvent struct {
+	ObjectKind       string         `json:"object_kind"`
+	Project          *gitlabProject `json:"project"`
+	ObjectAttributes struct {
+		Note         string `json:"note"`
+		NoteableType string `json:"noteable_type"`
+	} `json:"object_attributes"`
+	MergeRequest *struct {
+		Iid int `json:"iid"`
+	} `json:"merge_request"`
+}
+
+// splitProjectPath splits a GitLab path_with_namespace into owner (the full, possibly nested,
+// namespace) and repo (the project path)
+func splitProjectPath(pathWithNamespace string) (string, string) {
+	idx := strings.LastIndex(pathWithNamespace, "/")
+	if idx < 0 {
+		return "", pathWithNamespace
+	}
+	return pathWithNamespace[:idx], pathWithNamespace[idx+1:]
+}
+
+// Processes a Merge Request Hook event received from gitlab
+func ProcessGitlabMergeRequest(payload []byte) (EventInfo, error) {
+	mrInfo := NewEventInfo()
+	mrInfo.Provider = ProviderGitlab
+	var mrEvent gitlabMergeRequestEvent
+	if err := json.Unmarshal(payload, &mrEvent); err != nil {
+		log.Error().Err(err).Msg("Error decoding JSON payload")
+		return mrInfo, err
+	}
+	if mrEvent.ObjectKind != "merge_request" || mrEvent.Project == nil {
+		err := errors.New("gitlab merge request event missing key field")
+		log.Error().Err(err).Msgf("Unexpected object_kind %s", mrEvent.ObjectKind)
+		return mrInfo, err
+	}
+	attrs := mrEvent.ObjectAttributes
+	mrInfo.RepoOwner, mrInfo.RepoName = splitProjectPath(mrEvent.Project.PathWithNamespace)
+	mrInfo.PrNum = attrs.Iid
+	switch attrs.Action {
+	case "open", "reopen":
+	case "update":
+		// updates also fire for title/label/assignee edits; oldrev is only set when commits were pushed
+		if attrs.OldRev == "" {
+			log.Info().Msgf("Ignoring update action without new commits for MR %s!%d", mrEvent.Project.PathWithNamespace, attrs.Iid)
+			return mrInfo, nil
+		}
+	default:
+		log.Info().Msgf("Ignoring %s action for MR %s!%d", attrs.Action, mrEvent.Project.PathWithNamespace, attrs.Iid)
+		return mrInfo, nil
+	}
+	mrInfo.Ignore = false
+	mrInfo.Sha = attrs.LastCommit.Id
+	mrInfo.RepoDefaultRef = mrEvent.Project.DefaultBranch
+	mrInfo.BaseRef = attrs.TargetBranch
+	mrInfo.ChangeRef = attrs.SourceBranch
+	log.Debug().Msgf("Returning EventInfo: %+v", mrInfo)
+	return mrInfo, validateEventInfo(mrInfo)
+}
+
+// Processes a Note Hook event received from gitlab
+func ProcessGitlabNote(payload []byte) (EventInfo, error) {
+	mrInfo := NewEventInfo()
+	mrInfo.Provider = ProviderGitlab
+	var noteEvent gitlabNoteEvent
+	if err := json.Unmarshal(payload, &noteEvent); err != nil {
+		log.Error().Err(err).Msg("Error decoding JSON payload")
+		return mrInfo, err
+	}
+	if noteEvent.Project == nil {
+		log.Warn().Msg("Ignoring note event with missing field(s)")
+		return mrInfo, nil
+	}
+	if noteEvent.ObjectAttributes.NoteableType != "MergeRequest" || noteEvent.MergeRequest == nil {
+		log.Info().Msgf("Ignoring note on %s", noteEvent.ObjectAttributes.NoteableType)
+		return mrInfo, nil
+	}
+	mrInfo.PrNum = noteEvent.MergeRequest.Iid
+	mrInfo.RepoOwner, mrInfo.RepoName = splitProjectPath(noteEvent.Project.PathWithNamespace)
+	mrInfo.RepoDefaultRef = noteEvent.Project.DefaultBranch
+	if !argoDiffGh.IsRefreshComment(noteEvent.ObjectAttributes.Note) {
+		log.Info().Msg("Ignoring merge request note")
+		return mrInfo, nil
+	}
+	mrInfo.Ignore = false
+	mrInfo.Refresh = true
+	log.Debug().Msgf("Returning EventInfo: %+v", mrInfo)
+	return mrInfo, validateEventInfo(mrInfo)
+}
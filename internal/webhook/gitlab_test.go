@@ -0,0 +1,91 @@
+package webhook
+
+import (
+	"testing"
+)
+
+const payloadGitlabMrOpen = "payload-gitlab-mr-open.json"
+const payloadGitlabMrUpdatePush = "payload-gitlab-mr-update-push.json"
+const payloadGitlabMrUpdateTitle = "payload-gitlab-mr-update-title.json"
+const payloadGitlabMrClose = "payload-gitlab-mr-close.json"
+const payloadGitlabNoteCreated = "payload-gitlab-note-created.json"
+const payloadGitlabNoteArgoDiff = "payload-gitlab-note-argodiff-created.json"
+const payloadGitlabNoteCommit = "payload-gitlab-note-commit.json"
+
+func TestLoadGitlabMergeRequestEvents(t *testing.T) {
+	expectIgnore := map[string]bool{
+		payloadGitlabMrOpen:        false,
+		payloadGitlabMrUpdatePush:  false,
+		payloadGitlabMrUpdateTitle: true,
+		payloadGitlabMrClose:       true,
+	}
+	for payloadFile, ignore := range expectIgnore {
+		payload, filePath, err := readFileToByteArray(payloadFile)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", payloadFile, err)
+		}
+		result, err := ProcessGitlabMergeRequest(payload)
+		if err != nil {
+			t.Errorf("Failed to load payload from %s: %v", filePath, err)
+		}
+		if result.Provider != ProviderGitlab || !result.IsGitlab() {
+			t.Errorf("ProcessGitlabMergeRequest() Expected gitlab provider, got %q. Payload %s", result.Provider, filePath)
+		}
+		if result.RepoOwner != "platform/gitops" || result.RepoName != "deployments" || result.PrNum != 7 {
+			t.Errorf("ProcessGitlabMergeRequest() Unexpected project/iid: %+v; Payload %s", result, filePath)
+		}
+		if result.Ignore != ignore {
+			t.Errorf("ProcessGitlabMergeRequest() Ignore = %t, want %t. Payload %s", result.Ignore, ignore, filePath)
+		}
+		if ignore {
+			continue
+		}
+		if result.Sha != "da1560886d4f094c3e6c9ef40349f7d38b5d27d7" || result.ChangeRef != "bump-api" || result.BaseRef != "main" || result.RepoDefaultRef != "main" {
+			t.Errorf("ProcessGitlabMergeRequest() Unexpected refs: %+v; Payload %s", result, filePath)
+		}
+		if result.Refresh {
+			t.Errorf("ProcessGitlabMergeRequest() Expected to NOT set refresh flag. Payload %s", filePath)
+		}
+	}
+}
+
+func TestLoadGitlabNoteEvents(t *testing.T) {
+	expectIgnore := map[string]bool{
+		payloadGitlabNoteCreated:  true,
+		payloadGitlabNoteArgoDiff: false,
+		payloadGitlabNoteCommit:   true,
+	}
+	for payloadFile, ignore := range expectIgnore {
+		payload, filePath, err := readFileToByteArray(payloadFile)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", payloadFile, err)
+		}
+		result, err := ProcessGitlabNote(payload)
+		if err != nil {
+			t.Errorf("Failed to load payload from %s: %v", filePath, err)
+		}
+		if result.Ignore != ignore {
+			t.Errorf("ProcessGitlabNote() Ignore = %t, want %t. Payload %s", result.Ignore, ignore, filePath)
+		}
+		if result.Refresh == ignore {
+			t.Errorf("ProcessGitlabNote() Refresh = %t, want %t. Payload %s", result.Refresh, !ignore, filePath)
+		}
+		if !ignore && (result.RepoOwner != "platform/gitops" || result.RepoName != "deployments" || result.RepoDefaultRef != "main" || result.PrNum != 7) {
+			t.Errorf("ProcessGitlabNote() Unexpected result: %+v; Payload %s", result, filePath)
+		}
+	}
+}
+
+func TestSplitProjectPath(t *testing.T) {
+	cases := map[string][2]string{
+		"group/project":          {"group", "project"},
+		"group/sub/deep/project": {"group/sub/deep", "project"},
+		"project":                {"", "project"},
+	}
+	for in, want := range cases {
+		owner, repo := splitProjectPath(in)
+		if owner != want[0] || repo != want[1] {
+			t.Errorf("splitProjectPath(%q) = %q, %q; want %q, %q", in, owner, repo, want[0], want[1])
+		}
+	}
+}
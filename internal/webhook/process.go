@@ -21,8 +21,20 @@ type EventInfo struct {
 	PrNum          int      `json:"pr"`
 	ChangeRef      string   `json:"change_ref"`
 	BaseRef        string   `json:"base_ref"`
+	MergeBase      string   `json:"merge_base,omitempty"`
 	Refresh        bool     `json:"refresh"`
 	ChangedFiles   []string `json:"changed_files,omitempty"`
+	Provider       string   `json:"provider,omitempty"`
+}
+
+// Source control providers an EventInfo can originate from. An empty Provider means GitHub, so
+// existing event files and /dev payloads keep working.
+const ProviderGithub = "github"
+const ProviderGitlab = "gitlab"
+
+// IsGitlab returns true when the event came from a GitLab merge request
+func (e EventInfo) IsGitlab() bool {
+	return e.Provider == ProviderGitlab
 }
 
 func NewEventInfo() EventInfo {
@@ -36,6 +48,7 @@ func NewEventInfo() EventInfo {
 		ChangeRef:      "",
 		BaseRef:        "",
 		Refresh:        false,
+		Provider:       ProviderGithub,
 	}
 }
 
@@ -123,3 +136,40 @@ func ProcessComment(payload []byte) (EventInfo, error) {
 	log.Debug().Msgf("Returning EventInfo: %+v", prInfo)
 	return prInfo, validateEventInfo(prInfo)
 }
+
+// Processes a check_run event received from github: a "Re-run" of argo-diff's check run re-diffs
+// the pull request's current head commit
+func ProcessCheckRun(payload []byte) (EventInfo, error) {
+	prInfo := NewEventInfo()
+	var checkRunEvent github.CheckRunEvent
+	if err := json.Unmarshal(payload, &checkRunEvent); err != nil {
+		log.Error().Err(err).Msg("Error decoding JSON payload")
+		return prInfo, err
+	}
+	if action := checkRunEvent.GetAction(); action != "rerequested" {
+		log.Info().Msgf("Ignoring check run event with action %s", action)
+		return prInfo, nil
+	}
+	checkRun := checkRunEvent.GetCheckRun()
+	repo := checkRunEvent.GetRepo()
+	if checkRun == nil || repo == nil {
+		log.Warn().Msg("Ignoring check run event with missing field(s)")
+		return prInfo, nil
+	}
+	if name := checkRun.GetName(); name != argoDiffGh.CheckRunName() {
+		log.Info().Msgf("Ignoring re-run of check run %s", name)
+		return prInfo, nil
+	}
+	if len(checkRun.PullRequests) == 0 {
+		log.Info().Msgf("Ignoring re-run of check run %d with no pull request", checkRun.GetID())
+		return prInfo, nil
+	}
+	prInfo.PrNum = checkRun.PullRequests[0].GetNumber()
+	prInfo.RepoOwner = repo.GetOwner().GetLogin()
+	prInfo.RepoName = repo.GetName()
+	prInfo.RepoDefaultRef = repo.GetDefaultBranch()
+	prInfo.Ignore = false
+	prInfo.Refresh = true
+	log.Debug().Msgf("Returning EventInfo: %+v", prInfo)
+	return prInfo, validateEventInfo(prInfo)
+}
@@ -1,6 +1,7 @@
 package webhook
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -15,6 +16,7 @@ const payloadPrOpen = "payload-pr-open.json"
 const payloadPrSync = "payload-pr-sync.json"
 const payloadCommentCreated = "payload-comment-created.json"
 const payloadCommentCreatedArgoDiff = "payload-comment-argodiff-created.json"
+const payloadCheckRunRerequested = "payload-check-run-rerequested.json"
 
 func readFileToByteArray(fileName string) ([]byte, string, error) {
 	workingDir, err := os.Getwd()
@@ -103,3 +105,33 @@ func TestLoadCommentEvent(t *testing.T) {
 		}
 	}
 }
+
+func TestLoadCheckRunEvent(t *testing.T) {
+	payload, filePath, err := readFileToByteArray(payloadCheckRunRerequested)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", payloadCheckRunRerequested, err)
+	}
+	result, err := ProcessCheckRun(payload)
+	if err != nil {
+		t.Errorf("Failed to load payload from %s: %v", filePath, err)
+	}
+	if result.Ignore || !result.Refresh {
+		t.Errorf("ProcessCheckRun() Expected a refresh that's not ignored: %+v; Payload %s", result, filePath)
+	}
+	if result.RepoOwner != "vince-riv" || result.RepoName != "argo-diff" || result.RepoDefaultRef != "main" || result.PrNum != 2 {
+		t.Errorf("ProcessCheckRun() Unexpected result %+v; Payload %s", result, filePath)
+	}
+	if result.Sha != "" {
+		t.Errorf("ProcessCheckRun() Expected no sha, so the current head gets diffed; got %s", result.Sha)
+	}
+
+	// a re-run of somebody else's check run
+	otherPayload := bytes.Replace(payload, []byte(`"name": "argo-diff",`), []byte(`"name": "lint",`), 1)
+	result, err = ProcessCheckRun(otherPayload)
+	if err != nil {
+		t.Errorf("ProcessCheckRun() failed on another check run: %v", err)
+	}
+	if !result.Ignore {
+		t.Errorf("ProcessCheckRun() Expected to ignore a re-run of another check run: %+v", result)
+	}
+}
@@ -3,6 +3,7 @@ package webhook
 import (
 	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
 	"strconv"
 	"strings"
@@ -46,3 +47,19 @@ func VerifySignature(payload []byte, headerSignature string, secret string) bool
 	log.Debug().Msgf("signature [%s] verification result: %s", headerSignature, strconv.FormatBool(sigIsValid))
 	return sigIsValid
 }
+
+// VerifyGitlabToken checks the X-Gitlab-Token header against the configured secret. GitLab sends
+// the secret itself rather than a signature, so this is a constant-time string comparison.
+func VerifyGitlabToken(headerToken string, secret string) bool {
+	if secret == "" {
+		log.Error().Msg("Empty gitlab webhook secret")
+		return false
+	}
+	if headerToken == "" {
+		log.Error().Msg("X-Gitlab-Token header has no value - did you forget to configure the secret token in gitlab?")
+		return false
+	}
+	tokenIsValid := subtle.ConstantTimeCompare([]byte(headerToken), []byte(secret)) == 1
+	log.Debug().Msgf("gitlab token verification result: %s", strconv.FormatBool(tokenIsValid))
+	return tokenIsValid
+}
@@ -56,3 +56,18 @@ func TestVerifySignature(t *testing.T) {
 		t.Errorf("VerifySignature verified an incorrect signature")
 	}
 }
+
+func TestVerifyGitlabToken(t *testing.T) {
+	if !VerifyGitlabToken(testSecret, testSecret) {
+		t.Errorf("VerifyGitlabToken failed to verify a correct token")
+	}
+	if VerifyGitlabToken(testSecret+"x", testSecret) {
+		t.Errorf("VerifyGitlabToken verified an incorrect token")
+	}
+	if VerifyGitlabToken("", testSecret) {
+		t.Errorf("VerifyGitlabToken verified an empty token")
+	}
+	if VerifyGitlabToken("", "") {
+		t.Errorf("VerifyGitlabToken verified against an empty secret")
+	}
+}